@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// recordAudit writes an entry to the audit log. Failures are logged but never
+// block the operation being audited.
+func (as *AuthService) recordAudit(r *http.Request, actorID int, action string, targetUserID int, details map[string]interface{}) {
+	var detailsJSON []byte
+	if details != nil {
+		detailsJSON, _ = json.Marshal(details)
+	}
+
+	ip := as.clientIP(r)
+	log.Printf("AUDIT action=%s actor=%d target=%d ip=%s details=%s", action, actorID, targetUserID, ip, detailsJSON)
+
+	_, err := as.db.Exec(`
+		INSERT INTO audit_log (actor_id, action, target_user_id, details, ip_address)
+		VALUES (?, ?, ?, ?, ?)
+	`, actorID, action, targetUserID, string(detailsJSON), ip)
+	if err != nil {
+		log.Printf("Failed to write audit log entry for %s: %v", action, err)
+	}
+}
+
+// parseTrustedProxies reads a comma-separated list of proxy addresses and
+// CIDR ranges
+func parseTrustedProxies(value string) ([]*net.IPNet, error) {
+	var proxies []*net.IPNet
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid proxy address %q", entry)
+			}
+			bits := 8 * len(ip.To16())
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			proxies = append(proxies, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy range %q", entry)
+		}
+		proxies = append(proxies, network)
+	}
+	return proxies, nil
+}
+
+func (as *AuthService) trustedProxy(ip net.IP) bool {
+	for _, network := range as.trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the originating client address. X-Forwarded-For is only
+// honoured from trusted proxies, and is read from the right: the address
+// before the nearest trusted proxy is the client, since anything further
+// left was supplied by the client itself.
+func (as *AuthService) clientIP(r *http.Request) string {
+	if r == nil {
+		return ""
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !as.trustedProxy(ip) {
+		return host
+	}
+
+	var hops []string
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(header, ",")...)
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := net.ParseIP(strings.TrimSpace(hops[i]))
+		if hop == nil {
+			break
+		}
+		ip = hop
+		if !as.trustedProxy(hop) {
+			break
+		}
+	}
+	return ip.String()
+}
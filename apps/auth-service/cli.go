@@ -0,0 +1,571 @@
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/mattn/go-sqlite3"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const cliUsage = `Usage: auth-service <command> [flags]
+
+Commands:
+  serve                    Start the HTTP server (default)
+  migrate                  Apply (or roll back) schema migrations
+  migrate status           Show applied and pending migrations
+  user create              Create a user
+  user reset-password      Set a new password and revoke the user's tokens
+  user set-role            Grant or remove a role
+  user disable             Disable (or re-enable) a user
+  keys rotate              Create a new token signing key
+  keys list                List token signing keys
+  tokens revoke            Revoke a single token or all tokens of a user
+  guests gc                Delete guest accounts inactive for too long
+
+All commands use DATABASE_URL and print JSON to stdout.
+Run "auth-service <command> -h" for the flags of a command.
+`
+
+// cliUser is the JSON form of a user in CLI output
+type cliUser struct {
+	User
+	Active bool     `json:"active"`
+	Roles  []string `json:"roles"`
+}
+
+// stringList collects a repeatable string flag
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// runCommand dispatches a subcommand and returns the process exit code
+func runCommand(args []string) int {
+	if len(args) == 0 || args[0] == "serve" {
+		serve()
+		return 0
+	}
+
+	command := args[0]
+	if (command == "user" || command == "keys" || command == "tokens" || command == "guests" || command == "migrate") && len(args) > 1 && !strings.HasPrefix(args[1], "-") {
+		command += " " + args[1]
+		args = args[1:]
+	}
+
+	var err error
+	switch command {
+	case "migrate":
+		err = cliMigrate(args[1:])
+	case "migrate status":
+		err = cliMigrateStatus(args[1:])
+	case "user create":
+		err = cliUserCreate(args[1:])
+	case "user reset-password":
+		err = cliUserResetPassword(args[1:])
+	case "user set-role":
+		err = cliUserSetRole(args[1:])
+	case "user disable":
+		err = cliUserDisable(args[1:])
+	case "keys rotate":
+		err = cliKeysRotate(args[1:])
+	case "keys list":
+		err = cliKeysList(args[1:])
+	case "tokens revoke":
+		err = cliTokensRevoke(args[1:])
+	case "guests gc":
+		err = cliGuestsGC(args[1:])
+	case "help", "-h", "--help":
+		fmt.Fprint(os.Stdout, cliUsage)
+		return 0
+	default:
+		fmt.Fprint(os.Stderr, cliUsage)
+		return 2
+	}
+
+	if err == flag.ErrHelp {
+		return 0
+	}
+	if err != nil {
+		json.NewEncoder(os.Stderr).Encode(map[string]string{"error": err.Error()})
+		return 1
+	}
+	return 0
+}
+
+// openCLIService opens the database configured for the server
+func openCLIService() (*AuthService, error) {
+	db, err := initDatabase(getEnv("DATABASE_URL", defaultDatabaseURL), getEnv("AUTO_MIGRATE", "true") == "true")
+	if err != nil {
+		return nil, err
+	}
+
+	issuer, audiences := tokenConfig(configuredPublicURL())
+	return &AuthService{
+		db:             db,
+		jwtSecret:      getEnv("JWT_SECRET", defaultJWTSecret),
+		issuer:         issuer,
+		audiences:      audiences,
+		taskServiceURL: getEnv("TASK_SERVICE_URL", "http://localhost:8081"),
+	}, nil
+}
+
+func newFlagSet(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(os.Stderr)
+	return fs
+}
+
+func writeCLIJSON(v interface{}) error {
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(v)
+}
+
+// readPassword returns the flag value, or the first line of stdin when fromStdin is set
+func readPassword(value string, fromStdin bool) (string, error) {
+	if !fromStdin {
+		return value, nil
+	}
+
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return "", fmt.Errorf("failed to read password from stdin: %v", err)
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// findUser resolves a user from --username or --id
+func (as *AuthService) findUser(username string, id int) (*cliUser, error) {
+	if username == "" && id == 0 {
+		return nil, fmt.Errorf("--username or --id is required")
+	}
+
+	query := "SELECT id, username, email, active, created_at FROM users WHERE id = ?"
+	var arg interface{} = id
+	if id == 0 {
+		query = "SELECT id, username, email, active, created_at FROM users WHERE username = ?"
+		arg = username
+	}
+
+	var user cliUser
+	err := as.db.QueryRow(query, arg).Scan(&user.ID, &user.Username, &user.Email, &user.Active, &user.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("user not found")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	user.Roles, err = as.getUserRoles(user.ID)
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+func cliMigrate(args []string) error {
+	fs := newFlagSet("migrate")
+	to := fs.Int("to", -1, "target schema version; lower than the current version rolls back (default latest)")
+	dryRun := fs.Bool("dry-run", false, "run the migrations in a transaction and roll it back")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	db, err := openDatabase(getEnv("DATABASE_URL", defaultDatabaseURL))
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	result, err := migrateDatabase(db, *to, *dryRun)
+	if err != nil {
+		return err
+	}
+
+	// A fresh database also needs the default admin
+	if !*dryRun && *to < 0 {
+		if err := seedDatabase(db); err != nil {
+			return err
+		}
+	}
+
+	return writeCLIJSON(result)
+}
+
+func cliMigrateStatus(args []string) error {
+	fs := newFlagSet("migrate status")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	db, err := openDatabase(getEnv("DATABASE_URL", defaultDatabaseURL))
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	status, err := migrationStatus(db)
+	if err != nil {
+		return err
+	}
+	return writeCLIJSON(status)
+}
+
+func cliUserCreate(args []string) error {
+	fs := newFlagSet("user create")
+	username := fs.String("username", "", "username (required)")
+	email := fs.String("email", "", "email address (required)")
+	password := fs.String("password", "", "password; a random one is generated if omitted")
+	passwordStdin := fs.Bool("password-stdin", false, "read the password from stdin")
+	emailVerified := fs.Bool("email-verified", false, "mark the email address as verified")
+	var roles stringList
+	fs.Var(&roles, "role", "role to grant (repeatable)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if *username == "" || *email == "" {
+		return fmt.Errorf("--username and --email are required")
+	}
+
+	pw, err := readPassword(*password, *passwordStdin)
+	if err != nil {
+		return err
+	}
+	generated := pw == ""
+	if generated {
+		if pw, err = randomSecret(); err != nil {
+			return err
+		}
+		pw = pw[:20]
+	}
+
+	as, err := openCLIService()
+	if err != nil {
+		return err
+	}
+	defer as.db.Close()
+
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(pw), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+
+	tx, err := as.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`
+		INSERT INTO users (username, email, password_hash, email_verified) VALUES (?, ?, ?, ?)
+	`, *username, *email, string(hashedPassword), *emailVerified)
+	if err != nil {
+		if sqliteErr, ok := err.(sqlite3.Error); ok && sqliteErr.Code == sqlite3.ErrConstraint {
+			return fmt.Errorf("username or email already exists")
+		}
+		return err
+	}
+
+	userID, _ := result.LastInsertId()
+	for _, role := range roles {
+		if _, err := tx.Exec("INSERT OR IGNORE INTO user_roles (user_id, role) VALUES (?, ?)", userID, role); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	as.recordAudit(nil, 0, "cli.user.create", int(userID), map[string]interface{}{"roles": roles})
+
+	user, err := as.findUser("", int(userID))
+	if err != nil {
+		return err
+	}
+
+	output := map[string]interface{}{"user": user}
+	if generated {
+		output["password"] = pw
+	}
+	return writeCLIJSON(output)
+}
+
+func cliUserResetPassword(args []string) error {
+	fs := newFlagSet("user reset-password")
+	username := fs.String("username", "", "username")
+	id := fs.Int("id", 0, "user ID")
+	password := fs.String("password", "", "new password; a random one is generated if omitted")
+	passwordStdin := fs.Bool("password-stdin", false, "read the password from stdin")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	pw, err := readPassword(*password, *passwordStdin)
+	if err != nil {
+		return err
+	}
+	generated := pw == ""
+	if generated {
+		if pw, err = randomSecret(); err != nil {
+			return err
+		}
+		pw = pw[:20]
+	}
+
+	as, err := openCLIService()
+	if err != nil {
+		return err
+	}
+	defer as.db.Close()
+
+	user, err := as.findUser(*username, *id)
+	if err != nil {
+		return err
+	}
+
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(pw), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	if _, err := as.db.Exec("UPDATE users SET password_hash = ? WHERE id = ?", string(hashedPassword), user.ID); err != nil {
+		return err
+	}
+	if err := as.revokeUserTokens(user.ID); err != nil {
+		return err
+	}
+
+	as.recordAudit(nil, 0, "cli.user.reset_password", user.ID, nil)
+
+	output := map[string]interface{}{"user": user, "tokens_revoked": true}
+	if generated {
+		output["password"] = pw
+	}
+	return writeCLIJSON(output)
+}
+
+func cliUserSetRole(args []string) error {
+	fs := newFlagSet("user set-role")
+	username := fs.String("username", "", "username")
+	id := fs.Int("id", 0, "user ID")
+	role := fs.String("role", "", "role to grant or remove (required)")
+	remove := fs.Bool("remove", false, "remove the role instead of granting it")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if *role == "" {
+		return fmt.Errorf("--role is required")
+	}
+
+	as, err := openCLIService()
+	if err != nil {
+		return err
+	}
+	defer as.db.Close()
+
+	user, err := as.findUser(*username, *id)
+	if err != nil {
+		return err
+	}
+
+	action := "cli.user.grant_role"
+	if *remove {
+		action = "cli.user.remove_role"
+		_, err = as.db.Exec("DELETE FROM user_roles WHERE user_id = ? AND role = ?", user.ID, *role)
+	} else {
+		_, err = as.db.Exec("INSERT OR IGNORE INTO user_roles (user_id, role) VALUES (?, ?)", user.ID, *role)
+	}
+	if err != nil {
+		return err
+	}
+
+	as.recordAudit(nil, 0, action, user.ID, map[string]interface{}{"role": *role})
+
+	if user.Roles, err = as.getUserRoles(user.ID); err != nil {
+		return err
+	}
+	return writeCLIJSON(map[string]interface{}{"user": user})
+}
+
+func cliUserDisable(args []string) error {
+	fs := newFlagSet("user disable")
+	username := fs.String("username", "", "username")
+	id := fs.Int("id", 0, "user ID")
+	enable := fs.Bool("enable", false, "re-enable a disabled user")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	as, err := openCLIService()
+	if err != nil {
+		return err
+	}
+	defer as.db.Close()
+
+	user, err := as.findUser(*username, *id)
+	if err != nil {
+		return err
+	}
+
+	_, err = as.db.Exec("UPDATE users SET active = ?, updated_at = ? WHERE id = ?", *enable, time.Now().UTC(), user.ID)
+	if err != nil {
+		return err
+	}
+
+	action := "cli.user.disable"
+	if *enable {
+		action = "cli.user.enable"
+	}
+	as.recordAudit(nil, 0, action, user.ID, nil)
+
+	user.Active = *enable
+	return writeCLIJSON(map[string]interface{}{"user": user})
+}
+
+func cliKeysRotate(args []string) error {
+	fs := newFlagSet("keys rotate")
+	retirePrevious := fs.Bool("retire-previous", false, "retire previous keys immediately, invalidating every token they signed")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	as, err := openCLIService()
+	if err != nil {
+		return err
+	}
+	defer as.db.Close()
+
+	key, err := as.rotateSigningKey(*retirePrevious)
+	if err != nil {
+		return err
+	}
+
+	as.recordAudit(nil, 0, "cli.keys.rotate", 0, map[string]interface{}{
+		"kid":             key.KID,
+		"retire_previous": *retirePrevious,
+	})
+
+	keys, err := as.listSigningKeys()
+	if err != nil {
+		return err
+	}
+	return writeCLIJSON(map[string]interface{}{"current": key, "keys": keys})
+}
+
+func cliKeysList(args []string) error {
+	fs := newFlagSet("keys list")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	as, err := openCLIService()
+	if err != nil {
+		return err
+	}
+	defer as.db.Close()
+
+	keys, err := as.listSigningKeys()
+	if err != nil {
+		return err
+	}
+	return writeCLIJSON(map[string]interface{}{"keys": keys})
+}
+
+func cliTokensRevoke(args []string) error {
+	fs := newFlagSet("tokens revoke")
+	jti := fs.String("jti", "", "ID (jti) of a single token to revoke")
+	token := fs.String("token", "", "a token to revoke")
+	username := fs.String("username", "", "revoke every token of this user")
+	id := fs.Int("id", 0, "revoke every token of the user with this ID")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	as, err := openCLIService()
+	if err != nil {
+		return err
+	}
+	defer as.db.Close()
+
+	switch {
+	case *jti != "":
+		if err := as.revokeToken(&Claims{RegisteredClaims: jwt.RegisteredClaims{ID: *jti}}); err != nil {
+			return err
+		}
+		as.recordAudit(nil, 0, "cli.tokens.revoke", 0, map[string]interface{}{"jti": *jti})
+		return writeCLIJSON(map[string]interface{}{"revoked": true, "jti": *jti})
+
+	case *token != "":
+		claims, err := as.parseToken(*token)
+		if err != nil {
+			// Invalid, expired or already revoked tokens need no action
+			return writeCLIJSON(map[string]interface{}{"revoked": false, "reason": err.Error()})
+		}
+		if err := as.revokeToken(claims); err != nil {
+			return err
+		}
+		as.recordAudit(nil, 0, "cli.tokens.revoke", claims.UserID, map[string]interface{}{"jti": claims.ID})
+		return writeCLIJSON(map[string]interface{}{"revoked": true, "jti": claims.ID, "user_id": claims.UserID})
+
+	case *username != "" || *id != 0:
+		user, err := as.findUser(*username, *id)
+		if err != nil {
+			return err
+		}
+		if err := as.revokeUserTokens(user.ID); err != nil {
+			return err
+		}
+		as.recordAudit(nil, 0, "cli.tokens.revoke_all", user.ID, nil)
+		return writeCLIJSON(map[string]interface{}{"revoked": true, "user": user})
+	}
+
+	return fmt.Errorf("one of --jti, --token, --username or --id is required")
+}
+
+func cliGuestsGC(args []string) error {
+	fs := newFlagSet("guests gc")
+	days := fs.Int("days", 0, "inactivity in days after which guests are deleted (default GUEST_RETENTION_DAYS or 30)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if *days == 0 {
+		var err error
+		*days, err = strconv.Atoi(getEnv("GUEST_RETENTION_DAYS", "30"))
+		if err != nil {
+			return fmt.Errorf("invalid GUEST_RETENTION_DAYS: %v", err)
+		}
+	}
+	if *days < 1 {
+		return fmt.Errorf("--days must be at least 1")
+	}
+
+	as, err := openCLIService()
+	if err != nil {
+		return err
+	}
+	defer as.db.Close()
+
+	collected, err := as.collectGuests(time.Duration(*days) * 24 * time.Hour)
+	if err != nil {
+		return err
+	}
+	return writeCLIJSON(map[string]interface{}{"deleted": len(collected), "user_ids": collected})
+}
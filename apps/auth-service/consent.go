@@ -0,0 +1,323 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// Policies users must accept
+const (
+	policyTerms   = "terms"
+	policyPrivacy = "privacy"
+)
+
+var knownPolicies = map[string]bool{
+	policyTerms:   true,
+	policyPrivacy: true,
+}
+
+// PolicyVersion is a published version of a legal document
+type PolicyVersion struct {
+	ID          int       `json:"id"`
+	Policy      string    `json:"policy"`
+	Version     string    `json:"version"`
+	URL         string    `json:"url,omitempty"`
+	Content     string    `json:"content,omitempty"`
+	PublishedAt time.Time `json:"published_at"`
+}
+
+// ConsentRecord is a user's acceptance of a policy version
+type ConsentRecord struct {
+	Policy     string    `json:"policy"`
+	Version    string    `json:"version"`
+	AcceptedAt time.Time `json:"accepted_at"`
+	IPAddress  string    `json:"ip_address,omitempty"`
+	UserAgent  string    `json:"user_agent,omitempty"`
+}
+
+// PublishPolicyRequest represents the publish policy request payload
+type PublishPolicyRequest struct {
+	Policy  string `json:"policy"`
+	Version string `json:"version"`
+	URL     string `json:"url"`
+	Content string `json:"content"`
+}
+
+// AcceptPolicyRequest represents the accept policy request payload. The
+// version must be the current one so users can't accept outdated terms.
+type AcceptPolicyRequest struct {
+	Policy  string `json:"policy"`
+	Version string `json:"version"`
+}
+
+// ConsentHistoryResponse lists a user's acceptances, newest first
+type ConsentHistoryResponse struct {
+	UserID          int             `json:"user_id"`
+	ConsentRequired []string        `json:"consent_required"`
+	Consents        []ConsentRecord `json:"consents"`
+}
+
+// currentPolicies returns the newest version of each published policy
+func (as *AuthService) currentPolicies() ([]PolicyVersion, error) {
+	rows, err := as.db.Query(`
+		SELECT id, policy, version, url, content, published_at FROM policy_versions
+		WHERE id IN (SELECT MAX(id) FROM policy_versions GROUP BY policy)
+		ORDER BY policy
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	policies := []PolicyVersion{}
+	for rows.Next() {
+		var policy PolicyVersion
+		var url, content sql.NullString
+		if err := rows.Scan(&policy.ID, &policy.Policy, &policy.Version, &url, &content, &policy.PublishedAt); err != nil {
+			return nil, err
+		}
+		policy.URL = url.String
+		policy.Content = content.String
+		policies = append(policies, policy)
+	}
+	return policies, rows.Err()
+}
+
+// consentRequired returns the policies whose current version the user has
+// not accepted
+func (as *AuthService) consentRequired(userID int) ([]string, error) {
+	rows, err := as.db.Query(`
+		SELECT p.policy FROM policy_versions p
+		WHERE p.id IN (SELECT MAX(id) FROM policy_versions GROUP BY policy)
+		AND NOT EXISTS (
+			SELECT 1 FROM policy_acceptances a
+			WHERE a.user_id = ? AND a.policy_version_id = p.id
+		)
+		ORDER BY p.policy
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	policies := []string{}
+	for rows.Next() {
+		var policy string
+		if err := rows.Scan(&policy); err != nil {
+			return nil, err
+		}
+		policies = append(policies, policy)
+	}
+	return policies, rows.Err()
+}
+
+func (as *AuthService) listPoliciesHandler(w http.ResponseWriter, r *http.Request) {
+	policies, err := as.currentPolicies()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(policies)
+}
+
+// publishPolicyHandler publishes a new version. Every user has to accept it,
+// so it takes effect the moment it is published.
+func (as *AuthService) publishPolicyHandler(w http.ResponseWriter, r *http.Request) {
+	admin, ok := as.requireAdmin(w, r)
+	if !ok {
+		return
+	}
+
+	var req PublishPolicyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	req.Policy = strings.ToLower(strings.TrimSpace(req.Policy))
+	req.Version = strings.TrimSpace(req.Version)
+	if !knownPolicies[req.Policy] {
+		http.Error(w, "policy must be terms or privacy", http.StatusBadRequest)
+		return
+	}
+	if req.Version == "" || (req.URL == "" && req.Content == "") {
+		http.Error(w, "version and a url or content are required", http.StatusBadRequest)
+		return
+	}
+
+	policy := PolicyVersion{
+		Policy:      req.Policy,
+		Version:     req.Version,
+		URL:         strings.TrimSpace(req.URL),
+		Content:     req.Content,
+		PublishedAt: time.Now().UTC(),
+	}
+
+	result, err := as.db.Exec(`
+		INSERT INTO policy_versions (policy, version, url, content, published_by, published_at)
+		VALUES (?, ?, ?, ?, ?, ?)
+	`, policy.Policy, policy.Version, policy.URL, policy.Content, admin.UserID, policy.PublishedAt)
+	if err != nil {
+		if sqliteErr, ok := err.(sqlite3.Error); ok && sqliteErr.Code == sqlite3.ErrConstraint {
+			http.Error(w, "Policy version already exists", http.StatusConflict)
+			return
+		}
+		http.Error(w, "Failed to publish policy", http.StatusInternalServerError)
+		return
+	}
+
+	id, _ := result.LastInsertId()
+	policy.ID = int(id)
+
+	as.recordAudit(r, admin.UserID, "policy.publish", 0, map[string]interface{}{
+		"policy":  policy.Policy,
+		"version": policy.Version,
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(policy)
+}
+
+func (as *AuthService) acceptPolicyHandler(w http.ResponseWriter, r *http.Request) {
+	claims, err := as.authenticateRequest(r)
+	if err != nil {
+		http.Error(w, "Invalid token", http.StatusUnauthorized)
+		return
+	}
+
+	var req AcceptPolicyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	var versionID int
+	var current bool
+	err = as.db.QueryRow(`
+		SELECT id, id = (SELECT MAX(id) FROM policy_versions WHERE policy = ?)
+		FROM policy_versions WHERE policy = ? AND version = ?
+	`, req.Policy, req.Policy, req.Version).Scan(&versionID, &current)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Policy version not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if !current {
+		http.Error(w, "A newer version of this policy has been published", http.StatusConflict)
+		return
+	}
+
+	record := ConsentRecord{
+		Policy:     req.Policy,
+		Version:    req.Version,
+		AcceptedAt: time.Now().UTC(),
+		IPAddress:  as.clientIP(r),
+		UserAgent:  r.UserAgent(),
+	}
+
+	// Accepting again keeps the original record
+	result, err := as.db.Exec(`
+		INSERT OR IGNORE INTO policy_acceptances (user_id, policy_version_id, accepted_at, ip_address, user_agent)
+		VALUES (?, ?, ?, ?, ?)
+	`, claims.UserID, versionID, record.AcceptedAt, record.IPAddress, record.UserAgent)
+	if err != nil {
+		http.Error(w, "Failed to record consent", http.StatusInternalServerError)
+		return
+	}
+
+	status := http.StatusOK
+	if n, _ := result.RowsAffected(); n > 0 {
+		status = http.StatusCreated
+		as.recordAudit(r, claims.UserID, "consent.accept", claims.UserID, map[string]interface{}{
+			"policy":  record.Policy,
+			"version": record.Version,
+		})
+	} else {
+		err = as.db.QueryRow(`
+			SELECT accepted_at, ip_address, user_agent FROM policy_acceptances
+			WHERE user_id = ? AND policy_version_id = ?
+		`, claims.UserID, versionID).Scan(&record.AcceptedAt, &record.IPAddress, &record.UserAgent)
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(record)
+}
+
+// consentHistoryHandler lists the caller's consents. Admins can pass
+// ?user_id= to look up another user's.
+func (as *AuthService) consentHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	claims, err := as.authenticateRequest(r)
+	if err != nil {
+		http.Error(w, "Invalid token", http.StatusUnauthorized)
+		return
+	}
+
+	userID := claims.UserID
+	if param := r.URL.Query().Get("user_id"); param != "" {
+		if _, ok := as.requireAdmin(w, r); !ok {
+			return
+		}
+		userID, err = strconv.Atoi(param)
+		if err != nil {
+			http.Error(w, "Invalid user_id", http.StatusBadRequest)
+			return
+		}
+	}
+
+	rows, err := as.db.Query(`
+		SELECT p.policy, p.version, a.accepted_at, a.ip_address, a.user_agent
+		FROM policy_acceptances a JOIN policy_versions p ON p.id = a.policy_version_id
+		WHERE a.user_id = ?
+		ORDER BY a.accepted_at DESC, a.id DESC
+	`, userID)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	response := ConsentHistoryResponse{UserID: userID, Consents: []ConsentRecord{}}
+	for rows.Next() {
+		var record ConsentRecord
+		var ip, userAgent sql.NullString
+		if err := rows.Scan(&record.Policy, &record.Version, &record.AcceptedAt, &ip, &userAgent); err != nil {
+			http.Error(w, "Database scan error", http.StatusInternalServerError)
+			return
+		}
+		record.IPAddress = ip.String
+		record.UserAgent = userAgent.String
+		response.Consents = append(response.Consents, record)
+	}
+	if err := rows.Err(); err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	response.ConsentRequired, err = as.consentRequired(userID)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(response)
+}
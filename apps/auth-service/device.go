@@ -0,0 +1,467 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"html/template"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// RFC 8628 device authorization grant settings
+const (
+	deviceGrantType       = "urn:ietf:params:oauth:grant-type:device_code"
+	deviceCodeTTL         = 10 * time.Minute
+	devicePollInterval    = 5 // seconds
+	deviceSlowDownSeconds = 5
+	deviceTokenTTL        = 24 * time.Hour
+
+	// Consonants only, so user codes never spell words and survive case changes
+	userCodeAlphabet = "BCDFGHJKLMNPQRSTVWXZ"
+	userCodeLength   = 8
+)
+
+// Errors returned when a user code can't be approved or denied
+var (
+	errUserCodeNotFound = errors.New("unknown code")
+	errUserCodeExpired  = errors.New("code has expired")
+	errUserCodeDecided  = errors.New("code has already been used")
+)
+
+// DeviceAuthorizationResponse is returned to the device (RFC 8628 section 3.2)
+type DeviceAuthorizationResponse struct {
+	DeviceCode              string `json:"device_code"`
+	UserCode                string `json:"user_code"`
+	VerificationURI         string `json:"verification_uri"`
+	VerificationURIComplete string `json:"verification_uri_complete"`
+	ExpiresIn               int    `json:"expires_in"`
+	Interval                int    `json:"interval"`
+}
+
+// TokenResponse is a successful OAuth 2.0 token response
+type TokenResponse struct {
+	AccessToken     string `json:"access_token"`
+	IssuedTokenType string `json:"issued_token_type,omitempty"`
+	TokenType       string `json:"token_type"`
+	ExpiresIn       int    `json:"expires_in"`
+	Scope           string `json:"scope,omitempty"`
+}
+
+// DeviceDecisionRequest represents the device approval request payload
+type DeviceDecisionRequest struct {
+	UserCode string `json:"user_code"`
+	Action   string `json:"action"` // approve or deny
+}
+
+var deviceVerificationPage = template.Must(template.New("device").Parse(`<!DOCTYPE html>
+<html>
+<head><title>Task Manager - Connect a device</title></head>
+<body>
+{{if .Done}}
+<h1>{{if .Approved}}Device connected{{else}}Request denied{{end}}</h1>
+<p>{{if .Approved}}You can return to your device.{{else}}The device was not given access to your account.{{end}}</p>
+{{else}}
+<h1>Connect a device</h1>
+<p>Enter the code shown on your device{{if .ClientID}} ({{.ClientID}}){{end}} and sign in to give it access to your account.</p>
+{{if .Error}}<p><strong>{{.Error}}</strong></p>{{end}}
+<form method="POST">
+<p><label>Code <input name="user_code" value="{{.UserCode}}" autocomplete="off"></label></p>
+<p><label>Username <input name="username" value="{{.Username}}" autocomplete="username"></label></p>
+<p><label>Password <input name="password" type="password" autocomplete="current-password"></label></p>
+<button type="submit" name="action" value="approve">Approve</button>
+<button type="submit" name="action" value="deny">Deny</button>
+</form>
+{{end}}
+</body>
+</html>
+`))
+
+// parseDeviceClients parses DEVICE_CLIENTS, the public client IDs allowed to use the device grant
+func parseDeviceClients(value string) map[string]bool {
+	clients := make(map[string]bool)
+	for _, id := range strings.Split(value, ",") {
+		if id = strings.TrimSpace(id); id != "" {
+			clients[id] = true
+		}
+	}
+	return clients
+}
+
+// deviceAuthorizationHandler starts a device flow (RFC 8628 section 3.1)
+func (as *AuthService) deviceAuthorizationHandler(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_request", "Malformed form body")
+		return
+	}
+
+	clientID := r.PostFormValue("client_id")
+	if !as.deviceClients[clientID] {
+		authAttempts.WithLabelValues("device", "invalid_client").Inc()
+		writeOAuthError(w, http.StatusUnauthorized, "invalid_client", "Unknown client")
+		return
+	}
+
+	// Without a scope the token is unrestricted, like one from a sign-in
+	scope := strings.TrimSpace(r.PostFormValue("scope"))
+	if scope != "" {
+		var ok bool
+		if scope, ok = downscope("", scope); !ok {
+			writeOAuthError(w, http.StatusBadRequest, "invalid_scope", "Unknown scope")
+			return
+		}
+	}
+
+	deviceCode, err := randomSecret()
+	if err != nil {
+		writeOAuthError(w, http.StatusInternalServerError, "server_error", "Failed to generate device code")
+		return
+	}
+	userCode, err := generateUserCode()
+	if err != nil {
+		writeOAuthError(w, http.StatusInternalServerError, "server_error", "Failed to generate user code")
+		return
+	}
+
+	now := time.Now().UTC()
+
+	// Drop requests nobody will poll again
+	as.db.Exec("DELETE FROM device_authorizations WHERE expires_at < ?", now.Add(-24*time.Hour))
+
+	_, err = as.db.Exec(`
+		INSERT INTO device_authorizations (device_code_hash, user_code_hash, client_id, scope, poll_interval, created_at, expires_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+	`, hashInviteCode(deviceCode), hashInviteCode(normalizeUserCode(userCode)), clientID, scope,
+		devicePollInterval, now, now.Add(deviceCodeTTL))
+	if err != nil {
+		writeOAuthError(w, http.StatusInternalServerError, "server_error", "Failed to store device authorization")
+		return
+	}
+
+	authAttempts.WithLabelValues("device", "started").Inc()
+
+	verificationURI := as.publicURL + "/device"
+	response := DeviceAuthorizationResponse{
+		DeviceCode:              deviceCode,
+		UserCode:                userCode,
+		VerificationURI:         verificationURI,
+		VerificationURIComplete: verificationURI + "?user_code=" + userCode,
+		ExpiresIn:               int(deviceCodeTTL.Seconds()),
+		Interval:                devicePollInterval,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(response)
+}
+
+// tokenHandler is the OAuth 2.0 token endpoint
+func (as *AuthService) tokenHandler(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_request", "Malformed form body")
+		return
+	}
+
+	switch r.PostFormValue("grant_type") {
+	case deviceGrantType:
+		as.deviceTokenGrant(w, r)
+	case tokenExchangeGrantType:
+		as.tokenExchangeGrant(w, r)
+	case clientCredentialsGrantType:
+		as.clientCredentialsGrant(w, r)
+	case "":
+		writeOAuthError(w, http.StatusBadRequest, "invalid_request", "The grant_type parameter is required")
+	default:
+		writeOAuthError(w, http.StatusBadRequest, "unsupported_grant_type", "Unsupported grant type")
+	}
+}
+
+// deviceTokenGrant answers a device polling for its token (RFC 8628 section 3.5)
+func (as *AuthService) deviceTokenGrant(w http.ResponseWriter, r *http.Request) {
+	deviceCode := r.PostFormValue("device_code")
+	if deviceCode == "" {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_request", "The device_code parameter is required")
+		return
+	}
+
+	var id, interval int
+	var userID sql.NullInt64
+	var clientID, scope string
+	var expiresAt time.Time
+	var lastPolledAt, approvedAt, deniedAt, consumedAt sql.NullTime
+	err := as.db.QueryRow(`
+		SELECT id, client_id, COALESCE(scope, ''), poll_interval, expires_at, last_polled_at, user_id, approved_at, denied_at, consumed_at
+		FROM device_authorizations WHERE device_code_hash = ?
+	`, hashInviteCode(deviceCode)).Scan(&id, &clientID, &scope, &interval, &expiresAt, &lastPolledAt, &userID, &approvedAt, &deniedAt, &consumedAt)
+
+	if err == sql.ErrNoRows || (err == nil && clientID != r.PostFormValue("client_id")) {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_grant", "Unknown device code")
+		return
+	}
+	if err != nil {
+		writeOAuthError(w, http.StatusInternalServerError, "server_error", "Database error")
+		return
+	}
+
+	now := time.Now().UTC()
+	switch {
+	case consumedAt.Valid:
+		writeOAuthError(w, http.StatusBadRequest, "invalid_grant", "The device code has already been used")
+		return
+	case now.After(expiresAt):
+		writeOAuthError(w, http.StatusBadRequest, "expired_token", "The device code has expired")
+		return
+	case deniedAt.Valid:
+		writeOAuthError(w, http.StatusBadRequest, "access_denied", "The user denied the request")
+		return
+	}
+
+	if !approvedAt.Valid {
+		// Clients polling faster than the interval must back off by 5 seconds
+		if lastPolledAt.Valid && now.Sub(lastPolledAt.Time) < time.Duration(interval)*time.Second {
+			interval += deviceSlowDownSeconds
+			as.db.Exec("UPDATE device_authorizations SET poll_interval = ?, last_polled_at = ? WHERE id = ?", interval, now, id)
+			writeOAuthError(w, http.StatusBadRequest, "slow_down", "Polling too frequently")
+			return
+		}
+		as.db.Exec("UPDATE device_authorizations SET last_polled_at = ? WHERE id = ?", now, id)
+		writeOAuthError(w, http.StatusBadRequest, "authorization_pending", "The user has not yet approved the request")
+		return
+	}
+
+	// Each device code yields a single token, even when polls race
+	result, err := as.db.Exec(`
+		UPDATE device_authorizations SET consumed_at = ? WHERE id = ? AND consumed_at IS NULL
+	`, now, id)
+	if err != nil {
+		writeOAuthError(w, http.StatusInternalServerError, "server_error", "Database error")
+		return
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_grant", "The device code has already been used")
+		return
+	}
+
+	var username string
+	if err := as.db.QueryRow("SELECT username FROM users WHERE id = ?", userID.Int64).Scan(&username); err != nil {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_grant", "The approving user no longer exists")
+		return
+	}
+
+	claims, err := newClaims(int(userID.Int64), username, deviceTokenTTL)
+	if err != nil {
+		writeOAuthError(w, http.StatusInternalServerError, "server_error", "Failed to generate token")
+		return
+	}
+	claims.Scope = scope
+	token, err := as.signToken(claims)
+	if err != nil {
+		writeOAuthError(w, http.StatusInternalServerError, "server_error", "Failed to generate token")
+		return
+	}
+
+	authAttempts.WithLabelValues("device", "success").Inc()
+	as.recordAudit(r, int(userID.Int64), "device.token", int(userID.Int64), map[string]interface{}{
+		"client_id": clientID,
+		"jti":       claims.ID,
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(TokenResponse{
+		AccessToken: token,
+		TokenType:   "Bearer",
+		ExpiresIn:   int(deviceTokenTTL.Seconds()),
+		Scope:       scope,
+	})
+}
+
+// decideDeviceAuthorization approves or denies a pending request on behalf
+// of the user and returns the client that asked
+func (as *AuthService) decideDeviceAuthorization(r *http.Request, userCode string, userID int, approve bool) (string, error) {
+	var id int
+	var clientID string
+	var expiresAt time.Time
+	var decided bool
+	err := as.db.QueryRow(`
+		SELECT id, client_id, expires_at, approved_at IS NOT NULL OR denied_at IS NOT NULL
+		FROM device_authorizations WHERE user_code_hash = ?
+	`, hashInviteCode(normalizeUserCode(userCode))).Scan(&id, &clientID, &expiresAt, &decided)
+
+	if err == sql.ErrNoRows {
+		return "", errUserCodeNotFound
+	}
+	if err != nil {
+		return "", err
+	}
+	if decided {
+		return "", errUserCodeDecided
+	}
+	if time.Now().After(expiresAt) {
+		return "", errUserCodeExpired
+	}
+
+	column, action := "denied_at", "device.deny"
+	if approve {
+		column, action = "approved_at", "device.approve"
+	}
+	result, err := as.db.Exec(`
+		UPDATE device_authorizations SET user_id = ?, `+column+` = ?
+		WHERE id = ? AND approved_at IS NULL AND denied_at IS NULL
+	`, userID, time.Now().UTC(), id)
+	if err != nil {
+		return "", err
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return "", errUserCodeDecided
+	}
+
+	authAttempts.WithLabelValues("device", strings.TrimPrefix(action, "device.")).Inc()
+	as.recordAudit(r, userID, action, userID, map[string]interface{}{"client_id": clientID})
+	return clientID, nil
+}
+
+// deviceVerificationHandler is the page users open on another device to
+// sign in and approve the code shown by the CLI or TV client
+func (as *AuthService) deviceVerificationHandler(w http.ResponseWriter, r *http.Request) {
+	page := struct {
+		Done     bool
+		Approved bool
+		UserCode string
+		Username string
+		ClientID string
+		Error    string
+	}{UserCode: r.FormValue("user_code")}
+
+	if r.Method == http.MethodGet {
+		if page.UserCode != "" {
+			as.db.QueryRow(`
+				SELECT client_id FROM device_authorizations WHERE user_code_hash = ?
+			`, hashInviteCode(normalizeUserCode(page.UserCode))).Scan(&page.ClientID)
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		deviceVerificationPage.Execute(w, page)
+		return
+	}
+
+	page.Username = r.PostFormValue("username")
+	approve := r.PostFormValue("action") == "approve"
+
+	user, err := as.verifyCredentials(page.Username, r.PostFormValue("password"))
+	switch {
+	case err == errInvalidCredentials:
+		authAttempts.WithLabelValues("device", "failed").Inc()
+		page.Error = "Invalid username or password."
+	case err == errAccountDisabled:
+		page.Error = "This account is disabled."
+	case err != nil:
+		page.Error = "Something went wrong. Please try again."
+	default:
+		_, err = as.decideDeviceAuthorization(r, page.UserCode, user.ID, approve)
+		if err != nil {
+			page.Error = deviceDecisionMessage(err)
+		} else {
+			page.Done = true
+			page.Approved = approve
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if page.Error != "" {
+		w.WriteHeader(http.StatusBadRequest)
+	}
+	deviceVerificationPage.Execute(w, page)
+}
+
+// deviceDecisionHandler lets a signed-in client (such as the web app)
+// approve or deny a user code with its access token
+func (as *AuthService) deviceDecisionHandler(w http.ResponseWriter, r *http.Request) {
+	claims, err := as.authenticateRequest(r)
+	if err != nil {
+		http.Error(w, "Invalid token", http.StatusUnauthorized)
+		return
+	}
+
+	var req DeviceDecisionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.UserCode == "" || (req.Action != "approve" && req.Action != "deny") {
+		http.Error(w, "user_code and an action of approve or deny are required", http.StatusBadRequest)
+		return
+	}
+
+	clientID, err := as.decideDeviceAuthorization(r, req.UserCode, claims.UserID, req.Action == "approve")
+	if err == errUserCodeNotFound {
+		http.Error(w, deviceDecisionMessage(err), http.StatusNotFound)
+		return
+	}
+	if err == errUserCodeExpired || err == errUserCodeDecided {
+		http.Error(w, deviceDecisionMessage(err), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	status := "approved"
+	if req.Action == "deny" {
+		status = "denied"
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{
+		"status":    status,
+		"client_id": clientID,
+	})
+}
+
+func deviceDecisionMessage(err error) string {
+	switch err {
+	case errUserCodeNotFound:
+		return "That code is not valid. Check the code shown on your device."
+	case errUserCodeExpired:
+		return "That code has expired. Start again on your device."
+	case errUserCodeDecided:
+		return "That code has already been used."
+	}
+	return "Something went wrong. Please try again."
+}
+
+// generateUserCode returns a code like BDFG-HJKL for the user to type
+func generateUserCode() (string, error) {
+	var code strings.Builder
+	max := big.NewInt(int64(len(userCodeAlphabet)))
+	for i := 0; i < userCodeLength; i++ {
+		if i == userCodeLength/2 {
+			code.WriteByte('-')
+		}
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		code.WriteByte(userCodeAlphabet[n.Int64()])
+	}
+	return code.String(), nil
+}
+
+// normalizeUserCode ignores case, dashes and spaces in typed user codes
+func normalizeUserCode(code string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' {
+			r -= 'a' - 'A'
+		}
+		if r < 'A' || r > 'Z' {
+			return -1
+		}
+		return r
+	}, code)
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/gorilla/mux"
+)
+
+// Thresholds for impossible-travel detection. Hops shorter than
+// impossibleTravelMinKm are ignored because GeoIP positions are approximate.
+const (
+	impossibleTravelSpeedKmh = 900.0
+	impossibleTravelMinKm    = 300.0
+)
+
+// KnownDevice is a device fingerprint a user has logged in from before
+type KnownDevice struct {
+	ID        int       `json:"id"`
+	UserAgent string    `json:"user_agent"`
+	IPSubnet  string    `json:"ip_subnet"`
+	LastIP    string    `json:"last_ip"`
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+}
+
+// sessionRevokeClaims are carried by the "this wasn't me" link. The ID is the
+// jti of the session to revoke.
+type sessionRevokeClaims struct {
+	UserID   int `json:"user_id"`
+	DeviceID int `json:"device_id"`
+	jwt.RegisteredClaims
+}
+
+// userAgentVersions strips version numbers so browser updates don't look like new devices
+var userAgentVersions = regexp.MustCompile(`[0-9][0-9._]*`)
+
+var sessionRevokePage = template.Must(template.New("revoke").Parse(`<!DOCTYPE html>
+<html>
+<head><title>Task Manager - Secure your account</title></head>
+<body>
+{{if .Done}}
+<h1>Session revoked</h1>
+<p>The sign-in has been signed out. Please change your password.</p>
+{{else}}
+<h1>Wasn't you?</h1>
+<p>Revoke the sign-in from {{.UserAgent}} ({{.IP}}) to sign it out immediately.</p>
+<form method="POST">
+<input type="hidden" name="token" value="{{.Token}}">
+<button type="submit">Revoke this session</button>
+</form>
+{{end}}
+</body>
+</html>
+`))
+
+// deviceFingerprint identifies a device by its normalized user agent and IP subnet
+func deviceFingerprint(userAgent, subnet string) string {
+	normalized := strings.ToLower(userAgentVersions.ReplaceAllString(userAgent, ""))
+	sum := sha256.Sum256([]byte(normalized + "|" + subnet))
+	return hex.EncodeToString(sum[:])
+}
+
+// ipSubnet returns the /24 (IPv4) or /48 (IPv6) network containing the address
+func ipSubnet(ip net.IP) string {
+	if ip == nil {
+		return ""
+	}
+	if v4 := ip.To4(); v4 != nil {
+		return (&net.IPNet{IP: v4.Mask(net.CIDRMask(24, 32)), Mask: net.CIDRMask(24, 32)}).String()
+	}
+	return (&net.IPNet{IP: ip.Mask(net.CIDRMask(48, 128)), Mask: net.CIDRMask(48, 128)}).String()
+}
+
+// assessLogin records the device used for a successful login and alerts the
+// user when it is new or implies impossible travel since the previous login
+func (as *AuthService) assessLogin(r *http.Request, user User, session *Claims) {
+	userAgent := r.UserAgent()
+	ipString := as.clientIP(r)
+	ip := net.ParseIP(ipString)
+	subnet := ipSubnet(ip)
+	fingerprint := deviceFingerprint(userAgent, subnet)
+
+	var knownDevices int
+	if err := as.db.QueryRow("SELECT COUNT(*) FROM known_devices WHERE user_id = ?", user.ID).Scan(&knownDevices); err != nil {
+		log.Printf("Failed to load known devices for user %d: %v", user.ID, err)
+		return
+	}
+
+	var existingID int
+	err := as.db.QueryRow(`
+		SELECT id FROM known_devices WHERE user_id = ? AND fingerprint = ?
+	`, user.ID, fingerprint).Scan(&existingID)
+	if err != nil && err != sql.ErrNoRows {
+		log.Printf("Failed to look up device for user %d: %v", user.ID, err)
+		return
+	}
+	newDevice := err == sql.ErrNoRows
+
+	// Compare against the location of the previous login
+	location, located := as.geoIP.Lookup(ip)
+	impossibleTravel := false
+	var distance float64
+	if located {
+		var prev GeoLocation
+		var prevSeen time.Time
+		err := as.db.QueryRow(`
+			SELECT latitude, longitude, last_seen FROM known_devices
+			WHERE user_id = ? AND latitude IS NOT NULL
+			ORDER BY last_seen DESC LIMIT 1
+		`, user.ID).Scan(&prev.Latitude, &prev.Longitude, &prevSeen)
+		if err == nil {
+			distance = distanceKm(prev, location)
+			hours := time.Since(prevSeen).Hours()
+			if distance > impossibleTravelMinKm && (hours <= 0 || distance/hours > impossibleTravelSpeedKmh) {
+				impossibleTravel = true
+			}
+		}
+	}
+
+	var latitude, longitude interface{}
+	if located {
+		latitude, longitude = location.Latitude, location.Longitude
+	}
+
+	now := time.Now().UTC()
+	_, err = as.db.Exec(`
+		INSERT INTO known_devices (user_id, fingerprint, user_agent, ip_subnet, last_ip, latitude, longitude, first_seen, last_seen)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (user_id, fingerprint) DO UPDATE SET
+			user_agent = excluded.user_agent,
+			last_ip = excluded.last_ip,
+			latitude = excluded.latitude,
+			longitude = excluded.longitude,
+			last_seen = excluded.last_seen
+	`, user.ID, fingerprint, userAgent, subnet, ipString, latitude, longitude, now, now)
+	if err != nil {
+		log.Printf("Failed to record device for user %d: %v", user.ID, err)
+		return
+	}
+
+	deviceID := existingID
+	if newDevice {
+		as.db.QueryRow("SELECT id FROM known_devices WHERE user_id = ? AND fingerprint = ?", user.ID, fingerprint).Scan(&deviceID)
+	}
+
+	// The very first device of an account is not suspicious
+	alertNewDevice := newDevice && knownDevices > 0
+	if !alertNewDevice && !impossibleTravel {
+		return
+	}
+
+	reason := "new_device"
+	if impossibleTravel {
+		reason = "impossible_travel"
+	}
+	authAttempts.WithLabelValues("login_alert", reason).Inc()
+	as.recordAudit(r, user.ID, "login.suspicious", user.ID, map[string]interface{}{
+		"reason":      reason,
+		"device_id":   deviceID,
+		"user_agent":  userAgent,
+		"distance_km": int(distance),
+		"jti":         session.ID,
+	})
+
+	link, err := as.sessionRevokeLink(user.ID, deviceID, session)
+	if err != nil {
+		log.Printf("Failed to create session revoke link for user %d: %v", user.ID, err)
+		return
+	}
+
+	title := "New sign-in to your account"
+	message := fmt.Sprintf("Your account was signed in from a new device (%s, %s).", userAgent, ipString)
+	if impossibleTravel {
+		title = "Unusual sign-in location"
+		message = fmt.Sprintf("Your account was signed in from %s, about %d km from your previous sign-in, too far to travel in the time between them.", ipString, int(distance))
+	}
+	message += " If this wasn't you, revoke the session: " + link
+
+	as.sendNotificationAsync(SecurityNotification{
+		UserID:  user.ID,
+		Title:   title,
+		Message: message,
+		Type:    "security",
+	})
+}
+
+// sessionRevokeLink builds the "this wasn't me" URL. Link tokens are signed
+// with a key derived from the JWT secret so they can never pass as access tokens.
+func (as *AuthService) sessionRevokeLink(userID, deviceID int, session *Claims) (string, error) {
+	claims := sessionRevokeClaims{
+		UserID:   userID,
+		DeviceID: deviceID,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        session.ID,
+			Subject:   strconv.Itoa(userID),
+			ExpiresAt: session.ExpiresAt,
+			IssuedAt:  jwt.NewNumericDate(time.Now()),
+		},
+	}
+
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(as.sessionRevokeKey())
+	if err != nil {
+		return "", err
+	}
+	return as.publicURL + "/api/auth/sessions/revoke?token=" + url.QueryEscape(token), nil
+}
+
+func (as *AuthService) sessionRevokeKey() []byte {
+	return []byte(as.jwtSecret + "|session-revoke")
+}
+
+// sessionRevokeHandler shows a confirmation page on GET and revokes the
+// session on POST, so link scanners following the URL don't revoke anything
+func (as *AuthService) sessionRevokeHandler(w http.ResponseWriter, r *http.Request) {
+	tokenString := r.FormValue("token")
+	claims := &sessionRevokeClaims{}
+	_, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+		return as.sessionRevokeKey(), nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Name}))
+	if err != nil {
+		http.Error(w, "Invalid or expired link", http.StatusBadRequest)
+		return
+	}
+
+	page := struct {
+		Done      bool
+		Token     string
+		UserAgent string
+		IP        string
+	}{Token: tokenString}
+
+	if r.Method == http.MethodGet {
+		as.db.QueryRow(`
+			SELECT user_agent, last_ip FROM known_devices WHERE id = ? AND user_id = ?
+		`, claims.DeviceID, claims.UserID).Scan(&page.UserAgent, &page.IP)
+
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		sessionRevokePage.Execute(w, page)
+		return
+	}
+
+	if err := as.revokeToken(&Claims{UserID: claims.UserID, RegisteredClaims: claims.RegisteredClaims}); err != nil {
+		http.Error(w, "Failed to revoke session", http.StatusInternalServerError)
+		return
+	}
+
+	// Forget the device so another login from it alerts again
+	as.db.Exec("DELETE FROM known_devices WHERE id = ? AND user_id = ?", claims.DeviceID, claims.UserID)
+
+	as.recordAudit(r, claims.UserID, "session.revoke", claims.UserID, map[string]interface{}{
+		"jti":       claims.ID,
+		"device_id": claims.DeviceID,
+		"source":    "login_alert",
+	})
+
+	page.Done = true
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	sessionRevokePage.Execute(w, page)
+}
+
+func (as *AuthService) listDevicesHandler(w http.ResponseWriter, r *http.Request) {
+	claims, err := as.authenticateRequest(r)
+	if err != nil {
+		http.Error(w, "Invalid token", http.StatusUnauthorized)
+		return
+	}
+
+	rows, err := as.db.Query(`
+		SELECT id, user_agent, ip_subnet, last_ip, first_seen, last_seen
+		FROM known_devices WHERE user_id = ? ORDER BY last_seen DESC
+	`, claims.UserID)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	devices := []KnownDevice{}
+	for rows.Next() {
+		var device KnownDevice
+		err := rows.Scan(&device.ID, &device.UserAgent, &device.IPSubnet, &device.LastIP, &device.FirstSeen, &device.LastSeen)
+		if err != nil {
+			http.Error(w, "Database scan error", http.StatusInternalServerError)
+			return
+		}
+		devices = append(devices, device)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(devices)
+}
+
+func (as *AuthService) deleteDeviceHandler(w http.ResponseWriter, r *http.Request) {
+	claims, err := as.authenticateRequest(r)
+	if err != nil {
+		http.Error(w, "Invalid token", http.StatusUnauthorized)
+		return
+	}
+
+	deviceID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid device ID", http.StatusBadRequest)
+		return
+	}
+
+	result, err := as.db.Exec("DELETE FROM known_devices WHERE id = ? AND user_id = ?", deviceID, claims.UserID)
+	if err != nil {
+		http.Error(w, "Failed to delete device", http.StatusInternalServerError)
+		return
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		http.Error(w, "Device not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// RFC 8693 token exchange settings
+const (
+	tokenExchangeGrantType = "urn:ietf:params:oauth:grant-type:token-exchange"
+	tokenTypeAccessToken   = "urn:ietf:params:oauth:token-type:access_token"
+	tokenTypeJWT           = "urn:ietf:params:oauth:token-type:jwt"
+	exchangedTokenTTL      = 5 * time.Minute
+
+	clientCredentialsGrantType = "client_credentials"
+)
+
+// knownScopes are the scopes a down-scoped token can carry. Tokens without a
+// scope claim are unrestricted.
+var knownScopes = map[string]bool{
+	"tasks:read":          true,
+	"tasks:write":         true,
+	"notifications:read":  true,
+	"notifications:write": true,
+	"users:delete":        true, // deleting a user's data in task-service
+}
+
+// tokenExchangeGrant trades a user's token for one that only a single
+// downstream service accepts, with fewer scopes, a short lifetime and an act
+// claim naming the calling client (RFC 8693 section 2)
+func (as *AuthService) tokenExchangeGrant(w http.ResponseWriter, r *http.Request) {
+	clientID, ok := as.authenticateClient(r)
+	if !ok {
+		authAttempts.WithLabelValues("token_exchange", "invalid_client").Inc()
+		w.Header().Set("WWW-Authenticate", `Basic realm="auth-service"`)
+		writeOAuthError(w, http.StatusUnauthorized, "invalid_client", "Client authentication failed")
+		return
+	}
+
+	subjectToken := r.PostFormValue("subject_token")
+	subjectTokenType := r.PostFormValue("subject_token_type")
+	if subjectToken == "" || subjectTokenType == "" {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_request", "The subject_token and subject_token_type parameters are required")
+		return
+	}
+	if subjectTokenType != tokenTypeAccessToken && subjectTokenType != tokenTypeJWT {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_request", "Unsupported subject_token_type")
+		return
+	}
+	if requested := r.PostFormValue("requested_token_type"); requested != "" && requested != tokenTypeAccessToken {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_request", "Only access tokens can be issued")
+		return
+	}
+	if r.PostFormValue("actor_token") != "" {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_request", "actor_token is not supported; the authenticated client is the actor")
+		return
+	}
+
+	// Exactly one audience, so the new token is only good at one service
+	audiences := r.PostForm["audience"]
+	if len(audiences) != 1 || !hasAudience(as.audiences, audiences[0]) {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_target", "audience must name one service this server issues tokens for")
+		return
+	}
+
+	subject, err := as.parseToken(subjectToken)
+	if err != nil {
+		authAttempts.WithLabelValues("token_exchange", "invalid_grant").Inc()
+		writeOAuthError(w, http.StatusBadRequest, "invalid_grant", "The subject token is invalid or expired")
+		return
+	}
+
+	scope, ok := downscope(subject.Scope, r.PostFormValue("scope"))
+	if !ok {
+		authAttempts.WithLabelValues("token_exchange", "invalid_scope").Inc()
+		writeOAuthError(w, http.StatusBadRequest, "invalid_scope", "scope must be a non-empty subset of the subject token's scope")
+		return
+	}
+	if !as.clientGrants.allows(clientID, audiences[0], scope) {
+		authAttempts.WithLabelValues("token_exchange", "invalid_scope").Inc()
+		writeOAuthError(w, http.StatusBadRequest, "invalid_scope", "The client may not request this scope for this audience")
+		return
+	}
+
+	// Never outlive the token that was exchanged
+	ttl := exchangedTokenTTL
+	if subject.ExpiresAt != nil {
+		if remaining := time.Until(subject.ExpiresAt.Time); remaining < ttl {
+			ttl = remaining
+		}
+	}
+
+	claims, err := newClaims(subject.UserID, subject.Username, ttl)
+	if err != nil {
+		writeOAuthError(w, http.StatusInternalServerError, "server_error", "Failed to generate token")
+		return
+	}
+	claims.Audience = jwt.ClaimStrings{audiences[0]}
+	claims.Scope = scope
+	claims.Impersonated = subject.Impersonated
+	// Earlier actors of a delegation chain stay nested under the new one
+	claims.Actor = &Actor{Subject: "client:" + clientID, Actor: subject.Actor}
+	claims.ClientID = clientID
+
+	token, err := as.signToken(claims)
+	if err != nil {
+		writeOAuthError(w, http.StatusInternalServerError, "server_error", "Failed to generate token")
+		return
+	}
+
+	authAttempts.WithLabelValues("token_exchange", "success").Inc()
+	as.recordAudit(r, subject.UserID, "token.exchange", subject.UserID, map[string]interface{}{
+		"client_id":   clientID,
+		"audience":    audiences[0],
+		"scope":       scope,
+		"subject_jti": subject.ID,
+		"jti":         claims.ID,
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(TokenResponse{
+		AccessToken:     token,
+		IssuedTokenType: tokenTypeAccessToken,
+		TokenType:       "Bearer",
+		ExpiresIn:       int(ttl.Seconds()),
+		Scope:           scope,
+	})
+}
+
+// clientCredentialsGrant issues a token to a client acting for itself rather
+// than for a user (RFC 6749 section 4.4), for work no user request starts,
+// such as scheduled reminders. Like exchanged tokens, it is for one audience
+// and the scopes the client names, within what OAUTH_CLIENT_GRANTS allows it.
+func (as *AuthService) clientCredentialsGrant(w http.ResponseWriter, r *http.Request) {
+	clientID, ok := as.authenticateClient(r)
+	if !ok {
+		authAttempts.WithLabelValues("client_credentials", "invalid_client").Inc()
+		w.Header().Set("WWW-Authenticate", `Basic realm="auth-service"`)
+		writeOAuthError(w, http.StatusUnauthorized, "invalid_client", "Client authentication failed")
+		return
+	}
+
+	audiences := r.PostForm["audience"]
+	if len(audiences) != 1 || !hasAudience(as.audiences, audiences[0]) {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_target", "audience must name one service this server issues tokens for")
+		return
+	}
+	scope, ok := downscope("", r.PostFormValue("scope"))
+	if !ok {
+		authAttempts.WithLabelValues("client_credentials", "invalid_scope").Inc()
+		writeOAuthError(w, http.StatusBadRequest, "invalid_scope", "scope must name one or more known scopes")
+		return
+	}
+	if !as.clientGrants.allows(clientID, audiences[0], scope) {
+		authAttempts.WithLabelValues("client_credentials", "invalid_scope").Inc()
+		writeOAuthError(w, http.StatusBadRequest, "invalid_scope", "The client may not request this scope for this audience")
+		return
+	}
+
+	token, err := as.serviceToken(clientID, audiences[0], scope)
+	if err != nil {
+		writeOAuthError(w, http.StatusInternalServerError, "server_error", "Failed to generate token")
+		return
+	}
+
+	authAttempts.WithLabelValues("client_credentials", "success").Inc()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(TokenResponse{
+		AccessToken: token,
+		TokenType:   "Bearer",
+		ExpiresIn:   int(exchangedTokenTTL.Seconds()),
+		Scope:       scope,
+	})
+}
+
+// serviceToken signs a short-lived token for a client acting for itself.
+// It has no user, so only services that accept service tokens take it.
+func (as *AuthService) serviceToken(clientID, audience, scope string) (string, error) {
+	claims, err := newClaims(0, "", exchangedTokenTTL)
+	if err != nil {
+		return "", err
+	}
+	claims.Subject = "client:" + clientID
+	claims.ClientID = clientID
+	claims.Audience = jwt.ClaimStrings{audience}
+	claims.Scope = scope
+	return as.signToken(claims)
+}
+
+// downscope returns the scope for an exchanged token. An unscoped subject
+// token allows any known scope but the caller must name them; a scoped one
+// allows a subset and defaults to its own scope.
+func downscope(subjectScope, requested string) (string, bool) {
+	requestedScopes := strings.Fields(requested)
+	if len(requestedScopes) == 0 {
+		return subjectScope, subjectScope != ""
+	}
+
+	allowed := knownScopes
+	if subjectScope != "" {
+		allowed = map[string]bool{}
+		for _, scope := range strings.Fields(subjectScope) {
+			allowed[scope] = true
+		}
+	}
+
+	for _, scope := range requestedScopes {
+		if !allowed[scope] {
+			return "", false
+		}
+	}
+	return strings.Join(requestedScopes, " "), true
+}
+
+// hasScope reports whether a token's scope grants the given scope. Tokens
+// without a scope claim are unrestricted.
+func hasScope(tokenScope, want string) bool {
+	if tokenScope == "" {
+		return true
+	}
+	for _, scope := range strings.Fields(tokenScope) {
+		if scope == want {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// GeoLocation is an approximate position for an IP address
+type GeoLocation struct {
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+}
+
+// GeoIPDatabase is an in-memory copy of an offline GeoIP CSV file
+type GeoIPDatabase struct {
+	ranges []geoIPRange
+}
+
+type geoIPRange struct {
+	start, end net.IP // 16-byte form
+	location   GeoLocation
+}
+
+// loadGeoIPDatabase reads a CSV file with network, latitude and longitude
+// columns, such as MaxMind's GeoLite2-City-Blocks-IPv4.csv and -IPv6.csv.
+// Several files can be given separated by commas.
+func loadGeoIPDatabase(paths string) (*GeoIPDatabase, error) {
+	db := &GeoIPDatabase{}
+	for _, path := range strings.Split(paths, ",") {
+		path = strings.TrimSpace(path)
+		if path == "" {
+			continue
+		}
+		if err := db.loadFile(path); err != nil {
+			return nil, err
+		}
+	}
+
+	sort.Slice(db.ranges, func(i, j int) bool {
+		return bytes.Compare(db.ranges[i].start, db.ranges[j].start) < 0
+	})
+	return db, nil
+}
+
+func (db *GeoIPDatabase) loadFile(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open GeoIP database: %v", err)
+	}
+	defer file.Close()
+
+	reader := csv.NewReader(file)
+	reader.ReuseRecord = true
+
+	header, err := reader.Read()
+	if err != nil {
+		return fmt.Errorf("failed to read GeoIP header: %v", err)
+	}
+
+	networkCol, latCol, lonCol := -1, -1, -1
+	for i, name := range header {
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "network":
+			networkCol = i
+		case "latitude":
+			latCol = i
+		case "longitude":
+			lonCol = i
+		}
+	}
+	if networkCol < 0 || latCol < 0 || lonCol < 0 {
+		return fmt.Errorf("GeoIP file %s needs network, latitude and longitude columns", path)
+	}
+
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read GeoIP record: %v", err)
+		}
+
+		_, network, err := net.ParseCIDR(record[networkCol])
+		if err != nil {
+			continue
+		}
+		lat, latErr := strconv.ParseFloat(record[latCol], 64)
+		lon, lonErr := strconv.ParseFloat(record[lonCol], 64)
+		if latErr != nil || lonErr != nil {
+			continue
+		}
+
+		start := network.IP.To16()
+		end := make(net.IP, len(start))
+		mask := network.Mask
+		if len(mask) == net.IPv4len {
+			mask = append(net.CIDRMask(96, 128)[:12], mask...)
+		}
+		for i := range start {
+			end[i] = start[i] | ^mask[i]
+		}
+
+		db.ranges = append(db.ranges, geoIPRange{start: start, end: end, location: GeoLocation{lat, lon}})
+	}
+
+	return nil
+}
+
+// Lookup returns the location of the address, if known
+func (db *GeoIPDatabase) Lookup(ip net.IP) (GeoLocation, bool) {
+	if db == nil || ip == nil {
+		return GeoLocation{}, false
+	}
+	ip = ip.To16()
+
+	// Find the last range starting at or before the address
+	i := sort.Search(len(db.ranges), func(i int) bool {
+		return bytes.Compare(db.ranges[i].start, ip) > 0
+	}) - 1
+	if i < 0 || bytes.Compare(ip, db.ranges[i].end) > 0 {
+		return GeoLocation{}, false
+	}
+	return db.ranges[i].location, true
+}
+
+// distanceKm returns the great-circle distance between two locations
+func distanceKm(a, b GeoLocation) float64 {
+	const earthRadiusKm = 6371.0
+	lat1, lat2 := a.Latitude*math.Pi/180, b.Latitude*math.Pi/180
+	dLat := lat2 - lat1
+	dLon := (b.Longitude - a.Longitude) * math.Pi / 180
+
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(lat1)*math.Cos(lat2)*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadiusKm * math.Asin(math.Sqrt(h))
+}
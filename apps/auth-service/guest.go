@@ -0,0 +1,346 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Guest account settings
+const (
+	// Guests have no credentials to sign in again, so their token lasts
+	// until the account is upgraded or collected
+	guestTokenTTL = 365 * 24 * time.Hour
+	// guestActivityInterval limits how often token use updates last_active_at
+	guestActivityInterval = time.Hour
+	guestCollectInterval  = time.Hour
+	guestEmailDomain      = "guest.invalid"
+)
+
+// newGuestIdentity returns a generated username and a placeholder email that
+// satisfies the users table constraints but can never receive mail
+func newGuestIdentity() (string, string, error) {
+	b := make([]byte, 6)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+	username := "guest-" + hex.EncodeToString(b)
+	return username, username + "@" + guestEmailDomain, nil
+}
+
+func (as *AuthService) createGuestHandler(w http.ResponseWriter, r *http.Request) {
+	// Guests get a token without an invite or a checked email address, so
+	// they're only offered when anyone may register
+	if as.registration.Mode != registrationOpen {
+		authAttempts.WithLabelValues("guest", "rejected").Inc()
+		http.Error(w, "Guest accounts are only available when registration is open", http.StatusForbidden)
+		return
+	}
+
+	username, email, err := newGuestIdentity()
+	if err != nil {
+		http.Error(w, "Failed to create guest", http.StatusInternalServerError)
+		return
+	}
+
+	// An empty password hash never matches, so guests can't sign in with a password
+	now := time.Now().UTC()
+	result, err := as.db.Exec(`
+		INSERT INTO users (username, email, password_hash, guest, last_active_at)
+		VALUES (?, ?, '', 1, ?)
+	`, username, email, now)
+	if err != nil {
+		authAttempts.WithLabelValues("guest", "error").Inc()
+		http.Error(w, "Failed to create guest", http.StatusInternalServerError)
+		return
+	}
+	userID, _ := result.LastInsertId()
+
+	claims, err := newClaims(int(userID), username, guestTokenTTL)
+	if err != nil {
+		http.Error(w, "Failed to generate token", http.StatusInternalServerError)
+		return
+	}
+
+	token, err := as.signToken(claims)
+	if err != nil {
+		http.Error(w, "Failed to generate token", http.StatusInternalServerError)
+		return
+	}
+
+	authAttempts.WithLabelValues("guest", "success").Inc()
+	as.recordAudit(r, int(userID), "guest.create", int(userID), nil)
+
+	response := LoginResponse{
+		Token: token,
+		User: User{
+			ID:        int(userID),
+			Username:  username,
+			CreatedAt: now,
+		},
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(response)
+}
+
+// upgradeGuestHandler attaches an email and password to the caller's guest
+// account. The user ID doesn't change, so data in other services is kept.
+func (as *AuthService) upgradeGuestHandler(w http.ResponseWriter, r *http.Request) {
+	claims, err := as.authenticateRequest(r)
+	if err != nil {
+		http.Error(w, "Invalid token", http.StatusUnauthorized)
+		return
+	}
+
+	if !claims.Guest {
+		http.Error(w, "Only guest accounts can be upgraded", http.StatusConflict)
+		return
+	}
+
+	var req RegisterRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if req.Email == "" || req.Password == "" {
+		http.Error(w, "Email and password are required", http.StatusBadRequest)
+		return
+	}
+	if req.Username == "" {
+		req.Username = claims.Username
+	}
+
+	// Upgrading is registering, so the same mode, domain and invite rules apply
+	invite, err := as.checkRegistration(req)
+	if err != nil {
+		authAttempts.WithLabelValues("guest_upgrade", "rejected").Inc()
+		writeRegistrationError(w, err)
+		return
+	}
+
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+	if err != nil {
+		http.Error(w, "Failed to hash password", http.StatusInternalServerError)
+		return
+	}
+
+	tx, err := as.db.Begin()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`
+		UPDATE users SET username = ?, email = ?, password_hash = ?, guest = 0,
+			last_active_at = NULL, updated_at = ?
+		WHERE id = ? AND guest = 1
+	`, req.Username, req.Email, string(hashedPassword), time.Now().UTC(), claims.UserID)
+	if err != nil {
+		if sqliteErr, ok := err.(sqlite3.Error); ok && sqliteErr.Code == sqlite3.ErrConstraint {
+			authAttempts.WithLabelValues("guest_upgrade", "failed").Inc()
+			http.Error(w, "Username or email already exists", http.StatusConflict)
+			return
+		}
+		http.Error(w, "Failed to upgrade account", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		http.Error(w, "Only guest accounts can be upgraded", http.StatusConflict)
+		return
+	}
+
+	if invite != nil {
+		if err := redeemInvite(tx, invite, claims.UserID); err != nil {
+			authAttempts.WithLabelValues("guest_upgrade", "rejected").Inc()
+			writeRegistrationError(w, err)
+			return
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Failed to upgrade account", http.StatusInternalServerError)
+		return
+	}
+
+	// The guest token says guest; replace it with a full session
+	if err := as.revokeToken(claims); err != nil {
+		log.Printf("Failed to revoke guest token of user %d: %v", claims.UserID, err)
+	}
+
+	authAttempts.WithLabelValues("guest_upgrade", "success").Inc()
+	as.recordAudit(r, claims.UserID, "guest.upgrade", claims.UserID, map[string]interface{}{
+		"username": req.Username,
+	})
+
+	var user User
+	err = as.db.QueryRow(`
+		SELECT id, username, email, created_at FROM users WHERE id = ?
+	`, claims.UserID).Scan(&user.ID, &user.Username, &user.Email, &user.CreatedAt)
+	if err != nil {
+		http.Error(w, "Failed to retrieve user", http.StatusInternalServerError)
+		return
+	}
+
+	session, err := newClaims(user.ID, user.Username, 24*time.Hour)
+	if err != nil {
+		http.Error(w, "Failed to generate token", http.StatusInternalServerError)
+		return
+	}
+	markAuthenticated(session, acrAAL1)
+
+	token, err := as.signToken(session)
+	if err != nil {
+		http.Error(w, "Failed to generate token", http.StatusInternalServerError)
+		return
+	}
+
+	response := LoginResponse{
+		Token: token,
+		User:  user,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(response)
+}
+
+// touchGuest records that a guest is still using their account, at most once
+// per guestActivityInterval
+func (as *AuthService) touchGuest(userID int) {
+	now := time.Now().UTC()
+	_, err := as.db.Exec(`
+		UPDATE users SET last_active_at = ?
+		WHERE id = ? AND guest = 1 AND (last_active_at IS NULL OR last_active_at < ?)
+	`, now, userID, now.Add(-guestActivityInterval))
+	if err != nil {
+		log.Printf("Failed to record activity of guest %d: %v", userID, err)
+	}
+}
+
+// collectGuests deletes guests inactive for longer than retention and returns
+// their IDs. Their tasks are deleted from task-service first; a guest whose
+// tasks couldn't be deleted is retried on the next run.
+func (as *AuthService) collectGuests(retention time.Duration) ([]int, error) {
+	cutoff := time.Now().UTC().Add(-retention)
+	rows, err := as.db.Query(`
+		SELECT id FROM users
+		WHERE guest = 1 AND COALESCE(last_active_at, created_at) < ?
+	`, cutoff)
+	if err != nil {
+		return nil, err
+	}
+
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	collected := []int{}
+	for _, id := range ids {
+		// Deactivating the guest first stops their token, so they can't
+		// upgrade the account while their tasks are being deleted. They stay
+		// deactivated until a later run manages to delete them.
+		result, err := as.db.Exec(`
+			UPDATE users SET active = 0
+			WHERE id = ? AND guest = 1 AND COALESCE(last_active_at, created_at) < ?
+		`, id, cutoff)
+		if err != nil {
+			return collected, err
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			continue
+		}
+		if err := as.deleteTaskData(id); err != nil {
+			log.Printf("Failed to delete the tasks of guest %d: %v", id, err)
+			continue
+		}
+
+		tx, err := as.db.Begin()
+		if err != nil {
+			return collected, err
+		}
+		if err := deleteUser(tx, id); err != nil {
+			tx.Rollback()
+			return collected, err
+		}
+		if err := tx.Commit(); err != nil {
+			return collected, err
+		}
+		collected = append(collected, id)
+	}
+
+	if len(collected) > 0 {
+		as.recordAudit(nil, 0, "guest.collect", 0, map[string]interface{}{
+			"count":    len(collected),
+			"user_ids": collected,
+		})
+	}
+	return collected, nil
+}
+
+// collectGuestsPeriodically runs collectGuests until the process exits
+func (as *AuthService) collectGuestsPeriodically(retention time.Duration) {
+	for {
+		collected, err := as.collectGuests(retention)
+		if err != nil {
+			log.Printf("Failed to collect inactive guests: %v", err)
+		} else if len(collected) > 0 {
+			log.Printf("Collected %d inactive guest accounts", len(collected))
+		}
+		time.Sleep(guestCollectInterval)
+	}
+}
+
+// taskServiceAudience is the audience task-service requires
+const taskServiceAudience = "task-service"
+
+// deleteTaskData asks task-service to delete everything a user has there
+func (as *AuthService) deleteTaskData(userID int) error {
+	if as.taskServiceURL == "" {
+		return fmt.Errorf("task service URL not configured")
+	}
+
+	token, err := as.serviceToken(authServiceAudience, taskServiceAudience, "users:delete")
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("DELETE", as.taskServiceURL+"/api/users/"+strconv.Itoa(userID), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent {
+		return fmt.Errorf("task service returned status %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// impersonationTokenTTL bounds how long support can act as another user
+const impersonationTokenTTL = 15 * time.Minute
+
+// Actor identifies the party acting on behalf of the token subject (RFC 8693 act claim)
+type Actor struct {
+	Subject  string `json:"sub"`
+	Username string `json:"username,omitempty"`
+	Actor    *Actor `json:"act,omitempty"`
+}
+
+// ImpersonateRequest represents the impersonation request payload
+type ImpersonateRequest struct {
+	UserID   int    `json:"user_id"`
+	Username string `json:"username"`
+	Reason   string `json:"reason"`
+}
+
+// ImpersonateResponse represents the impersonation response
+type ImpersonateResponse struct {
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expires_at"`
+	User      User      `json:"user"`
+	Actor     Actor     `json:"act"`
+}
+
+func (as *AuthService) impersonateHandler(w http.ResponseWriter, r *http.Request) {
+	admin, ok := as.requireAdmin(w, r)
+	if !ok {
+		return
+	}
+
+	var req ImpersonateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if req.UserID == 0 && req.Username == "" {
+		http.Error(w, "user_id or username is required", http.StatusBadRequest)
+		return
+	}
+	if req.Reason == "" {
+		http.Error(w, "A reason is required for impersonation", http.StatusBadRequest)
+		return
+	}
+
+	// Find target user by ID, falling back to username
+	query := "SELECT id, username, email, created_at FROM users WHERE id = ?"
+	var arg interface{} = req.UserID
+	if req.UserID == 0 {
+		query = "SELECT id, username, email, created_at FROM users WHERE username = ?"
+		arg = req.Username
+	}
+
+	var user User
+	err := as.db.QueryRow(query, arg).Scan(&user.ID, &user.Username, &user.Email, &user.CreatedAt)
+
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "User not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	if user.ID == admin.UserID {
+		http.Error(w, "Cannot impersonate yourself", http.StatusBadRequest)
+		return
+	}
+
+	claims, err := newClaims(user.ID, user.Username, impersonationTokenTTL)
+	if err != nil {
+		http.Error(w, "Failed to generate token", http.StatusInternalServerError)
+		return
+	}
+
+	actor := Actor{
+		Subject:  strconv.Itoa(admin.UserID),
+		Username: admin.Username,
+	}
+	claims.Impersonated = true
+	claims.Actor = &actor
+
+	token, err := as.signToken(claims)
+	if err != nil {
+		http.Error(w, "Failed to generate token", http.StatusInternalServerError)
+		return
+	}
+
+	authAttempts.WithLabelValues("impersonate", "success").Inc()
+	as.recordAudit(r, admin.UserID, "user.impersonate", user.ID, map[string]interface{}{
+		"reason":     req.Reason,
+		"jti":        claims.ID,
+		"expires_at": claims.ExpiresAt.Time,
+	})
+
+	response := ImpersonateResponse{
+		Token:     token,
+		ExpiresAt: claims.ExpiresAt.Time,
+		User:      user,
+		Actor:     actor,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(response)
+}
+
+// checkDirectSession rejects impersonated and delegated (exchanged) tokens,
+// which are for the other services' APIs and not for account operations.
+// Attempts by impersonating admins are audited.
+func (as *AuthService) checkDirectSession(r *http.Request, claims *Claims) error {
+	if !claims.Impersonated && claims.Actor == nil {
+		return nil
+	}
+	operation := r.Method + " " + r.URL.Path
+
+	if !claims.Impersonated {
+		log.Printf("Blocked %s by delegated token of user %d (actor %s)", operation, claims.UserID, claims.Actor.Subject)
+		return fmt.Errorf("delegated tokens are not accepted")
+	}
+
+	actorID := 0
+	if claims.Actor != nil {
+		actorID, _ = strconv.Atoi(claims.Actor.Subject)
+	}
+
+	log.Printf("Blocked %s by impersonated session of user %d (actor %d)", operation, claims.UserID, actorID)
+	as.recordAudit(r, actorID, "impersonation.blocked", claims.UserID, map[string]interface{}{
+		"operation": operation,
+		"jti":       claims.ID,
+	})
+	return fmt.Errorf("impersonation tokens are not accepted")
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"time"
+)
+
+// legacyKeyID stands for JWT_SECRET once rotated keys exist. Tokens signed
+// before the first rotation carry no kid header and map to this key.
+const legacyKeyID = "env"
+
+// SigningKey describes a token signing key without its secret
+type SigningKey struct {
+	KID       string     `json:"kid"`
+	CreatedAt time.Time  `json:"created_at"`
+	RetiredAt *time.Time `json:"retired_at,omitempty"`
+	Current   bool       `json:"current"`
+}
+
+// currentSigningKey returns the newest active key, or JWT_SECRET (with no kid)
+// if keys have never been rotated
+func (as *AuthService) currentSigningKey() (string, []byte, error) {
+	var kid string
+	var secret sql.NullString
+	err := as.db.QueryRow(`
+		SELECT kid, secret FROM signing_keys
+		WHERE retired_at IS NULL
+		ORDER BY created_at DESC LIMIT 1
+	`).Scan(&kid, &secret)
+
+	if err == sql.ErrNoRows {
+		return "", []byte(as.jwtSecret), nil
+	}
+	if err != nil {
+		return "", nil, err
+	}
+	if !secret.Valid {
+		return kid, []byte(as.jwtSecret), nil
+	}
+	return kid, []byte(secret.String), nil
+}
+
+// verificationKey returns the secret for a token's kid, refusing retired keys
+func (as *AuthService) verificationKey(kid string) ([]byte, error) {
+	if kid == "" {
+		kid = legacyKeyID
+	}
+
+	var secret sql.NullString
+	var retired bool
+	err := as.db.QueryRow(`
+		SELECT secret, retired_at IS NOT NULL FROM signing_keys WHERE kid = ?
+	`, kid).Scan(&secret, &retired)
+
+	if err == sql.ErrNoRows {
+		// Before the first rotation only JWT_SECRET exists
+		if kid == legacyKeyID {
+			return []byte(as.jwtSecret), nil
+		}
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if retired {
+		return nil, fmt.Errorf("signing key %q has been retired", kid)
+	}
+	if !secret.Valid {
+		return []byte(as.jwtSecret), nil
+	}
+	return []byte(secret.String), nil
+}
+
+// rotateSigningKey creates a new current signing key. Previous keys keep
+// verifying tokens until they expire unless retirePrevious is set, which
+// invalidates every token signed with them immediately.
+func (as *AuthService) rotateSigningKey(retirePrevious bool) (*SigningKey, error) {
+	secretBytes := make([]byte, 32)
+	if _, err := rand.Read(secretBytes); err != nil {
+		return nil, err
+	}
+	kidBytes := make([]byte, 8)
+	if _, err := rand.Read(kidBytes); err != nil {
+		return nil, err
+	}
+
+	tx, err := as.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	now := time.Now().UTC()
+
+	// Record JWT_SECRET as a key on first rotation so it can be retired later
+	_, err = tx.Exec(`
+		INSERT OR IGNORE INTO signing_keys (kid, secret, created_at) VALUES (?, NULL, ?)
+	`, legacyKeyID, now.Add(-time.Second))
+	if err != nil {
+		return nil, err
+	}
+
+	if retirePrevious {
+		if _, err := tx.Exec("UPDATE signing_keys SET retired_at = ? WHERE retired_at IS NULL", now); err != nil {
+			return nil, err
+		}
+	}
+
+	key := &SigningKey{
+		KID:       hex.EncodeToString(kidBytes),
+		CreatedAt: now,
+		Current:   true,
+	}
+	_, err = tx.Exec(`
+		INSERT INTO signing_keys (kid, secret, created_at) VALUES (?, ?, ?)
+	`, key.KID, base64.RawStdEncoding.EncodeToString(secretBytes), key.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	return key, tx.Commit()
+}
+
+// listSigningKeys returns every key, newest first
+func (as *AuthService) listSigningKeys() ([]SigningKey, error) {
+	rows, err := as.db.Query("SELECT kid, created_at, retired_at FROM signing_keys ORDER BY created_at DESC")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []SigningKey{}
+	for rows.Next() {
+		var key SigningKey
+		var retiredAt sql.NullTime
+		if err := rows.Scan(&key.KID, &key.CreatedAt, &retiredAt); err != nil {
+			return nil, err
+		}
+		key.RetiredAt = nullTimePtr(retiredAt)
+		keys = append(keys, key)
+	}
+
+	for i := range keys {
+		if keys[i].RetiredAt == nil {
+			keys[i].Current = true
+			break
+		}
+	}
+	return keys, rows.Err()
+}
+
+// revokeUserTokens invalidates every token issued to the user until now
+func (as *AuthService) revokeUserTokens(userID int) error {
+	_, err := as.db.Exec(`
+		INSERT INTO user_token_revocations (user_id, revoked_before) VALUES (?, ?)
+		ON CONFLICT (user_id) DO UPDATE SET revoked_before = excluded.revoked_before
+	`, userID, time.Now().UTC().Truncate(time.Second))
+	return err
+}
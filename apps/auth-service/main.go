@@ -3,11 +3,14 @@ package main
 import (
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
@@ -26,6 +29,15 @@ type User struct {
 	CreatedAt time.Time `json:"created_at"`
 }
 
+// UserSummary is what other signed-in users can see of a user
+type UserSummary struct {
+	ID       int    `json:"id"`
+	Username string `json:"username"`
+}
+
+// maxUserLookups bounds the usernames one lookup can resolve
+const maxUserLookups = 50
+
 // LoginRequest represents the login request payload
 type LoginRequest struct {
 	Username string `json:"username"`
@@ -34,9 +46,16 @@ type LoginRequest struct {
 
 // RegisterRequest represents the registration request payload
 type RegisterRequest struct {
-	Username string `json:"username"`
-	Email    string `json:"email"`
-	Password string `json:"password"`
+	Username   string `json:"username"`
+	Email      string `json:"email"`
+	Password   string `json:"password"`
+	InviteCode string `json:"invite_code,omitempty"`
+}
+
+// ChangePasswordRequest represents the change password request payload
+type ChangePasswordRequest struct {
+	CurrentPassword string `json:"current_password"`
+	NewPassword     string `json:"new_password"`
 }
 
 // LoginResponse represents the login response
@@ -80,15 +99,41 @@ var (
 
 // AuthService handles authentication operations
 type AuthService struct {
-	db          *sql.DB
-	jwtSecret   string
-	corsOrigins string
+	db            *sql.DB
+	jwtSecret     string
+	corsOrigins   string
+	oauthClients  map[string]string // client ID -> client secret
+	clientGrants  clientGrants      // what each client may request for other services
+	deviceClients map[string]bool   // public clients allowed to use the device grant
+	registration  RegistrationPolicy
+	scimToken     string
+	issuer        string
+	audiences     []string // aud of issued tokens; parsed tokens need one of them
+	webauthn      WebAuthnConfig
+
+	trustedProxies         []*net.IPNet // X-Forwarded-For is only honoured from these
+	notificationServiceURL string
+	taskServiceURL         string // deletes the data of collected guests
+	publicURL              string
+	geoIP                  *GeoIPDatabase
 }
 
 // Claims represents JWT claims
 type Claims struct {
-	UserID   int    `json:"user_id"`
-	Username string `json:"username"`
+	UserID        int      `json:"user_id"`
+	Username      string   `json:"username"`
+	Email         string   `json:"email,omitempty"`
+	EmailVerified bool     `json:"email_verified,omitempty"`
+	Roles         []string `json:"roles,omitempty"`
+	Scope         string   `json:"scope,omitempty"`
+	Guest         bool     `json:"guest,omitempty"`
+	Impersonated  bool     `json:"impersonated,omitempty"`
+	Actor         *Actor   `json:"act,omitempty"`
+	ClientID      string   `json:"client_id,omitempty"` // client an exchanged or service token was issued to
+	// AuthTime is when the user last proved their identity, and ACR how.
+	// Tokens not issued by a sign-in (device grants, impersonation) carry neither.
+	AuthTime *jwt.NumericDate `json:"auth_time,omitempty"`
+	ACR      string           `json:"acr,omitempty"`
 	jwt.RegisteredClaims
 }
 
@@ -100,27 +145,96 @@ func init() {
 	prometheus.MustRegister(authAttempts)
 }
 
+// Defaults shared by the server and the administrative CLI
+const (
+	defaultDatabaseURL = "./data/auth.db"
+	defaultJWTSecret   = "your-super-secret-jwt-key-change-in-production"
+	defaultJWTAudience = "auth-service,task-service,notification-service"
+	// authServiceAudience is the audience the auth service's own API requires
+	authServiceAudience = "auth-service"
+)
+
 func main() {
+	// Without a subcommand the binary starts the HTTP server
+	os.Exit(runCommand(os.Args[1:]))
+}
+
+func serve() {
 	// Get configuration from environment variables
 	port := getEnv("PORT", "8080")
-	databaseURL := getEnv("DATABASE_URL", "./data/auth.db")
-	jwtSecret := getEnv("JWT_SECRET", "your-super-secret-jwt-key-change-in-production")
+	databaseURL := getEnv("DATABASE_URL", defaultDatabaseURL)
+	jwtSecret := getEnv("JWT_SECRET", defaultJWTSecret)
 	corsOrigins := getEnv("CORS_ORIGINS", "http://localhost:3000")
+	oauthClients := parseOAuthClients(getEnv("OAUTH_CLIENTS", ""))
+	clientGrants, err := parseClientGrants(getEnv("OAUTH_CLIENT_GRANTS", ""))
+	if err != nil {
+		log.Fatal("Invalid OAUTH_CLIENT_GRANTS:", err)
+	}
+	deviceClients := parseDeviceClients(getEnv("DEVICE_CLIENTS", "task-cli"))
+	scimToken := getEnv("SCIM_TOKEN", "")
+	notificationServiceURL := getEnv("NOTIFICATION_SERVICE_URL", "http://localhost:8082")
+	taskServiceURL := getEnv("TASK_SERVICE_URL", "http://localhost:8081")
+	publicURL := configuredPublicURL()
+	issuer, audiences := tokenConfig(publicURL)
+	webauthn := parseWebAuthnConfig(getEnv("WEBAUTHN_RP_ID", "localhost"), getEnv("WEBAUTHN_ORIGINS", corsOrigins))
+	geoIPPath := getEnv("GEOIP_DATABASE", "")
+	autoMigrate := getEnv("AUTO_MIGRATE", "true") == "true"
+	if !hasAudience(audiences, authServiceAudience) {
+		log.Fatalf("JWT_AUDIENCE must include %s", authServiceAudience)
+	}
+	registration, err := parseRegistrationPolicy(getEnv("REGISTRATION_MODE", registrationOpen), getEnv("REGISTRATION_ALLOWED_DOMAINS", ""))
+	if err != nil {
+		log.Fatal("Invalid registration configuration:", err)
+	}
+	trustedProxies, err := parseTrustedProxies(getEnv("TRUSTED_PROXIES", ""))
+	if err != nil {
+		log.Fatal("Invalid TRUSTED_PROXIES:", err)
+	}
+	guestRetentionDays, err := strconv.Atoi(getEnv("GUEST_RETENTION_DAYS", "30"))
+	if err != nil || guestRetentionDays < 1 {
+		log.Fatal("GUEST_RETENTION_DAYS must be a positive number of days")
+	}
 
 	// Initialize database
-	db, err := initDatabase(databaseURL)
+	db, err := initDatabase(databaseURL, autoMigrate)
 	if err != nil {
 		log.Fatal("Failed to initialize database:", err)
 	}
 	defer db.Close()
 
+	// Load the offline GeoIP database used for impossible-travel detection
+	var geoIP *GeoIPDatabase
+	if geoIPPath != "" {
+		geoIP, err = loadGeoIPDatabase(geoIPPath)
+		if err != nil {
+			log.Fatal("Failed to load GeoIP database:", err)
+		}
+	}
+
 	// Create auth service
 	authService := &AuthService{
-		db:          db,
-		jwtSecret:   jwtSecret,
-		corsOrigins: corsOrigins,
+		db:            db,
+		jwtSecret:     jwtSecret,
+		corsOrigins:   corsOrigins,
+		oauthClients:  oauthClients,
+		clientGrants:  clientGrants,
+		deviceClients: deviceClients,
+		registration:  registration,
+		scimToken:     scimToken,
+		issuer:        issuer,
+		audiences:     audiences,
+		webauthn:      webauthn,
+
+		trustedProxies:         trustedProxies,
+		notificationServiceURL: notificationServiceURL,
+		taskServiceURL:         taskServiceURL,
+		publicURL:              publicURL,
+		geoIP:                  geoIP,
 	}
 
+	// Delete guest accounts that have been abandoned
+	go authService.collectGuestsPeriodically(time.Duration(guestRetentionDays) * 24 * time.Hour)
+
 	// Setup routes
 	router := setupRoutes(authService)
 
@@ -128,6 +242,18 @@ func main() {
 	log.Printf("Auth service starting on port %s", port)
 	log.Printf("Database: %s", databaseURL)
 	log.Printf("CORS Origins: %s", corsOrigins)
+	log.Printf("OAuth clients configured: %d", len(oauthClients))
+	log.Printf("Device flow clients configured: %d", len(deviceClients))
+	log.Printf("Token issuer: %s", issuer)
+	log.Printf("Token audiences: %s", strings.Join(audiences, ", "))
+	log.Printf("Trusted proxies: %d", len(trustedProxies))
+	log.Printf("Passkey relying party: %s", webauthn.RPID)
+	log.Printf("Registration mode: %s", registration.Mode)
+	log.Printf("Inactive guests collected after %d days", guestRetentionDays)
+	log.Printf("SCIM provisioning enabled: %t", scimToken != "")
+	log.Printf("Notification Service URL: %s", notificationServiceURL)
+	log.Printf("Task Service URL: %s", taskServiceURL)
+	log.Printf("GeoIP database: %s", geoIPPath)
 	log.Printf("Metrics available at http://localhost:%s/metrics", port)
 
 	if err := http.ListenAndServe(":"+port, router); err != nil {
@@ -135,7 +261,25 @@ func main() {
 	}
 }
 
-func initDatabase(databaseURL string) (*sql.DB, error) {
+// configuredPublicURL is the externally reachable base URL of the service
+func configuredPublicURL() string {
+	return strings.TrimSuffix(getEnv("PUBLIC_URL", "http://localhost:"+getEnv("PORT", "8080")), "/")
+}
+
+// tokenConfig reads the issuer and audiences of access tokens. The issuer
+// defaults to the public URL so each environment only accepts its own tokens.
+func tokenConfig(publicURL string) (string, []string) {
+	var audiences []string
+	for _, audience := range strings.Split(getEnv("JWT_AUDIENCE", defaultJWTAudience), ",") {
+		if audience = strings.TrimSpace(audience); audience != "" {
+			audiences = append(audiences, audience)
+		}
+	}
+	return getEnv("JWT_ISSUER", publicURL), audiences
+}
+
+// openDatabase opens the SQLite database without touching its schema
+func openDatabase(databaseURL string) (*sql.DB, error) {
 	// Create data directory if it doesn't exist
 	if err := os.MkdirAll("./data", 0755); err != nil {
 		return nil, fmt.Errorf("failed to create data directory: %v", err)
@@ -145,47 +289,88 @@ func initDatabase(databaseURL string) (*sql.DB, error) {
 	if err != nil {
 		return nil, fmt.Errorf("failed to open database: %v", err)
 	}
+	return db, nil
+}
 
-	// Create users table
-	createTableSQL := `
-	CREATE TABLE IF NOT EXISTS users (
-		id INTEGER PRIMARY KEY AUTOINCREMENT,
-		username TEXT UNIQUE NOT NULL,
-		email TEXT UNIQUE NOT NULL,
-		password_hash TEXT NOT NULL,
-		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
-	);
-	`
+// initDatabase opens the database, applies pending migrations when
+// autoMigrate is set, checks the schema version and seeds the default admin
+func initDatabase(databaseURL string, autoMigrate bool) (*sql.DB, error) {
+	db, err := openDatabase(databaseURL)
+	if err != nil {
+		return nil, err
+	}
 
-	if _, err := db.Exec(createTableSQL); err != nil {
-		return nil, fmt.Errorf("failed to create users table: %v", err)
+	if autoMigrate {
+		result, err := migrateDatabase(db, -1, false)
+		if err != nil {
+			db.Close()
+			return nil, fmt.Errorf("failed to migrate database: %v", err)
+		}
+		for _, step := range result.Steps {
+			log.Printf("Applied migration %d_%s", step.Version, step.Name)
+		}
+	}
+
+	if err := checkSchemaVersion(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	if err := seedDatabase(db); err != nil {
+		db.Close()
+		return nil, err
 	}
+	return db, nil
+}
 
+// seedDatabase creates the default admin user on an empty database
+func seedDatabase(db *sql.DB) error {
 	// Create default admin user if no users exist
 	var count int
-	err = db.QueryRow("SELECT COUNT(*) FROM users").Scan(&count)
+	err := db.QueryRow("SELECT COUNT(*) FROM users").Scan(&count)
 	if err != nil {
-		return nil, fmt.Errorf("failed to check users count: %v", err)
+		return fmt.Errorf("failed to check users count: %v", err)
 	}
 
 	if count == 0 {
 		hashedPassword, err := bcrypt.GenerateFromPassword([]byte("admin123"), bcrypt.DefaultCost)
 		if err != nil {
-			return nil, fmt.Errorf("failed to hash default password: %v", err)
+			return fmt.Errorf("failed to hash default password: %v", err)
 		}
 
-		_, err = db.Exec(`
-			INSERT INTO users (username, email, password_hash) 
-			VALUES (?, ?, ?)
+		// Replicas starting together may all see an empty table
+		result, err := db.Exec(`
+			INSERT INTO users (username, email, password_hash)
+			SELECT ?, ?, ? WHERE NOT EXISTS (SELECT 1 FROM users)
 		`, "admin", "admin@taskmanager.com", string(hashedPassword))
 
 		if err != nil {
-			return nil, fmt.Errorf("failed to create default user: %v", err)
+			return fmt.Errorf("failed to create default user: %v", err)
+		}
+		if created, _ := result.RowsAffected(); created > 0 {
+			log.Println("Created default admin user (username: admin, password: admin123)")
 		}
-		log.Println("Created default admin user (username: admin, password: admin123)")
 	}
 
-	return db, nil
+	// Make sure there is at least one administrator
+	var admins int
+	err = db.QueryRow("SELECT COUNT(*) FROM user_roles WHERE role = ?", roleAdmin).Scan(&admins)
+	if err != nil {
+		return fmt.Errorf("failed to check admin count: %v", err)
+	}
+
+	if admins == 0 {
+		_, err = db.Exec(`
+			INSERT OR IGNORE INTO user_roles (user_id, role)
+			SELECT id, ? FROM users WHERE username = 'admin'
+		`, roleAdmin)
+
+		if err != nil {
+			return fmt.Errorf("failed to grant default admin role: %v", err)
+		}
+	}
+
+	return nil
 }
 
 func setupRoutes(authService *AuthService) *mux.Router {
@@ -206,8 +391,46 @@ func setupRoutes(authService *AuthService) *mux.Router {
 	// Auth endpoints
 	router.HandleFunc("/api/auth/login", authService.loginHandler).Methods("POST")
 	router.HandleFunc("/api/auth/register", authService.registerHandler).Methods("POST")
+	router.HandleFunc("/api/auth/guest", authService.createGuestHandler).Methods("POST")
+	router.HandleFunc("/api/auth/guest/upgrade", authService.upgradeGuestHandler).Methods("POST")
 	router.HandleFunc("/api/auth/validate", authService.validateTokenHandler).Methods("GET")
 	router.HandleFunc("/api/auth/user", authService.getUserHandler).Methods("GET")
+	router.HandleFunc("/api/auth/users/lookup", authService.lookupUsersHandler).Methods("GET")
+	router.HandleFunc("/api/auth/password", authService.changePasswordHandler).Methods("PUT")
+	router.HandleFunc("/api/auth/policies", authService.listPoliciesHandler).Methods("GET")
+	router.HandleFunc("/api/auth/consents", authService.consentHistoryHandler).Methods("GET")
+	router.HandleFunc("/api/auth/consents", authService.acceptPolicyHandler).Methods("POST")
+	router.HandleFunc("/api/auth/reauthenticate", authService.reauthenticateHandler).Methods("POST")
+	router.HandleFunc("/api/auth/devices", authService.listDevicesHandler).Methods("GET")
+	router.HandleFunc("/api/auth/devices/{id}", authService.deleteDeviceHandler).Methods("DELETE")
+	router.HandleFunc("/api/auth/sessions/revoke", authService.sessionRevokeHandler).Methods("GET", "POST")
+	router.HandleFunc("/api/auth/passkeys", authService.listPasskeysHandler).Methods("GET")
+	router.HandleFunc("/api/auth/passkeys/{id}", authService.renamePasskeyHandler).Methods("PATCH")
+	router.HandleFunc("/api/auth/passkeys/{id}", authService.requireRecentAuth(stepUpMaxAge, authService.deletePasskeyHandler)).Methods("DELETE")
+	router.HandleFunc("/api/auth/passkeys/register/begin", authService.requireRecentAuth(stepUpMaxAge, authService.passkeyRegisterBeginHandler)).Methods("POST")
+	router.HandleFunc("/api/auth/passkeys/register/finish", authService.passkeyRegisterFinishHandler).Methods("POST")
+	router.HandleFunc("/api/auth/passkeys/login/begin", authService.passkeyLoginBeginHandler).Methods("POST")
+	router.HandleFunc("/api/auth/passkeys/login/finish", authService.passkeyLoginFinishHandler).Methods("POST")
+	router.HandleFunc("/api/auth/device/approve", authService.requireRecentAuth(stepUpMaxAge, authService.deviceDecisionHandler)).Methods("POST")
+	router.HandleFunc("/device", authService.deviceVerificationHandler).Methods("GET", "POST")
+
+	// Admin endpoints
+	router.HandleFunc("/api/auth/admin/impersonate", authService.requireRecentAuth(stepUpMaxAge, authService.impersonateHandler)).Methods("POST")
+	router.HandleFunc("/api/auth/policies", authService.publishPolicyHandler).Methods("POST")
+	router.HandleFunc("/api/auth/invites", authService.requireRecentAuth(stepUpMaxAge, authService.createInviteHandler)).Methods("POST")
+	router.HandleFunc("/api/auth/invites", authService.listInvitesHandler).Methods("GET")
+	router.HandleFunc("/api/auth/invites/{id}", authService.revokeInviteHandler).Methods("DELETE")
+
+	// OAuth 2.0 endpoints (RFC 7662 introspection, RFC 7009 revocation, RFC 8628 device grant)
+	router.HandleFunc("/oauth2/introspect", authService.introspectHandler).Methods("POST")
+	router.HandleFunc("/oauth2/revoke", authService.revokeHandler).Methods("POST")
+	router.HandleFunc("/oauth2/device_authorization", authService.deviceAuthorizationHandler).Methods("POST")
+	router.HandleFunc("/oauth2/token", authService.tokenHandler).Methods("POST")
+
+	// SCIM 2.0 provisioning endpoints (only when a provisioning token is configured)
+	if authService.scimToken != "" {
+		setupSCIMRoutes(router, authService)
+	}
 
 	return router
 }
@@ -216,7 +439,7 @@ func corsMiddleware(corsOrigins string) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			w.Header().Set("Access-Control-Allow-Origin", corsOrigins)
-			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
+			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, PATCH, DELETE, OPTIONS")
 			w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
 			w.Header().Set("Access-Control-Allow-Credentials", "true")
 
@@ -278,43 +501,45 @@ func (as *AuthService) loginHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Find user by username
-	var user User
-	var passwordHash string
-	err := as.db.QueryRow(`
-		SELECT id, username, email, password_hash, created_at 
-		FROM users WHERE username = ?
-	`, req.Username).Scan(&user.ID, &user.Username, &user.Email, &passwordHash, &user.CreatedAt)
-
-	if err != nil {
-		if err == sql.ErrNoRows {
-			http.Error(w, "Invalid credentials", http.StatusUnauthorized)
-			return
-		}
-		http.Error(w, "Database error", http.StatusInternalServerError)
-		return
-	}
-
-	// Verify password
-	if err := bcrypt.CompareHashAndPassword([]byte(passwordHash), []byte(req.Password)); err != nil {
+	user, err := as.verifyCredentials(req.Username, req.Password)
+	if err == errInvalidCredentials {
 		authAttempts.WithLabelValues("login", "failed").Inc()
 		http.Error(w, "Invalid credentials", http.StatusUnauthorized)
 		return
 	}
+	if err == errAccountDisabled {
+		authAttempts.WithLabelValues("login", "disabled").Inc()
+		http.Error(w, "Account is disabled", http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
 
 	authAttempts.WithLabelValues("login", "success").Inc()
 
 	// Generate JWT token
-	token, err := as.generateToken(user.ID, user.Username)
+	claims, err := newClaims(user.ID, user.Username, 24*time.Hour)
+	if err != nil {
+		http.Error(w, "Failed to generate token", http.StatusInternalServerError)
+		return
+	}
+	markAuthenticated(claims, acrAAL1)
+
+	token, err := as.signToken(claims)
 	if err != nil {
 		http.Error(w, "Failed to generate token", http.StatusInternalServerError)
 		return
 	}
 
+	// Track the device and alert the user about suspicious logins
+	as.assessLogin(r, *user, claims)
+
 	// Return response
 	response := LoginResponse{
 		Token: token,
-		User:  user,
+		User:  *user,
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -335,6 +560,14 @@ func (as *AuthService) registerHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Enforce the configured registration mode
+	invite, err := as.checkRegistration(req)
+	if err != nil {
+		authAttempts.WithLabelValues("register", "rejected").Inc()
+		writeRegistrationError(w, err)
+		return
+	}
+
 	// Hash password
 	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
 	if err != nil {
@@ -342,8 +575,15 @@ func (as *AuthService) registerHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	tx, err := as.db.Begin()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
 	// Insert user
-	result, err := as.db.Exec(`
+	result, err := tx.Exec(`
 		INSERT INTO users (username, email, password_hash) 
 		VALUES (?, ?, ?)
 	`, req.Username, req.Email, string(hashedPassword))
@@ -359,10 +599,26 @@ func (as *AuthService) registerHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	userID, _ := result.LastInsertId()
+
+	// Redeem the invite and grant its preset role in the same transaction
+	if invite != nil {
+		if err := redeemInvite(tx, invite, int(userID)); err != nil {
+			authAttempts.WithLabelValues("register", "rejected").Inc()
+			writeRegistrationError(w, err)
+			return
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		authAttempts.WithLabelValues("register", "error").Inc()
+		http.Error(w, "Failed to create user", http.StatusInternalServerError)
+		return
+	}
+
 	authAttempts.WithLabelValues("register", "success").Inc()
 
 	// Get created user
-	userID, _ := result.LastInsertId()
 	var user User
 	err = as.db.QueryRow(`
 		SELECT id, username, email, created_at 
@@ -411,11 +667,58 @@ func (as *AuthService) validateTokenHandler(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
+	// Services pass their own audience so tokens minted for others are refused
+	if audience := r.URL.Query().Get("audience"); audience != "" && !hasAudience(claims.Audience, audience) {
+		http.Error(w, "Invalid token audience", http.StatusUnauthorized)
+		return
+	}
+	// ...and the scope the request needs, which only down-scoped tokens can lack
+	if scope := r.URL.Query().Get("scope"); scope != "" && !hasScope(claims.Scope, scope) {
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer error="insufficient_scope", scope=%q`, scope))
+		http.Error(w, "Insufficient token scope", http.StatusForbidden)
+		return
+	}
+
 	// Return user info
 	response := map[string]interface{}{
-		"valid":    true,
-		"user_id":  claims.UserID,
-		"username": claims.Username,
+		"valid":          true,
+		"user_id":        claims.UserID,
+		"username":       claims.Username,
+		"email":          claims.Email,
+		"email_verified": claims.EmailVerified,
+		"roles":          claims.Roles,
+		"iss":            claims.Issuer,
+		"aud":            []string(claims.Audience),
+	}
+	if claims.Roles == nil {
+		response["roles"] = []string{}
+	}
+
+	// Checked live so accepting a new policy version doesn't need a new token
+	consentRequired, err := as.consentRequired(claims.UserID)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	response["consent_required"] = consentRequired
+	if claims.Guest {
+		response["guest"] = true
+	}
+	if claims.AuthTime != nil {
+		response["auth_time"] = claims.AuthTime.Unix()
+		response["acr"] = claims.ACR
+	}
+	if claims.Scope != "" {
+		response["scope"] = claims.Scope
+	}
+	if claims.Impersonated {
+		response["impersonated"] = true
+	}
+	if claims.Actor != nil {
+		response["act"] = claims.Actor
+	}
+	if claims.ClientID != "" {
+		response["client_id"] = claims.ClientID
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -424,19 +727,7 @@ func (as *AuthService) validateTokenHandler(w http.ResponseWriter, r *http.Reque
 }
 
 func (as *AuthService) getUserHandler(w http.ResponseWriter, r *http.Request) {
-	tokenString := r.Header.Get("Authorization")
-	if tokenString == "" {
-		http.Error(w, "Authorization header required", http.StatusUnauthorized)
-		return
-	}
-
-	// Remove "Bearer " prefix if present
-	if len(tokenString) > 7 && tokenString[:7] == "Bearer " {
-		tokenString = tokenString[7:]
-	}
-
-	// Parse and validate token
-	claims, err := as.parseToken(tokenString)
+	claims, err := as.authenticateRequest(r)
 	if err != nil {
 		http.Error(w, "Invalid token", http.StatusUnauthorized)
 		return
@@ -459,26 +750,271 @@ func (as *AuthService) getUserHandler(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(user)
 }
 
+// lookupUsersHandler resolves the username parameters to active users, for
+// services that let users refer to each other by name. Unknown names are
+// left out.
+func (as *AuthService) lookupUsersHandler(w http.ResponseWriter, r *http.Request) {
+	if _, err := as.authenticateRequest(r); err != nil {
+		http.Error(w, "Invalid token", http.StatusUnauthorized)
+		return
+	}
+
+	usernames := r.URL.Query()["username"]
+	if len(usernames) == 0 {
+		http.Error(w, "username is required", http.StatusBadRequest)
+		return
+	}
+	if len(usernames) > maxUserLookups {
+		http.Error(w, fmt.Sprintf("at most %d usernames can be looked up at once", maxUserLookups), http.StatusBadRequest)
+		return
+	}
+
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(usernames)), ", ")
+	args := make([]interface{}, len(usernames))
+	for i, username := range usernames {
+		args[i] = username
+	}
+	rows, err := as.db.Query(`
+		SELECT id, username FROM users
+		WHERE active = 1 AND username IN (`+placeholders+`)
+		ORDER BY username
+	`, args...)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	users := []UserSummary{}
+	for rows.Next() {
+		var user UserSummary
+		if err := rows.Scan(&user.ID, &user.Username); err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		users = append(users, user)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(users)
+}
+
+func (as *AuthService) changePasswordHandler(w http.ResponseWriter, r *http.Request) {
+	claims, err := as.authenticateRequest(r)
+	if err != nil {
+		http.Error(w, "Invalid token", http.StatusUnauthorized)
+		return
+	}
+
+	var req ChangePasswordRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if req.CurrentPassword == "" || req.NewPassword == "" {
+		http.Error(w, "Current and new password are required", http.StatusBadRequest)
+		return
+	}
+
+	var passwordHash string
+	err = as.db.QueryRow("SELECT password_hash FROM users WHERE id = ?", claims.UserID).Scan(&passwordHash)
+	if err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	if err := bcrypt.CompareHashAndPassword([]byte(passwordHash), []byte(req.CurrentPassword)); err != nil {
+		authAttempts.WithLabelValues("change_password", "failed").Inc()
+		http.Error(w, "Invalid credentials", http.StatusUnauthorized)
+		return
+	}
+
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(req.NewPassword), bcrypt.DefaultCost)
+	if err != nil {
+		http.Error(w, "Failed to hash password", http.StatusInternalServerError)
+		return
+	}
+
+	_, err = as.db.Exec("UPDATE users SET password_hash = ? WHERE id = ?", string(hashedPassword), claims.UserID)
+	if err != nil {
+		http.Error(w, "Failed to update password", http.StatusInternalServerError)
+		return
+	}
+
+	authAttempts.WithLabelValues("change_password", "success").Inc()
+	as.recordAudit(r, claims.UserID, "password.change", claims.UserID, nil)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// authenticateRequest parses the bearer token from the Authorization header
+// for the auth service's own API. Tokens minted for other services, scoped
+// tokens and tokens used on someone else's behalf are refused.
+func (as *AuthService) authenticateRequest(r *http.Request) (*Claims, error) {
+	tokenString := r.Header.Get("Authorization")
+	if tokenString == "" {
+		return nil, fmt.Errorf("authorization header required")
+	}
+
+	// Remove "Bearer " prefix if present
+	if len(tokenString) > 7 && tokenString[:7] == "Bearer " {
+		tokenString = tokenString[7:]
+	}
+
+	claims, err := as.parseToken(tokenString)
+	if err != nil {
+		return nil, err
+	}
+	if !hasAudience(claims.Audience, authServiceAudience) {
+		return nil, fmt.Errorf("token audience not accepted")
+	}
+	if claims.Scope != "" {
+		return nil, fmt.Errorf("scoped tokens are not accepted")
+	}
+	if err := as.checkDirectSession(r, claims); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// Credential check failures. Unknown users and wrong passwords are
+// indistinguishable to callers.
+var (
+	errInvalidCredentials = errors.New("invalid credentials")
+	errAccountDisabled    = errors.New("account is disabled")
+)
+
+// verifyCredentials checks a username and password and returns the user
+func (as *AuthService) verifyCredentials(username, password string) (*User, error) {
+	var user User
+	var passwordHash string
+	var active bool
+	err := as.db.QueryRow(`
+		SELECT id, username, email, password_hash, active, created_at
+		FROM users WHERE username = ?
+	`, username).Scan(&user.ID, &user.Username, &user.Email, &passwordHash, &active, &user.CreatedAt)
+
+	if err == sql.ErrNoRows {
+		return nil, errInvalidCredentials
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := bcrypt.CompareHashAndPassword([]byte(passwordHash), []byte(password)); err != nil {
+		return nil, errInvalidCredentials
+	}
+	if !active {
+		return nil, errAccountDisabled
+	}
+	return &user, nil
+}
+
+// deleteUser removes a user and everything that belongs to them in this service
+func deleteUser(tx *sql.Tx, userID int) error {
+	for _, stmt := range []string{
+		"DELETE FROM group_members WHERE user_id = ?",
+		"DELETE FROM user_roles WHERE user_id = ?",
+		"DELETE FROM webauthn_credentials WHERE user_id = ?",
+		"DELETE FROM known_devices WHERE user_id = ?",
+		"DELETE FROM users WHERE id = ?",
+	} {
+		if _, err := tx.Exec(stmt, userID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (as *AuthService) generateToken(userID int, username string) (string, error) {
-	claims := Claims{
+	claims, err := newClaims(userID, username, 24*time.Hour)
+	if err != nil {
+		return "", err
+	}
+
+	return as.signToken(claims)
+}
+
+// newClaims builds the registered claims shared by every token we issue
+func newClaims(userID int, username string, ttl time.Duration) (*Claims, error) {
+	jti, err := generateTokenID()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	return &Claims{
 		UserID:   userID,
 		Username: username,
 		RegisteredClaims: jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(time.Now().Add(24 * time.Hour)),
-			IssuedAt:  jwt.NewNumericDate(time.Now()),
-			NotBefore: jwt.NewNumericDate(time.Now()),
+			ID:        jti,
+			Subject:   strconv.Itoa(userID),
+			ExpiresAt: jwt.NewNumericDate(now.Add(ttl)),
+			IssuedAt:  jwt.NewNumericDate(now),
+			NotBefore: jwt.NewNumericDate(now),
 		},
+	}, nil
+}
+
+// addIdentityClaims sets the issuer, the audience unless the token is for
+// particular services, and the user's email and roles as they are when the
+// token is issued
+func (as *AuthService) addIdentityClaims(claims *Claims) error {
+	claims.Issuer = as.issuer
+	if len(claims.Audience) == 0 {
+		claims.Audience = jwt.ClaimStrings(as.audiences)
+	}
+	// Service tokens have no user
+	if claims.UserID == 0 {
+		return nil
+	}
+
+	err := as.db.QueryRow(`
+		SELECT email, email_verified, guest FROM users WHERE id = ?
+	`, claims.UserID).Scan(&claims.Email, &claims.EmailVerified, &claims.Guest)
+	if err != nil {
+		return err
+	}
+	// A guest's email is a placeholder
+	if claims.Guest {
+		claims.Email = ""
+	}
+
+	roles, err := as.getUserRoles(claims.UserID)
+	if err != nil {
+		return err
+	}
+	if len(roles) > 0 {
+		claims.Roles = roles
+	}
+	return nil
+}
+
+func (as *AuthService) signToken(claims *Claims) (string, error) {
+	if err := as.addIdentityClaims(claims); err != nil {
+		return "", err
+	}
+
+	kid, secret, err := as.currentSigningKey()
+	if err != nil {
+		return "", err
 	}
 
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString([]byte(as.jwtSecret))
+	if kid != "" {
+		token.Header["kid"] = kid
+	}
+	return token.SignedString(secret)
 }
 
 func (as *AuthService) parseToken(tokenString string) (*Claims, error) {
 	claims := &Claims{}
 	token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
-		return []byte(as.jwtSecret), nil
-	})
+		kid, _ := token.Header["kid"].(string)
+		return as.verificationKey(kid)
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Name}), jwt.WithIssuer(as.issuer))
 
 	if err != nil {
 		return nil, err
@@ -488,9 +1024,67 @@ func (as *AuthService) parseToken(tokenString string) (*Claims, error) {
 		return nil, fmt.Errorf("invalid token")
 	}
 
+	// Reject tokens minted for audiences this deployment doesn't serve
+	if !as.acceptsAudience(claims.Audience) {
+		return nil, fmt.Errorf("token audience not accepted")
+	}
+
+	// Reject tokens that have been revoked
+	revoked, err := as.isTokenRevoked(claims.ID)
+	if err != nil {
+		return nil, err
+	}
+	if revoked {
+		return nil, fmt.Errorf("token has been revoked")
+	}
+
+	// Service tokens have no user to check
+	if claims.UserID == 0 && claims.ClientID != "" {
+		return claims, nil
+	}
+
+	// Reject tokens of deactivated or deleted users, and tokens issued before
+	// the user's tokens were revoked in bulk
+	var active bool
+	var revokedBefore sql.NullTime
+	err = as.db.QueryRow(`
+		SELECT u.active, r.revoked_before
+		FROM users u LEFT JOIN user_token_revocations r ON r.user_id = u.id
+		WHERE u.id = ?
+	`, claims.UserID).Scan(&active, &revokedBefore)
+	if err != nil || !active {
+		return nil, fmt.Errorf("user is not active")
+	}
+	if revokedBefore.Valid && (claims.IssuedAt == nil || !claims.IssuedAt.After(revokedBefore.Time)) {
+		return nil, fmt.Errorf("token has been revoked")
+	}
+
+	// Guests that keep using their token are not collected
+	if claims.Guest {
+		as.touchGuest(claims.UserID)
+	}
+
 	return claims, nil
 }
 
+func (as *AuthService) acceptsAudience(audience jwt.ClaimStrings) bool {
+	for _, aud := range audience {
+		if hasAudience(as.audiences, aud) {
+			return true
+		}
+	}
+	return false
+}
+
+func hasAudience(audience []string, want string) bool {
+	for _, aud := range audience {
+		if aud == want {
+			return true
+		}
+	}
+	return false
+}
+
 func getEnv(key, defaultValue string) string {
 	if value := os.Getenv(key); value != "" {
 		return value
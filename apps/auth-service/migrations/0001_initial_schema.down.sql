@@ -0,0 +1,10 @@
+DROP TABLE IF EXISTS known_devices;
+DROP TABLE IF EXISTS group_members;
+DROP TABLE IF EXISTS user_groups;
+DROP TABLE IF EXISTS invites;
+DROP TABLE IF EXISTS audit_log;
+DROP TABLE IF EXISTS user_roles;
+DROP TABLE IF EXISTS signing_keys;
+DROP TABLE IF EXISTS user_token_revocations;
+DROP TABLE IF EXISTS revoked_tokens;
+DROP TABLE IF EXISTS users;
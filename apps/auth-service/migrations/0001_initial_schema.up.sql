@@ -0,0 +1,95 @@
+-- Baseline schema. Databases created before versioned migrations already
+-- have these tables, so every statement must be safe to re-run.
+
+CREATE TABLE IF NOT EXISTS users (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	username TEXT UNIQUE NOT NULL,
+	email TEXT UNIQUE NOT NULL,
+	password_hash TEXT NOT NULL,
+	created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+	active INTEGER NOT NULL DEFAULT 1,
+	external_id TEXT,
+	given_name TEXT,
+	family_name TEXT,
+	display_name TEXT,
+	updated_at DATETIME
+);
+
+-- Denylist of JWT IDs until they expire
+CREATE TABLE IF NOT EXISTS revoked_tokens (
+	jti TEXT PRIMARY KEY,
+	expires_at DATETIME NOT NULL,
+	revoked_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Tokens issued to the user before the cutoff are rejected
+CREATE TABLE IF NOT EXISTS user_token_revocations (
+	user_id INTEGER PRIMARY KEY,
+	revoked_before DATETIME NOT NULL
+);
+
+-- Empty until the first key rotation
+CREATE TABLE IF NOT EXISTS signing_keys (
+	kid TEXT PRIMARY KEY,
+	secret TEXT,
+	created_at DATETIME NOT NULL,
+	retired_at DATETIME
+);
+
+CREATE TABLE IF NOT EXISTS user_roles (
+	user_id INTEGER NOT NULL,
+	role TEXT NOT NULL,
+	created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+	PRIMARY KEY (user_id, role)
+);
+
+CREATE TABLE IF NOT EXISTS audit_log (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	actor_id INTEGER,
+	action TEXT NOT NULL,
+	target_user_id INTEGER,
+	details TEXT,
+	ip_address TEXT,
+	created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS invites (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	code_hash TEXT UNIQUE NOT NULL,
+	email TEXT,
+	role TEXT,
+	created_by INTEGER NOT NULL,
+	created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+	expires_at DATETIME,
+	used_at DATETIME,
+	used_by INTEGER,
+	revoked_at DATETIME
+);
+
+CREATE TABLE IF NOT EXISTS user_groups (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	display_name TEXT UNIQUE NOT NULL,
+	external_id TEXT,
+	created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+	updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS group_members (
+	group_id INTEGER NOT NULL,
+	user_id INTEGER NOT NULL,
+	PRIMARY KEY (group_id, user_id)
+);
+
+CREATE TABLE IF NOT EXISTS known_devices (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	user_id INTEGER NOT NULL,
+	fingerprint TEXT NOT NULL,
+	user_agent TEXT,
+	ip_subnet TEXT,
+	last_ip TEXT,
+	latitude REAL,
+	longitude REAL,
+	first_seen DATETIME DEFAULT CURRENT_TIMESTAMP,
+	last_seen DATETIME DEFAULT CURRENT_TIMESTAMP,
+	UNIQUE (user_id, fingerprint)
+);
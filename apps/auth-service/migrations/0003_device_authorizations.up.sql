@@ -0,0 +1,16 @@
+-- RFC 8628 device authorization requests. Codes are stored as SHA-256 hashes.
+CREATE TABLE device_authorizations (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	device_code_hash TEXT UNIQUE NOT NULL,
+	user_code_hash TEXT UNIQUE NOT NULL,
+	client_id TEXT NOT NULL,
+	scope TEXT,
+	poll_interval INTEGER NOT NULL,
+	created_at DATETIME NOT NULL,
+	expires_at DATETIME NOT NULL,
+	last_polled_at DATETIME,
+	user_id INTEGER,
+	approved_at DATETIME,
+	denied_at DATETIME,
+	consumed_at DATETIME
+);
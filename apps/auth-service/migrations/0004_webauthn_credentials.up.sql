@@ -0,0 +1,23 @@
+-- Passkeys (WebAuthn credentials). public_key holds the COSE-encoded key.
+CREATE TABLE webauthn_credentials (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	user_id INTEGER NOT NULL,
+	credential_id TEXT UNIQUE NOT NULL,
+	public_key BLOB NOT NULL,
+	sign_count INTEGER NOT NULL DEFAULT 0,
+	name TEXT NOT NULL,
+	aaguid TEXT,
+	transports TEXT,
+	created_at DATETIME NOT NULL,
+	last_used_at DATETIME
+);
+
+CREATE INDEX idx_webauthn_credentials_user_id ON webauthn_credentials (user_id);
+
+-- Outstanding ceremony challenges; each can be used once
+CREATE TABLE webauthn_challenges (
+	challenge TEXT PRIMARY KEY,
+	ceremony TEXT NOT NULL,
+	user_id INTEGER,
+	expires_at DATETIME NOT NULL
+);
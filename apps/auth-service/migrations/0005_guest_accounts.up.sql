@@ -0,0 +1,5 @@
+-- Anonymous guest accounts. last_active_at is only tracked for guests and
+-- drives garbage collection of abandoned ones.
+ALTER TABLE users ADD COLUMN guest INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE users ADD COLUMN last_active_at DATETIME;
+CREATE INDEX idx_users_guest_last_active ON users(guest, last_active_at);
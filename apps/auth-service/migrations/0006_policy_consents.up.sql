@@ -0,0 +1,24 @@
+-- Versioned legal documents (terms of service, privacy policy). The newest
+-- version of each policy is the one users must have accepted.
+CREATE TABLE policy_versions (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	policy TEXT NOT NULL,
+	version TEXT NOT NULL,
+	url TEXT,
+	content TEXT,
+	published_by INTEGER,
+	published_at DATETIME NOT NULL,
+	UNIQUE (policy, version)
+);
+
+-- Acceptance records are evidence for legal and outlive the user account
+CREATE TABLE policy_acceptances (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	user_id INTEGER NOT NULL,
+	policy_version_id INTEGER NOT NULL,
+	accepted_at DATETIME NOT NULL,
+	ip_address TEXT,
+	user_agent TEXT,
+	UNIQUE (user_id, policy_version_id)
+);
+CREATE INDEX idx_policy_acceptances_user ON policy_acceptances(user_id);
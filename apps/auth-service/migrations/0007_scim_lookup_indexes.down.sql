@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS idx_users_external_id_nocase;
+DROP INDEX IF EXISTS idx_users_username_nocase;
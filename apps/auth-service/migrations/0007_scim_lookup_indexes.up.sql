@@ -0,0 +1,4 @@
+-- SCIM clients look users up by userName and externalId before provisioning
+-- them; both compare case-insensitively
+CREATE INDEX idx_users_username_nocase ON users(username COLLATE NOCASE);
+CREATE INDEX idx_users_external_id_nocase ON users(external_id COLLATE NOCASE);
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// notificationServiceAudience is the audience notification-service requires
+const notificationServiceAudience = "notification-service"
+
+// SecurityNotification is the payload for notification-service's POST /api/notifications
+type SecurityNotification struct {
+	UserID  int    `json:"user_id"`
+	Title   string `json:"title"`
+	Message string `json:"message"`
+	Type    string `json:"type"`
+}
+
+// sendNotification posts a notification to notification-service
+func (as *AuthService) sendNotification(notification SecurityNotification) error {
+	if as.notificationServiceURL == "" {
+		return fmt.Errorf("notification service URL not configured")
+	}
+
+	payload, err := json.Marshal(notification)
+	if err != nil {
+		return err
+	}
+
+	// Notification-service only takes notifications from services
+	token, err := as.serviceToken(authServiceAudience, notificationServiceAudience, "notifications:write")
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", as.notificationServiceURL+"/api/notifications", bytes.NewBuffer(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("notification service returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// sendNotificationAsync delivers a notification without blocking the request
+func (as *AuthService) sendNotificationAsync(notification SecurityNotification) {
+	go func() {
+		if err := as.sendNotification(notification); err != nil {
+			log.Printf("Failed to send %q notification to user %d: %v", notification.Title, notification.UserID, err)
+		}
+	}()
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// IntrospectionResponse represents an RFC 7662 token introspection response
+type IntrospectionResponse struct {
+	Active    bool     `json:"active"`
+	TokenType string   `json:"token_type,omitempty"`
+	ClientID  string   `json:"client_id,omitempty"` // client the token was issued to; empty for sign-ins
+	Username  string   `json:"username,omitempty"`
+	Subject   string   `json:"sub,omitempty"`
+	Issuer    string   `json:"iss,omitempty"`
+	Audience  []string `json:"aud,omitempty"`
+	UserID    int      `json:"user_id,omitempty"`
+	ExpiresAt int64    `json:"exp,omitempty"`
+	IssuedAt  int64    `json:"iat,omitempty"`
+	NotBefore int64    `json:"nbf,omitempty"`
+	JTI       string   `json:"jti,omitempty"`
+	Scope     string   `json:"scope,omitempty"`
+	AuthTime  int64    `json:"auth_time,omitempty"`
+	ACR       string   `json:"acr,omitempty"`
+	Actor     *Actor   `json:"act,omitempty"`
+}
+
+// OAuthError represents an RFC 6749 section 5.2 error response
+type OAuthError struct {
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description,omitempty"`
+}
+
+// parseOAuthClients parses a comma-separated list of client_id:client_secret pairs
+func parseOAuthClients(value string) map[string]string {
+	clients := make(map[string]string)
+	for _, pair := range strings.Split(value, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+
+		id, secret, ok := strings.Cut(pair, ":")
+		if !ok || id == "" || secret == "" {
+			log.Printf("Ignoring malformed OAuth client entry %q", pair)
+			continue
+		}
+		clients[id] = secret
+	}
+	return clients
+}
+
+// clientGrants is what each OAuth client may ask for by token exchange or
+// the client credentials grant: client ID -> audience -> scopes
+type clientGrants map[string]map[string]map[string]bool
+
+// parseClientGrants parses OAUTH_CLIENT_GRANTS, a comma-separated list of
+// client:audience=scope entries such as
+// task-service:notification-service=notifications:write. Several scopes are
+// separated by spaces, and a client can have an entry per audience.
+func parseClientGrants(value string) (clientGrants, error) {
+	grants := clientGrants{}
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		clientID, rest, ok := strings.Cut(entry, ":")
+		audience, scope, ok2 := strings.Cut(rest, "=")
+		scopes := strings.Fields(scope)
+		if !ok || !ok2 || clientID == "" || audience == "" || len(scopes) == 0 {
+			return nil, fmt.Errorf("malformed entry %q", entry)
+		}
+		if grants[clientID] == nil {
+			grants[clientID] = map[string]map[string]bool{}
+		}
+		if grants[clientID][audience] == nil {
+			grants[clientID][audience] = map[string]bool{}
+		}
+		for _, s := range scopes {
+			if !knownScopes[s] {
+				return nil, fmt.Errorf("unknown scope %q", s)
+			}
+			grants[clientID][audience][s] = true
+		}
+	}
+	return grants, nil
+}
+
+// allows reports whether a client may get a token for audience with every
+// scope in scope
+func (grants clientGrants) allows(clientID, audience, scope string) bool {
+	allowed := grants[clientID][audience]
+	for _, s := range strings.Fields(scope) {
+		if !allowed[s] {
+			return false
+		}
+	}
+	return len(allowed) > 0
+}
+
+// authenticateClient verifies client credentials sent either with HTTP Basic
+// authentication or as client_id/client_secret form parameters
+func (as *AuthService) authenticateClient(r *http.Request) (string, bool) {
+	clientID, clientSecret, ok := r.BasicAuth()
+	if !ok {
+		clientID = r.PostFormValue("client_id")
+		clientSecret = r.PostFormValue("client_secret")
+	}
+
+	if clientID == "" || clientSecret == "" {
+		return "", false
+	}
+
+	expected, exists := as.oauthClients[clientID]
+	if !exists {
+		return "", false
+	}
+
+	if subtle.ConstantTimeCompare([]byte(expected), []byte(clientSecret)) != 1 {
+		return "", false
+	}
+
+	return clientID, true
+}
+
+func (as *AuthService) introspectHandler(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_request", "Malformed form body")
+		return
+	}
+
+	if _, ok := as.authenticateClient(r); !ok {
+		authAttempts.WithLabelValues("introspect", "invalid_client").Inc()
+		w.Header().Set("WWW-Authenticate", `Basic realm="auth-service"`)
+		writeOAuthError(w, http.StatusUnauthorized, "invalid_client", "Client authentication failed")
+		return
+	}
+
+	token := r.PostFormValue("token")
+	if token == "" {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_request", "The token parameter is required")
+		return
+	}
+
+	// token_type_hint is optional; every token type we issue is checked regardless
+	response := IntrospectionResponse{Active: false}
+	if claims, err := as.parseToken(token); err == nil {
+		response = IntrospectionResponse{
+			Active:    true,
+			TokenType: "access_token",
+			ClientID:  claims.ClientID,
+			Username:  claims.Username,
+			Subject:   claims.Subject,
+			Issuer:    claims.Issuer,
+			Audience:  claims.Audience,
+			UserID:    claims.UserID,
+			JTI:       claims.ID,
+			Scope:     claims.Scope,
+			ACR:       claims.ACR,
+			Actor:     claims.Actor,
+		}
+		if claims.AuthTime != nil {
+			response.AuthTime = claims.AuthTime.Unix()
+		}
+		if claims.ExpiresAt != nil {
+			response.ExpiresAt = claims.ExpiresAt.Unix()
+		}
+		if claims.IssuedAt != nil {
+			response.IssuedAt = claims.IssuedAt.Unix()
+		}
+		if claims.NotBefore != nil {
+			response.NotBefore = claims.NotBefore.Unix()
+		}
+	}
+
+	authAttempts.WithLabelValues("introspect", "success").Inc()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(response)
+}
+
+func (as *AuthService) revokeHandler(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_request", "Malformed form body")
+		return
+	}
+
+	if _, ok := as.authenticateClient(r); !ok {
+		authAttempts.WithLabelValues("revoke", "invalid_client").Inc()
+		w.Header().Set("WWW-Authenticate", `Basic realm="auth-service"`)
+		writeOAuthError(w, http.StatusUnauthorized, "invalid_client", "Client authentication failed")
+		return
+	}
+
+	token := r.PostFormValue("token")
+	if token == "" {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_request", "The token parameter is required")
+		return
+	}
+
+	// Per RFC 7009 invalid, expired or already revoked tokens are not an error
+	if claims, err := as.parseToken(token); err == nil {
+		if err := as.revokeToken(claims); err != nil {
+			writeOAuthError(w, http.StatusServiceUnavailable, "temporarily_unavailable", "Failed to revoke token")
+			return
+		}
+	}
+
+	authAttempts.WithLabelValues("revoke", "success").Inc()
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// revokeToken adds the token's ID to the denylist until the token expires
+func (as *AuthService) revokeToken(claims *Claims) error {
+	if claims.ID == "" {
+		return nil
+	}
+
+	expiresAt := time.Now().Add(24 * time.Hour)
+	if claims.ExpiresAt != nil {
+		expiresAt = claims.ExpiresAt.Time
+	}
+
+	// Expired tokens are rejected by signature validation, so their entries can go
+	if _, err := as.db.Exec("DELETE FROM revoked_tokens WHERE expires_at < ?", time.Now().UTC()); err != nil {
+		return err
+	}
+
+	_, err := as.db.Exec(`
+		INSERT OR IGNORE INTO revoked_tokens (jti, expires_at)
+		VALUES (?, ?)
+	`, claims.ID, expiresAt.UTC())
+	return err
+}
+
+// isTokenRevoked reports whether the token ID is on the denylist
+func (as *AuthService) isTokenRevoked(jti string) (bool, error) {
+	if jti == "" {
+		return false, nil
+	}
+
+	var exists int
+	err := as.db.QueryRow("SELECT 1 FROM revoked_tokens WHERE jti = ?", jti).Scan(&exists)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// generateTokenID returns a random identifier suitable for the jti claim
+func generateTokenID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func writeOAuthError(w http.ResponseWriter, status int, code, description string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(OAuthError{
+		Error:            code,
+		ErrorDescription: description,
+	})
+}
@@ -0,0 +1,367 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Registration modes
+const (
+	registrationOpen   = "open"
+	registrationClosed = "closed"
+	registrationInvite = "invite"
+	registrationDomain = "domain"
+)
+
+// RegistrationPolicy controls who may use the public registration endpoint
+type RegistrationPolicy struct {
+	Mode           string
+	AllowedDomains []string
+}
+
+// Invite represents an admin-issued single-use registration code
+type Invite struct {
+	ID        int        `json:"id"`
+	Code      string     `json:"code,omitempty"`
+	Email     string     `json:"email,omitempty"`
+	Role      string     `json:"role,omitempty"`
+	CreatedBy int        `json:"created_by"`
+	CreatedAt time.Time  `json:"created_at"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	UsedAt    *time.Time `json:"used_at,omitempty"`
+	UsedBy    *int       `json:"used_by,omitempty"`
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+}
+
+// CreateInviteRequest represents the create invite request payload
+type CreateInviteRequest struct {
+	Email          string `json:"email"`
+	Role           string `json:"role"`
+	ExpiresInHours int    `json:"expires_in_hours"`
+}
+
+// registrationError carries the HTTP status for a rejected registration
+type registrationError struct {
+	status  int
+	message string
+}
+
+func (e *registrationError) Error() string {
+	return e.message
+}
+
+// parseRegistrationPolicy validates the REGISTRATION_MODE and REGISTRATION_ALLOWED_DOMAINS settings
+func parseRegistrationPolicy(mode, domains string) (RegistrationPolicy, error) {
+	policy := RegistrationPolicy{Mode: strings.ToLower(strings.TrimSpace(mode))}
+
+	switch policy.Mode {
+	case registrationOpen, registrationClosed, registrationInvite, registrationDomain:
+	default:
+		return policy, fmt.Errorf("unknown registration mode %q", mode)
+	}
+
+	for _, domain := range strings.Split(domains, ",") {
+		domain = strings.ToLower(strings.TrimSpace(domain))
+		if domain != "" {
+			policy.AllowedDomains = append(policy.AllowedDomains, domain)
+		}
+	}
+
+	if policy.Mode == registrationDomain && len(policy.AllowedDomains) == 0 {
+		return policy, fmt.Errorf("registration mode %q requires REGISTRATION_ALLOWED_DOMAINS", registrationDomain)
+	}
+
+	return policy, nil
+}
+
+// allowsEmail reports whether the email's domain is on the allowlist
+func (p RegistrationPolicy) allowsEmail(email string) bool {
+	at := strings.LastIndex(email, "@")
+	if at < 0 {
+		return false
+	}
+
+	domain := strings.ToLower(email[at+1:])
+	for _, allowed := range p.AllowedDomains {
+		if domain == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// checkRegistration applies the registration mode to a request and returns
+// the invite to redeem, if one was supplied
+func (as *AuthService) checkRegistration(req RegisterRequest) (*Invite, error) {
+	if as.registration.Mode == registrationClosed {
+		return nil, &registrationError{http.StatusForbidden, "Registration is closed"}
+	}
+
+	var invite *Invite
+	if req.InviteCode != "" {
+		var err error
+		invite, err = as.findUsableInvite(req.InviteCode, req.Email)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	switch as.registration.Mode {
+	case registrationInvite:
+		if invite == nil {
+			return nil, &registrationError{http.StatusForbidden, "An invite code is required to register"}
+		}
+	case registrationDomain:
+		// A valid invite lets admins bring in people from outside the allowlist
+		if invite == nil && !as.registration.allowsEmail(req.Email) {
+			return nil, &registrationError{http.StatusForbidden, "Registration is restricted to approved email domains"}
+		}
+	}
+
+	return invite, nil
+}
+
+// findUsableInvite looks up an invite code that has not been used, revoked or expired
+func (as *AuthService) findUsableInvite(code, email string) (*Invite, error) {
+	var invite Invite
+	var inviteEmail, role sql.NullString
+	var expiresAt sql.NullTime
+	var used, revoked bool
+
+	err := as.db.QueryRow(`
+		SELECT id, email, role, expires_at, used_at IS NOT NULL, revoked_at IS NOT NULL
+		FROM invites WHERE code_hash = ?
+	`, hashInviteCode(code)).Scan(&invite.ID, &inviteEmail, &role, &expiresAt, &used, &revoked)
+
+	if err == sql.ErrNoRows {
+		return nil, &registrationError{http.StatusForbidden, "Invalid invite code"}
+	}
+	if err != nil {
+		return nil, &registrationError{http.StatusInternalServerError, "Database error"}
+	}
+
+	if used || revoked || (expiresAt.Valid && time.Now().After(expiresAt.Time)) {
+		return nil, &registrationError{http.StatusGone, "Invite code is no longer valid"}
+	}
+
+	if inviteEmail.Valid && inviteEmail.String != "" && !strings.EqualFold(inviteEmail.String, email) {
+		return nil, &registrationError{http.StatusForbidden, "Invite code was issued for a different email address"}
+	}
+
+	invite.Email = inviteEmail.String
+	invite.Role = role.String
+	return &invite, nil
+}
+
+// redeemInvite marks the invite as used and grants its preset role. The
+// conditional update makes concurrent redemptions of the same code fail.
+func redeemInvite(tx *sql.Tx, invite *Invite, userID int) error {
+	result, err := tx.Exec(`
+		UPDATE invites SET used_at = ?, used_by = ?
+		WHERE id = ? AND used_at IS NULL AND revoked_at IS NULL
+	`, time.Now().UTC(), userID, invite.ID)
+	if err != nil {
+		return &registrationError{http.StatusInternalServerError, "Failed to redeem invite"}
+	}
+
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return &registrationError{http.StatusGone, "Invite code is no longer valid"}
+	}
+
+	if invite.Role != "" {
+		_, err = tx.Exec("INSERT OR IGNORE INTO user_roles (user_id, role) VALUES (?, ?)", userID, invite.Role)
+		if err != nil {
+			return &registrationError{http.StatusInternalServerError, "Failed to assign invite role"}
+		}
+	}
+
+	return nil
+}
+
+func writeRegistrationError(w http.ResponseWriter, err error) {
+	if regErr, ok := err.(*registrationError); ok {
+		http.Error(w, regErr.message, regErr.status)
+		return
+	}
+	http.Error(w, "Failed to create user", http.StatusInternalServerError)
+}
+
+func (as *AuthService) createInviteHandler(w http.ResponseWriter, r *http.Request) {
+	admin, ok := as.requireAdmin(w, r)
+	if !ok {
+		return
+	}
+
+	var req CreateInviteRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if req.ExpiresInHours < 0 {
+		http.Error(w, "expires_in_hours must not be negative", http.StatusBadRequest)
+		return
+	}
+
+	role := strings.TrimSpace(req.Role)
+	if role != "" && !knownRoles[role] {
+		http.Error(w, "Unknown role: "+role, http.StatusBadRequest)
+		return
+	}
+
+	code, err := generateInviteCode()
+	if err != nil {
+		http.Error(w, "Failed to generate invite code", http.StatusInternalServerError)
+		return
+	}
+
+	invite := Invite{
+		Code:      code,
+		Email:     strings.TrimSpace(req.Email),
+		Role:      role,
+		CreatedBy: admin.UserID,
+		CreatedAt: time.Now().UTC(),
+	}
+
+	var expiresAt interface{}
+	if req.ExpiresInHours > 0 {
+		t := invite.CreatedAt.Add(time.Duration(req.ExpiresInHours) * time.Hour)
+		invite.ExpiresAt = &t
+		expiresAt = t
+	}
+
+	result, err := as.db.Exec(`
+		INSERT INTO invites (code_hash, email, role, created_by, created_at, expires_at)
+		VALUES (?, ?, ?, ?, ?, ?)
+	`, hashInviteCode(code), invite.Email, invite.Role, invite.CreatedBy, invite.CreatedAt, expiresAt)
+
+	if err != nil {
+		http.Error(w, "Failed to create invite", http.StatusInternalServerError)
+		return
+	}
+
+	inviteID, _ := result.LastInsertId()
+	invite.ID = int(inviteID)
+
+	as.recordAudit(r, admin.UserID, "invite.create", 0, map[string]interface{}{
+		"invite_id": invite.ID,
+		"email":     invite.Email,
+		"role":      invite.Role,
+	})
+
+	// The plaintext code is only ever returned here
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(invite)
+}
+
+func (as *AuthService) listInvitesHandler(w http.ResponseWriter, r *http.Request) {
+	if _, ok := as.requireAdmin(w, r); !ok {
+		return
+	}
+
+	rows, err := as.db.Query(`
+		SELECT id, email, role, created_by, created_at, expires_at, used_at, used_by, revoked_at
+		FROM invites ORDER BY created_at DESC
+	`)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	invites := []Invite{}
+	for rows.Next() {
+		var invite Invite
+		var email, role sql.NullString
+		var expiresAt, usedAt, revokedAt sql.NullTime
+		var usedBy sql.NullInt64
+
+		err := rows.Scan(&invite.ID, &email, &role, &invite.CreatedBy, &invite.CreatedAt, &expiresAt, &usedAt, &usedBy, &revokedAt)
+		if err != nil {
+			http.Error(w, "Database scan error", http.StatusInternalServerError)
+			return
+		}
+
+		invite.Email = email.String
+		invite.Role = role.String
+		invite.ExpiresAt = nullTimePtr(expiresAt)
+		invite.UsedAt = nullTimePtr(usedAt)
+		invite.RevokedAt = nullTimePtr(revokedAt)
+		if usedBy.Valid {
+			id := int(usedBy.Int64)
+			invite.UsedBy = &id
+		}
+		invites = append(invites, invite)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(invites)
+}
+
+func (as *AuthService) revokeInviteHandler(w http.ResponseWriter, r *http.Request) {
+	admin, ok := as.requireAdmin(w, r)
+	if !ok {
+		return
+	}
+
+	vars := mux.Vars(r)
+	inviteID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid invite ID", http.StatusBadRequest)
+		return
+	}
+
+	result, err := as.db.Exec(`
+		UPDATE invites SET revoked_at = ?
+		WHERE id = ? AND used_at IS NULL AND revoked_at IS NULL
+	`, time.Now().UTC(), inviteID)
+	if err != nil {
+		http.Error(w, "Failed to revoke invite", http.StatusInternalServerError)
+		return
+	}
+
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		http.Error(w, "Invite not found or already used", http.StatusNotFound)
+		return
+	}
+
+	as.recordAudit(r, admin.UserID, "invite.revoke", 0, map[string]interface{}{
+		"invite_id": inviteID,
+	})
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// generateInviteCode returns a random, URL-safe invite code
+func generateInviteCode() (string, error) {
+	b := make([]byte, 12)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// hashInviteCode returns the stored form of an invite code
+func hashInviteCode(code string) string {
+	sum := sha256.Sum256([]byte(strings.TrimSpace(code)))
+	return hex.EncodeToString(sum[:])
+}
+
+func nullTimePtr(t sql.NullTime) *time.Time {
+	if !t.Valid {
+		return nil
+	}
+	return &t.Time
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"net/http"
+)
+
+// Well-known roles
+const (
+	roleAdmin = "admin"
+)
+
+// knownRoles are the roles that grant something; invites can only carry these
+var knownRoles = map[string]bool{roleAdmin: true}
+
+// hasRole reports whether the user has been granted the role
+func (as *AuthService) hasRole(userID int, role string) (bool, error) {
+	var count int
+	err := as.db.QueryRow(`
+		SELECT COUNT(*) FROM user_roles WHERE user_id = ? AND role = ?
+	`, userID, role).Scan(&count)
+	if err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+// getUserRoles returns all roles granted to the user
+func (as *AuthService) getUserRoles(userID int) ([]string, error) {
+	rows, err := as.db.Query("SELECT role FROM user_roles WHERE user_id = ? ORDER BY role", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	roles := []string{}
+	for rows.Next() {
+		var role string
+		if err := rows.Scan(&role); err != nil {
+			return nil, err
+		}
+		roles = append(roles, role)
+	}
+	return roles, rows.Err()
+}
+
+// requireAdmin authenticates the request and checks that the caller is an
+// administrator acting as themselves. It writes the error response itself.
+func (as *AuthService) requireAdmin(w http.ResponseWriter, r *http.Request) (*Claims, bool) {
+	claims, err := as.authenticateRequest(r)
+	if err != nil {
+		http.Error(w, "Invalid token", http.StatusUnauthorized)
+		return nil, false
+	}
+
+	isAdmin, err := as.hasRole(claims.UserID, roleAdmin)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return nil, false
+	}
+	if !isAdmin {
+		http.Error(w, "Admin role required", http.StatusForbidden)
+		return nil, false
+	}
+
+	return claims, true
+}
@@ -0,0 +1,1271 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/mattn/go-sqlite3"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// SCIM schema URNs (RFC 7643, RFC 7644)
+const (
+	scimUserSchema         = "urn:ietf:params:scim:schemas:core:2.0:User"
+	scimGroupSchema        = "urn:ietf:params:scim:schemas:core:2.0:Group"
+	scimListResponseSchema = "urn:ietf:params:scim:api:messages:2.0:ListResponse"
+	scimErrorSchema        = "urn:ietf:params:scim:api:messages:2.0:Error"
+	scimSPConfigSchema     = "urn:ietf:params:scim:schemas:core:2.0:ServiceProviderConfig"
+	scimContentType        = "application/scim+json"
+	scimDefaultCount       = 100
+	scimMaxCount           = 500
+)
+
+// SCIMUser is the SCIM representation of a row in the users table
+type SCIMUser struct {
+	Schemas     []string        `json:"schemas"`
+	ID          string          `json:"id,omitempty"`
+	ExternalID  string          `json:"externalId,omitempty"`
+	UserName    string          `json:"userName"`
+	Name        *SCIMName       `json:"name,omitempty"`
+	DisplayName string          `json:"displayName,omitempty"`
+	Emails      []SCIMEmail     `json:"emails,omitempty"`
+	Active      *bool           `json:"active,omitempty"`
+	Password    string          `json:"password,omitempty"`
+	Groups      []SCIMMemberRef `json:"groups,omitempty"`
+	Meta        *SCIMMeta       `json:"meta,omitempty"`
+}
+
+// SCIMName holds the components of a user's name
+type SCIMName struct {
+	GivenName  string `json:"givenName,omitempty"`
+	FamilyName string `json:"familyName,omitempty"`
+	Formatted  string `json:"formatted,omitempty"`
+}
+
+// SCIMEmail is an entry of the multi-valued emails attribute
+type SCIMEmail struct {
+	Value   string `json:"value"`
+	Type    string `json:"type,omitempty"`
+	Primary bool   `json:"primary,omitempty"`
+}
+
+// SCIMGroup is the SCIM representation of a row in the user_groups table
+type SCIMGroup struct {
+	Schemas     []string        `json:"schemas"`
+	ID          string          `json:"id,omitempty"`
+	ExternalID  string          `json:"externalId,omitempty"`
+	DisplayName string          `json:"displayName"`
+	Members     []SCIMMemberRef `json:"members,omitempty"`
+	Meta        *SCIMMeta       `json:"meta,omitempty"`
+}
+
+// SCIMMemberRef references a user (group members) or a group (user groups)
+type SCIMMemberRef struct {
+	Value   string `json:"value"`
+	Display string `json:"display,omitempty"`
+	Ref     string `json:"$ref,omitempty"`
+}
+
+// SCIMMeta carries resource metadata
+type SCIMMeta struct {
+	ResourceType string    `json:"resourceType"`
+	Created      time.Time `json:"created"`
+	LastModified time.Time `json:"lastModified"`
+	Location     string    `json:"location,omitempty"`
+}
+
+// SCIMListResponse wraps query results
+type SCIMListResponse struct {
+	Schemas      []string    `json:"schemas"`
+	TotalResults int         `json:"totalResults"`
+	StartIndex   int         `json:"startIndex"`
+	ItemsPerPage int         `json:"itemsPerPage"`
+	Resources    interface{} `json:"Resources"`
+}
+
+// SCIMPatchRequest represents a PATCH request body
+type SCIMPatchRequest struct {
+	Schemas    []string             `json:"schemas"`
+	Operations []SCIMPatchOperation `json:"Operations"`
+}
+
+// SCIMPatchOperation is a single add, replace or remove operation
+type SCIMPatchOperation struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	Value json.RawMessage `json:"value"`
+}
+
+// SCIMError represents a SCIM error response
+type SCIMError struct {
+	Schemas  []string `json:"schemas"`
+	Status   string   `json:"status"`
+	ScimType string   `json:"scimType,omitempty"`
+	Detail   string   `json:"detail,omitempty"`
+}
+
+// scimStatusError carries the HTTP status and scimType for a failed operation
+type scimStatusError struct {
+	status   int
+	scimType string
+	detail   string
+}
+
+func (e *scimStatusError) Error() string {
+	return e.detail
+}
+
+func scimBadRequest(scimType, format string, args ...interface{}) error {
+	return &scimStatusError{http.StatusBadRequest, scimType, fmt.Sprintf(format, args...)}
+}
+
+func setupSCIMRoutes(router *mux.Router, as *AuthService) {
+	scim := router.PathPrefix("/scim/v2").Subrouter()
+	scim.Use(as.scimAuthMiddleware)
+
+	scim.HandleFunc("/ServiceProviderConfig", scimServiceProviderConfigHandler).Methods("GET")
+
+	scim.HandleFunc("/Users", as.scimListUsersHandler).Methods("GET")
+	scim.HandleFunc("/Users", as.scimCreateUserHandler).Methods("POST")
+	scim.HandleFunc("/Users/{id}", as.scimGetUserHandler).Methods("GET")
+	scim.HandleFunc("/Users/{id}", as.scimReplaceUserHandler).Methods("PUT")
+	scim.HandleFunc("/Users/{id}", as.scimPatchUserHandler).Methods("PATCH")
+	scim.HandleFunc("/Users/{id}", as.scimDeleteUserHandler).Methods("DELETE")
+
+	scim.HandleFunc("/Groups", as.scimListGroupsHandler).Methods("GET")
+	scim.HandleFunc("/Groups", as.scimCreateGroupHandler).Methods("POST")
+	scim.HandleFunc("/Groups/{id}", as.scimGetGroupHandler).Methods("GET")
+	scim.HandleFunc("/Groups/{id}", as.scimReplaceGroupHandler).Methods("PUT")
+	scim.HandleFunc("/Groups/{id}", as.scimPatchGroupHandler).Methods("PATCH")
+	scim.HandleFunc("/Groups/{id}", as.scimDeleteGroupHandler).Methods("DELETE")
+}
+
+// scimAuthMiddleware checks the provisioning bearer token from SCIM_TOKEN
+func (as *AuthService) scimAuthMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tokenString := r.Header.Get("Authorization")
+		if len(tokenString) > 7 && strings.EqualFold(tokenString[:7], "Bearer ") {
+			tokenString = tokenString[7:]
+		} else {
+			tokenString = ""
+		}
+
+		if tokenString == "" || subtle.ConstantTimeCompare([]byte(tokenString), []byte(as.scimToken)) != 1 {
+			authAttempts.WithLabelValues("scim", "failed").Inc()
+			w.Header().Set("WWW-Authenticate", `Bearer realm="scim"`)
+			writeSCIMError(w, &scimStatusError{http.StatusUnauthorized, "", "Invalid SCIM bearer token"})
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func scimServiceProviderConfigHandler(w http.ResponseWriter, r *http.Request) {
+	writeSCIMJSON(w, http.StatusOK, map[string]interface{}{
+		"schemas":        []string{scimSPConfigSchema},
+		"patch":          map[string]bool{"supported": true},
+		"bulk":           map[string]interface{}{"supported": false, "maxOperations": 0, "maxPayloadSize": 0},
+		"filter":         map[string]interface{}{"supported": true, "maxResults": scimMaxCount},
+		"changePassword": map[string]bool{"supported": true},
+		"sort":           map[string]bool{"supported": false},
+		"etag":           map[string]bool{"supported": false},
+		"authenticationSchemes": []map[string]string{{
+			"type":        "oauthbearertoken",
+			"name":        "Bearer Token",
+			"description": "Static provisioning token configured with SCIM_TOKEN",
+		}},
+	})
+}
+
+// Users
+
+func (as *AuthService) scimListUsersHandler(w http.ResponseWriter, r *http.Request) {
+	// Lookups such as userName eq "bjensen", which IdPs send before every
+	// create, run in SQL and load only the page asked for. Other filters are
+	// applied to every user by writeSCIMList.
+	where, args, ok := "", []interface{}(nil), true
+	if filterExpr := r.URL.Query().Get("filter"); filterExpr != "" {
+		filter, err := parseSCIMFilter(filterExpr)
+		if err != nil {
+			writeSCIMError(w, scimBadRequest("invalidFilter", "%v", err))
+			return
+		}
+		where, args, ok = scimUserCondition(filter)
+	}
+
+	if !ok {
+		users, err := as.scimQueryUsers("", nil, -1, 0)
+		if err != nil {
+			writeSCIMError(w, err)
+			return
+		}
+		writeSCIMList(w, r, scimUserResources(r, users))
+		return
+	}
+
+	startIndex, count := scimPaging(r)
+	countQuery := "SELECT COUNT(*) FROM users"
+	if where != "" {
+		countQuery += " WHERE " + where
+	}
+	var total int
+	if err := as.db.QueryRow(countQuery, args...).Scan(&total); err != nil {
+		writeSCIMError(w, err)
+		return
+	}
+	users, err := as.scimQueryUsers(where, args, count, startIndex-1)
+	if err != nil {
+		writeSCIMError(w, err)
+		return
+	}
+	writeSCIMPage(w, scimUserResources(r, users), total, startIndex)
+}
+
+func scimUserResources(r *http.Request, users []SCIMUser) []interface{} {
+	resources := make([]interface{}, 0, len(users))
+	for i := range users {
+		users[i].Meta.Location = scimLocation(r, "Users", users[i].ID)
+		resources = append(resources, users[i])
+	}
+	return resources
+}
+
+func (as *AuthService) scimGetUserHandler(w http.ResponseWriter, r *http.Request) {
+	user, err := as.scimLoadUser(mux.Vars(r)["id"])
+	if err != nil {
+		writeSCIMError(w, err)
+		return
+	}
+
+	user.Meta.Location = scimLocation(r, "Users", user.ID)
+	writeSCIMJSON(w, http.StatusOK, user)
+}
+
+func (as *AuthService) scimCreateUserHandler(w http.ResponseWriter, r *http.Request) {
+	var user SCIMUser
+	if err := json.NewDecoder(r.Body).Decode(&user); err != nil {
+		writeSCIMError(w, scimBadRequest("invalidSyntax", "Invalid request body"))
+		return
+	}
+
+	userID, err := as.scimSaveUser(0, &user)
+	if err != nil {
+		writeSCIMError(w, err)
+		return
+	}
+
+	as.recordAudit(r, 0, "scim.user.create", userID, map[string]interface{}{"userName": user.UserName})
+
+	created, err := as.scimLoadUser(strconv.Itoa(userID))
+	if err != nil {
+		writeSCIMError(w, err)
+		return
+	}
+
+	created.Meta.Location = scimLocation(r, "Users", created.ID)
+	w.Header().Set("Location", created.Meta.Location)
+	writeSCIMJSON(w, http.StatusCreated, created)
+}
+
+func (as *AuthService) scimReplaceUserHandler(w http.ResponseWriter, r *http.Request) {
+	existing, err := as.scimLoadUser(mux.Vars(r)["id"])
+	if err != nil {
+		writeSCIMError(w, err)
+		return
+	}
+
+	var user SCIMUser
+	if err := json.NewDecoder(r.Body).Decode(&user); err != nil {
+		writeSCIMError(w, scimBadRequest("invalidSyntax", "Invalid request body"))
+		return
+	}
+
+	as.scimUpdateUser(w, r, existing, &user)
+}
+
+func (as *AuthService) scimPatchUserHandler(w http.ResponseWriter, r *http.Request) {
+	existing, err := as.scimLoadUser(mux.Vars(r)["id"])
+	if err != nil {
+		writeSCIMError(w, err)
+		return
+	}
+
+	var req SCIMPatchRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeSCIMError(w, scimBadRequest("invalidSyntax", "Invalid request body"))
+		return
+	}
+
+	user := *existing
+	if existing.Name != nil {
+		name := *existing.Name
+		user.Name = &name
+	}
+	for _, op := range req.Operations {
+		if err := applySCIMUserPatch(&user, op); err != nil {
+			writeSCIMError(w, err)
+			return
+		}
+	}
+
+	as.scimUpdateUser(w, r, existing, &user)
+}
+
+// scimUpdateUser persists a replaced or patched user and writes the response
+func (as *AuthService) scimUpdateUser(w http.ResponseWriter, r *http.Request, existing, user *SCIMUser) {
+	userID, _ := strconv.Atoi(existing.ID)
+	if _, err := as.scimSaveUser(userID, user); err != nil {
+		writeSCIMError(w, err)
+		return
+	}
+
+	wasActive := existing.Active == nil || *existing.Active
+	isActive := user.Active == nil || *user.Active
+	switch {
+	case wasActive && !isActive:
+		as.recordAudit(r, 0, "scim.user.deactivate", userID, map[string]interface{}{"userName": user.UserName})
+	case !wasActive && isActive:
+		as.recordAudit(r, 0, "scim.user.reactivate", userID, map[string]interface{}{"userName": user.UserName})
+	default:
+		as.recordAudit(r, 0, "scim.user.update", userID, map[string]interface{}{"userName": user.UserName})
+	}
+
+	updated, err := as.scimLoadUser(existing.ID)
+	if err != nil {
+		writeSCIMError(w, err)
+		return
+	}
+
+	updated.Meta.Location = scimLocation(r, "Users", updated.ID)
+	writeSCIMJSON(w, http.StatusOK, updated)
+}
+
+func (as *AuthService) scimDeleteUserHandler(w http.ResponseWriter, r *http.Request) {
+	user, err := as.scimLoadUser(mux.Vars(r)["id"])
+	if err != nil {
+		writeSCIMError(w, err)
+		return
+	}
+	userID, _ := strconv.Atoi(user.ID)
+
+	tx, err := as.db.Begin()
+	if err != nil {
+		writeSCIMError(w, err)
+		return
+	}
+	defer tx.Rollback()
+
+	if err := deleteUser(tx, userID); err != nil {
+		writeSCIMError(w, err)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		writeSCIMError(w, err)
+		return
+	}
+
+	as.recordAudit(r, 0, "scim.user.delete", userID, map[string]interface{}{"userName": user.UserName})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// scimLoadUser loads a single user by SCIM ID
+func (as *AuthService) scimLoadUser(id string) (*SCIMUser, error) {
+	userID, err := strconv.Atoi(id)
+	if err != nil || userID <= 0 {
+		return nil, &scimStatusError{http.StatusNotFound, "", fmt.Sprintf("User %s not found", id)}
+	}
+
+	users, err := as.scimLoadUsers(userID)
+	if err != nil {
+		return nil, err
+	}
+	if len(users) == 0 {
+		return nil, &scimStatusError{http.StatusNotFound, "", fmt.Sprintf("User %s not found", id)}
+	}
+	return &users[0], nil
+}
+
+// scimLoadUsers loads one user, or every user when userID is 0
+func (as *AuthService) scimLoadUsers(userID int) ([]SCIMUser, error) {
+	if userID == 0 {
+		return as.scimQueryUsers("", nil, -1, 0)
+	}
+	return as.scimQueryUsers("id = ?", []interface{}{userID}, -1, 0)
+}
+
+// scimQueryUsers loads the users matching where, all when it is empty, in ID
+// order. A negative limit loads them all.
+func (as *AuthService) scimQueryUsers(where string, args []interface{}, limit, offset int) ([]SCIMUser, error) {
+	query := `
+		SELECT id, username, email, active, external_id, given_name, family_name, display_name, created_at, updated_at
+		FROM users`
+	if where != "" {
+		query += " WHERE " + where
+	}
+	query += " ORDER BY id"
+	if limit >= 0 {
+		query += " LIMIT ? OFFSET ?"
+		args = append(append([]interface{}{}, args...), limit, offset)
+	}
+
+	rows, err := as.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := []SCIMUser{}
+	for rows.Next() {
+		var id int
+		var active bool
+		var user SCIMUser
+		var email string
+		var externalID, givenName, familyName, displayName sql.NullString
+		var createdAt time.Time
+		var updatedAt sql.NullTime
+
+		err := rows.Scan(&id, &user.UserName, &email, &active, &externalID, &givenName, &familyName, &displayName, &createdAt, &updatedAt)
+		if err != nil {
+			return nil, err
+		}
+
+		user.Schemas = []string{scimUserSchema}
+		user.ID = strconv.Itoa(id)
+		user.ExternalID = externalID.String
+		user.DisplayName = displayName.String
+		user.Active = &active
+		user.Emails = []SCIMEmail{{Value: email, Type: "work", Primary: true}}
+		if givenName.String != "" || familyName.String != "" {
+			user.Name = &SCIMName{
+				GivenName:  givenName.String,
+				FamilyName: familyName.String,
+				Formatted:  strings.TrimSpace(givenName.String + " " + familyName.String),
+			}
+		}
+
+		lastModified := createdAt
+		if updatedAt.Valid {
+			lastModified = updatedAt.Time
+		}
+		user.Meta = &SCIMMeta{ResourceType: "User", Created: createdAt, LastModified: lastModified}
+		users = append(users, user)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// Attach group memberships, of just these users unless all were loaded
+	var members []interface{}
+	if where != "" || limit >= 0 {
+		for _, user := range users {
+			id, _ := strconv.Atoi(user.ID)
+			members = append(members, id)
+		}
+		if len(members) == 0 {
+			return users, nil
+		}
+	}
+	groups, err := as.scimGroupsByUser(members)
+	if err != nil {
+		return nil, err
+	}
+	for i := range users {
+		users[i].Groups = groups[users[i].ID]
+	}
+
+	return users, nil
+}
+
+// scimGroupsByUser loads the groups of the given users, or of every user when
+// userIDs is empty
+func (as *AuthService) scimGroupsByUser(userIDs []interface{}) (map[string][]SCIMMemberRef, error) {
+	query := `
+		SELECT gm.user_id, g.id, g.display_name
+		FROM group_members gm JOIN user_groups g ON g.id = gm.group_id`
+	if len(userIDs) > 0 {
+		query += " WHERE gm.user_id IN (" + strings.TrimSuffix(strings.Repeat("?, ", len(userIDs)), ", ") + ")"
+	}
+	query += " ORDER BY g.display_name"
+
+	rows, err := as.db.Query(query, userIDs...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	groups := make(map[string][]SCIMMemberRef)
+	for rows.Next() {
+		var memberID, groupID int
+		var displayName string
+		if err := rows.Scan(&memberID, &groupID, &displayName); err != nil {
+			return nil, err
+		}
+		key := strconv.Itoa(memberID)
+		groups[key] = append(groups[key], SCIMMemberRef{Value: strconv.Itoa(groupID), Display: displayName})
+	}
+	return groups, rows.Err()
+}
+
+// scimSaveUser inserts (userID 0) or updates a user from its SCIM representation
+func (as *AuthService) scimSaveUser(userID int, user *SCIMUser) (int, error) {
+	user.UserName = strings.TrimSpace(user.UserName)
+	if user.UserName == "" {
+		return 0, scimBadRequest("invalidValue", "userName is required")
+	}
+
+	email := scimPrimaryEmail(user)
+	if email == "" {
+		return 0, scimBadRequest("invalidValue", "A primary email is required")
+	}
+
+	active := user.Active == nil || *user.Active
+	var givenName, familyName string
+	if user.Name != nil {
+		givenName, familyName = user.Name.GivenName, user.Name.FamilyName
+	}
+	now := time.Now().UTC()
+
+	var err error
+	if userID == 0 {
+		// Provisioned users get an unusable random password unless one is supplied
+		password := user.Password
+		if password == "" {
+			if password, err = randomSecret(); err != nil {
+				return 0, err
+			}
+		}
+		hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		if err != nil {
+			return 0, err
+		}
+
+		var result sql.Result
+		result, err = as.db.Exec(`
+			INSERT INTO users (username, email, password_hash, active, external_id, given_name, family_name, display_name, updated_at)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+		`, user.UserName, email, string(hashedPassword), active, user.ExternalID, givenName, familyName, user.DisplayName, now)
+		if err == nil {
+			id, _ := result.LastInsertId()
+			userID = int(id)
+		}
+	} else {
+		_, err = as.db.Exec(`
+			UPDATE users SET username = ?, email = ?, active = ?, external_id = ?, given_name = ?, family_name = ?, display_name = ?, updated_at = ?
+			WHERE id = ?
+		`, user.UserName, email, active, user.ExternalID, givenName, familyName, user.DisplayName, now, userID)
+
+		if err == nil && user.Password != "" {
+			var hashedPassword []byte
+			hashedPassword, err = bcrypt.GenerateFromPassword([]byte(user.Password), bcrypt.DefaultCost)
+			if err == nil {
+				_, err = as.db.Exec("UPDATE users SET password_hash = ? WHERE id = ?", string(hashedPassword), userID)
+			}
+		}
+	}
+
+	if err != nil {
+		if sqliteErr, ok := err.(sqlite3.Error); ok && sqliteErr.Code == sqlite3.ErrConstraint {
+			return 0, &scimStatusError{http.StatusConflict, "uniqueness", "userName or email already exists"}
+		}
+		return 0, err
+	}
+
+	return userID, nil
+}
+
+// scimPrimaryEmail picks the primary email, falling back to the first one or
+// to a userName that looks like an email address
+func scimPrimaryEmail(user *SCIMUser) string {
+	for _, email := range user.Emails {
+		if email.Primary && email.Value != "" {
+			return strings.TrimSpace(email.Value)
+		}
+	}
+	for _, email := range user.Emails {
+		if email.Value != "" {
+			return strings.TrimSpace(email.Value)
+		}
+	}
+	if strings.Contains(user.UserName, "@") {
+		return user.UserName
+	}
+	return ""
+}
+
+// applySCIMUserPatch applies one PATCH operation to a user
+func applySCIMUserPatch(user *SCIMUser, op SCIMPatchOperation) error {
+	opName := strings.ToLower(op.Op)
+	if opName != "add" && opName != "replace" && opName != "remove" {
+		return scimBadRequest("invalidSyntax", "Unsupported PATCH op %q", op.Op)
+	}
+
+	// Without a path the value is an object of attributes to set
+	if op.Path == "" {
+		if opName == "remove" {
+			return scimBadRequest("noTarget", "remove requires a path")
+		}
+		var attrs map[string]json.RawMessage
+		if err := json.Unmarshal(op.Value, &attrs); err != nil {
+			return scimBadRequest("invalidValue", "PATCH value must be an object when no path is given")
+		}
+		for attr, value := range attrs {
+			if err := setSCIMUserAttr(user, attr, value, opName); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if opName == "remove" {
+		return removeSCIMUserAttr(user, op.Path)
+	}
+	return setSCIMUserAttr(user, op.Path, op.Value, opName)
+}
+
+func setSCIMUserAttr(user *SCIMUser, path string, value json.RawMessage, opName string) error {
+	parts := splitSCIMAttrPath(path)
+	attr := strings.ToLower(parts[0])
+
+	// emails[type eq "work"].value is treated as the primary email
+	if strings.HasPrefix(attr, "emails[") {
+		attr = "emails"
+		parts = []string{"emails", "value"}
+	}
+
+	switch attr {
+	case "username":
+		return unmarshalSCIMString(value, &user.UserName)
+	case "externalid":
+		return unmarshalSCIMString(value, &user.ExternalID)
+	case "displayname":
+		return unmarshalSCIMString(value, &user.DisplayName)
+	case "password":
+		return unmarshalSCIMString(value, &user.Password)
+	case "active":
+		active, err := unmarshalSCIMBool(value)
+		if err != nil {
+			return err
+		}
+		user.Active = &active
+		return nil
+	case "name":
+		if user.Name == nil {
+			user.Name = &SCIMName{}
+		}
+		if len(parts) == 1 {
+			var name SCIMName
+			if err := json.Unmarshal(value, &name); err != nil {
+				return scimBadRequest("invalidValue", "Invalid name value")
+			}
+			if opName == "replace" {
+				*user.Name = name
+				return nil
+			}
+			if name.GivenName != "" {
+				user.Name.GivenName = name.GivenName
+			}
+			if name.FamilyName != "" {
+				user.Name.FamilyName = name.FamilyName
+			}
+			return nil
+		}
+		switch strings.ToLower(parts[1]) {
+		case "givenname":
+			return unmarshalSCIMString(value, &user.Name.GivenName)
+		case "familyname":
+			return unmarshalSCIMString(value, &user.Name.FamilyName)
+		case "formatted":
+			return nil
+		}
+	case "emails":
+		var email string
+		if len(parts) > 1 && strings.EqualFold(parts[1], "value") {
+			if err := unmarshalSCIMString(value, &email); err != nil {
+				return err
+			}
+		} else {
+			var emails []SCIMEmail
+			if err := json.Unmarshal(value, &emails); err != nil {
+				return scimBadRequest("invalidValue", "Invalid emails value")
+			}
+			email = scimPrimaryEmail(&SCIMUser{Emails: emails})
+		}
+		if email != "" {
+			user.Emails = []SCIMEmail{{Value: email, Type: "work", Primary: true}}
+		}
+		return nil
+	case "schemas", "id", "meta", "groups":
+		return &scimStatusError{http.StatusBadRequest, "mutability", fmt.Sprintf("%s is read-only", parts[0])}
+	}
+
+	return scimBadRequest("invalidPath", "Unsupported attribute path %q", path)
+}
+
+func removeSCIMUserAttr(user *SCIMUser, path string) error {
+	parts := splitSCIMAttrPath(path)
+	switch strings.ToLower(parts[0]) {
+	case "externalid":
+		user.ExternalID = ""
+	case "displayname":
+		user.DisplayName = ""
+	case "name":
+		if len(parts) == 1 || user.Name == nil {
+			user.Name = nil
+			return nil
+		}
+		switch strings.ToLower(parts[1]) {
+		case "givenname":
+			user.Name.GivenName = ""
+		case "familyname":
+			user.Name.FamilyName = ""
+		}
+	case "username", "emails", "active":
+		return &scimStatusError{http.StatusBadRequest, "mutability", fmt.Sprintf("%s cannot be removed", parts[0])}
+	default:
+		return scimBadRequest("invalidPath", "Unsupported attribute path %q", path)
+	}
+	return nil
+}
+
+// Groups
+
+func (as *AuthService) scimListGroupsHandler(w http.ResponseWriter, r *http.Request) {
+	groups, err := as.scimLoadGroups(0)
+	if err != nil {
+		writeSCIMError(w, err)
+		return
+	}
+
+	resources := make([]interface{}, 0, len(groups))
+	for i := range groups {
+		groups[i].Meta.Location = scimLocation(r, "Groups", groups[i].ID)
+		resources = append(resources, groups[i])
+	}
+
+	writeSCIMList(w, r, resources)
+}
+
+func (as *AuthService) scimGetGroupHandler(w http.ResponseWriter, r *http.Request) {
+	group, err := as.scimLoadGroup(mux.Vars(r)["id"])
+	if err != nil {
+		writeSCIMError(w, err)
+		return
+	}
+
+	group.Meta.Location = scimLocation(r, "Groups", group.ID)
+	writeSCIMJSON(w, http.StatusOK, group)
+}
+
+func (as *AuthService) scimCreateGroupHandler(w http.ResponseWriter, r *http.Request) {
+	var group SCIMGroup
+	if err := json.NewDecoder(r.Body).Decode(&group); err != nil {
+		writeSCIMError(w, scimBadRequest("invalidSyntax", "Invalid request body"))
+		return
+	}
+
+	groupID, err := as.scimSaveGroup(0, &group)
+	if err != nil {
+		writeSCIMError(w, err)
+		return
+	}
+
+	as.recordAudit(r, 0, "scim.group.create", 0, map[string]interface{}{"group_id": groupID, "displayName": group.DisplayName})
+
+	created, err := as.scimLoadGroup(strconv.Itoa(groupID))
+	if err != nil {
+		writeSCIMError(w, err)
+		return
+	}
+
+	created.Meta.Location = scimLocation(r, "Groups", created.ID)
+	w.Header().Set("Location", created.Meta.Location)
+	writeSCIMJSON(w, http.StatusCreated, created)
+}
+
+func (as *AuthService) scimReplaceGroupHandler(w http.ResponseWriter, r *http.Request) {
+	existing, err := as.scimLoadGroup(mux.Vars(r)["id"])
+	if err != nil {
+		writeSCIMError(w, err)
+		return
+	}
+
+	var group SCIMGroup
+	if err := json.NewDecoder(r.Body).Decode(&group); err != nil {
+		writeSCIMError(w, scimBadRequest("invalidSyntax", "Invalid request body"))
+		return
+	}
+
+	as.scimUpdateGroup(w, r, existing, &group)
+}
+
+func (as *AuthService) scimPatchGroupHandler(w http.ResponseWriter, r *http.Request) {
+	existing, err := as.scimLoadGroup(mux.Vars(r)["id"])
+	if err != nil {
+		writeSCIMError(w, err)
+		return
+	}
+
+	var req SCIMPatchRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeSCIMError(w, scimBadRequest("invalidSyntax", "Invalid request body"))
+		return
+	}
+
+	group := *existing
+	group.Members = append([]SCIMMemberRef(nil), existing.Members...)
+	for _, op := range req.Operations {
+		if err := applySCIMGroupPatch(&group, op); err != nil {
+			writeSCIMError(w, err)
+			return
+		}
+	}
+
+	as.scimUpdateGroup(w, r, existing, &group)
+}
+
+func (as *AuthService) scimUpdateGroup(w http.ResponseWriter, r *http.Request, existing, group *SCIMGroup) {
+	groupID, _ := strconv.Atoi(existing.ID)
+	if _, err := as.scimSaveGroup(groupID, group); err != nil {
+		writeSCIMError(w, err)
+		return
+	}
+
+	as.recordAudit(r, 0, "scim.group.update", 0, map[string]interface{}{"group_id": groupID, "displayName": group.DisplayName})
+
+	updated, err := as.scimLoadGroup(existing.ID)
+	if err != nil {
+		writeSCIMError(w, err)
+		return
+	}
+
+	updated.Meta.Location = scimLocation(r, "Groups", updated.ID)
+	writeSCIMJSON(w, http.StatusOK, updated)
+}
+
+func (as *AuthService) scimDeleteGroupHandler(w http.ResponseWriter, r *http.Request) {
+	group, err := as.scimLoadGroup(mux.Vars(r)["id"])
+	if err != nil {
+		writeSCIMError(w, err)
+		return
+	}
+	groupID, _ := strconv.Atoi(group.ID)
+
+	tx, err := as.db.Begin()
+	if err != nil {
+		writeSCIMError(w, err)
+		return
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM group_members WHERE group_id = ?", groupID); err != nil {
+		writeSCIMError(w, err)
+		return
+	}
+	if _, err := tx.Exec("DELETE FROM user_groups WHERE id = ?", groupID); err != nil {
+		writeSCIMError(w, err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		writeSCIMError(w, err)
+		return
+	}
+
+	as.recordAudit(r, 0, "scim.group.delete", 0, map[string]interface{}{"group_id": groupID, "displayName": group.DisplayName})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (as *AuthService) scimLoadGroup(id string) (*SCIMGroup, error) {
+	groupID, err := strconv.Atoi(id)
+	if err != nil || groupID <= 0 {
+		return nil, &scimStatusError{http.StatusNotFound, "", fmt.Sprintf("Group %s not found", id)}
+	}
+
+	groups, err := as.scimLoadGroups(groupID)
+	if err != nil {
+		return nil, err
+	}
+	if len(groups) == 0 {
+		return nil, &scimStatusError{http.StatusNotFound, "", fmt.Sprintf("Group %s not found", id)}
+	}
+	return &groups[0], nil
+}
+
+// scimLoadGroups loads one group, or every group when groupID is 0
+func (as *AuthService) scimLoadGroups(groupID int) ([]SCIMGroup, error) {
+	query := "SELECT id, display_name, external_id, created_at, updated_at FROM user_groups"
+	var args []interface{}
+	if groupID != 0 {
+		query += " WHERE id = ?"
+		args = append(args, groupID)
+	}
+	query += " ORDER BY id"
+
+	rows, err := as.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	groups := []SCIMGroup{}
+	index := make(map[int]int)
+	for rows.Next() {
+		var id int
+		var group SCIMGroup
+		var externalID sql.NullString
+		var createdAt, updatedAt time.Time
+
+		if err := rows.Scan(&id, &group.DisplayName, &externalID, &createdAt, &updatedAt); err != nil {
+			return nil, err
+		}
+
+		group.Schemas = []string{scimGroupSchema}
+		group.ID = strconv.Itoa(id)
+		group.ExternalID = externalID.String
+		group.Meta = &SCIMMeta{ResourceType: "Group", Created: createdAt, LastModified: updatedAt}
+		index[id] = len(groups)
+		groups = append(groups, group)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	// Attach members
+	query = `
+		SELECT gm.group_id, u.id, u.username
+		FROM group_members gm JOIN users u ON u.id = gm.user_id`
+	args = nil
+	if groupID != 0 {
+		query += " WHERE gm.group_id = ?"
+		args = append(args, groupID)
+	}
+	query += " ORDER BY u.username"
+
+	memberRows, err := as.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer memberRows.Close()
+
+	for memberRows.Next() {
+		var gid, uid int
+		var username string
+		if err := memberRows.Scan(&gid, &uid, &username); err != nil {
+			return nil, err
+		}
+		if i, ok := index[gid]; ok {
+			groups[i].Members = append(groups[i].Members, SCIMMemberRef{Value: strconv.Itoa(uid), Display: username})
+		}
+	}
+
+	return groups, memberRows.Err()
+}
+
+// scimSaveGroup inserts (groupID 0) or updates a group and replaces its members
+func (as *AuthService) scimSaveGroup(groupID int, group *SCIMGroup) (int, error) {
+	group.DisplayName = strings.TrimSpace(group.DisplayName)
+	if group.DisplayName == "" {
+		return 0, scimBadRequest("invalidValue", "displayName is required")
+	}
+
+	tx, err := as.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	now := time.Now().UTC()
+	if groupID == 0 {
+		var result sql.Result
+		result, err = tx.Exec(`
+			INSERT INTO user_groups (display_name, external_id, created_at, updated_at)
+			VALUES (?, ?, ?, ?)
+		`, group.DisplayName, group.ExternalID, now, now)
+		if err == nil {
+			id, _ := result.LastInsertId()
+			groupID = int(id)
+		}
+	} else {
+		_, err = tx.Exec(`
+			UPDATE user_groups SET display_name = ?, external_id = ?, updated_at = ? WHERE id = ?
+		`, group.DisplayName, group.ExternalID, now, groupID)
+	}
+
+	if err != nil {
+		if sqliteErr, ok := err.(sqlite3.Error); ok && sqliteErr.Code == sqlite3.ErrConstraint {
+			return 0, &scimStatusError{http.StatusConflict, "uniqueness", "displayName already exists"}
+		}
+		return 0, err
+	}
+
+	if _, err := tx.Exec("DELETE FROM group_members WHERE group_id = ?", groupID); err != nil {
+		return 0, err
+	}
+
+	for _, member := range group.Members {
+		userID, err := strconv.Atoi(member.Value)
+		if err != nil {
+			return 0, scimBadRequest("invalidValue", "Invalid member %q", member.Value)
+		}
+
+		var exists int
+		if err := tx.QueryRow("SELECT COUNT(*) FROM users WHERE id = ?", userID).Scan(&exists); err != nil {
+			return 0, err
+		}
+		if exists == 0 {
+			return 0, scimBadRequest("invalidValue", "Member %q does not exist", member.Value)
+		}
+
+		if _, err := tx.Exec("INSERT OR IGNORE INTO group_members (group_id, user_id) VALUES (?, ?)", groupID, userID); err != nil {
+			return 0, err
+		}
+	}
+
+	return groupID, tx.Commit()
+}
+
+// applySCIMGroupPatch applies one PATCH operation to a group
+func applySCIMGroupPatch(group *SCIMGroup, op SCIMPatchOperation) error {
+	opName := strings.ToLower(op.Op)
+	if opName != "add" && opName != "replace" && opName != "remove" {
+		return scimBadRequest("invalidSyntax", "Unsupported PATCH op %q", op.Op)
+	}
+
+	if op.Path == "" {
+		if opName == "remove" {
+			return scimBadRequest("noTarget", "remove requires a path")
+		}
+		var attrs map[string]json.RawMessage
+		if err := json.Unmarshal(op.Value, &attrs); err != nil {
+			return scimBadRequest("invalidValue", "PATCH value must be an object when no path is given")
+		}
+		for attr, value := range attrs {
+			if err := applySCIMGroupPatch(group, SCIMPatchOperation{Op: opName, Path: attr, Value: value}); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	// members[value eq "42"] selects members to remove
+	if bracket := strings.Index(op.Path, "["); bracket > 0 {
+		if opName != "remove" || !strings.EqualFold(op.Path[:bracket], "members") || !strings.HasSuffix(op.Path, "]") {
+			return scimBadRequest("invalidPath", "Unsupported attribute path %q", op.Path)
+		}
+		filter, err := parseSCIMFilter(op.Path[bracket+1 : len(op.Path)-1])
+		if err != nil {
+			return scimBadRequest("invalidFilter", "%v", err)
+		}
+
+		kept := group.Members[:0]
+		for _, member := range group.Members {
+			if !filter.matches(map[string]interface{}{"value": member.Value, "display": member.Display}) {
+				kept = append(kept, member)
+			}
+		}
+		group.Members = kept
+		return nil
+	}
+
+	switch strings.ToLower(splitSCIMAttrPath(op.Path)[0]) {
+	case "displayname":
+		if opName == "remove" {
+			return &scimStatusError{http.StatusBadRequest, "mutability", "displayName cannot be removed"}
+		}
+		return unmarshalSCIMString(op.Value, &group.DisplayName)
+	case "externalid":
+		if opName == "remove" {
+			group.ExternalID = ""
+			return nil
+		}
+		return unmarshalSCIMString(op.Value, &group.ExternalID)
+	case "members":
+		var members []SCIMMemberRef
+		if len(op.Value) > 0 {
+			if err := json.Unmarshal(op.Value, &members); err != nil {
+				return scimBadRequest("invalidValue", "Invalid members value")
+			}
+		}
+
+		switch opName {
+		case "replace":
+			group.Members = members
+		case "add":
+			for _, member := range members {
+				if !scimHasMember(group.Members, member.Value) {
+					group.Members = append(group.Members, member)
+				}
+			}
+		case "remove":
+			if len(members) == 0 {
+				group.Members = nil
+				return nil
+			}
+			kept := group.Members[:0]
+			for _, member := range group.Members {
+				if !scimHasMember(members, member.Value) {
+					kept = append(kept, member)
+				}
+			}
+			group.Members = kept
+		}
+		return nil
+	}
+
+	return scimBadRequest("invalidPath", "Unsupported attribute path %q", op.Path)
+}
+
+func scimHasMember(members []SCIMMemberRef, value string) bool {
+	for _, member := range members {
+		if member.Value == value {
+			return true
+		}
+	}
+	return false
+}
+
+// Helpers
+
+func unmarshalSCIMString(value json.RawMessage, target *string) error {
+	if err := json.Unmarshal(value, target); err != nil {
+		return scimBadRequest("invalidValue", "Expected a string value")
+	}
+	return nil
+}
+
+// unmarshalSCIMBool accepts JSON booleans and the "True"/"False" strings some
+// identity providers send
+func unmarshalSCIMBool(value json.RawMessage) (bool, error) {
+	var b bool
+	if err := json.Unmarshal(value, &b); err == nil {
+		return b, nil
+	}
+
+	var s string
+	if err := json.Unmarshal(value, &s); err == nil {
+		if parsed, err := strconv.ParseBool(s); err == nil {
+			return parsed, nil
+		}
+	}
+	return false, scimBadRequest("invalidValue", "Expected a boolean value")
+}
+
+// writeSCIMList applies filter, startIndex and count to the resources
+func writeSCIMList(w http.ResponseWriter, r *http.Request, resources []interface{}) {
+	query := r.URL.Query()
+
+	if filterExpr := query.Get("filter"); filterExpr != "" {
+		filter, err := parseSCIMFilter(filterExpr)
+		if err != nil {
+			writeSCIMError(w, scimBadRequest("invalidFilter", "%v", err))
+			return
+		}
+
+		matched := make([]interface{}, 0, len(resources))
+		for _, resource := range resources {
+			if filter.matches(toSCIMMap(resource)) {
+				matched = append(matched, resource)
+			}
+		}
+		resources = matched
+	}
+
+	startIndex, count := scimPaging(r)
+	total := len(resources)
+	start := startIndex - 1
+	if start > total {
+		start = total
+	}
+	end := start + count
+	if end > total {
+		end = total
+	}
+	writeSCIMPage(w, resources[start:end], total, startIndex)
+}
+
+// scimPaging reads the 1-based startIndex and count of a list request
+func scimPaging(r *http.Request) (int, int) {
+	query := r.URL.Query()
+	startIndex, err := strconv.Atoi(query.Get("startIndex"))
+	if err != nil || startIndex < 1 {
+		startIndex = 1
+	}
+	count, err := strconv.Atoi(query.Get("count"))
+	if err != nil || count < 0 {
+		count = scimDefaultCount
+	}
+	if count > scimMaxCount {
+		count = scimMaxCount
+	}
+	return startIndex, count
+}
+
+// writeSCIMPage writes one page of a list of total resources
+func writeSCIMPage(w http.ResponseWriter, page []interface{}, total, startIndex int) {
+	writeSCIMJSON(w, http.StatusOK, SCIMListResponse{
+		Schemas:      []string{scimListResponseSchema},
+		TotalResults: total,
+		StartIndex:   startIndex,
+		ItemsPerPage: len(page),
+		Resources:    page,
+	})
+}
+
+// toSCIMMap converts a resource to its generic JSON form for filtering
+func toSCIMMap(resource interface{}) map[string]interface{} {
+	data, _ := json.Marshal(resource)
+	var m map[string]interface{}
+	json.Unmarshal(data, &m)
+	return m
+}
+
+func scimLocation(r *http.Request, resourceType, id string) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if proto := r.Header.Get("X-Forwarded-Proto"); proto != "" {
+		scheme = proto
+	}
+	return fmt.Sprintf("%s://%s/scim/v2/%s/%s", scheme, r.Host, resourceType, id)
+}
+
+func writeSCIMJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", scimContentType)
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeSCIMError(w http.ResponseWriter, err error) {
+	statusErr, ok := err.(*scimStatusError)
+	if !ok {
+		statusErr = &scimStatusError{http.StatusInternalServerError, "", "Internal server error"}
+	}
+
+	writeSCIMJSON(w, statusErr.status, SCIMError{
+		Schemas:  []string{scimErrorSchema},
+		Status:   strconv.Itoa(statusErr.status),
+		ScimType: statusErr.scimType,
+		Detail:   statusErr.detail,
+	})
+}
+
+// randomSecret returns a random string used as an unusable initial password
+func randomSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,498 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// scimFilter is a parsed SCIM filter expression (RFC 7644 section 3.4.2.2).
+// Filters are evaluated against the JSON form of a resource so the same
+// implementation serves Users and Groups.
+type scimFilter interface {
+	matches(resource map[string]interface{}) bool
+}
+
+type scimLogicalFilter struct {
+	op          string // "and" or "or"
+	left, right scimFilter
+}
+
+type scimNotFilter struct {
+	inner scimFilter
+}
+
+type scimCompareFilter struct {
+	path  []string
+	op    string
+	value interface{}
+}
+
+// scimValuePathFilter matches when any element of a multi-valued attribute
+// matches the inner filter, e.g. emails[type eq "work"]
+type scimValuePathFilter struct {
+	attr  string
+	inner scimFilter
+}
+
+// scimCoreSchemaPrefixes may prefix attribute names in filters and PATCH paths
+var scimCoreSchemaPrefixes = []string{
+	scimUserSchema + ":",
+	scimGroupSchema + ":",
+}
+
+func (f *scimLogicalFilter) matches(resource map[string]interface{}) bool {
+	if f.op == "and" {
+		return f.left.matches(resource) && f.right.matches(resource)
+	}
+	return f.left.matches(resource) || f.right.matches(resource)
+}
+
+func (f *scimNotFilter) matches(resource map[string]interface{}) bool {
+	return !f.inner.matches(resource)
+}
+
+func (f *scimCompareFilter) matches(resource map[string]interface{}) bool {
+	values := resolveSCIMPath(resource, f.path)
+
+	if f.op == "pr" {
+		for _, v := range values {
+			if v != nil && v != "" {
+				return true
+			}
+		}
+		return false
+	}
+
+	if len(values) == 0 {
+		return (f.op == "eq" && f.value == nil) || (f.op == "ne" && f.value != nil)
+	}
+
+	for _, v := range values {
+		if compareSCIMValue(v, f.op, f.value) {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *scimValuePathFilter) matches(resource map[string]interface{}) bool {
+	value, ok := lookupSCIMAttr(resource, f.attr)
+	if !ok {
+		return false
+	}
+
+	items, ok := value.([]interface{})
+	if !ok {
+		items = []interface{}{value}
+	}
+
+	for _, item := range items {
+		if m, ok := item.(map[string]interface{}); ok && f.inner.matches(m) {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveSCIMPath returns every value found at the attribute path, flattening
+// multi-valued attributes along the way
+func resolveSCIMPath(resource map[string]interface{}, path []string) []interface{} {
+	current := []interface{}{resource}
+	for _, name := range path {
+		var next []interface{}
+		for _, item := range current {
+			m, ok := item.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			value, ok := lookupSCIMAttr(m, name)
+			if !ok {
+				continue
+			}
+			if list, ok := value.([]interface{}); ok {
+				next = append(next, list...)
+			} else {
+				next = append(next, value)
+			}
+		}
+		current = next
+	}
+
+	// Comparing a complex value compares its "value" sub-attribute
+	for i, item := range current {
+		if m, ok := item.(map[string]interface{}); ok {
+			current[i], _ = lookupSCIMAttr(m, "value")
+		}
+	}
+	return current
+}
+
+// lookupSCIMAttr finds an attribute by name; SCIM attribute names are case-insensitive
+func lookupSCIMAttr(m map[string]interface{}, name string) (interface{}, bool) {
+	if value, ok := m[name]; ok {
+		return value, true
+	}
+	for key, value := range m {
+		if strings.EqualFold(key, name) {
+			return value, true
+		}
+	}
+	return nil, false
+}
+
+func compareSCIMValue(actual interface{}, op string, expected interface{}) bool {
+	switch a := actual.(type) {
+	case string:
+		e, ok := expected.(string)
+		if !ok {
+			return op == "ne"
+		}
+		a, e = strings.ToLower(a), strings.ToLower(e)
+		switch op {
+		case "eq":
+			return a == e
+		case "ne":
+			return a != e
+		case "co":
+			return strings.Contains(a, e)
+		case "sw":
+			return strings.HasPrefix(a, e)
+		case "ew":
+			return strings.HasSuffix(a, e)
+		case "gt":
+			return a > e
+		case "ge":
+			return a >= e
+		case "lt":
+			return a < e
+		case "le":
+			return a <= e
+		}
+	case float64:
+		e, ok := expected.(float64)
+		if !ok {
+			return op == "ne"
+		}
+		switch op {
+		case "eq":
+			return a == e
+		case "ne":
+			return a != e
+		case "gt":
+			return a > e
+		case "ge":
+			return a >= e
+		case "lt":
+			return a < e
+		case "le":
+			return a <= e
+		}
+	case bool:
+		e, ok := expected.(bool)
+		if !ok {
+			return op == "ne"
+		}
+		switch op {
+		case "eq":
+			return a == e
+		case "ne":
+			return a != e
+		}
+	case nil:
+		return (op == "eq" && expected == nil) || (op == "ne" && expected != nil)
+	}
+	return false
+}
+
+// scimUserColumns are the User attributes scimUserCondition can filter on
+var scimUserColumns = map[string]string{
+	"id":         "id",
+	"username":   "username",
+	"externalid": "external_id",
+}
+
+// scimUserCondition compiles a filter of eq comparisons on id, userName and
+// externalId, combined with and/or, into a WHERE clause on users. ok is
+// false for any other filter, which has to be matched in memory.
+func scimUserCondition(filter scimFilter) (where string, args []interface{}, ok bool) {
+	switch f := filter.(type) {
+	case *scimLogicalFilter:
+		left, leftArgs, ok := scimUserCondition(f.left)
+		if !ok {
+			return "", nil, false
+		}
+		right, rightArgs, ok := scimUserCondition(f.right)
+		if !ok {
+			return "", nil, false
+		}
+		return "(" + left + " " + strings.ToUpper(f.op) + " " + right + ")", append(leftArgs, rightArgs...), true
+	case *scimCompareFilter:
+		if f.op != "eq" || len(f.path) != 1 {
+			return "", nil, false
+		}
+		column, known := scimUserColumns[strings.ToLower(f.path[0])]
+		value, isString := f.value.(string)
+		if !known || !isString {
+			return "", nil, false
+		}
+		if column == "id" {
+			id, err := strconv.Atoi(value)
+			if err != nil {
+				return "0 = 1", nil, true
+			}
+			return "id = ?", []interface{}{id}, true
+		}
+		// Like compareSCIMValue, string comparisons ignore case
+		return column + " = ? COLLATE NOCASE", []interface{}{value}, true
+	}
+	return "", nil, false
+}
+
+// splitSCIMAttrPath strips a core schema URN and splits a dotted attribute path
+func splitSCIMAttrPath(path string) []string {
+	for _, prefix := range scimCoreSchemaPrefixes {
+		if len(path) > len(prefix) && strings.EqualFold(path[:len(prefix)], prefix) {
+			path = path[len(prefix):]
+			break
+		}
+	}
+	return strings.Split(path, ".")
+}
+
+// scimFilterToken is a lexical token of a filter expression
+type scimFilterToken struct {
+	text   string
+	quoted bool
+	pos    int
+}
+
+type scimFilterParser struct {
+	tokens []scimFilterToken
+	pos    int
+}
+
+// parseSCIMFilter parses a filter expression such as
+// userName eq "bjensen" and (emails co "example.com" or not (active eq false))
+func parseSCIMFilter(input string) (scimFilter, error) {
+	tokens, err := tokenizeSCIMFilter(input)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("empty filter")
+	}
+
+	p := &scimFilterParser{tokens: tokens}
+	filter, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if tok, ok := p.peek(); ok {
+		return nil, fmt.Errorf("unexpected %q at position %d", tok.text, tok.pos)
+	}
+	return filter, nil
+}
+
+func tokenizeSCIMFilter(input string) ([]scimFilterToken, error) {
+	var tokens []scimFilterToken
+	i := 0
+	for i < len(input) {
+		c := input[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '(' || c == ')' || c == '[' || c == ']':
+			tokens = append(tokens, scimFilterToken{text: string(c), pos: i})
+			i++
+		case c == '"':
+			start := i
+			i++
+			for i < len(input) && input[i] != '"' {
+				if input[i] == '\\' {
+					i++
+				}
+				i++
+			}
+			if i >= len(input) {
+				return nil, fmt.Errorf("unterminated string at position %d", start)
+			}
+			value, err := strconv.Unquote(input[start : i+1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid string at position %d", start)
+			}
+			tokens = append(tokens, scimFilterToken{text: value, quoted: true, pos: start})
+			i++
+		default:
+			start := i
+			for i < len(input) && !strings.ContainsRune(" \t\r\n()[]\"", rune(input[i])) {
+				i++
+			}
+			tokens = append(tokens, scimFilterToken{text: input[start:i], pos: start})
+		}
+	}
+	return tokens, nil
+}
+
+func (p *scimFilterParser) peek() (scimFilterToken, bool) {
+	if p.pos >= len(p.tokens) {
+		return scimFilterToken{}, false
+	}
+	return p.tokens[p.pos], true
+}
+
+func (p *scimFilterParser) next() (scimFilterToken, error) {
+	tok, ok := p.peek()
+	if !ok {
+		return tok, fmt.Errorf("unexpected end of filter")
+	}
+	p.pos++
+	return tok, nil
+}
+
+func (p *scimFilterParser) peekKeyword(keyword string) bool {
+	tok, ok := p.peek()
+	return ok && !tok.quoted && strings.EqualFold(tok.text, keyword)
+}
+
+func (p *scimFilterParser) expect(text string) error {
+	tok, err := p.next()
+	if err != nil {
+		return fmt.Errorf("expected %q: %v", text, err)
+	}
+	if tok.quoted || tok.text != text {
+		return fmt.Errorf("expected %q at position %d", text, tok.pos)
+	}
+	return nil
+}
+
+func (p *scimFilterParser) parseOr() (scimFilter, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.peekKeyword("or") {
+		p.pos++
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &scimLogicalFilter{op: "or", left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *scimFilterParser) parseAnd() (scimFilter, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for p.peekKeyword("and") {
+		p.pos++
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		left = &scimLogicalFilter{op: "and", left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *scimFilterParser) parseNot() (scimFilter, error) {
+	if p.peekKeyword("not") {
+		p.pos++
+		if err := p.expect("("); err != nil {
+			return nil, err
+		}
+		inner, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(")"); err != nil {
+			return nil, err
+		}
+		return &scimNotFilter{inner: inner}, nil
+	}
+	return p.parseAtom()
+}
+
+func (p *scimFilterParser) parseAtom() (scimFilter, error) {
+	tok, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+
+	if !tok.quoted && tok.text == "(" {
+		inner, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(")"); err != nil {
+			return nil, err
+		}
+		return inner, nil
+	}
+
+	if tok.quoted || strings.ContainsAny(tok.text, "()[]") {
+		return nil, fmt.Errorf("expected attribute name at position %d", tok.pos)
+	}
+	attr := tok.text
+
+	// Value path: attr[filter]
+	if next, ok := p.peek(); ok && !next.quoted && next.text == "[" {
+		p.pos++
+		inner, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect("]"); err != nil {
+			return nil, err
+		}
+		return &scimValuePathFilter{attr: splitSCIMAttrPath(attr)[0], inner: inner}, nil
+	}
+
+	opTok, err := p.next()
+	if err != nil {
+		return nil, fmt.Errorf("expected operator after %q", attr)
+	}
+	op := strings.ToLower(opTok.text)
+
+	switch op {
+	case "pr":
+		return &scimCompareFilter{path: splitSCIMAttrPath(attr), op: op}, nil
+	case "eq", "ne", "co", "sw", "ew", "gt", "ge", "lt", "le":
+	default:
+		return nil, fmt.Errorf("unknown operator %q at position %d", opTok.text, opTok.pos)
+	}
+
+	valueTok, err := p.next()
+	if err != nil {
+		return nil, fmt.Errorf("expected value after %q", opTok.text)
+	}
+	value, err := parseSCIMFilterValue(valueTok)
+	if err != nil {
+		return nil, err
+	}
+
+	return &scimCompareFilter{path: splitSCIMAttrPath(attr), op: op, value: value}, nil
+}
+
+func parseSCIMFilterValue(tok scimFilterToken) (interface{}, error) {
+	if tok.quoted {
+		return tok.text, nil
+	}
+
+	switch strings.ToLower(tok.text) {
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	case "null":
+		return nil, nil
+	}
+
+	if n, err := strconv.ParseFloat(tok.text, 64); err == nil {
+		return n, nil
+	}
+	return nil, fmt.Errorf("invalid value %q at position %d", tok.text, tok.pos)
+}
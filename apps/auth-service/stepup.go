@@ -0,0 +1,188 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// stepUpMaxAge is how recently the user must have proven their identity
+// before a sensitive operation is allowed
+const stepUpMaxAge = 10 * time.Minute
+
+// Authentication context classes carried in the acr claim (NIST SP 800-63B
+// assurance levels). A password is one factor; a passkey that verified the
+// user with a PIN or biometric is two.
+const (
+	acrAAL1 = "aal1"
+	acrAAL2 = "aal2"
+)
+
+// ReauthenticateRequest proves the user's identity again with either their
+// password or a passkey assertion (challenge from /api/auth/passkeys/login/begin)
+type ReauthenticateRequest struct {
+	Password   string             `json:"password,omitempty"`
+	Credential *PasskeyCredential `json:"credential,omitempty"`
+}
+
+// StepUpError tells the client which freshness requirement was not met
+type StepUpError struct {
+	Error                  string `json:"error"`
+	ErrorDescription       string `json:"error_description"`
+	MaxAge                 int    `json:"max_age"`
+	AuthTime               int64  `json:"auth_time,omitempty"`
+	ReauthenticateEndpoint string `json:"reauthenticate_endpoint"`
+}
+
+// markAuthenticated records that the user proved their identity just now
+func markAuthenticated(claims *Claims, acr string) {
+	claims.AuthTime = jwt.NewNumericDate(time.Now())
+	claims.ACR = acr
+}
+
+// requireRecentAuth wraps a handler for an operation that needs fresh proof
+// of identity. Tokens without an auth_time within maxAge get a
+// step_up_required error (RFC 9470) instead of reaching the handler.
+func (as *AuthService) requireRecentAuth(maxAge time.Duration, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		claims, err := as.authenticateRequest(r)
+		if err != nil {
+			http.Error(w, "Invalid token", http.StatusUnauthorized)
+			return
+		}
+
+		if claims.AuthTime != nil && time.Since(claims.AuthTime.Time) <= maxAge {
+			next(w, r)
+			return
+		}
+
+		authAttempts.WithLabelValues("step_up", "required").Inc()
+
+		response := StepUpError{
+			Error:                  "step_up_required",
+			ErrorDescription:       "This operation requires a recent sign-in; re-authenticate and retry",
+			MaxAge:                 int(maxAge.Seconds()),
+			ReauthenticateEndpoint: "/api/auth/reauthenticate",
+		}
+		if claims.AuthTime != nil {
+			response.AuthTime = claims.AuthTime.Unix()
+		}
+
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(
+			`Bearer error="insufficient_user_authentication", error_description=%q, max_age=%d`,
+			response.ErrorDescription, response.MaxAge))
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(response)
+	}
+}
+
+// reauthenticateHandler upgrades the caller's session after they prove their
+// identity again. The new token keeps the session's expiry and replaces the
+// old one, which is revoked.
+func (as *AuthService) reauthenticateHandler(w http.ResponseWriter, r *http.Request) {
+	claims, err := as.authenticateRequest(r)
+	if err != nil {
+		http.Error(w, "Invalid token", http.StatusUnauthorized)
+		return
+	}
+
+	if claims.Guest {
+		http.Error(w, "Guest accounts must be upgraded before re-authenticating", http.StatusForbidden)
+		return
+	}
+
+	var req ReauthenticateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	var acr string
+	switch {
+	case req.Credential != nil:
+		userID, userVerified, err := as.verifyAssertion(r, *req.Credential)
+		if err != nil || userID != claims.UserID {
+			authAttempts.WithLabelValues("reauth", "failed").Inc()
+			http.Error(w, "Invalid credentials", http.StatusUnauthorized)
+			return
+		}
+		acr = acrAAL1
+		if userVerified {
+			acr = acrAAL2
+		}
+	case req.Password != "":
+		var verified *User
+		verified, err = as.verifyCredentials(claims.Username, req.Password)
+		if err == nil && verified.ID != claims.UserID {
+			err = errInvalidCredentials
+		}
+		if err == errInvalidCredentials {
+			authAttempts.WithLabelValues("reauth", "failed").Inc()
+			http.Error(w, "Invalid credentials", http.StatusUnauthorized)
+			return
+		}
+		if err == errAccountDisabled {
+			http.Error(w, "Account is disabled", http.StatusForbidden)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		acr = acrAAL1
+	default:
+		http.Error(w, "password or credential is required", http.StatusBadRequest)
+		return
+	}
+
+	var user User
+	err = as.db.QueryRow(`
+		SELECT id, username, email, created_at FROM users WHERE id = ?
+	`, claims.UserID).Scan(&user.ID, &user.Username, &user.Email, &user.CreatedAt)
+	if err == sql.ErrNoRows {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	upgraded, err := newClaims(claims.UserID, claims.Username, time.Until(claims.ExpiresAt.Time))
+	if err != nil {
+		http.Error(w, "Failed to generate token", http.StatusInternalServerError)
+		return
+	}
+	markAuthenticated(upgraded, acr)
+
+	token, err := as.signToken(upgraded)
+	if err != nil {
+		http.Error(w, "Failed to generate token", http.StatusInternalServerError)
+		return
+	}
+	if err := as.revokeToken(claims); err != nil {
+		http.Error(w, "Failed to upgrade session", http.StatusInternalServerError)
+		return
+	}
+
+	authAttempts.WithLabelValues("reauth", "success").Inc()
+	as.recordAudit(r, claims.UserID, "session.reauthenticate", claims.UserID, map[string]interface{}{
+		"acr":          acr,
+		"previous_jti": claims.ID,
+		"jti":          upgraded.ID,
+	})
+
+	response := LoginResponse{
+		Token: token,
+		User:  user,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(response)
+}
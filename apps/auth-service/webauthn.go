@@ -0,0 +1,878 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/mattn/go-sqlite3"
+)
+
+// Passkey (WebAuthn) settings
+const (
+	webauthnChallengeTTL = 5 * time.Minute
+	webauthnTimeoutMs    = 5 * 60 * 1000
+	passkeyNameMaxLength = 64
+)
+
+// COSE algorithm identifiers we accept, in order of preference
+const (
+	coseAlgES256 = -7
+	coseAlgEdDSA = -8
+	coseAlgRS256 = -257
+)
+
+// Authenticator data flags (WebAuthn section 6.1)
+const (
+	authDataUserPresent        = 0x01
+	authDataUserVerified       = 0x04
+	authDataAttestedCredential = 0x40
+)
+
+var errPasskeyVerification = errors.New("passkey verification failed")
+
+// WebAuthnConfig identifies this relying party to authenticators
+type WebAuthnConfig struct {
+	RPID    string
+	RPName  string
+	Origins map[string]bool // origins allowed to run ceremonies
+}
+
+// Passkey is a registered WebAuthn credential
+type Passkey struct {
+	ID           int        `json:"id"`
+	Name         string     `json:"name"`
+	CredentialID string     `json:"credential_id"`
+	Transports   []string   `json:"transports,omitempty"`
+	CreatedAt    time.Time  `json:"created_at"`
+	LastUsedAt   *time.Time `json:"last_used_at,omitempty"`
+}
+
+// PasskeyCredential is the JSON form of a PublicKeyCredential, as produced by
+// its toJSON() method. Binary fields are base64url encoded.
+type PasskeyCredential struct {
+	ID       string `json:"id"`
+	RawID    string `json:"rawId"`
+	Type     string `json:"type"`
+	Response struct {
+		ClientDataJSON    string   `json:"clientDataJSON"`
+		AttestationObject string   `json:"attestationObject,omitempty"`
+		AuthenticatorData string   `json:"authenticatorData,omitempty"`
+		Signature         string   `json:"signature,omitempty"`
+		UserHandle        string   `json:"userHandle,omitempty"`
+		Transports        []string `json:"transports,omitempty"`
+	} `json:"response"`
+}
+
+// PasskeyRegisterRequest represents the passkey registration payload
+type PasskeyRegisterRequest struct {
+	Name       string            `json:"name"`
+	Credential PasskeyCredential `json:"credential"`
+}
+
+// PasskeyLoginRequest represents the passkey login payloads. Username is
+// optional when starting; without it any discoverable passkey can be used.
+type PasskeyLoginRequest struct {
+	Username   string            `json:"username"`
+	Credential PasskeyCredential `json:"credential"`
+}
+
+// PasskeyRenameRequest represents the passkey rename payload
+type PasskeyRenameRequest struct {
+	Name string `json:"name"`
+}
+
+type relyingParty struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+type passkeyUserEntity struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	DisplayName string `json:"displayName"`
+}
+
+type credentialParameter struct {
+	Type string `json:"type"`
+	Alg  int    `json:"alg"`
+}
+
+type credentialDescriptor struct {
+	Type       string   `json:"type"`
+	ID         string   `json:"id"`
+	Transports []string `json:"transports,omitempty"`
+}
+
+type authenticatorSelection struct {
+	ResidentKey      string `json:"residentKey"`
+	UserVerification string `json:"userVerification"`
+}
+
+// creationOptions is PublicKeyCredentialCreationOptionsJSON
+type creationOptions struct {
+	Challenge              string                 `json:"challenge"`
+	RP                     relyingParty           `json:"rp"`
+	User                   passkeyUserEntity      `json:"user"`
+	PubKeyCredParams       []credentialParameter  `json:"pubKeyCredParams"`
+	Timeout                int                    `json:"timeout"`
+	ExcludeCredentials     []credentialDescriptor `json:"excludeCredentials"`
+	AuthenticatorSelection authenticatorSelection `json:"authenticatorSelection"`
+	Attestation            string                 `json:"attestation"`
+}
+
+// requestOptions is PublicKeyCredentialRequestOptionsJSON
+type requestOptions struct {
+	Challenge        string                 `json:"challenge"`
+	RPID             string                 `json:"rpId"`
+	Timeout          int                    `json:"timeout"`
+	AllowCredentials []credentialDescriptor `json:"allowCredentials"`
+	UserVerification string                 `json:"userVerification"`
+}
+
+// collectedClientData is the clientDataJSON signed by the authenticator
+type collectedClientData struct {
+	Type        string `json:"type"`
+	Challenge   string `json:"challenge"`
+	Origin      string `json:"origin"`
+	CrossOrigin bool   `json:"crossOrigin"`
+}
+
+type authenticatorData struct {
+	RPIDHash     []byte
+	Flags        byte
+	SignCount    uint32
+	AAGUID       []byte
+	CredentialID []byte
+	PublicKey    []byte // COSE_Key
+}
+
+// parseWebAuthnConfig reads the relying party ID and the comma-separated allowed origins
+func parseWebAuthnConfig(rpID, origins string) WebAuthnConfig {
+	config := WebAuthnConfig{
+		RPID:    rpID,
+		RPName:  "Task Manager",
+		Origins: make(map[string]bool),
+	}
+	for _, origin := range strings.Split(origins, ",") {
+		if origin = strings.TrimSuffix(strings.TrimSpace(origin), "/"); origin != "" {
+			config.Origins[origin] = true
+		}
+	}
+	return config
+}
+
+func (as *AuthService) passkeyRegisterBeginHandler(w http.ResponseWriter, r *http.Request) {
+	claims, err := as.authenticateRequest(r)
+	if err != nil {
+		http.Error(w, "Invalid token", http.StatusUnauthorized)
+		return
+	}
+
+	var displayName sql.NullString
+	as.db.QueryRow("SELECT display_name FROM users WHERE id = ?", claims.UserID).Scan(&displayName)
+	if displayName.String == "" {
+		displayName.String = claims.Username
+	}
+
+	existing, err := as.userCredentialDescriptors(claims.UserID)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	challenge, err := as.newWebAuthnChallenge("register", claims.UserID)
+	if err != nil {
+		http.Error(w, "Failed to create challenge", http.StatusInternalServerError)
+		return
+	}
+
+	options := creationOptions{
+		Challenge: challenge,
+		RP:        relyingParty{ID: as.webauthn.RPID, Name: as.webauthn.RPName},
+		User: passkeyUserEntity{
+			ID:          base64.RawURLEncoding.EncodeToString(passkeyUserHandle(claims.UserID)),
+			Name:        claims.Username,
+			DisplayName: displayName.String,
+		},
+		PubKeyCredParams: []credentialParameter{
+			{Type: "public-key", Alg: coseAlgES256},
+			{Type: "public-key", Alg: coseAlgEdDSA},
+			{Type: "public-key", Alg: coseAlgRS256},
+		},
+		Timeout:            webauthnTimeoutMs,
+		ExcludeCredentials: existing,
+		AuthenticatorSelection: authenticatorSelection{
+			ResidentKey:      "required",
+			UserVerification: "preferred",
+		},
+		Attestation: "none",
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{"publicKey": options})
+}
+
+func (as *AuthService) passkeyRegisterFinishHandler(w http.ResponseWriter, r *http.Request) {
+	claims, err := as.authenticateRequest(r)
+	if err != nil {
+		http.Error(w, "Invalid token", http.StatusUnauthorized)
+		return
+	}
+
+	var req PasskeyRegisterRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	name, err := passkeyName(req.Name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	credentialID, publicKey, authData, err := as.verifyRegistration(req.Credential, claims.UserID)
+	if err != nil {
+		authAttempts.WithLabelValues("passkey_register", "failed").Inc()
+		http.Error(w, "Passkey registration failed: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	passkey := Passkey{
+		Name:         name,
+		CredentialID: credentialID,
+		Transports:   req.Credential.Response.Transports,
+		CreatedAt:    time.Now().UTC(),
+	}
+	result, err := as.db.Exec(`
+		INSERT INTO webauthn_credentials (user_id, credential_id, public_key, sign_count, name, aaguid, transports, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+	`, claims.UserID, credentialID, publicKey, authData.SignCount, name, hex.EncodeToString(authData.AAGUID),
+		strings.Join(passkey.Transports, ","), passkey.CreatedAt)
+	if err != nil {
+		if sqliteErr, ok := err.(sqlite3.Error); ok && sqliteErr.Code == sqlite3.ErrConstraint {
+			http.Error(w, "Passkey is already registered", http.StatusConflict)
+			return
+		}
+		http.Error(w, "Failed to save passkey", http.StatusInternalServerError)
+		return
+	}
+	id, _ := result.LastInsertId()
+	passkey.ID = int(id)
+
+	authAttempts.WithLabelValues("passkey_register", "success").Inc()
+	as.recordAudit(r, claims.UserID, "passkey.register", claims.UserID, map[string]interface{}{
+		"passkey_id": passkey.ID,
+		"name":       name,
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(passkey)
+}
+
+func (as *AuthService) passkeyLoginBeginHandler(w http.ResponseWriter, r *http.Request) {
+	var req PasskeyLoginRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+	}
+
+	// Unknown usernames get the same response as users without passkeys
+	userID := 0
+	allow := []credentialDescriptor{}
+	if req.Username != "" {
+		if err := as.db.QueryRow("SELECT id FROM users WHERE username = ?", req.Username).Scan(&userID); err == nil {
+			descriptors, err := as.userCredentialDescriptors(userID)
+			if err != nil {
+				http.Error(w, "Database error", http.StatusInternalServerError)
+				return
+			}
+			allow = descriptors
+		}
+	}
+
+	challenge, err := as.newWebAuthnChallenge("login", userID)
+	if err != nil {
+		http.Error(w, "Failed to create challenge", http.StatusInternalServerError)
+		return
+	}
+
+	options := requestOptions{
+		Challenge:        challenge,
+		RPID:             as.webauthn.RPID,
+		Timeout:          webauthnTimeoutMs,
+		AllowCredentials: allow,
+		UserVerification: "preferred",
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{"publicKey": options})
+}
+
+func (as *AuthService) passkeyLoginFinishHandler(w http.ResponseWriter, r *http.Request) {
+	var req PasskeyLoginRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	userID, userVerified, err := as.verifyAssertion(r, req.Credential)
+	if err != nil {
+		authAttempts.WithLabelValues("passkey", "failed").Inc()
+		http.Error(w, "Invalid credentials", http.StatusUnauthorized)
+		return
+	}
+
+	var user User
+	var active bool
+	err = as.db.QueryRow(`
+		SELECT id, username, email, active, created_at FROM users WHERE id = ?
+	`, userID).Scan(&user.ID, &user.Username, &user.Email, &active, &user.CreatedAt)
+	if err != nil {
+		http.Error(w, "Invalid credentials", http.StatusUnauthorized)
+		return
+	}
+	if !active {
+		authAttempts.WithLabelValues("passkey", "disabled").Inc()
+		http.Error(w, "Account is disabled", http.StatusForbidden)
+		return
+	}
+
+	authAttempts.WithLabelValues("passkey", "success").Inc()
+
+	claims, err := newClaims(user.ID, user.Username, 24*time.Hour)
+	if err != nil {
+		http.Error(w, "Failed to generate token", http.StatusInternalServerError)
+		return
+	}
+	markAuthenticated(claims, acrAAL1)
+	if userVerified {
+		claims.ACR = acrAAL2
+	}
+
+	token, err := as.signToken(claims)
+	if err != nil {
+		http.Error(w, "Failed to generate token", http.StatusInternalServerError)
+		return
+	}
+
+	// Track the device and alert the user about suspicious logins
+	as.assessLogin(r, user, claims)
+
+	response := LoginResponse{
+		Token: token,
+		User:  user,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(response)
+}
+
+func (as *AuthService) listPasskeysHandler(w http.ResponseWriter, r *http.Request) {
+	claims, err := as.authenticateRequest(r)
+	if err != nil {
+		http.Error(w, "Invalid token", http.StatusUnauthorized)
+		return
+	}
+
+	rows, err := as.db.Query(`
+		SELECT id, name, credential_id, COALESCE(transports, ''), created_at, last_used_at
+		FROM webauthn_credentials WHERE user_id = ? ORDER BY created_at
+	`, claims.UserID)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	passkeys := []Passkey{}
+	for rows.Next() {
+		var passkey Passkey
+		var transports string
+		var lastUsedAt sql.NullTime
+		if err := rows.Scan(&passkey.ID, &passkey.Name, &passkey.CredentialID, &transports, &passkey.CreatedAt, &lastUsedAt); err != nil {
+			http.Error(w, "Database scan error", http.StatusInternalServerError)
+			return
+		}
+		if transports != "" {
+			passkey.Transports = strings.Split(transports, ",")
+		}
+		passkey.LastUsedAt = nullTimePtr(lastUsedAt)
+		passkeys = append(passkeys, passkey)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(passkeys)
+}
+
+func (as *AuthService) renamePasskeyHandler(w http.ResponseWriter, r *http.Request) {
+	claims, err := as.authenticateRequest(r)
+	if err != nil {
+		http.Error(w, "Invalid token", http.StatusUnauthorized)
+		return
+	}
+
+	passkeyID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid passkey ID", http.StatusBadRequest)
+		return
+	}
+
+	var req PasskeyRenameRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	name, err := passkeyName(req.Name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	result, err := as.db.Exec("UPDATE webauthn_credentials SET name = ? WHERE id = ? AND user_id = ?", name, passkeyID, claims.UserID)
+	if err != nil {
+		http.Error(w, "Failed to rename passkey", http.StatusInternalServerError)
+		return
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		http.Error(w, "Passkey not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{"id": passkeyID, "name": name})
+}
+
+func (as *AuthService) deletePasskeyHandler(w http.ResponseWriter, r *http.Request) {
+	claims, err := as.authenticateRequest(r)
+	if err != nil {
+		http.Error(w, "Invalid token", http.StatusUnauthorized)
+		return
+	}
+
+	passkeyID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid passkey ID", http.StatusBadRequest)
+		return
+	}
+
+	result, err := as.db.Exec("DELETE FROM webauthn_credentials WHERE id = ? AND user_id = ?", passkeyID, claims.UserID)
+	if err != nil {
+		http.Error(w, "Failed to delete passkey", http.StatusInternalServerError)
+		return
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		http.Error(w, "Passkey not found", http.StatusNotFound)
+		return
+	}
+
+	as.recordAudit(r, claims.UserID, "passkey.delete", claims.UserID, map[string]interface{}{"passkey_id": passkeyID})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// verifyRegistration checks an attestation response (WebAuthn section 7.1)
+// and returns the credential ID, its COSE public key and the authenticator data
+func (as *AuthService) verifyRegistration(credential PasskeyCredential, userID int) (string, []byte, *authenticatorData, error) {
+	if credential.Type != "public-key" {
+		return "", nil, nil, fmt.Errorf("unsupported credential type")
+	}
+
+	clientDataJSON, err := decodeBase64URL(credential.Response.ClientDataJSON)
+	if err != nil {
+		return "", nil, nil, fmt.Errorf("malformed clientDataJSON")
+	}
+	challengeUserID, err := as.verifyClientData(clientDataJSON, "webauthn.create", "register")
+	if err != nil {
+		return "", nil, nil, err
+	}
+	if challengeUserID != userID {
+		return "", nil, nil, fmt.Errorf("challenge was issued to another user")
+	}
+
+	attestationObject, err := decodeBase64URL(credential.Response.AttestationObject)
+	if err != nil {
+		return "", nil, nil, fmt.Errorf("malformed attestationObject")
+	}
+	decoded, _, err := decodeCBOR(attestationObject)
+	if err != nil {
+		return "", nil, nil, fmt.Errorf("malformed attestationObject: %v", err)
+	}
+	attestation, ok := decoded.(map[interface{}]interface{})
+	if !ok {
+		return "", nil, nil, fmt.Errorf("malformed attestationObject")
+	}
+	rawAuthData, ok := attestation["authData"].([]byte)
+	if !ok {
+		return "", nil, nil, fmt.Errorf("attestationObject has no authData")
+	}
+
+	// We ask for no attestation, so whatever statement is present is not
+	// verified; the credential is trusted because the user is signed in
+	authData, err := parseAuthenticatorData(rawAuthData)
+	if err != nil {
+		return "", nil, nil, err
+	}
+	if err := as.checkAuthenticatorData(authData); err != nil {
+		return "", nil, nil, err
+	}
+	if authData.Flags&authDataAttestedCredential == 0 {
+		return "", nil, nil, fmt.Errorf("authenticator data has no credential")
+	}
+
+	rawID, err := decodeBase64URL(credential.RawID)
+	if err != nil || !bytes.Equal(rawID, authData.CredentialID) {
+		return "", nil, nil, fmt.Errorf("credential ID mismatch")
+	}
+	if _, _, err := parseCOSEKey(authData.PublicKey); err != nil {
+		return "", nil, nil, err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(authData.CredentialID), authData.PublicKey, authData, nil
+}
+
+// verifyAssertion checks an assertion response (WebAuthn section 7.2),
+// updates the credential's sign count and returns the user it belongs to and
+// whether the authenticator verified them
+func (as *AuthService) verifyAssertion(r *http.Request, credential PasskeyCredential) (int, bool, error) {
+	if credential.Type != "public-key" {
+		return 0, false, errPasskeyVerification
+	}
+
+	clientDataJSON, err := decodeBase64URL(credential.Response.ClientDataJSON)
+	if err != nil {
+		return 0, false, errPasskeyVerification
+	}
+	// Consume the challenge first so it can't be retried after a failure
+	challengeUserID, err := as.verifyClientData(clientDataJSON, "webauthn.get", "login")
+	if err != nil {
+		return 0, false, err
+	}
+
+	if credential.RawID == "" {
+		credential.RawID = credential.ID
+	}
+	rawID, err := decodeBase64URL(credential.RawID)
+	if err != nil {
+		return 0, false, errPasskeyVerification
+	}
+	credentialID := base64.RawURLEncoding.EncodeToString(rawID)
+
+	var id, userID int
+	var publicKey []byte
+	var storedCount uint32
+	err = as.db.QueryRow(`
+		SELECT id, user_id, public_key, sign_count FROM webauthn_credentials WHERE credential_id = ?
+	`, credentialID).Scan(&id, &userID, &publicKey, &storedCount)
+	if err != nil {
+		return 0, false, errPasskeyVerification
+	}
+
+	if challengeUserID != 0 && challengeUserID != userID {
+		return 0, false, errPasskeyVerification
+	}
+	if credential.Response.UserHandle != "" {
+		userHandle, err := decodeBase64URL(credential.Response.UserHandle)
+		if err != nil || !bytes.Equal(userHandle, passkeyUserHandle(userID)) {
+			return 0, false, errPasskeyVerification
+		}
+	}
+
+	rawAuthData, err := decodeBase64URL(credential.Response.AuthenticatorData)
+	if err != nil {
+		return 0, false, errPasskeyVerification
+	}
+	authData, err := parseAuthenticatorData(rawAuthData)
+	if err != nil {
+		return 0, false, err
+	}
+	if err := as.checkAuthenticatorData(authData); err != nil {
+		return 0, false, err
+	}
+
+	signature, err := decodeBase64URL(credential.Response.Signature)
+	if err != nil {
+		return 0, false, errPasskeyVerification
+	}
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	signed := append(append([]byte{}, rawAuthData...), clientDataHash[:]...)
+	if err := verifyCOSESignature(publicKey, signed, signature); err != nil {
+		return 0, false, err
+	}
+
+	// A counter that doesn't increase suggests a cloned authenticator.
+	// Authenticators that don't count always report zero. The check is part
+	// of the update so two assertions can't both use the same count.
+	result, err := as.db.Exec(`
+		UPDATE webauthn_credentials SET sign_count = ?, last_used_at = ?
+		WHERE id = ? AND (sign_count < ? OR (sign_count = 0 AND ? = 0))
+	`, authData.SignCount, time.Now().UTC(), id, authData.SignCount, authData.SignCount)
+	if err != nil {
+		return 0, false, err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		as.recordAudit(r, userID, "passkey.sign_count_regression", userID, map[string]interface{}{
+			"passkey_id":   id,
+			"stored_count": storedCount,
+			"sign_count":   authData.SignCount,
+		})
+		return 0, false, fmt.Errorf("sign count did not increase")
+	}
+	return userID, authData.Flags&authDataUserVerified != 0, nil
+}
+
+// verifyClientData checks the ceremony type and origin and consumes the
+// challenge, returning the user it was issued to (zero if none)
+func (as *AuthService) verifyClientData(clientDataJSON []byte, ceremonyType, ceremony string) (int, error) {
+	var clientData collectedClientData
+	if err := json.Unmarshal(clientDataJSON, &clientData); err != nil {
+		return 0, fmt.Errorf("malformed clientDataJSON")
+	}
+
+	userID, err := as.consumeWebAuthnChallenge(clientData.Challenge, ceremony)
+	if err != nil {
+		return 0, err
+	}
+
+	if clientData.Type != ceremonyType {
+		return 0, fmt.Errorf("unexpected client data type %q", clientData.Type)
+	}
+	if !as.webauthn.Origins[clientData.Origin] || clientData.CrossOrigin {
+		return 0, fmt.Errorf("origin %q is not allowed", clientData.Origin)
+	}
+	return userID, nil
+}
+
+// checkAuthenticatorData verifies the relying party and user presence
+func (as *AuthService) checkAuthenticatorData(authData *authenticatorData) error {
+	rpIDHash := sha256.Sum256([]byte(as.webauthn.RPID))
+	if !bytes.Equal(authData.RPIDHash, rpIDHash[:]) {
+		return fmt.Errorf("credential is for another relying party")
+	}
+	if authData.Flags&authDataUserPresent == 0 {
+		return fmt.Errorf("user was not present")
+	}
+	return nil
+}
+
+func (as *AuthService) newWebAuthnChallenge(ceremony string, userID int) (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	challenge := base64.RawURLEncoding.EncodeToString(b)
+
+	now := time.Now().UTC()
+	as.db.Exec("DELETE FROM webauthn_challenges WHERE expires_at < ?", now)
+
+	var owner interface{}
+	if userID != 0 {
+		owner = userID
+	}
+	_, err := as.db.Exec(`
+		INSERT INTO webauthn_challenges (challenge, ceremony, user_id, expires_at) VALUES (?, ?, ?, ?)
+	`, challenge, ceremony, owner, now.Add(webauthnChallengeTTL))
+	if err != nil {
+		return "", err
+	}
+	return challenge, nil
+}
+
+// consumeWebAuthnChallenge deletes the challenge so it can only be answered once
+func (as *AuthService) consumeWebAuthnChallenge(challenge, ceremony string) (int, error) {
+	var userID sql.NullInt64
+	var expiresAt time.Time
+	err := as.db.QueryRow(`
+		DELETE FROM webauthn_challenges WHERE challenge = ? AND ceremony = ?
+		RETURNING user_id, expires_at
+	`, challenge, ceremony).Scan(&userID, &expiresAt)
+	if err == sql.ErrNoRows {
+		return 0, fmt.Errorf("unknown or already used challenge")
+	}
+	if err != nil {
+		return 0, err
+	}
+	if time.Now().After(expiresAt) {
+		return 0, fmt.Errorf("challenge has expired")
+	}
+	return int(userID.Int64), nil
+}
+
+func (as *AuthService) userCredentialDescriptors(userID int) ([]credentialDescriptor, error) {
+	rows, err := as.db.Query(`
+		SELECT credential_id, COALESCE(transports, '') FROM webauthn_credentials WHERE user_id = ?
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	descriptors := []credentialDescriptor{}
+	for rows.Next() {
+		descriptor := credentialDescriptor{Type: "public-key"}
+		var transports string
+		if err := rows.Scan(&descriptor.ID, &transports); err != nil {
+			return nil, err
+		}
+		if transports != "" {
+			descriptor.Transports = strings.Split(transports, ",")
+		}
+		descriptors = append(descriptors, descriptor)
+	}
+	return descriptors, rows.Err()
+}
+
+// passkeyUserHandle is the WebAuthn user.id, which must not contain personal data
+func passkeyUserHandle(userID int) []byte {
+	return []byte(strconv.Itoa(userID))
+}
+
+func passkeyName(name string) (string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return "Passkey", nil
+	}
+	if len(name) > passkeyNameMaxLength {
+		return "", fmt.Errorf("Passkey name must be at most %d characters", passkeyNameMaxLength)
+	}
+	return name, nil
+}
+
+// parseAuthenticatorData parses the binary authenticator data (WebAuthn section 6.1)
+func parseAuthenticatorData(data []byte) (*authenticatorData, error) {
+	if len(data) < 37 {
+		return nil, fmt.Errorf("authenticator data is too short")
+	}
+
+	authData := &authenticatorData{
+		RPIDHash:  data[:32],
+		Flags:     data[32],
+		SignCount: binary.BigEndian.Uint32(data[33:37]),
+	}
+	if authData.Flags&authDataAttestedCredential == 0 {
+		return authData, nil
+	}
+
+	rest := data[37:]
+	if len(rest) < 18 {
+		return nil, fmt.Errorf("attested credential data is too short")
+	}
+	authData.AAGUID = rest[:16]
+	idLength := int(binary.BigEndian.Uint16(rest[16:18]))
+	rest = rest[18:]
+	if len(rest) < idLength {
+		return nil, fmt.Errorf("credential ID is truncated")
+	}
+	authData.CredentialID = rest[:idLength]
+	rest = rest[idLength:]
+
+	_, keyLength, err := decodeCBOR(rest)
+	if err != nil {
+		return nil, fmt.Errorf("malformed credential public key: %v", err)
+	}
+	authData.PublicKey = rest[:keyLength]
+	return authData, nil
+}
+
+// parseCOSEKey decodes an ES256, EdDSA (Ed25519) or RS256 COSE_Key (RFC 9053)
+func parseCOSEKey(data []byte) (crypto.PublicKey, int64, error) {
+	decoded, _, err := decodeCBOR(data)
+	if err != nil {
+		return nil, 0, fmt.Errorf("malformed credential public key: %v", err)
+	}
+	key, ok := decoded.(map[interface{}]interface{})
+	if !ok {
+		return nil, 0, fmt.Errorf("malformed credential public key")
+	}
+
+	kty, _ := key[int64(1)].(int64)
+	alg, _ := key[int64(3)].(int64)
+	switch alg {
+	case coseAlgES256:
+		crv, _ := key[int64(-1)].(int64)
+		x, _ := key[int64(-2)].([]byte)
+		y, _ := key[int64(-3)].([]byte)
+		if kty != 2 || crv != 1 || len(x) != 32 || len(y) != 32 {
+			return nil, 0, fmt.Errorf("invalid ES256 key")
+		}
+		// crypto/ecdh rejects points that are not on the curve
+		point := append(append([]byte{4}, x...), y...)
+		if _, err := ecdh.P256().NewPublicKey(point); err != nil {
+			return nil, 0, fmt.Errorf("invalid ES256 key")
+		}
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, alg, nil
+
+	case coseAlgEdDSA:
+		crv, _ := key[int64(-1)].(int64)
+		x, _ := key[int64(-2)].([]byte)
+		if kty != 1 || crv != 6 || len(x) != ed25519.PublicKeySize {
+			return nil, 0, fmt.Errorf("invalid EdDSA key")
+		}
+		return ed25519.PublicKey(x), alg, nil
+
+	case coseAlgRS256:
+		n, _ := key[int64(-1)].([]byte)
+		e, _ := key[int64(-2)].([]byte)
+		exponent := new(big.Int).SetBytes(e)
+		modulus := new(big.Int).SetBytes(n)
+		if kty != 3 || modulus.BitLen() < 2048 || !exponent.IsInt64() || exponent.Int64() < 3 || exponent.Int64() > 1<<31-1 {
+			return nil, 0, fmt.Errorf("invalid RS256 key")
+		}
+		return &rsa.PublicKey{N: modulus, E: int(exponent.Int64())}, alg, nil
+	}
+	return nil, 0, fmt.Errorf("unsupported key algorithm %d", alg)
+}
+
+func verifyCOSESignature(coseKey, message, signature []byte) error {
+	key, alg, err := parseCOSEKey(coseKey)
+	if err != nil {
+		return err
+	}
+
+	hash := sha256.Sum256(message)
+	valid := false
+	switch alg {
+	case coseAlgES256:
+		valid = ecdsa.VerifyASN1(key.(*ecdsa.PublicKey), hash[:], signature)
+	case coseAlgEdDSA:
+		valid = ed25519.Verify(key.(ed25519.PublicKey), message, signature)
+	case coseAlgRS256:
+		valid = rsa.VerifyPKCS1v15(key.(*rsa.PublicKey), crypto.SHA256, hash[:], signature) == nil
+	}
+	if !valid {
+		return errPasskeyVerification
+	}
+	return nil
+}
+
+// decodeBase64URL accepts base64url with or without padding
+func decodeBase64URL(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+}
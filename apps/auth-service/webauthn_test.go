@@ -0,0 +1,398 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+const (
+	testRPID   = "localhost"
+	testOrigin = "http://localhost:3000"
+)
+
+// softAuthenticator is an in-memory WebAuthn authenticator with ES256 keys
+type softAuthenticator struct {
+	origin      string
+	credentials map[string]*softCredential
+}
+
+type softCredential struct {
+	id         []byte
+	key        *ecdsa.PrivateKey
+	userHandle []byte
+	signCount  uint32
+}
+
+func newSoftAuthenticator() *softAuthenticator {
+	return &softAuthenticator{origin: testOrigin, credentials: map[string]*softCredential{}}
+}
+
+// create answers navigator.credentials.create() with a "none" attestation
+func (a *softAuthenticator) create(t *testing.T, options creationOptions) (PasskeyCredential, *softCredential) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cred := &softCredential{id: make([]byte, 16), key: key}
+	rand.Read(cred.id)
+	cred.userHandle, _ = decodeBase64URL(options.User.ID)
+	a.credentials[b64(cred.id)] = cred
+
+	coseKey := encodeTestCBOR(map[interface{}]interface{}{
+		int64(1):  int64(2),
+		int64(3):  int64(coseAlgES256),
+		int64(-1): int64(1),
+		int64(-2): padTo32(key.X.Bytes()),
+		int64(-3): padTo32(key.Y.Bytes()),
+	})
+
+	authData := a.authenticatorData(options.RP.ID, authDataUserPresent|authDataAttestedCredential, cred.signCount)
+	authData = append(authData, make([]byte, 16)...) // AAGUID
+	authData = binary.BigEndian.AppendUint16(authData, uint16(len(cred.id)))
+	authData = append(authData, cred.id...)
+	authData = append(authData, coseKey...)
+
+	attestationObject := encodeTestCBOR(map[interface{}]interface{}{
+		"fmt":      "none",
+		"attStmt":  map[interface{}]interface{}{},
+		"authData": authData,
+	})
+
+	var credential PasskeyCredential
+	credential.ID = b64(cred.id)
+	credential.RawID = b64(cred.id)
+	credential.Type = "public-key"
+	credential.Response.ClientDataJSON = b64(a.clientData("webauthn.create", options.Challenge))
+	credential.Response.AttestationObject = b64(attestationObject)
+	credential.Response.Transports = []string{"internal"}
+	return credential, cred
+}
+
+// get answers navigator.credentials.get() with the given credential
+func (a *softAuthenticator) get(t *testing.T, options requestOptions, cred *softCredential) PasskeyCredential {
+	t.Helper()
+
+	cred.signCount++
+	authData := a.authenticatorData(options.RPID, authDataUserPresent, cred.signCount)
+	clientDataJSON := a.clientData("webauthn.get", options.Challenge)
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	digest := sha256.Sum256(append(append([]byte{}, authData...), clientDataHash[:]...))
+	signature, err := ecdsa.SignASN1(rand.Reader, cred.key, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var credential PasskeyCredential
+	credential.ID = b64(cred.id)
+	credential.RawID = b64(cred.id)
+	credential.Type = "public-key"
+	credential.Response.ClientDataJSON = b64(clientDataJSON)
+	credential.Response.AuthenticatorData = b64(authData)
+	credential.Response.Signature = b64(signature)
+	credential.Response.UserHandle = b64(cred.userHandle)
+	return credential
+}
+
+func (a *softAuthenticator) authenticatorData(rpID string, flags byte, signCount uint32) []byte {
+	rpIDHash := sha256.Sum256([]byte(rpID))
+	data := append([]byte{}, rpIDHash[:]...)
+	data = append(data, flags)
+	return binary.BigEndian.AppendUint32(data, signCount)
+}
+
+func (a *softAuthenticator) clientData(ceremonyType, challenge string) []byte {
+	data, _ := json.Marshal(collectedClientData{Type: ceremonyType, Challenge: challenge, Origin: a.origin})
+	return data
+}
+
+func b64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func padTo32(b []byte) []byte {
+	return append(make([]byte, 32-len(b)), b...)
+}
+
+// encodeTestCBOR encodes the subset of CBOR the authenticator needs
+func encodeTestCBOR(value interface{}) []byte {
+	var buf bytes.Buffer
+	writeHead := func(major byte, n uint64) {
+		switch {
+		case n < 24:
+			buf.WriteByte(major<<5 | byte(n))
+		case n < 1<<8:
+			buf.Write([]byte{major<<5 | 24, byte(n)})
+		case n < 1<<16:
+			buf.WriteByte(major<<5 | 25)
+			binary.Write(&buf, binary.BigEndian, uint16(n))
+		default:
+			buf.WriteByte(major<<5 | 26)
+			binary.Write(&buf, binary.BigEndian, uint32(n))
+		}
+	}
+
+	switch v := value.(type) {
+	case int64:
+		if v >= 0 {
+			writeHead(0, uint64(v))
+		} else {
+			writeHead(1, uint64(-1-v))
+		}
+	case []byte:
+		writeHead(2, uint64(len(v)))
+		buf.Write(v)
+	case string:
+		writeHead(3, uint64(len(v)))
+		buf.WriteString(v)
+	case map[interface{}]interface{}:
+		writeHead(5, uint64(len(v)))
+		keys := make([]string, 0, len(v))
+		encoded := map[string][]byte{}
+		for key, item := range v {
+			k := string(encodeTestCBOR(key))
+			keys = append(keys, k)
+			encoded[k] = encodeTestCBOR(item)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			buf.WriteString(k)
+			buf.Write(encoded[k])
+		}
+	default:
+		panic(fmt.Sprintf("unsupported CBOR test value %T", value))
+	}
+	return buf.Bytes()
+}
+
+// passkeyTestServer runs the auth service against a fresh database
+type passkeyTestServer struct {
+	t     *testing.T
+	as    *AuthService
+	srv   *httptest.Server
+	token string
+}
+
+func newPasskeyTestServer(t *testing.T) *passkeyTestServer {
+	t.Helper()
+
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "auth.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if _, err := migrateDatabase(db, -1, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := seedDatabase(db); err != nil {
+		t.Fatal(err)
+	}
+
+	as := &AuthService{
+		db:        db,
+		jwtSecret: "test-secret",
+		issuer:    "http://auth.test",
+		audiences: []string{"auth-service"},
+		webauthn:  parseWebAuthnConfig(testRPID, testOrigin),
+		publicURL: "http://auth.test",
+	}
+	srv := httptest.NewServer(setupRoutes(as))
+	t.Cleanup(srv.Close)
+
+	ts := &passkeyTestServer{t: t, as: as, srv: srv}
+	var login LoginResponse
+	if status := ts.do("POST", "/api/auth/login", "", LoginRequest{Username: "admin", Password: "admin123"}, &login); status != http.StatusOK {
+		t.Fatalf("password login returned %d", status)
+	}
+	ts.token = login.Token
+	return ts
+}
+
+func (ts *passkeyTestServer) do(method, path, token string, body, out interface{}) int {
+	ts.t.Helper()
+
+	var payload bytes.Buffer
+	if body != nil {
+		json.NewEncoder(&payload).Encode(body)
+	}
+	req, _ := http.NewRequest(method, ts.srv.URL+path, &payload)
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		ts.t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if out != nil && resp.StatusCode < 300 {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			ts.t.Fatal(err)
+		}
+	}
+	return resp.StatusCode
+}
+
+func (ts *passkeyTestServer) register(authenticator *softAuthenticator, name string) (Passkey, *softCredential) {
+	ts.t.Helper()
+
+	var begin struct{ PublicKey creationOptions }
+	if status := ts.do("POST", "/api/auth/passkeys/register/begin", ts.token, nil, &begin); status != http.StatusOK {
+		ts.t.Fatalf("register begin returned %d", status)
+	}
+
+	credential, cred := authenticator.create(ts.t, begin.PublicKey)
+	var passkey Passkey
+	status := ts.do("POST", "/api/auth/passkeys/register/finish", ts.token, PasskeyRegisterRequest{Name: name, Credential: credential}, &passkey)
+	if status != http.StatusCreated {
+		ts.t.Fatalf("register finish returned %d", status)
+	}
+	return passkey, cred
+}
+
+func (ts *passkeyTestServer) beginLogin(username string) requestOptions {
+	ts.t.Helper()
+
+	var begin struct{ PublicKey requestOptions }
+	if status := ts.do("POST", "/api/auth/passkeys/login/begin", "", PasskeyLoginRequest{Username: username}, &begin); status != http.StatusOK {
+		ts.t.Fatalf("login begin returned %d", status)
+	}
+	return begin.PublicKey
+}
+
+func (ts *passkeyTestServer) finishLogin(credential PasskeyCredential) (LoginResponse, int) {
+	ts.t.Helper()
+
+	var login LoginResponse
+	status := ts.do("POST", "/api/auth/passkeys/login/finish", "", PasskeyLoginRequest{Credential: credential}, &login)
+	return login, status
+}
+
+func TestPasskeyRegistrationAndLogin(t *testing.T) {
+	ts := newPasskeyTestServer(t)
+	authenticator := newSoftAuthenticator()
+
+	passkey, cred := ts.register(authenticator, "Laptop")
+	if passkey.Name != "Laptop" || passkey.CredentialID != b64(cred.id) {
+		t.Fatalf("unexpected passkey %+v", passkey)
+	}
+
+	login, status := ts.finishLogin(authenticator.get(t, ts.beginLogin(""), cred))
+	if status != http.StatusOK {
+		t.Fatalf("passkey login returned %d", status)
+	}
+	if login.User.Username != "admin" || login.Token == "" {
+		t.Fatalf("unexpected login response %+v", login)
+	}
+	if status := ts.do("GET", "/api/auth/validate", login.Token, nil, nil); status != http.StatusOK {
+		t.Fatalf("token from passkey login is not valid: %d", status)
+	}
+
+	var passkeys []Passkey
+	ts.do("GET", "/api/auth/passkeys", ts.token, nil, &passkeys)
+	if len(passkeys) != 1 || passkeys[0].LastUsedAt == nil {
+		t.Fatalf("expected one used passkey, got %+v", passkeys)
+	}
+}
+
+func TestPasskeyMultipleNamedAndRemoval(t *testing.T) {
+	ts := newPasskeyTestServer(t)
+	authenticator := newSoftAuthenticator()
+
+	laptop, laptopCred := ts.register(authenticator, "Laptop")
+	_, phoneCred := ts.register(authenticator, "Phone")
+
+	options := ts.beginLogin("admin")
+	if len(options.AllowCredentials) != 2 {
+		t.Fatalf("expected 2 allowed credentials, got %d", len(options.AllowCredentials))
+	}
+
+	if status := ts.do("PATCH", fmt.Sprintf("/api/auth/passkeys/%d", laptop.ID), ts.token, PasskeyRenameRequest{Name: "Work laptop"}, nil); status != http.StatusOK {
+		t.Fatalf("rename returned %d", status)
+	}
+	if status := ts.do("DELETE", fmt.Sprintf("/api/auth/passkeys/%d", laptop.ID), ts.token, nil, nil); status != http.StatusNoContent {
+		t.Fatalf("delete returned %d", status)
+	}
+
+	if _, status := ts.finishLogin(authenticator.get(t, ts.beginLogin(""), laptopCred)); status != http.StatusUnauthorized {
+		t.Fatalf("removed passkey login returned %d", status)
+	}
+	if _, status := ts.finishLogin(authenticator.get(t, ts.beginLogin(""), phoneCred)); status != http.StatusOK {
+		t.Fatalf("remaining passkey login returned %d", status)
+	}
+
+	var passkeys []Passkey
+	ts.do("GET", "/api/auth/passkeys", ts.token, nil, &passkeys)
+	if len(passkeys) != 1 || passkeys[0].Name != "Phone" {
+		t.Fatalf("expected only the phone passkey, got %+v", passkeys)
+	}
+}
+
+func TestPasskeySignCountMustIncrease(t *testing.T) {
+	ts := newPasskeyTestServer(t)
+	authenticator := newSoftAuthenticator()
+	_, cred := ts.register(authenticator, "Key")
+
+	if _, status := ts.finishLogin(authenticator.get(t, ts.beginLogin(""), cred)); status != http.StatusOK {
+		t.Fatalf("first login returned %d", status)
+	}
+
+	// A clone of the authenticator would report a counter that was already seen
+	cred.signCount = 0
+	if _, status := ts.finishLogin(authenticator.get(t, ts.beginLogin(""), cred)); status != http.StatusUnauthorized {
+		t.Fatalf("login with a stale sign count returned %d", status)
+	}
+}
+
+func TestPasskeyAssertionChecks(t *testing.T) {
+	ts := newPasskeyTestServer(t)
+	authenticator := newSoftAuthenticator()
+	_, cred := ts.register(authenticator, "Key")
+
+	assertion := authenticator.get(t, ts.beginLogin(""), cred)
+	if _, status := ts.finishLogin(assertion); status != http.StatusOK {
+		t.Fatalf("login returned %d", status)
+	}
+	if _, status := ts.finishLogin(assertion); status != http.StatusUnauthorized {
+		t.Fatalf("replayed assertion returned %d", status)
+	}
+
+	phishing := &softAuthenticator{origin: "https://evil.example", credentials: authenticator.credentials}
+	if _, status := ts.finishLogin(phishing.get(t, ts.beginLogin(""), cred)); status != http.StatusUnauthorized {
+		t.Fatalf("assertion from another origin returned %d", status)
+	}
+
+	tampered := authenticator.get(t, ts.beginLogin(""), cred)
+	tampered.Response.Signature = b64([]byte("not a signature"))
+	if _, status := ts.finishLogin(tampered); status != http.StatusUnauthorized {
+		t.Fatalf("assertion with a bad signature returned %d", status)
+	}
+}
+
+func TestDecodeCBORRejectsMalformedInput(t *testing.T) {
+	for _, input := range [][]byte{
+		{},
+		{0x5a, 0xff, 0xff, 0xff, 0xff},  // byte string longer than the data
+		{0xbf},                          // indefinite-length map
+		{0xa1, 0x80, 0x01},              // array as map key
+		bytes.Repeat([]byte{0x81}, 100), // nesting too deep
+	} {
+		if _, _, err := decodeCBOR(input); err == nil {
+			t.Errorf("decodeCBOR(%x) succeeded", input)
+		}
+	}
+}
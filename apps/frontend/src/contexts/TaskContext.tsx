@@ -1,15 +1,24 @@
-import React, { createContext, useContext, useState, useEffect, ReactNode } from 'react';
+import React, { createContext, useContext, useState, useEffect, useRef, ReactNode } from 'react';
 import { apiClient, Task, CreateTaskRequest, UpdateTaskRequest } from '../services/api';
 
+interface TaskStats {
+  total: number;
+  pending: number;
+  inProgress: number;
+  completed: number;
+}
+
 interface TaskContextType {
   tasks: Task[];
   isLoading: boolean;
   error: string | null;
+  hasMoreTasks: boolean;
   fetchTasks: (status?: string, priority?: string) => Promise<void>;
+  loadMoreTasks: () => Promise<void>;
   createTask: (taskData: CreateTaskRequest) => Promise<void>;
   updateTask: (id: number, taskData: UpdateTaskRequest) => Promise<void>;
   deleteTask: (id: number) => Promise<void>;
-  getTaskStats: () => { total: number; pending: number; inProgress: number; completed: number };
+  getTaskStats: () => TaskStats;
 }
 
 const TaskContext = createContext<TaskContextType | undefined>(undefined);
@@ -30,14 +39,36 @@ export const TaskProvider: React.FC<TaskProviderProps> = ({ children }) => {
   const [tasks, setTasks] = useState<Task[]>([]);
   const [isLoading, setIsLoading] = useState(false);
   const [error, setError] = useState<string | null>(null);
+  const [nextCursor, setNextCursor] = useState<string | null>(null);
+  const [stats, setStats] = useState<TaskStats>({ total: 0, pending: 0, inProgress: 0, completed: 0 });
+  // The filters of the loaded pages, for loading more of them
+  const filters = useRef<{ status?: string; priority?: string }>({});
+
+  // Stats are counted by the service, since only some pages are loaded
+  const refreshStats = async () => {
+    try {
+      const [total, pending, inProgress, completed] = await Promise.all([
+        apiClient.countTasks(),
+        apiClient.countTasks('pending'),
+        apiClient.countTasks('in-progress'),
+        apiClient.countTasks('completed'),
+      ]);
+      setStats({ total, pending, inProgress, completed });
+    } catch (err) {
+      console.error('Error counting tasks:', err);
+    }
+  };
 
   const fetchTasks = async (status?: string, priority?: string) => {
     try {
       setError(null);
       setIsLoading(true);
       
-      const fetchedTasks = await apiClient.getTasks(status, priority);
-      setTasks(fetchedTasks);
+      filters.current = { status, priority };
+      const page = await apiClient.getTasks(status, priority);
+      setTasks(page.tasks);
+      setNextCursor(page.next_cursor);
+      refreshStats();
     } catch (err: any) {
       const errorMessage = err.response?.data?.message || 'Failed to fetch tasks';
       setError(errorMessage);
@@ -47,6 +78,22 @@ export const TaskProvider: React.FC<TaskProviderProps> = ({ children }) => {
     }
   };
 
+  const loadMoreTasks = async () => {
+    if (!nextCursor) return;
+    // The loaded tasks stay on screen while the next page loads
+    try {
+      setError(null);
+      const { status, priority } = filters.current;
+      const page = await apiClient.getTasks(status, priority, undefined, undefined, undefined, { cursor: nextCursor });
+      setTasks(prevTasks => [...prevTasks, ...page.tasks]);
+      setNextCursor(page.next_cursor);
+    } catch (err: any) {
+      const errorMessage = err.response?.data?.message || 'Failed to fetch tasks';
+      setError(errorMessage);
+      console.error('Error fetching tasks:', err);
+    }
+  };
+
   const createTask = async (taskData: CreateTaskRequest) => {
     try {
       setError(null);
@@ -54,6 +101,7 @@ export const TaskProvider: React.FC<TaskProviderProps> = ({ children }) => {
       
       const newTask = await apiClient.createTask(taskData);
       setTasks(prevTasks => [newTask, ...prevTasks]);
+      refreshStats();
     } catch (err: any) {
       const errorMessage = err.response?.data?.message || 'Failed to create task';
       setError(errorMessage);
@@ -72,6 +120,7 @@ export const TaskProvider: React.FC<TaskProviderProps> = ({ children }) => {
       setTasks(prevTasks => 
         prevTasks.map(task => task.id === id ? updatedTask : task)
       );
+      refreshStats();
     } catch (err: any) {
       const errorMessage = err.response?.data?.message || 'Failed to update task';
       setError(errorMessage);
@@ -88,6 +137,7 @@ export const TaskProvider: React.FC<TaskProviderProps> = ({ children }) => {
       
       await apiClient.deleteTask(id);
       setTasks(prevTasks => prevTasks.filter(task => task.id !== id));
+      refreshStats();
     } catch (err: any) {
       const errorMessage = err.response?.data?.message || 'Failed to delete task';
       setError(errorMessage);
@@ -97,14 +147,7 @@ export const TaskProvider: React.FC<TaskProviderProps> = ({ children }) => {
     }
   };
 
-  const getTaskStats = () => {
-    const total = tasks.length;
-    const pending = tasks.filter(task => task.status === 'pending').length;
-    const inProgress = tasks.filter(task => task.status === 'in-progress').length;
-    const completed = tasks.filter(task => task.status === 'completed').length;
-
-    return { total, pending, inProgress, completed };
-  };
+  const getTaskStats = () => stats;
 
   // Fetch tasks on mount
   useEffect(() => {
@@ -117,7 +160,9 @@ export const TaskProvider: React.FC<TaskProviderProps> = ({ children }) => {
     tasks,
     isLoading,
     error,
+    hasMoreTasks: nextCursor !== null,
     fetchTasks,
+    loadMoreTasks,
     createTask,
     updateTask,
     deleteTask,
@@ -2,7 +2,7 @@ import React, { useState } from 'react';
 import { useTasks } from '../contexts/TaskContext';
 
 const TaskList: React.FC = () => {
-  const { tasks, isLoading, error, fetchTasks, createTask, updateTask, deleteTask } = useTasks();
+  const { tasks, isLoading, error, hasMoreTasks, fetchTasks, loadMoreTasks, createTask, updateTask, deleteTask } = useTasks();
   const [showCreateForm, setShowCreateForm] = useState(false);
   const [editingTask, setEditingTask] = useState<number | null>(null);
   const [filters, setFilters] = useState({ status: '', priority: '' });
@@ -321,6 +321,11 @@ const TaskList: React.FC = () => {
               </div>
             ))
           )}
+          {hasMoreTasks && (
+            <button className="btn btn-secondary" onClick={() => loadMoreTasks()}>
+              Load more
+            </button>
+          )}
         </div>
       )}
     </div>
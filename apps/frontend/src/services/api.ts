@@ -34,19 +34,184 @@ export interface Task {
   user_id: number;
   created_at: string;
   updated_at: string;
+  due_at: string | null;
+  start_at: string | null;
+  timezone: string;
+  overdue: boolean;
+  blocked: boolean;
+  tags: Tag[];
+  assignees: UserRef[];
+  access: TaskAccess;
+  series_id?: number;
+  parent_id: number | null;
+  progress?: Progress;
+  subtasks?: Task[];
+  reminders?: Reminder[];
+  recurrence?: Recurrence;
+  links?: TaskLinks;
+}
+
+export interface LinkedTask {
+  link_id: number;
+  task_id: number;
+  title: string;
+  status: string;
+}
+
+export interface TaskLinks {
+  blocks: LinkedTask[];
+  blocked_by: LinkedTask[];
+  relates_to: LinkedTask[];
+}
+
+export interface Tag {
+  id: number;
+  name: string;
+  color: string;
+}
+
+export interface TagUsage extends Tag {
+  usage: number;
+}
+
+export type LinkType = 'blocks' | 'blocked_by' | 'relates_to';
+
+export interface UserRef {
+  user_id: number;
+  username: string;
+}
+
+export type TaskAccess = 'owner' | 'editor' | 'viewer';
+
+export interface Share {
+  user_id: number;
+  username: string;
+  role: 'viewer' | 'editor';
+  created_at: string;
+}
+
+export interface Comment {
+  id: number;
+  task_id: number;
+  user_id: number;
+  username: string;
+  body: string;
+  body_html: string;
+  mentions: UserRef[];
+  edits: number;
+  created_at: string;
+  updated_at: string | null;
+}
+
+export interface CommentEdit {
+  body: string;
+  body_html: string;
+  edited_at: string;
+}
+
+export interface Attachment {
+  id: number;
+  task_id: number;
+  user_id: number;
+  filename: string;
+  content_type: string;
+  size: number;
+  created_at: string;
+  url: string;
+  expires_at: string;
+}
+
+export interface CommentPage {
+  comments: Comment[];
+  next_cursor: string | null;
+}
+
+export interface Progress {
+  done: number;
+  total: number;
+  percent: number;
+}
+
+export type SubtaskPolicy = 'cascade' | 'block' | 'orphan';
+
+export interface Reminder {
+  id: number;
+  minutes_before?: number;
+  remind_at: string;
+  sent_at?: string;
+}
+
+export interface ReminderRequest {
+  minutes_before?: number;
+  at?: string;
+}
+
+export interface Recurrence {
+  series_id: number;
+  rrule: string;
+  recur_from: 'due' | 'completion';
+  timezone: string;
+  occurrence_at: string | null;
+  occurrences: number;
+  ended: boolean;
+  next_task_id?: number;
+  upcoming?: string[];
+}
+
+export interface RecurrenceRequest {
+  rrule: string;
+  recur_from?: 'due' | 'completion';
+}
+
+export interface TaskPage {
+  tasks: Task[];
+  next_cursor: string | null;
+  total?: number;
+}
+
+export interface TaskPageOptions {
+  cursor?: string | null;
+  limit?: number;
+  includeTotal?: boolean;
 }
 
 export interface CreateTaskRequest {
   title: string;
   description: string;
   priority: string;
+  due_at?: string;
+  start_at?: string;
+  timezone?: string;
+  reminders?: ReminderRequest[];
+  recurrence?: RecurrenceRequest;
+  parent_id?: number;
+  tags?: string[];
+  assignees?: string[];
 }
 
+// Schedule fields that are left out keep their value; '' clears a date
 export interface UpdateTaskRequest {
   title: string;
   description: string;
   status: string;
   priority: string;
+  due_at?: string;
+  start_at?: string;
+  timezone?: string;
+  reminders?: ReminderRequest[];
+  // 0 makes the task a top-level one
+  parent_id?: number;
+  tags?: string[];
+  // Usernames; left out, the assignees stay as they are
+  assignees?: string[];
+}
+
+// Narrows a task listing by who the tasks are assigned to, created by or
+// shared with
+export interface SharingFilter {
+  assignedTo?: 'me' | 'none' | number;
+  createdBy?: 'me' | number;
+  sharedWithMe?: boolean;
 }
 
 export interface Notification {
@@ -155,16 +320,42 @@ class ApiClient {
   }
 
   // Task Service Methods
-  async getTasks(status?: string, priority?: string): Promise<Task[]> {
+  // Returns one page; pass its next_cursor back in page.cursor for the next one
+  async getTasks(
+    status?: string,
+    priority?: string,
+    filter?: string,
+    tags?: string[],
+    sharing?: SharingFilter,
+    page?: TaskPageOptions
+  ): Promise<TaskPage> {
+    // Filters use the task query language, e.g. "status:pending sort:-updated"
+    const terms: string[] = [];
+    if (status) terms.push(`status:${status}`);
+    if (priority) terms.push(`priority:${priority}`);
+    if (filter) terms.push(filter);
+
     const params = new URLSearchParams();
-    if (status) params.append('status', status);
-    if (priority) params.append('priority', priority);
+    if (terms.length > 0) params.append('filter', terms.join(' '));
+    if (tags && tags.length > 0) params.append('tag', tags.join(','));
+    if (sharing?.assignedTo !== undefined) params.append('assigned_to', String(sharing.assignedTo));
+    if (sharing?.createdBy !== undefined) params.append('created_by', String(sharing.createdBy));
+    if (sharing?.sharedWithMe !== undefined) params.append('shared_with_me', String(sharing.sharedWithMe));
+
+    if (page?.limit) params.append('limit', String(page.limit));
+    if (page?.cursor) params.append('cursor', page.cursor);
+    if (page?.includeTotal) params.append('include_total', 'true');
 
-    const url = `/api/tasks${params.toString() ? `?${params.toString()}` : ''}`;
-    const response: AxiosResponse<Task[]> = await this.taskClient.get(url);
+    const response: AxiosResponse<TaskPage> = await this.taskClient.get(`/api/tasks?${params.toString()}`);
     return response.data;
   }
 
+  // Counts matching tasks without loading them
+  async countTasks(status?: string): Promise<number> {
+    const page = await this.getTasks(status, undefined, undefined, undefined, undefined, { limit: 1, includeTotal: true });
+    return page.total ?? page.tasks.length;
+  }
+
   async getTask(id: number): Promise<Task> {
     const response: AxiosResponse<Task> = await this.taskClient.get(`/api/tasks/${id}`);
     return response.data;
@@ -175,13 +366,141 @@ class ApiClient {
     return response.data;
   }
 
-  async updateTask(id: number, taskData: UpdateTaskRequest): Promise<Task> {
-    const response: AxiosResponse<Task> = await this.taskClient.put(`/api/tasks/${id}`, taskData);
+  // scope 'following' also applies the changes to later occurrences of a recurring task
+  async updateTask(id: number, taskData: UpdateTaskRequest, scope?: 'this' | 'following'): Promise<Task> {
+    const response: AxiosResponse<Task> = await this.taskClient.put(`/api/tasks/${id}`, taskData, {
+      params: scope ? { scope } : undefined,
+    });
+    return response.data;
+  }
+
+  async setRecurrence(id: number, recurrence: RecurrenceRequest): Promise<Task> {
+    const response: AxiosResponse<Task> = await this.taskClient.put(`/api/tasks/${id}/recurrence`, recurrence);
+    return response.data;
+  }
+
+  async endRecurrence(id: number): Promise<Task> {
+    const response: AxiosResponse<Task> = await this.taskClient.delete(`/api/tasks/${id}/recurrence`);
+    return response.data;
+  }
+
+  async skipOccurrence(id: number): Promise<Task> {
+    const response: AxiosResponse<Task> = await this.taskClient.post(`/api/tasks/${id}/skip`);
+    return response.data;
+  }
+
+  // subtasks overrides what the service does with the task's subtasks
+  async deleteTask(id: number, subtasks?: SubtaskPolicy): Promise<void> {
+    await this.taskClient.delete(`/api/tasks/${id}`, {
+      params: subtasks ? { subtasks } : undefined,
+    });
+  }
+
+  async getSubtasks(id: number): Promise<Task[]> {
+    const response: AxiosResponse<Task[]> = await this.taskClient.get(`/api/tasks/${id}/subtasks`);
+    return response.data;
+  }
+
+  async getTaskLinks(id: number): Promise<TaskLinks> {
+    const response: AxiosResponse<TaskLinks> = await this.taskClient.get(`/api/tasks/${id}/links`);
+    return response.data;
+  }
+
+  async linkTasks(id: number, type: LinkType, taskId: number): Promise<TaskLinks> {
+    const response: AxiosResponse<TaskLinks> = await this.taskClient.post(`/api/tasks/${id}/links`, { type, task_id: taskId });
+    return response.data;
+  }
+
+  async unlinkTasks(id: number, linkId: number): Promise<void> {
+    await this.taskClient.delete(`/api/tasks/${id}/links/${linkId}`);
+  }
+
+  async getShares(id: number): Promise<Share[]> {
+    const response: AxiosResponse<Share[]> = await this.taskClient.get(`/api/tasks/${id}/shares`);
+    return response.data;
+  }
+
+  async shareTask(id: number, username: string, role: Share['role']): Promise<Share> {
+    const response: AxiosResponse<Share> = await this.taskClient.post(`/api/tasks/${id}/shares`, { username, role });
+    return response.data;
+  }
+
+  async unshareTask(id: number, userId: number): Promise<void> {
+    await this.taskClient.delete(`/api/tasks/${id}/shares/${userId}`);
+  }
+
+  async getAttachments(id: number): Promise<Attachment[]> {
+    const response: AxiosResponse<Attachment[]> = await this.taskClient.get(`/api/tasks/${id}/attachments`);
+    return response.data;
+  }
+
+  async uploadAttachment(id: number, file: File): Promise<Attachment> {
+    const form = new FormData();
+    form.append('file', file);
+    const response: AxiosResponse<Attachment> = await this.taskClient.post(`/api/tasks/${id}/attachments`, form, {
+      headers: { 'Content-Type': 'multipart/form-data' },
+    });
+    return response.data;
+  }
+
+  // The attachment's url expires; this returns it with a fresh one
+  async getAttachment(id: number, attachmentId: number): Promise<Attachment> {
+    const response: AxiosResponse<Attachment> = await this.taskClient.get(`/api/tasks/${id}/attachments/${attachmentId}`);
+    return response.data;
+  }
+
+  async deleteAttachment(id: number, attachmentId: number): Promise<void> {
+    await this.taskClient.delete(`/api/tasks/${id}/attachments/${attachmentId}`);
+  }
+
+  async getComments(id: number, cursor?: string): Promise<CommentPage> {
+    const response: AxiosResponse<CommentPage> = await this.taskClient.get(`/api/tasks/${id}/comments`, {
+      params: cursor ? { cursor } : undefined,
+    });
+    return response.data;
+  }
+
+  async addComment(id: number, body: string): Promise<Comment> {
+    const response: AxiosResponse<Comment> = await this.taskClient.post(`/api/tasks/${id}/comments`, { body });
+    return response.data;
+  }
+
+  async editComment(id: number, commentId: number, body: string): Promise<Comment> {
+    const response: AxiosResponse<Comment> = await this.taskClient.put(`/api/tasks/${id}/comments/${commentId}`, { body });
+    return response.data;
+  }
+
+  async deleteComment(id: number, commentId: number): Promise<void> {
+    await this.taskClient.delete(`/api/tasks/${id}/comments/${commentId}`);
+  }
+
+  async getCommentHistory(id: number, commentId: number): Promise<CommentEdit[]> {
+    const response: AxiosResponse<CommentEdit[]> = await this.taskClient.get(`/api/tasks/${id}/comments/${commentId}/history`);
+    return response.data;
+  }
+
+  async getTags(): Promise<TagUsage[]> {
+    const response: AxiosResponse<TagUsage[]> = await this.taskClient.get('/api/tags');
+    return response.data;
+  }
+
+  async createTag(name: string, color?: string): Promise<TagUsage> {
+    const response: AxiosResponse<TagUsage> = await this.taskClient.post('/api/tags', { name, color });
+    return response.data;
+  }
+
+  async updateTag(id: number, changes: { name?: string; color?: string }): Promise<TagUsage> {
+    const response: AxiosResponse<TagUsage> = await this.taskClient.put(`/api/tags/${id}`, changes);
+    return response.data;
+  }
+
+  async mergeTag(id: number, into: number): Promise<TagUsage> {
+    const response: AxiosResponse<TagUsage> = await this.taskClient.post(`/api/tags/${id}/merge`, { into });
     return response.data;
   }
 
-  async deleteTask(id: number): Promise<void> {
-    await this.taskClient.delete(`/api/tasks/${id}`);
+  async deleteTag(id: number): Promise<void> {
+    await this.taskClient.delete(`/api/tags/${id}`);
   }
 
   // Notification Service Methods
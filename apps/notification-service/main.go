@@ -3,10 +3,14 @@ package main
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
@@ -40,8 +44,10 @@ type WebhookRequest struct {
 
 // NotificationService handles notification operations
 type NotificationService struct {
-	corsOrigins string
-	webhooks    map[string][]string // event type -> webhook URLs
+	corsOrigins    string
+	authServiceURL string
+	audience       string              // tokens must be issued for this audience
+	webhooks       map[string][]string // event type -> webhook URLs
 }
 
 // Claims represents JWT claims
@@ -55,11 +61,15 @@ func main() {
 	// Get configuration from environment variables
 	port := getEnv("PORT", "8082")
 	corsOrigins := getEnv("CORS_ORIGINS", "http://localhost:3000")
+	authServiceURL := getEnv("AUTH_SERVICE_URL", "http://localhost:8080")
+	audience := getEnv("JWT_AUDIENCE", "notification-service")
 
 	// Create notification service
 	notificationService := &NotificationService{
-		corsOrigins: corsOrigins,
-		webhooks:    make(map[string][]string),
+		corsOrigins:    corsOrigins,
+		authServiceURL: authServiceURL,
+		audience:       audience,
+		webhooks:       make(map[string][]string),
 	}
 
 	// Setup routes
@@ -68,6 +78,8 @@ func main() {
 	// Start server
 	log.Printf("Notification service starting on port %s", port)
 	log.Printf("CORS Origins: %s", corsOrigins)
+	log.Printf("Auth Service URL: %s", authServiceURL)
+	log.Printf("Token audience: %s", audience)
 
 	if err := http.ListenAndServe(":"+port, router); err != nil {
 		log.Fatal("Server failed to start:", err)
@@ -83,11 +95,11 @@ func setupRoutes(ns *NotificationService) *mux.Router {
 	// Health check endpoint
 	router.HandleFunc("/health", healthCheck).Methods("GET")
 
-	// Notification endpoints
-	router.HandleFunc("/api/notifications", ns.getNotificationsHandler).Methods("GET")
-	router.HandleFunc("/api/notifications", ns.createNotificationHandler).Methods("POST")
-	router.HandleFunc("/api/notifications/{id}/read", ns.markAsReadHandler).Methods("PUT")
-	router.HandleFunc("/api/notifications/read-all", ns.markAllAsReadHandler).Methods("PUT")
+	// Notification endpoints (users read their notifications; services create them)
+	router.HandleFunc("/api/notifications", ns.authMiddleware(ns.getNotificationsHandler)).Methods("GET")
+	router.HandleFunc("/api/notifications", ns.serviceMiddleware(ns.createNotificationHandler)).Methods("POST")
+	router.HandleFunc("/api/notifications/{id}/read", ns.authMiddleware(ns.markAsReadHandler)).Methods("PUT")
+	router.HandleFunc("/api/notifications/read-all", ns.authMiddleware(ns.markAllAsReadHandler)).Methods("PUT")
 
 	// Webhook endpoints
 	router.HandleFunc("/api/webhooks", ns.registerWebhookHandler).Methods("POST")
@@ -127,6 +139,151 @@ func healthCheck(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+func (ns *NotificationService) authMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		tokenString := r.Header.Get("Authorization")
+		if tokenString == "" {
+			http.Error(w, "Authorization header required", http.StatusUnauthorized)
+			return
+		}
+
+		// Remove "Bearer " prefix if present
+		if len(tokenString) > 7 && tokenString[:7] == "Bearer " {
+			tokenString = tokenString[7:]
+		}
+
+		// Validate token with auth service
+		token, err := ns.validateToken(tokenString, requiredScope(r))
+		if err == errInsufficientScope {
+			http.Error(w, "Insufficient token scope", http.StatusForbidden)
+			return
+		}
+		if err != nil || token.UserID == 0 {
+			http.Error(w, "Invalid token", http.StatusUnauthorized)
+			return
+		}
+
+		// Add user ID to request context
+		r.Header.Set("X-User-ID", strconv.Itoa(token.UserID))
+		next.ServeHTTP(w, r)
+	}
+}
+
+// serviceMiddleware lets services create notifications. They need a token
+// issued to them, by token exchange or the client credentials grant, that
+// explicitly grants notifications:write; users' own tokens are refused even
+// though they are otherwise unrestricted.
+func (ns *NotificationService) serviceMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		tokenString := r.Header.Get("Authorization")
+		if tokenString == "" {
+			http.Error(w, "Authorization header required", http.StatusUnauthorized)
+			return
+		}
+
+		// Remove "Bearer " prefix if present
+		if len(tokenString) > 7 && tokenString[:7] == "Bearer " {
+			tokenString = tokenString[7:]
+		}
+
+		token, err := ns.validateToken(tokenString, "notifications:write")
+		if err == errInsufficientScope {
+			http.Error(w, "Insufficient token scope", http.StatusForbidden)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Invalid token", http.StatusUnauthorized)
+			return
+		}
+		if token.ClientID == "" || !hasScope(token.Scope, "notifications:write") {
+			http.Error(w, "A service token with the notifications:write scope is required", http.StatusForbidden)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	}
+}
+
+// errInsufficientScope means the token is valid but down-scoped below what
+// the request needs
+var errInsufficientScope = errors.New("insufficient token scope")
+
+// requiredScope is the scope a down-scoped token needs for the request.
+// Tokens without a scope claim are accepted for every request.
+func requiredScope(r *http.Request) string {
+	if r.Method == http.MethodGet {
+		return "notifications:read"
+	}
+	return "notifications:write"
+}
+
+// validatedToken is what the auth service reports about a valid token
+type validatedToken struct {
+	Valid    bool     `json:"valid"`
+	UserID   int      `json:"user_id"` // 0 for service tokens
+	Audience []string `json:"aud"`
+	Scope    string   `json:"scope"`     // empty for unrestricted tokens
+	ClientID string   `json:"client_id"` // set for tokens issued to a service
+}
+
+func (ns *NotificationService) validateToken(tokenString, scope string) (*validatedToken, error) {
+	// Call auth service to validate token for our audience
+	req, err := http.NewRequest("GET", ns.authServiceURL+"/api/auth/validate?audience="+url.QueryEscape(ns.audience)+"&scope="+url.QueryEscape(scope), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Authorization", "Bearer "+tokenString)
+
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusForbidden {
+		return nil, errInsufficientScope
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("token validation failed")
+	}
+
+	var validationResponse validatedToken
+	if err := json.NewDecoder(resp.Body).Decode(&validationResponse); err != nil {
+		return nil, err
+	}
+
+	if !validationResponse.Valid {
+		return nil, fmt.Errorf("invalid token")
+	}
+
+	if !hasAudience(validationResponse.Audience, ns.audience) {
+		return nil, fmt.Errorf("token not issued for %s", ns.audience)
+	}
+
+	return &validationResponse, nil
+}
+
+func hasAudience(audience []string, want string) bool {
+	for _, aud := range audience {
+		if aud == want {
+			return true
+		}
+	}
+	return false
+}
+
+// hasScope reports whether a space-separated scope lists the given one
+func hasScope(scope, want string) bool {
+	for _, s := range strings.Fields(scope) {
+		if s == want {
+			return true
+		}
+	}
+	return false
+}
+
 func (ns *NotificationService) getNotificationsHandler(w http.ResponseWriter, r *http.Request) {
 	// For demo purposes, return mock notifications
 	// In a real application, this would query a database
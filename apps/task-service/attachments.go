@@ -0,0 +1,563 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Attachment limits. The upload size and allowed types are configurable.
+const (
+	defaultAttachmentMaxSize = 10 << 20
+	maxAttachmentsPerTask    = 50
+	maxFilenameLength        = 255
+	// Multipart bodies are allowed this much on top of the file itself
+	multipartOverhead = 64 << 10
+	// deletedBlobBatchSize caps the blobs purgeDeletedBlobs removes per run
+	deletedBlobBatchSize = 100
+)
+
+// defaultAttachmentTypes are the MIME types ATTACHMENT_TYPES defaults to:
+// images, PDFs, plain text and office documents
+const defaultAttachmentTypes = "image/png,image/jpeg,image/gif,image/webp,application/pdf,text/plain,text/csv," +
+	"application/zip,application/msword,application/vnd.ms-excel," +
+	"application/vnd.openxmlformats-officedocument.wordprocessingml.document," +
+	"application/vnd.openxmlformats-officedocument.spreadsheetml.sheet," +
+	"application/vnd.openxmlformats-officedocument.presentationml.presentation"
+
+// Attachment is a file attached to a task. URL downloads it without a token
+// until ExpiresAt.
+type Attachment struct {
+	ID          int       `json:"id"`
+	TaskID      int       `json:"task_id"`
+	UserID      int       `json:"user_id"`
+	Filename    string    `json:"filename"`
+	ContentType string    `json:"content_type"`
+	Size        int64     `json:"size"`
+	CreatedAt   time.Time `json:"created_at"`
+	URL         string    `json:"url"`
+	ExpiresAt   time.Time `json:"expires_at"`
+	storageKey  string
+}
+
+// attachmentConfig is how attachments are stored, limited and downloaded
+type attachmentConfig struct {
+	store     BlobStore
+	maxSize   int64
+	types     []string // MIME types, or type/* for all subtypes
+	urlTTL    time.Duration
+	urlKey    []byte // signs download URLs
+	publicURL string // the service's external URL; the request's host when empty
+}
+
+// parseAttachmentTypes parses a comma-separated list of MIME types
+func parseAttachmentTypes(value string) ([]string, error) {
+	var types []string
+	for _, t := range strings.Split(value, ",") {
+		t = strings.ToLower(strings.TrimSpace(t))
+		if t == "" {
+			continue
+		}
+		if !strings.Contains(t, "/") {
+			return nil, fmt.Errorf("%q is not a MIME type", t)
+		}
+		types = append(types, t)
+	}
+	if len(types) == 0 {
+		return nil, errors.New("no MIME types given")
+	}
+	return types, nil
+}
+
+// attachmentURLKey is the key download URLs are signed with. Without a
+// configured secret, which is only allowed in development, a random one is
+// used, and URLs stop working when the service restarts and can only be used
+// on the replica that issued them.
+func attachmentURLKey(secret string) []byte {
+	if secret != "" {
+		return []byte(secret)
+	}
+	log.Printf("ATTACHMENT_URL_SECRET is not set; attachment URLs are only valid until restart")
+	key := make([]byte, 32)
+	rand.Read(key)
+	return key
+}
+
+func (c attachmentConfig) allows(contentType string) bool {
+	for _, t := range c.types {
+		if t == contentType || strings.HasSuffix(t, "/*") && strings.HasPrefix(contentType, strings.TrimSuffix(t, "*")) {
+			return true
+		}
+	}
+	return false
+}
+
+// uploadContentType is the MIME type of an uploaded file: the type its part
+// declares, or the one its extension implies
+func uploadContentType(declared, filename string) string {
+	mediaType, _, err := mime.ParseMediaType(declared)
+	if err != nil || mediaType == "application/octet-stream" {
+		mediaType, _, _ = mime.ParseMediaType(mime.TypeByExtension(filepath.Ext(filename)))
+	}
+	if mediaType == "" {
+		return "application/octet-stream"
+	}
+	return strings.ToLower(mediaType)
+}
+
+// checkContent checks that the start of a file is what its type says, so an
+// HTML page can't be uploaded as an image or text file
+func checkContent(contentType string, head []byte) error {
+	sniffed, _, _ := mime.ParseMediaType(http.DetectContentType(head))
+	if sniffed == "text/html" || sniffed == "text/xml" {
+		return fmt.Errorf("file content doesn't match %s", contentType)
+	}
+	if strings.HasPrefix(contentType, "image/") && sniffed != contentType {
+		return fmt.Errorf("file content doesn't match %s", contentType)
+	}
+	return nil
+}
+
+// cleanFilename keeps the base name of an uploaded file, without control
+// characters
+func cleanFilename(name string) string {
+	name = filepath.Base(strings.ReplaceAll(name, "\\", "/"))
+	name = strings.Map(func(r rune) rune {
+		if r < 0x20 || r == 0x7f {
+			return -1
+		}
+		return r
+	}, name)
+	if name == "." || name == "/" || name == "" {
+		name = "attachment"
+	}
+	if runes := []rune(name); len(runes) > maxFilenameLength {
+		name = string(runes[len(runes)-maxFilenameLength:])
+	}
+	return name
+}
+
+// newStorageKey returns a random key for an attachment of a task. File
+// names aren't used, so they never reach the store.
+func newStorageKey(taskID int) string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return fmt.Sprintf("tasks/%d/%s", taskID, hex.EncodeToString(b))
+}
+
+// signAttachment returns the signature of a download URL
+func (c attachmentConfig) signAttachment(id int, expires int64) string {
+	mac := hmac.New(sha256.New, c.urlKey)
+	fmt.Fprintf(mac, "attachment:%d:%d", id, expires)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// setDownloadURL gives an attachment a fresh signed download URL
+func (c attachmentConfig) setDownloadURL(r *http.Request, attachment *Attachment, now time.Time) {
+	base := c.publicURL
+	if base == "" {
+		scheme := "http"
+		if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+			scheme = "https"
+		}
+		base = scheme + "://" + r.Host
+	}
+
+	attachment.ExpiresAt = now.Add(c.urlTTL).Truncate(time.Second).UTC()
+	expires := attachment.ExpiresAt.Unix()
+	attachment.URL = fmt.Sprintf("%s/api/attachments/%d/content?%s", strings.TrimRight(base, "/"), attachment.ID, url.Values{
+		"expires":   {strconv.FormatInt(expires, 10)},
+		"signature": {c.signAttachment(attachment.ID, expires)},
+	}.Encode())
+}
+
+const attachmentColumns = "id, task_id, user_id, filename, content_type, size, created_at, storage_key"
+
+func scanAttachment(row rowScanner) (Attachment, error) {
+	var attachment Attachment
+	err := row.Scan(&attachment.ID, &attachment.TaskID, &attachment.UserID, &attachment.Filename,
+		&attachment.ContentType, &attachment.Size, &attachment.CreatedAt, &attachment.storageKey)
+	return attachment, err
+}
+
+// purgeDeletedBlobs removes the blobs of deleted attachments from the store.
+// deleteTask queues them, as the store can't take part in its transaction;
+// ones that fail stay queued for the scheduler's next run.
+func (ts *TaskService) purgeDeletedBlobs() (int, error) {
+	rows, err := ts.db.Query("SELECT storage_key FROM deleted_blobs ORDER BY deleted_at LIMIT ?", deletedBlobBatchSize)
+	if err != nil {
+		return 0, err
+	}
+	var keys []string
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		keys = append(keys, key)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	purged := 0
+	for _, key := range keys {
+		if err := ts.attachments.store.Delete(key); err != nil {
+			return purged, fmt.Errorf("blob %s: %v", key, err)
+		}
+		if _, err := ts.db.Exec("DELETE FROM deleted_blobs WHERE storage_key = ?", key); err != nil {
+			return purged, err
+		}
+		purged++
+	}
+	return purged, nil
+}
+
+// purgeDeletedBlobsAsync removes deleted blobs without blocking the request
+func (ts *TaskService) purgeDeletedBlobsAsync() {
+	go func() {
+		if _, err := ts.purgeDeletedBlobs(); err != nil {
+			log.Printf("Failed to delete attachment blobs: %v", err)
+		}
+	}()
+}
+
+func (ts *TaskService) getAttachmentsHandler(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.Atoi(r.Header.Get("X-User-ID"))
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+	taskID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid task ID", http.StatusBadRequest)
+		return
+	}
+
+	if _, err := ts.loadTask(taskID, userID); err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Task not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	rows, err := ts.db.Query("SELECT "+attachmentColumns+" FROM task_attachments WHERE task_id = ? ORDER BY id", taskID)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	now := time.Now()
+	attachments := []Attachment{}
+	for rows.Next() {
+		attachment, err := scanAttachment(rows)
+		if err != nil {
+			http.Error(w, "Database scan error", http.StatusInternalServerError)
+			return
+		}
+		ts.attachments.setDownloadURL(r, &attachment, now)
+		attachments = append(attachments, attachment)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(attachments)
+}
+
+// uploadAttachmentHandler stores the multipart "file" field of a request as
+// an attachment
+func (ts *TaskService) uploadAttachmentHandler(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.Atoi(r.Header.Get("X-User-ID"))
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+	taskID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid task ID", http.StatusBadRequest)
+		return
+	}
+
+	task, err := ts.loadTask(taskID, userID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Task not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if !task.allows(accessEditor) {
+		http.Error(w, "You can't edit this task", http.StatusForbidden)
+		return
+	}
+
+	var count int
+	err = ts.db.QueryRow("SELECT COUNT(*) FROM task_attachments WHERE task_id = ?", taskID).Scan(&count)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if count >= maxAttachmentsPerTask {
+		http.Error(w, fmt.Sprintf("A task can have at most %d attachments", maxAttachmentsPerTask), http.StatusConflict)
+		return
+	}
+
+	// Files past the first megabyte are buffered on disk
+	tooLarge := fmt.Sprintf("File must be at most %d bytes", ts.attachments.maxSize)
+	r.Body = http.MaxBytesReader(w, r.Body, ts.attachments.maxSize+multipartOverhead)
+	if err := r.ParseMultipartForm(1 << 20); err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			http.Error(w, tooLarge, http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(w, "Invalid multipart body", http.StatusBadRequest)
+		return
+	}
+	defer r.MultipartForm.RemoveAll()
+
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		http.Error(w, "file is required", http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+
+	if header.Size > ts.attachments.maxSize {
+		http.Error(w, tooLarge, http.StatusRequestEntityTooLarge)
+		return
+	}
+	if header.Size == 0 {
+		http.Error(w, "File is empty", http.StatusBadRequest)
+		return
+	}
+
+	filename := cleanFilename(header.Filename)
+	contentType := uploadContentType(header.Header.Get("Content-Type"), filename)
+	if !ts.attachments.allows(contentType) {
+		http.Error(w, "Files of type "+contentType+" are not allowed", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	head := make([]byte, 512)
+	n, _ := io.ReadFull(file, head)
+	if err := checkContent(contentType, head[:n]); err != nil {
+		http.Error(w, "File content doesn't match its type", http.StatusUnsupportedMediaType)
+		return
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		http.Error(w, "Failed to store attachment", http.StatusInternalServerError)
+		return
+	}
+
+	key := newStorageKey(taskID)
+	if err := ts.attachments.store.Put(key, file, header.Size, contentType); err != nil {
+		log.Printf("Failed to store attachment for task %d: %v", taskID, err)
+		http.Error(w, "Failed to store attachment", http.StatusBadGateway)
+		return
+	}
+
+	result, err := ts.db.Exec(`
+		INSERT INTO task_attachments (task_id, user_id, filename, content_type, size, storage_key)
+		VALUES (?, ?, ?, ?, ?, ?)
+	`, taskID, userID, filename, contentType, header.Size, key)
+	if err != nil {
+		ts.attachments.store.Delete(key)
+		http.Error(w, "Failed to create attachment", http.StatusInternalServerError)
+		return
+	}
+	attachmentID, _ := result.LastInsertId()
+
+	attachment, err := scanAttachment(ts.db.QueryRow("SELECT "+attachmentColumns+" FROM task_attachments WHERE id = ?", attachmentID))
+	if err != nil {
+		http.Error(w, "Failed to retrieve created attachment", http.StatusInternalServerError)
+		return
+	}
+	ts.attachments.setDownloadURL(r, &attachment, time.Now())
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(attachment)
+}
+
+func (ts *TaskService) getAttachmentHandler(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.Atoi(r.Header.Get("X-User-ID"))
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+	vars := mux.Vars(r)
+	taskID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid task ID", http.StatusBadRequest)
+		return
+	}
+	attachmentID, err := strconv.Atoi(vars["attachmentId"])
+	if err != nil {
+		http.Error(w, "Invalid attachment ID", http.StatusBadRequest)
+		return
+	}
+
+	if _, err := ts.loadTask(taskID, userID); err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Task not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	attachment, err := scanAttachment(ts.db.QueryRow(`
+		SELECT `+attachmentColumns+` FROM task_attachments WHERE id = ? AND task_id = ?
+	`, attachmentID, taskID))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Attachment not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	ts.attachments.setDownloadURL(r, &attachment, time.Now())
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(attachment)
+}
+
+func (ts *TaskService) deleteAttachmentHandler(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.Atoi(r.Header.Get("X-User-ID"))
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+	vars := mux.Vars(r)
+	taskID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid task ID", http.StatusBadRequest)
+		return
+	}
+	attachmentID, err := strconv.Atoi(vars["attachmentId"])
+	if err != nil {
+		http.Error(w, "Invalid attachment ID", http.StatusBadRequest)
+		return
+	}
+
+	task, err := ts.loadTask(taskID, userID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Task not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if !task.allows(accessEditor) {
+		http.Error(w, "You can't edit this task", http.StatusForbidden)
+		return
+	}
+
+	tx, err := ts.db.Begin()
+	if err != nil {
+		http.Error(w, "Failed to delete attachment", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		INSERT OR IGNORE INTO deleted_blobs (storage_key)
+		SELECT storage_key FROM task_attachments WHERE id = ? AND task_id = ?
+	`, attachmentID, taskID)
+	if err != nil {
+		http.Error(w, "Failed to delete attachment", http.StatusInternalServerError)
+		return
+	}
+	result, err := tx.Exec("DELETE FROM task_attachments WHERE id = ? AND task_id = ?", attachmentID, taskID)
+	if err != nil {
+		http.Error(w, "Failed to delete attachment", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		http.Error(w, "Attachment not found", http.StatusNotFound)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Failed to delete attachment", http.StatusInternalServerError)
+		return
+	}
+	ts.purgeDeletedBlobsAsync()
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// downloadAttachmentHandler serves an attachment to anyone with a signed,
+// unexpired URL. Files are always served as downloads, never rendered.
+func (ts *TaskService) downloadAttachmentHandler(w http.ResponseWriter, r *http.Request) {
+	attachmentID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid attachment ID", http.StatusBadRequest)
+		return
+	}
+	query := r.URL.Query()
+	expires, err := strconv.ParseInt(query.Get("expires"), 10, 64)
+	if err != nil || !hmac.Equal([]byte(query.Get("signature")), []byte(ts.attachments.signAttachment(attachmentID, expires))) {
+		http.Error(w, "Invalid signature", http.StatusForbidden)
+		return
+	}
+	if time.Now().Unix() > expires {
+		http.Error(w, "Link has expired", http.StatusForbidden)
+		return
+	}
+
+	attachment, err := scanAttachment(ts.db.QueryRow("SELECT "+attachmentColumns+" FROM task_attachments WHERE id = ?", attachmentID))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Attachment not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	blob, err := ts.attachments.store.Get(attachment.storageKey)
+	if err != nil {
+		if err == errBlobNotFound {
+			http.Error(w, "Attachment not found", http.StatusNotFound)
+			return
+		}
+		log.Printf("Failed to read attachment %d: %v", attachment.ID, err)
+		http.Error(w, "Failed to read attachment", http.StatusBadGateway)
+		return
+	}
+	defer blob.Close()
+
+	w.Header().Set("Content-Type", attachment.ContentType)
+	w.Header().Set("Content-Length", strconv.FormatInt(attachment.Size, 10))
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": attachment.Filename}))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Cache-Control", fmt.Sprintf("private, max-age=%d", expires-time.Now().Unix()))
+	w.WriteHeader(http.StatusOK)
+	io.Copy(w, blob)
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// errBlobNotFound is returned by BlobStore.Get for a key with no blob
+var errBlobNotFound = errors.New("blob not found")
+
+// BlobStore stores attachment contents by key. Keys are generated by the
+// service and are slash-separated, like tasks/12/3f9c….
+type BlobStore interface {
+	Put(key string, r io.Reader, size int64, contentType string) error
+	Get(key string) (io.ReadCloser, error)
+	// Delete removes a blob; deleting a missing one is not an error
+	Delete(key string) error
+}
+
+// newBlobStore builds the store ATTACHMENT_STORE selects from the
+// environment
+func newBlobStore() (BlobStore, string, error) {
+	switch kind := getEnv("ATTACHMENT_STORE", "local"); kind {
+	case "local":
+		dir := getEnv("ATTACHMENT_DIR", "./data/attachments")
+		store, err := newLocalBlobStore(dir)
+		return store, "local (" + dir + ")", err
+	case "s3":
+		store, err := newS3BlobStore(
+			os.Getenv("S3_ENDPOINT"),
+			getEnv("S3_REGION", "us-east-1"),
+			os.Getenv("S3_BUCKET"),
+			os.Getenv("S3_ACCESS_KEY_ID"),
+			os.Getenv("S3_SECRET_ACCESS_KEY"),
+		)
+		if err != nil {
+			return nil, "", err
+		}
+		return store, "s3 (" + store.bucketURL() + ")", nil
+	default:
+		return nil, "", fmt.Errorf("must be local or s3, not %q", kind)
+	}
+}
+
+// localBlobStore keeps blobs as files under a directory
+type localBlobStore struct {
+	dir string
+}
+
+func newLocalBlobStore(dir string) (*localBlobStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create attachment directory: %v", err)
+	}
+	return &localBlobStore{dir: dir}, nil
+}
+
+func (s *localBlobStore) path(key string) (string, error) {
+	for _, part := range strings.Split(key, "/") {
+		if part == "" || part == "." || part == ".." {
+			return "", fmt.Errorf("invalid blob key %q", key)
+		}
+	}
+	return filepath.Join(s.dir, filepath.FromSlash(key)), nil
+}
+
+// Put writes the blob to a temporary file and renames it into place, so
+// readers never see a partial blob
+func (s *localBlobStore) Put(key string, r io.Reader, size int64, contentType string) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".upload-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	n, err := io.Copy(tmp, r)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if n != size {
+		return fmt.Errorf("wrote %d bytes of %d", n, size)
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func (s *localBlobStore) Get(key string) (io.ReadCloser, error) {
+	path, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, errBlobNotFound
+	}
+	return f, err
+}
+
+func (s *localBlobStore) Delete(key string) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// s3BlobStore keeps blobs in an S3 bucket, or one of an S3-compatible store
+// such as MinIO, signing requests with AWS Signature Version 4. With an
+// endpoint, buckets are addressed by path (endpoint/bucket/key); without
+// one, AWS's virtual-hosted bucket.s3.region.amazonaws.com is used.
+type s3BlobStore struct {
+	endpoint  *url.URL
+	pathStyle bool
+	region    string
+	bucket    string
+	accessKey string
+	secretKey string
+	client    *http.Client
+	now       func() time.Time
+}
+
+func newS3BlobStore(endpoint, region, bucket, accessKey, secretKey string) (*s3BlobStore, error) {
+	if bucket == "" {
+		return nil, errors.New("S3_BUCKET is required")
+	}
+	if accessKey == "" || secretKey == "" {
+		return nil, errors.New("S3_ACCESS_KEY_ID and S3_SECRET_ACCESS_KEY are required")
+	}
+
+	pathStyle := endpoint != ""
+	if !pathStyle {
+		endpoint = "https://" + bucket + ".s3." + region + ".amazonaws.com"
+	}
+	u, err := url.Parse(strings.TrimRight(endpoint, "/"))
+	if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+		return nil, fmt.Errorf("invalid S3_ENDPOINT %q", endpoint)
+	}
+
+	return &s3BlobStore{
+		endpoint:  u,
+		pathStyle: pathStyle,
+		region:    region,
+		bucket:    bucket,
+		accessKey: accessKey,
+		secretKey: secretKey,
+		client:    &http.Client{Timeout: 5 * time.Minute},
+		now:       time.Now,
+	}, nil
+}
+
+func (s *s3BlobStore) bucketURL() string {
+	if s.pathStyle {
+		return s.endpoint.String() + "/" + s.bucket
+	}
+	return s.endpoint.String()
+}
+
+func (s *s3BlobStore) objectURL(key string) string {
+	return s.bucketURL() + "/" + s3Escape(key, false)
+}
+
+func (s *s3BlobStore) Put(key string, r io.Reader, size int64, contentType string) error {
+	req, err := http.NewRequest("PUT", s.objectURL(key), r)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	req.Header.Set("Content-Type", contentType)
+
+	resp, err := s.do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s *s3BlobStore) Get(key string) (io.ReadCloser, error) {
+	req, err := http.NewRequest("GET", s.objectURL(key), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := s.do(req)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (s *s3BlobStore) Delete(key string) error {
+	req, err := http.NewRequest("DELETE", s.objectURL(key), nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := s.do(req)
+	if err == errBlobNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// do signs and sends a request. Responses other than 2xx are returned as
+// errors, with S3's error body.
+func (s *s3BlobStore) do(req *http.Request) (*http.Response, error) {
+	// The body isn't hashed, so uploads can be streamed
+	req.Header.Set("X-Amz-Content-Sha256", "UNSIGNED-PAYLOAD")
+	s.sign(req, s.now())
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, errBlobNotFound
+	}
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	return nil, fmt.Errorf("s3 %s returned status %d: %s", req.Method, resp.StatusCode, strings.TrimSpace(string(body)))
+}
+
+// sign adds an AWS Signature Version 4 Authorization header. It signs the
+// host, Range, Content-Type and X-Amz-* headers, and expects
+// X-Amz-Content-Sha256 to be set.
+func (s *s3BlobStore) sign(req *http.Request, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	req.Header.Set("X-Amz-Date", amzDate)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		name = strings.ToLower(name)
+		if strings.HasPrefix(name, "x-amz-") || name == "range" || name == "content-type" {
+			headers[name] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	var names []string
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		s3Escape(req.URL.Path, false),
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		req.Header.Get("X-Amz-Content-Sha256"),
+	}, "\n")
+
+	scope := amzDate[:8] + "/" + s.region + "/s3/aws4_request"
+	hash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(hash[:])
+
+	key := []byte("AWS4" + s.secretKey)
+	for _, part := range []string{amzDate[:8], s.region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+s.accessKey+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// canonicalQuery sorts and escapes query parameters for signing
+func canonicalQuery(query url.Values) string {
+	var pairs []string
+	for name, values := range query {
+		for _, value := range values {
+			pairs = append(pairs, s3Escape(name, true)+"="+s3Escape(value, true))
+		}
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, "&")
+}
+
+// s3Escape percent-encodes everything but unreserved characters, and
+// slashes unless encodeSlash is set, as Signature Version 4 requires
+func s3Escape(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' ||
+			c == '-' || c == '_' || c == '.' || c == '~' || (c == '/' && !encodeSlash) {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+const cliUsage = `Usage: task-service <command> [flags]
+
+Commands:
+  serve                    Start the HTTP server (default)
+  migrate                  Apply (or roll back) schema migrations
+  migrate status           Show applied and pending migrations
+
+All commands use DATABASE_URL and print JSON to stdout.
+Run "task-service <command> -h" for the flags of a command.
+`
+
+// runCommand dispatches a subcommand and returns the process exit code
+func runCommand(args []string) int {
+	if len(args) == 0 || args[0] == "serve" {
+		serve()
+		return 0
+	}
+
+	command := args[0]
+	if command == "migrate" && len(args) > 1 && !strings.HasPrefix(args[1], "-") {
+		command += " " + args[1]
+		args = args[1:]
+	}
+
+	var err error
+	switch command {
+	case "migrate":
+		err = cliMigrate(args[1:])
+	case "migrate status":
+		err = cliMigrateStatus(args[1:])
+	case "help", "-h", "--help":
+		fmt.Fprint(os.Stdout, cliUsage)
+		return 0
+	default:
+		fmt.Fprint(os.Stderr, cliUsage)
+		return 2
+	}
+
+	if err == flag.ErrHelp {
+		return 0
+	}
+	if err != nil {
+		json.NewEncoder(os.Stderr).Encode(map[string]string{"error": err.Error()})
+		return 1
+	}
+	return 0
+}
+
+func newFlagSet(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(os.Stderr)
+	return fs
+}
+
+func writeCLIJSON(v interface{}) error {
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(v)
+}
+
+func cliMigrate(args []string) error {
+	fs := newFlagSet("migrate")
+	to := fs.Int("to", -1, "target schema version; lower than the current version rolls back (default latest)")
+	dryRun := fs.Bool("dry-run", false, "run the migrations in a transaction and roll it back")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	db, err := openDatabase(getEnv("DATABASE_URL", defaultDatabaseURL))
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	result, err := migrateDatabase(db, *to, *dryRun)
+	if err != nil {
+		return err
+	}
+	return writeCLIJSON(result)
+}
+
+func cliMigrateStatus(args []string) error {
+	fs := newFlagSet("migrate status")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	db, err := openDatabase(getEnv("DATABASE_URL", defaultDatabaseURL))
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	status, err := migrationStatus(db)
+	if err != nil {
+		return err
+	}
+	return writeCLIJSON(status)
+}
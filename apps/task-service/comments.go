@@ -0,0 +1,675 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"html"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/microcosm-cc/bluemonday"
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/extension"
+)
+
+// Comment limits
+const (
+	maxCommentLength      = 10000
+	maxMentionsPerComment = 20
+	mentionExcerptLength  = 140
+)
+
+// commentsSort identifies comment listings in page cursors
+const commentsSort = "comments"
+
+var (
+	// A mention is @ and a username of letters, digits, _, . and -, not
+	// preceded by something that makes it part of an email address
+	mentionPattern = regexp.MustCompile(`(^|[^\w@.])@(\w[\w.-]*)`)
+	// Mentions in code aren't mentions
+	codePattern = regexp.MustCompile("(?s)```.*?```|`[^`\n]*`")
+)
+
+// Comment bodies are GitHub-flavored Markdown. goldmark leaves out raw HTML
+// and the UGC policy strips anything else unsafe from the result.
+var (
+	commentMarkdown = goldmark.New(goldmark.WithExtensions(extension.GFM))
+	commentPolicy   = bluemonday.UGCPolicy()
+)
+
+// UserRef is a user, such as one mentioned in a comment or assigned to a task
+type UserRef struct {
+	UserID   int    `json:"user_id"`
+	Username string `json:"username"`
+}
+
+// Comment is a comment on a task. UpdatedAt is set once it has been edited.
+type Comment struct {
+	ID        int        `json:"id"`
+	TaskID    int        `json:"task_id"`
+	UserID    int        `json:"user_id"`
+	Username  string     `json:"username"`
+	Body      string     `json:"body"`
+	BodyHTML  string     `json:"body_html"`
+	Mentions  []UserRef  `json:"mentions"`
+	Edits     int        `json:"edits"`
+	CreatedAt time.Time  `json:"created_at"`
+	UpdatedAt *time.Time `json:"updated_at"`
+}
+
+// CommentEdit is an earlier version of an edited comment
+type CommentEdit struct {
+	Body     string    `json:"body"`
+	BodyHTML string    `json:"body_html"`
+	EditedAt time.Time `json:"edited_at"`
+}
+
+// CommentPage is one page of a task's comments, oldest first
+type CommentPage struct {
+	Comments   []Comment `json:"comments"`
+	NextCursor *string   `json:"next_cursor"`
+}
+
+// CommentRequest creates or edits a comment
+type CommentRequest struct {
+	Body string `json:"body"`
+}
+
+// commentColumns are the columns scanComment reads
+const commentColumns = `task_comments.id, task_comments.task_id, task_comments.user_id, task_comments.username,
+	task_comments.body, task_comments.created_at, task_comments.updated_at,
+	(SELECT COUNT(*) FROM task_comment_edits WHERE task_comment_edits.comment_id = task_comments.id)`
+
+func scanComment(row rowScanner) (Comment, error) {
+	var comment Comment
+	var updatedAt sql.NullTime
+	err := row.Scan(&comment.ID, &comment.TaskID, &comment.UserID, &comment.Username,
+		&comment.Body, &comment.CreatedAt, &updatedAt, &comment.Edits)
+	if err != nil {
+		return comment, err
+	}
+	if updatedAt.Valid {
+		comment.UpdatedAt = &updatedAt.Time
+	}
+	comment.BodyHTML = renderMarkdown(comment.Body)
+	comment.Mentions = []UserRef{}
+	return comment, nil
+}
+
+// renderMarkdown renders a comment body to sanitized HTML
+func renderMarkdown(body string) string {
+	var buf bytes.Buffer
+	if err := commentMarkdown.Convert([]byte(body), &buf); err != nil {
+		return "<p>" + html.EscapeString(body) + "</p>"
+	}
+	return commentPolicy.Sanitize(buf.String())
+}
+
+// validateComment checks a comment body
+func validateComment(body string) error {
+	if strings.TrimSpace(body) == "" {
+		return fmt.Errorf("body is required")
+	}
+	if len([]rune(body)) > maxCommentLength {
+		return fmt.Errorf("body must be at most %d characters", maxCommentLength)
+	}
+	return nil
+}
+
+// parseMentions returns the usernames a comment body mentions, outside code
+func parseMentions(body string) ([]string, error) {
+	body = codePattern.ReplaceAllString(body, " ")
+
+	var usernames []string
+	seen := map[string]bool{}
+	for _, match := range mentionPattern.FindAllStringSubmatch(body, -1) {
+		// "@alice." ends a sentence
+		username := strings.TrimRight(match[2], ".-")
+		if seen[username] {
+			continue
+		}
+		seen[username] = true
+		usernames = append(usernames, username)
+	}
+	if len(usernames) > maxMentionsPerComment {
+		return nil, fmt.Errorf("a comment can mention at most %d users", maxMentionsPerComment)
+	}
+	return usernames, nil
+}
+
+// lookupUsers resolves usernames through auth-service with the caller's
+// token. Names that aren't users are left out.
+func (ts *TaskService) lookupUsers(authorization string, usernames []string) ([]UserRef, error) {
+	if len(usernames) == 0 {
+		return nil, nil
+	}
+
+	req, err := http.NewRequest("GET", ts.authServiceURL+"/api/auth/users/lookup?"+url.Values{"username": usernames}.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", authorization)
+
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("user lookup returned status %d", resp.StatusCode)
+	}
+
+	var users []struct {
+		ID       int    `json:"id"`
+		Username string `json:"username"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&users); err != nil {
+		return nil, err
+	}
+
+	var mentions []UserRef
+	for _, user := range users {
+		mentions = append(mentions, UserRef{UserID: user.ID, Username: user.Username})
+	}
+	return mentions, nil
+}
+
+// resolveMentions finds and resolves the mentions of a comment body. Only
+// users who can see the task can be mentioned, so others don't learn of it.
+func (ts *TaskService) resolveMentions(r *http.Request, taskID int, body string) ([]UserRef, error) {
+	usernames, err := parseMentions(body)
+	if err != nil || len(usernames) == 0 {
+		return nil, err
+	}
+	users, err := ts.lookupUsers(r.Header.Get("Authorization"), usernames)
+	if err != nil {
+		return nil, err
+	}
+	members, err := ts.taskMembers(taskID)
+	if err != nil {
+		return nil, err
+	}
+
+	var mentions []UserRef
+	for _, user := range users {
+		if members[user.UserID] {
+			mentions = append(mentions, user)
+		}
+	}
+	return mentions, nil
+}
+
+// saveMentions replaces the mentions of a comment and returns the users
+// that weren't mentioned before
+func saveMentions(tx *sql.Tx, commentID int, mentions []UserRef) ([]UserRef, error) {
+	rows, err := tx.Query("SELECT user_id FROM task_comment_mentions WHERE comment_id = ?", commentID)
+	if err != nil {
+		return nil, err
+	}
+	previous := map[int]bool{}
+	for rows.Next() {
+		var userID int
+		if err := rows.Scan(&userID); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		previous[userID] = true
+	}
+	rows.Close()
+
+	if _, err := tx.Exec("DELETE FROM task_comment_mentions WHERE comment_id = ?", commentID); err != nil {
+		return nil, err
+	}
+
+	var added []UserRef
+	for _, mention := range mentions {
+		_, err := tx.Exec("INSERT INTO task_comment_mentions (comment_id, user_id, username) VALUES (?, ?, ?)", commentID, mention.UserID, mention.Username)
+		if err != nil {
+			return nil, err
+		}
+		if !previous[mention.UserID] {
+			added = append(added, mention)
+		}
+	}
+	return added, nil
+}
+
+// notifyMentions tells mentioned users about a comment, except its author
+func (ts *TaskService) notifyMentions(r *http.Request, task Task, comment Comment, mentions []UserRef) {
+	excerpt := []rune(strings.Join(strings.Fields(comment.Body), " "))
+	if len(excerpt) > mentionExcerptLength {
+		excerpt = append(excerpt[:mentionExcerptLength], '…')
+	}
+
+	for _, mention := range mentions {
+		if mention.UserID == comment.UserID {
+			continue
+		}
+		ts.sendNotificationAsync(r.Header.Get("Authorization"), TaskNotification{
+			UserID:  mention.UserID,
+			Title:   fmt.Sprintf("%s mentioned you", comment.Username),
+			Message: fmt.Sprintf("On %q: %s", task.Title, string(excerpt)),
+			Type:    "mention",
+		})
+	}
+}
+
+// attachMentions sets the mentions of the given comments
+func (ts *TaskService) attachMentions(comments []Comment) error {
+	if len(comments) == 0 {
+		return nil
+	}
+	index := map[int]int{}
+	var ids []interface{}
+	for i := range comments {
+		index[comments[i].ID] = i
+		ids = append(ids, comments[i].ID)
+	}
+
+	cond := inCondition("comment_id", ids)
+	rows, err := ts.db.Query("SELECT comment_id, user_id, username FROM task_comment_mentions WHERE "+cond.sql+" ORDER BY username", cond.args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var commentID int
+		var mention UserRef
+		if err := rows.Scan(&commentID, &mention.UserID, &mention.Username); err != nil {
+			return err
+		}
+		i := index[commentID]
+		comments[i].Mentions = append(comments[i].Mentions, mention)
+	}
+	return rows.Err()
+}
+
+// loadComment loads a comment on a task with its mentions
+func (ts *TaskService) loadComment(taskID, commentID int) (Comment, error) {
+	comment, err := scanComment(ts.db.QueryRow(`
+		SELECT `+commentColumns+` FROM task_comments WHERE id = ? AND task_id = ?
+	`, commentID, taskID))
+	if err != nil {
+		return comment, err
+	}
+	comments := []Comment{comment}
+	err = ts.attachMentions(comments)
+	return comments[0], err
+}
+
+// deleteComment removes a comment with its history and mentions
+func deleteComment(tx *sql.Tx, commentID int) error {
+	for _, stmt := range []string{
+		"DELETE FROM task_comment_mentions WHERE comment_id = ?",
+		"DELETE FROM task_comment_edits WHERE comment_id = ?",
+		"DELETE FROM task_comments WHERE id = ?",
+	} {
+		if _, err := tx.Exec(stmt, commentID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// commentRequestIDs reads the user, task and, when the route has one,
+// comment IDs of a comment request
+func commentRequestIDs(w http.ResponseWriter, r *http.Request) (userID, taskID, commentID int, ok bool) {
+	userID, err := strconv.Atoi(r.Header.Get("X-User-ID"))
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return 0, 0, 0, false
+	}
+	vars := mux.Vars(r)
+	taskID, err = strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid task ID", http.StatusBadRequest)
+		return 0, 0, 0, false
+	}
+	if id, found := vars["commentId"]; found {
+		commentID, err = strconv.Atoi(id)
+		if err != nil {
+			http.Error(w, "Invalid comment ID", http.StatusBadRequest)
+			return 0, 0, 0, false
+		}
+	}
+	return userID, taskID, commentID, true
+}
+
+// getCommentsHandler lists a task's comments, oldest first
+func (ts *TaskService) getCommentsHandler(w http.ResponseWriter, r *http.Request) {
+	userID, taskID, _, ok := commentRequestIDs(w, r)
+	if !ok {
+		return
+	}
+
+	page, err := parsePageParams(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if page.After != nil && page.After.Sort != commentsSort {
+		http.Error(w, "cursor belongs to a different listing", http.StatusBadRequest)
+		return
+	}
+
+	if _, err := ts.loadTask(taskID, userID); err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Task not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	where := " WHERE task_id = ?"
+	args := []interface{}{taskID}
+	if page.After != nil {
+		where += " AND id > ?"
+		args = append(args, page.After.ID)
+	}
+	args = append(args, page.Limit+1)
+
+	rows, err := ts.db.Query("SELECT "+commentColumns+" FROM task_comments"+where+" ORDER BY id LIMIT ?", args...)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	response := CommentPage{Comments: []Comment{}}
+	for rows.Next() {
+		comment, err := scanComment(rows)
+		if err != nil {
+			http.Error(w, "Database scan error", http.StatusInternalServerError)
+			return
+		}
+		response.Comments = append(response.Comments, comment)
+	}
+	if len(response.Comments) > page.Limit {
+		response.Comments = response.Comments[:page.Limit]
+		next := encodeCursor(pageCursor{ID: response.Comments[page.Limit-1].ID, Sort: commentsSort})
+		response.NextCursor = &next
+	}
+	if err := ts.attachMentions(response.Comments); err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(response)
+}
+
+// createCommentHandler comments on a task and notifies mentioned users
+func (ts *TaskService) createCommentHandler(w http.ResponseWriter, r *http.Request) {
+	userID, taskID, _, ok := commentRequestIDs(w, r)
+	if !ok {
+		return
+	}
+
+	var req CommentRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if err := validateComment(req.Body); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	task, err := ts.loadTask(taskID, userID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Task not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if !task.allows(accessEditor) {
+		http.Error(w, "Viewers can't comment", http.StatusForbidden)
+		return
+	}
+
+	mentions, err := ts.resolveMentions(r, taskID, req.Body)
+	if err != nil {
+		http.Error(w, "Failed to resolve mentions: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	tx, err := ts.db.Begin()
+	if err != nil {
+		http.Error(w, "Failed to create comment", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`
+		INSERT INTO task_comments (task_id, user_id, username, body) VALUES (?, ?, ?, ?)
+	`, taskID, userID, r.Header.Get("X-Username"), req.Body)
+	if err != nil {
+		http.Error(w, "Failed to create comment", http.StatusInternalServerError)
+		return
+	}
+	commentID, _ := result.LastInsertId()
+
+	added, err := saveMentions(tx, int(commentID), mentions)
+	if err != nil {
+		http.Error(w, "Failed to create comment", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Failed to create comment", http.StatusInternalServerError)
+		return
+	}
+
+	comment, err := ts.loadComment(taskID, int(commentID))
+	if err != nil {
+		http.Error(w, "Failed to retrieve created comment", http.StatusInternalServerError)
+		return
+	}
+	ts.notifyMentions(r, task, comment, added)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(comment)
+}
+
+// updateCommentHandler edits a comment, keeping the previous body. Only
+// users mentioned for the first time are notified.
+func (ts *TaskService) updateCommentHandler(w http.ResponseWriter, r *http.Request) {
+	userID, taskID, commentID, ok := commentRequestIDs(w, r)
+	if !ok {
+		return
+	}
+
+	var req CommentRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if err := validateComment(req.Body); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	task, err := ts.loadTask(taskID, userID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Task not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if !task.allows(accessEditor) {
+		http.Error(w, "Viewers can't comment", http.StatusForbidden)
+		return
+	}
+
+	existing, err := ts.loadComment(taskID, commentID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Comment not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if existing.UserID != userID {
+		http.Error(w, "Only the author can edit a comment", http.StatusForbidden)
+		return
+	}
+
+	mentions, err := ts.resolveMentions(r, taskID, req.Body)
+	if err != nil {
+		http.Error(w, "Failed to resolve mentions: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	tx, err := ts.db.Begin()
+	if err != nil {
+		http.Error(w, "Failed to update comment", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var added []UserRef
+	if req.Body != existing.Body {
+		_, err = tx.Exec("INSERT INTO task_comment_edits (comment_id, body) VALUES (?, ?)", commentID, existing.Body)
+		if err == nil {
+			_, err = tx.Exec("UPDATE task_comments SET body = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ?", req.Body, commentID)
+		}
+		if err == nil {
+			added, err = saveMentions(tx, commentID, mentions)
+		}
+		if err != nil {
+			http.Error(w, "Failed to update comment", http.StatusInternalServerError)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Failed to update comment", http.StatusInternalServerError)
+		return
+	}
+
+	comment, err := ts.loadComment(taskID, commentID)
+	if err != nil {
+		http.Error(w, "Failed to retrieve updated comment", http.StatusInternalServerError)
+		return
+	}
+	ts.notifyMentions(r, task, comment, added)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(comment)
+}
+
+// deleteCommentHandler deletes a comment; its author and the task's owner
+// can
+func (ts *TaskService) deleteCommentHandler(w http.ResponseWriter, r *http.Request) {
+	userID, taskID, commentID, ok := commentRequestIDs(w, r)
+	if !ok {
+		return
+	}
+
+	task, err := ts.loadTask(taskID, userID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Task not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	comment, err := ts.loadComment(taskID, commentID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Comment not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if comment.UserID != userID && !task.allows(accessOwner) {
+		http.Error(w, "Only the author or the task's owner can delete a comment", http.StatusForbidden)
+		return
+	}
+
+	tx, err := ts.db.Begin()
+	if err != nil {
+		http.Error(w, "Failed to delete comment", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	if err := deleteComment(tx, commentID); err != nil {
+		http.Error(w, "Failed to delete comment", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Failed to delete comment", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// getCommentHistoryHandler lists the earlier versions of a comment, newest
+// first
+func (ts *TaskService) getCommentHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	userID, taskID, commentID, ok := commentRequestIDs(w, r)
+	if !ok {
+		return
+	}
+
+	if _, err := ts.loadTask(taskID, userID); err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Task not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if _, err := ts.loadComment(taskID, commentID); err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Comment not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	rows, err := ts.db.Query("SELECT body, edited_at FROM task_comment_edits WHERE comment_id = ? ORDER BY id DESC", commentID)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	edits := []CommentEdit{}
+	for rows.Next() {
+		var edit CommentEdit
+		if err := rows.Scan(&edit.Body, &edit.EditedAt); err != nil {
+			http.Error(w, "Database scan error", http.StatusInternalServerError)
+			return
+		}
+		edit.BodyHTML = renderMarkdown(edit.Body)
+		edits = append(edits, edit)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(edits)
+}
@@ -0,0 +1,390 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+// What happens to the subtasks of a task that is finished or deleted
+const (
+	subtaskCascade = "cascade" // they are finished or deleted with it
+	subtaskBlock   = "block"   // the task can't be finished or deleted while it has them
+	subtaskOrphan  = "orphan"  // they become top-level tasks
+)
+
+// Errors for tasks a block policy keeps from being finished or deleted
+var (
+	errOpenSubtasks = errors.New("task has unfinished subtasks")
+	errHasSubtasks  = errors.New("task has subtasks")
+)
+
+// Progress counts a task's subtasks at any depth and how many are finished
+type Progress struct {
+	Done    int `json:"done"`
+	Total   int `json:"total"`
+	Percent int `json:"percent"`
+}
+
+// queryer is a *sql.DB or *sql.Tx
+type queryer interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+func parseSubtaskPolicy(value string) (string, error) {
+	switch value {
+	case subtaskCascade, subtaskBlock, subtaskOrphan:
+		return value, nil
+	}
+	return "", errors.New("must be cascade, block or orphan")
+}
+
+// subtaskPolicy is the policy a request asks for with the subtasks
+// parameter, or defaultPolicy
+func subtaskPolicy(r *http.Request, defaultPolicy string) (string, error) {
+	value := r.URL.Query().Get("subtasks")
+	if value == "" {
+		return defaultPolicy, nil
+	}
+	policy, err := parseSubtaskPolicy(value)
+	if err != nil {
+		return "", errors.New("subtasks " + err.Error())
+	}
+	return policy, nil
+}
+
+// loadSubtrees loads the subtasks at any depth of the given tasks, in ID order
+func loadSubtrees(q queryer, taskIDs []int) ([]Task, error) {
+	if len(taskIDs) == 0 {
+		return nil, nil
+	}
+	var ids []interface{}
+	for _, id := range taskIDs {
+		ids = append(ids, id)
+	}
+	roots := inCondition("parent_id", ids)
+
+	rows, err := q.Query(`
+		WITH RECURSIVE subtree(id) AS (
+			SELECT id FROM tasks WHERE `+roots.sql+`
+			UNION
+			SELECT tasks.id FROM tasks JOIN subtree ON tasks.parent_id = subtree.id
+		)
+		SELECT `+taskColumns+` FROM tasks WHERE id IN (SELECT id FROM subtree) ORDER BY tasks.id
+	`, roots.args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var subtasks []Task
+	for rows.Next() {
+		task, err := scanTask(rows)
+		if err != nil {
+			return nil, err
+		}
+		subtasks = append(subtasks, task)
+	}
+	return subtasks, rows.Err()
+}
+
+// attachSubtasks nests the subtasks under the given tasks and sets the
+// progress of every task that has any
+func attachSubtasks(tasks []Task, subtasks []Task) {
+	children := newSubtree(subtasks)
+
+	var attach func(task *Task)
+	attach = func(task *Task) {
+		task.Subtasks = children[task.ID]
+		var progress Progress
+		for i := range task.Subtasks {
+			child := &task.Subtasks[i]
+			attach(child)
+			progress.Total++
+			if isFinished(child.Status) {
+				progress.Done++
+			}
+			if child.Progress != nil {
+				progress.Total += child.Progress.Total
+				progress.Done += child.Progress.Done
+			}
+		}
+		if progress.Total > 0 {
+			progress.Percent = progress.Done * 100 / progress.Total
+			task.Progress = &progress
+		}
+	}
+	for i := range tasks {
+		attach(&tasks[i])
+	}
+}
+
+// loadProgress sets the progress of a task that has subtasks
+func (ts *TaskService) loadProgress(task *Task) error {
+	subtasks, err := loadSubtrees(ts.db, []int{task.ID})
+	if err != nil {
+		return err
+	}
+	tasks := []Task{*task}
+	attachSubtasks(tasks, subtasks)
+	task.Progress = tasks[0].Progress
+	return nil
+}
+
+// checkParent checks that a task can be moved under parentID: the parent is
+// a task the user can edit, not the task itself or one of its subtasks, and
+// not blocking it. taskID is 0 for a new task.
+func (ts *TaskService) checkParent(taskID, parentID, userID int) error {
+	editable := accessCondition("tasks", userID, true)
+	var count int
+	err := ts.db.QueryRow("SELECT COUNT(*) FROM tasks WHERE id = ? AND "+editable.sql, append([]interface{}{parentID}, editable.args...)...).Scan(&count)
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return errors.New("parent task not found")
+	}
+	if taskID == 0 {
+		return nil
+	}
+
+	if parentID == taskID {
+		return errors.New("a task can't be its own parent")
+	}
+	subtasks, err := loadSubtrees(ts.db, []int{taskID})
+	if err != nil {
+		return err
+	}
+	for _, subtask := range subtasks {
+		if subtask.ID == parentID {
+			return errors.New("a task can't be moved under one of its subtasks")
+		}
+	}
+
+	// The parent couldn't be finished before the task, nor the task started
+	// before the parent
+	path, err := blockingPath(ts.db, parentID, taskID)
+	if err != nil {
+		return err
+	}
+	if path != nil {
+		return errors.New("a task can't be moved under a task that blocks it: " + formatTaskPath(path))
+	}
+	return nil
+}
+
+// finishSubtasks applies policy to the unfinished subtasks of a task that
+// is being finished with status. A cascade only finishes subtasks the user
+// can edit; ones they can't are detached, with their own subtasks, when
+// anything in them is unfinished.
+func finishSubtasks(tx *sql.Tx, taskID, userID int, status, policy string) error {
+	subtasks, err := loadSubtrees(tx, []int{taskID})
+	if err != nil {
+		return err
+	}
+	var open []Task
+	for _, subtask := range subtasks {
+		if !isFinished(subtask.Status) {
+			open = append(open, subtask)
+		}
+	}
+	if len(open) == 0 {
+		return nil
+	}
+
+	switch policy {
+	case subtaskBlock:
+		return errOpenSubtasks
+	case subtaskOrphan:
+		_, err := tx.Exec("UPDATE tasks SET parent_id = NULL WHERE parent_id = ?", taskID)
+		return err
+	}
+
+	editable, err := editableTasks(tx, open, userID)
+	if err != nil {
+		return err
+	}
+	tree := newSubtree(subtasks)
+	cascade, others := tree.split(taskID, func(subtask Task) bool {
+		return isFinished(subtask.Status) || editable[subtask.ID]
+	})
+	for _, subtask := range others {
+		if tree.unfinished(subtask) {
+			if err := detachTask(tx, subtask.ID); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Recurring subtasks finished this way don't get a next occurrence,
+	// which would be an open subtask of a finished task
+	for _, subtask := range cascade {
+		if isFinished(subtask.Status) {
+			continue
+		}
+		if _, err := tx.Exec("UPDATE tasks SET status = ? WHERE id = ?", status, subtask.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteSubtasks applies policy to the subtasks of a task that is being
+// deleted. A cascade only deletes subtasks the user owns; ones they don't
+// are detached, with their own subtasks.
+func deleteSubtasks(tx *sql.Tx, taskID, userID int, policy string) error {
+	subtasks, err := loadSubtrees(tx, []int{taskID})
+	if err != nil || len(subtasks) == 0 {
+		return err
+	}
+
+	switch policy {
+	case subtaskBlock:
+		return errHasSubtasks
+	case subtaskOrphan:
+		_, err := tx.Exec("UPDATE tasks SET parent_id = NULL WHERE parent_id = ?", taskID)
+		return err
+	}
+
+	cascade, others := newSubtree(subtasks).split(taskID, func(subtask Task) bool {
+		return subtask.UserID == userID
+	})
+	for _, subtask := range others {
+		if err := detachTask(tx, subtask.ID); err != nil {
+			return err
+		}
+	}
+	for _, subtask := range cascade {
+		if err := deleteTask(tx, subtask.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// subtree indexes the subtasks loadSubtrees loaded by parent
+type subtree map[int][]Task
+
+func newSubtree(subtasks []Task) subtree {
+	children := subtree{}
+	for _, subtask := range subtasks {
+		children[*subtask.ParentID] = append(children[*subtask.ParentID], subtask)
+	}
+	return children
+}
+
+// split walks the subtasks of taskID. Those allowed, and reached only
+// through allowed subtasks, are in cascade; the first subtask on each path
+// that isn't allowed is in others, and the walk doesn't go below it.
+func (children subtree) split(taskID int, allowed func(Task) bool) (cascade, others []Task) {
+	var walk func(id int)
+	walk = func(id int) {
+		for _, child := range children[id] {
+			if !allowed(child) {
+				others = append(others, child)
+				continue
+			}
+			cascade = append(cascade, child)
+			walk(child.ID)
+		}
+	}
+	walk(taskID)
+	return cascade, others
+}
+
+// unfinished reports whether a subtask or any of its own subtasks is
+// unfinished
+func (children subtree) unfinished(subtask Task) bool {
+	if !isFinished(subtask.Status) {
+		return true
+	}
+	for _, child := range children[subtask.ID] {
+		if children.unfinished(child) {
+			return true
+		}
+	}
+	return false
+}
+
+// editableTasks returns which of the given tasks the user can edit
+func editableTasks(q queryer, tasks []Task, userID int) (map[int]bool, error) {
+	var ids []interface{}
+	for _, task := range tasks {
+		ids = append(ids, task.ID)
+	}
+	in := inCondition("id", ids)
+	editable := accessCondition("tasks", userID, true)
+	rows, err := q.Query("SELECT id FROM tasks WHERE "+in.sql+" AND "+editable.sql, append(in.args, editable.args...)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := map[int]bool{}
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		result[id] = true
+	}
+	return result, rows.Err()
+}
+
+// detachTask makes a subtask a top-level task
+func detachTask(tx *sql.Tx, taskID int) error {
+	_, err := tx.Exec("UPDATE tasks SET parent_id = NULL WHERE id = ?", taskID)
+	return err
+}
+
+// getSubtasksHandler lists the subtasks of a task the user can see, each
+// with its own subtasks nested
+func (ts *TaskService) getSubtasksHandler(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.Atoi(r.Header.Get("X-User-ID"))
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+	taskID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid task ID", http.StatusBadRequest)
+		return
+	}
+
+	task, err := ts.loadTask(taskID, userID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Task not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	subtasks, err := loadSubtrees(ts.db, []int{task.ID})
+	if err == nil {
+		err = ts.attachTags(subtasks)
+	}
+	if err == nil {
+		err = ts.attachAccess(subtasks, userID)
+	}
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	tasks := []Task{task}
+	attachSubtasks(tasks, visibleTasks(subtasks))
+
+	response := tasks[0].Subtasks
+	if response == nil {
+		response = []Task{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,360 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// Kinds of task_links rows. blocked_by is a blocks link seen from the task
+// it blocks.
+const (
+	linkBlocks    = "blocks"
+	linkBlockedBy = "blocked_by"
+	linkRelatesTo = "relates_to"
+)
+
+// statusInProgress is the status of a task that has been started
+const statusInProgress = "in-progress"
+
+// What happens when a blocked task is started or finished: the update is
+// refused, or made with a Warning header
+const (
+	blockedReject = "reject"
+	blockedWarn   = "warn"
+)
+
+// blockedExpr is true for a task with an unfinished blocker. The finished
+// statuses are constants, so they are inlined rather than bound, which lets
+// the expression be used as a column.
+var blockedExpr = func() string {
+	var statuses []string
+	for _, status := range finishedStatuses {
+		statuses = append(statuses, "'"+status+"'")
+	}
+	return `EXISTS (SELECT 1 FROM task_links JOIN tasks blocker ON blocker.id = task_links.task_id
+		WHERE task_links.target_id = tasks.id AND task_links.kind = 'blocks'
+		AND (blocker.status IN (` + strings.Join(statuses, ", ") + `)) IS NOT 1)`
+}()
+
+// LinkedTask is the task at the other end of a link
+type LinkedTask struct {
+	LinkID int    `json:"link_id"`
+	TaskID int    `json:"task_id"`
+	Title  string `json:"title"`
+	Status string `json:"status"`
+}
+
+// TaskLinks are a task's links, grouped by how the other task relates to it
+type TaskLinks struct {
+	Blocks    []LinkedTask `json:"blocks"`
+	BlockedBy []LinkedTask `json:"blocked_by"`
+	RelatesTo []LinkedTask `json:"relates_to"`
+}
+
+// LinkRequest links a task to another: it blocks, is blocked by or relates
+// to the task with TaskID
+type LinkRequest struct {
+	Type   string `json:"type"`
+	TaskID int    `json:"task_id"`
+}
+
+// blockers lists the unfinished tasks blocking a task, as "#3, #5"
+func (links TaskLinks) blockers() string {
+	var ids []string
+	for _, linked := range links.BlockedBy {
+		if !isFinished(linked.Status) {
+			ids = append(ids, "#"+strconv.Itoa(linked.TaskID))
+		}
+	}
+	return strings.Join(ids, ", ")
+}
+
+// loadLinks sets the links of a task to the tasks the user can see
+func (ts *TaskService) loadLinks(task *Task, userID int) error {
+	// The access condition's placeholders are numbered after ?1
+	visible := accessCondition("tasks", userID, false)
+	rows, err := ts.db.Query(`
+		SELECT task_links.id, task_links.task_id, task_links.kind, tasks.id, tasks.title, tasks.status
+		FROM task_links
+		JOIN tasks ON tasks.id = CASE WHEN task_links.task_id = ?1 THEN task_links.target_id ELSE task_links.task_id END
+		WHERE (task_links.task_id = ?1 OR task_links.target_id = ?1) AND `+visible.sql+`
+		ORDER BY task_links.id
+	`, append([]interface{}{task.ID}, visible.args...)...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	links := &TaskLinks{Blocks: []LinkedTask{}, BlockedBy: []LinkedTask{}, RelatesTo: []LinkedTask{}}
+	for rows.Next() {
+		var linked LinkedTask
+		var fromID int
+		var kind string
+		if err := rows.Scan(&linked.LinkID, &fromID, &kind, &linked.TaskID, &linked.Title, &linked.Status); err != nil {
+			return err
+		}
+		switch {
+		case kind == linkRelatesTo:
+			links.RelatesTo = append(links.RelatesTo, linked)
+		case fromID == task.ID:
+			links.Blocks = append(links.Blocks, linked)
+		default:
+			links.BlockedBy = append(links.BlockedBy, linked)
+		}
+	}
+	task.Links = links
+	return rows.Err()
+}
+
+// blockingPath returns the tasks along a chain of blocks links from one task
+// to another, or nil if there is none. A subtask counts as blocking its
+// parent, which can't be finished before it. Chains can pass through tasks
+// of other users. Only the links reachable from the first task are loaded.
+func blockingPath(q queryer, from, to int) ([]int, error) {
+	rows, err := q.Query(`
+		WITH RECURSIVE reachable(id) AS (
+			SELECT ?1
+			UNION
+			SELECT task_links.target_id FROM task_links JOIN reachable ON task_links.task_id = reachable.id
+			WHERE task_links.kind = ?2
+			UNION
+			SELECT tasks.parent_id FROM tasks JOIN reachable ON tasks.id = reachable.id
+			WHERE tasks.parent_id IS NOT NULL
+		)
+		SELECT task_id, target_id FROM task_links
+		WHERE kind = ?2 AND task_id IN (SELECT id FROM reachable)
+		UNION ALL
+		SELECT id, parent_id FROM tasks
+		WHERE parent_id IS NOT NULL AND id IN (SELECT id FROM reachable)
+	`, from, linkBlocks)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	edges := map[int][]int{}
+	for rows.Next() {
+		var taskID, targetID int
+		if err := rows.Scan(&taskID, &targetID); err != nil {
+			return nil, err
+		}
+		edges[taskID] = append(edges[taskID], targetID)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// Breadth first, so the shortest chain is reported
+	previous := map[int]int{from: 0}
+	queue := []int{from}
+	for len(queue) > 0 {
+		id := queue[0]
+		queue = queue[1:]
+		if id == to {
+			var path []int
+			for ; id != 0; id = previous[id] {
+				path = append([]int{id}, path...)
+			}
+			return path, nil
+		}
+		for _, next := range edges[id] {
+			if _, seen := previous[next]; !seen {
+				previous[next] = id
+				queue = append(queue, next)
+			}
+		}
+	}
+	return nil, nil
+}
+
+func formatTaskPath(path []int) string {
+	var ids []string
+	for _, id := range path {
+		ids = append(ids, "#"+strconv.Itoa(id))
+	}
+	return strings.Join(ids, " → ")
+}
+
+func (ts *TaskService) getLinksHandler(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.Atoi(r.Header.Get("X-User-ID"))
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+	taskID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid task ID", http.StatusBadRequest)
+		return
+	}
+
+	task, err := ts.loadTask(taskID, userID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Task not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(task.Links)
+}
+
+// addLinkHandler links two tasks the user can edit. Blocks links
+// that would make tasks wait on each other are refused.
+func (ts *TaskService) addLinkHandler(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.Atoi(r.Header.Get("X-User-ID"))
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+	taskID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid task ID", http.StatusBadRequest)
+		return
+	}
+
+	var req LinkRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	// Links are stored from the blocking task, or the lower ID
+	from, to, kind := taskID, req.TaskID, linkBlocks
+	switch req.Type {
+	case linkBlocks:
+	case linkBlockedBy:
+		from, to = req.TaskID, taskID
+	case linkRelatesTo:
+		kind = linkRelatesTo
+		if to < from {
+			from, to = to, from
+		}
+	default:
+		http.Error(w, "type must be blocks, blocked_by or relates_to", http.StatusBadRequest)
+		return
+	}
+	if req.TaskID == taskID {
+		http.Error(w, "A task can't be linked to itself", http.StatusBadRequest)
+		return
+	}
+
+	// Links change both tasks
+	for _, id := range []int{taskID, req.TaskID} {
+		task, err := ts.loadTask(id, userID)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				http.Error(w, "Task not found", http.StatusNotFound)
+				return
+			}
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		if !task.allows(accessEditor) {
+			http.Error(w, "You can't edit task #"+strconv.Itoa(id), http.StatusForbidden)
+			return
+		}
+	}
+
+	tx, err := ts.db.Begin()
+	if err != nil {
+		http.Error(w, "Failed to link tasks", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var count int
+	err = tx.QueryRow("SELECT COUNT(*) FROM task_links WHERE task_id = ? AND target_id = ? AND kind = ?", from, to, kind).Scan(&count)
+	if err != nil {
+		http.Error(w, "Failed to link tasks", http.StatusInternalServerError)
+		return
+	}
+	if count > 0 {
+		http.Error(w, "Tasks are already linked", http.StatusConflict)
+		return
+	}
+
+	if kind == linkBlocks {
+		path, err := blockingPath(tx, to, from)
+		if err != nil {
+			http.Error(w, "Failed to link tasks", http.StatusInternalServerError)
+			return
+		}
+		if path != nil {
+			http.Error(w, "Link would create a cycle: "+formatTaskPath(append([]int{from}, path...)), http.StatusConflict)
+			return
+		}
+	}
+
+	if _, err := tx.Exec("INSERT INTO task_links (task_id, target_id, kind) VALUES (?, ?, ?)", from, to, kind); err != nil {
+		http.Error(w, "Failed to link tasks", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Failed to link tasks", http.StatusInternalServerError)
+		return
+	}
+
+	task, err := ts.loadTask(taskID, userID)
+	if err != nil {
+		http.Error(w, "Failed to retrieve links", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(task.Links)
+}
+
+func (ts *TaskService) deleteLinkHandler(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.Atoi(r.Header.Get("X-User-ID"))
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+	vars := mux.Vars(r)
+	taskID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid task ID", http.StatusBadRequest)
+		return
+	}
+	linkID, err := strconv.Atoi(vars["linkId"])
+	if err != nil {
+		http.Error(w, "Invalid link ID", http.StatusBadRequest)
+		return
+	}
+
+	task, err := ts.loadTask(taskID, userID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Task not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if !task.allows(accessEditor) {
+		http.Error(w, "You can't edit this task", http.StatusForbidden)
+		return
+	}
+
+	result, err := ts.db.Exec("DELETE FROM task_links WHERE id = ?1 AND (task_id = ?2 OR target_id = ?2)", linkID, taskID)
+	if err != nil {
+		http.Error(w, "Failed to delete link", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		http.Error(w, "Link not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -3,11 +3,15 @@ package main
 import (
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
+	"sort"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
@@ -25,30 +29,110 @@ type Task struct {
 	UserID      int       `json:"user_id"`
 	CreatedAt   time.Time `json:"created_at"`
 	UpdatedAt   time.Time `json:"updated_at"`
+
+	// Due and start dates are shown in the task's timezone
+	DueAt    *time.Time `json:"due_at"`
+	StartAt  *time.Time `json:"start_at"`
+	Timezone string     `json:"timezone"`
+	Overdue  bool       `json:"overdue"`
+
+	// Set while a task it depends on is unfinished
+	Blocked bool `json:"blocked"`
+
+	Tags []Tag `json:"tags"`
+
+	// UserID is the task's creator, who owns it; assignees work on it. Access
+	// is the requesting user's: owner, editor or viewer.
+	Assignees []UserRef `json:"assignees"`
+	Access    string    `json:"access"`
+
+	// Occurrences of a recurring task share a series
+	SeriesID     *int `json:"series_id,omitempty"`
+	occurrenceAt *time.Time
+
+	// Subtasks point at their parent; top-level tasks have none
+	ParentID *int `json:"parent_id"`
+
+	// Set on single tasks, subtasks and the tree view only
+	Progress *Progress `json:"progress,omitempty"`
+	Subtasks []Task    `json:"subtasks,omitempty"`
+
+	// Set on single tasks only
+	Reminders  []Reminder  `json:"reminders,omitempty"`
+	Recurrence *Recurrence `json:"recurrence,omitempty"`
+	Links      *TaskLinks  `json:"links,omitempty"`
+
+	// Set on search results only
+	Highlights *TaskHighlights `json:"highlights,omitempty"`
 }
 
-// CreateTaskRequest represents the create task request payload
+// CreateTaskRequest represents the create task request payload. Due and
+// start dates are RFC 3339 timestamps or local times in the timezone.
 type CreateTaskRequest struct {
-	Title       string `json:"title"`
-	Description string `json:"description"`
-	Priority    string `json:"priority"`
+	Title       string             `json:"title"`
+	Description string             `json:"description"`
+	Priority    string             `json:"priority"`
+	DueAt       string             `json:"due_at"`
+	StartAt     string             `json:"start_at"`
+	Timezone    string             `json:"timezone"`
+	Reminders   []ReminderRequest  `json:"reminders"`
+	Recurrence  *RecurrenceRequest `json:"recurrence"`
+	ParentID    *int               `json:"parent_id"`
+	Tags        []string           `json:"tags"`
+	Assignees   []string           `json:"assignees"`
 }
 
-// UpdateTaskRequest represents the update task request payload
+// UpdateTaskRequest represents the update task request payload. Schedule
+// fields, the parent, tags and assignees that are left out keep their value; an empty
+// string clears a date and a parent_id of 0 makes the task a top-level one.
 type UpdateTaskRequest struct {
-	Title       string `json:"title"`
-	Description string `json:"description"`
-	Status      string `json:"status"`
-	Priority    string `json:"priority"`
+	Title       string             `json:"title"`
+	Description string             `json:"description"`
+	Status      string             `json:"status"`
+	Priority    string             `json:"priority"`
+	DueAt       *string            `json:"due_at"`
+	StartAt     *string            `json:"start_at"`
+	Timezone    *string            `json:"timezone"`
+	Reminders   *[]ReminderRequest `json:"reminders"`
+	ParentID    *int               `json:"parent_id"`
+	Tags        *[]string          `json:"tags"`
+	Assignees   *[]string          `json:"assignees"`
 }
 
 // TaskService handles task operations
 type TaskService struct {
-	db             *sql.DB
-	authServiceURL string
-	corsOrigins    string
+	db                     *sql.DB
+	authServiceURL         string
+	notificationServiceURL string
+	corsOrigins            string
+	audience               string // tokens must be issued for this audience
+
+	// task-service's client at auth-service, for tokens to call other services
+	oauthClientID     string
+	oauthClientSecret string
+	serviceToken      cachedToken
+
+	// What happens to subtasks when their parent is finished or deleted,
+	// unless a request asks otherwise
+	subtaskCompletePolicy string
+	subtaskDeletePolicy   string
+
+	// Whether blocked tasks can be started or finished, with a warning
+	blockedTaskPolicy string
+
+	attachments attachmentConfig
 }
 
+// taskColumns are the columns scanTask reads
+var taskColumns = "tasks.id, tasks.title, tasks.description, tasks.status, tasks.priority, tasks.user_id, tasks.created_at, tasks.updated_at, tasks.due_at, tasks.start_at, tasks.timezone, tasks.series_id, tasks.occurrence_at, tasks.parent_id, " + blockedExpr
+
+// rowScanner is a *sql.Row or *sql.Rows
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+const defaultDatabaseURL = "./data/tasks.db"
+
 // Claims represents JWT claims
 type Claims struct {
 	UserID   int    `json:"user_id"`
@@ -57,14 +141,65 @@ type Claims struct {
 }
 
 func main() {
+	os.Exit(runCommand(os.Args[1:]))
+}
+
+func serve() {
 	// Get configuration from environment variables
 	port := getEnv("PORT", "8081")
-	databaseURL := getEnv("DATABASE_URL", "./data/tasks.db")
+	databaseURL := getEnv("DATABASE_URL", defaultDatabaseURL)
 	authServiceURL := getEnv("AUTH_SERVICE_URL", "http://localhost:8080")
+	notificationServiceURL := getEnv("NOTIFICATION_SERVICE_URL", "http://localhost:8082")
 	corsOrigins := getEnv("CORS_ORIGINS", "http://localhost:3000")
+	autoMigrate := getEnv("AUTO_MIGRATE", "true") == "true"
+	audience := getEnv("JWT_AUDIENCE", "task-service")
+	oauthClientID := getEnv("OAUTH_CLIENT_ID", "task-service")
+	oauthClientSecret := os.Getenv("OAUTH_CLIENT_SECRET")
+
+	// Replicas sharing a database can all run the scheduler; 0 turns it off
+	reminderInterval, err := time.ParseDuration(getEnv("REMINDER_INTERVAL", "30s"))
+	if err != nil || reminderInterval < 0 {
+		log.Fatal("REMINDER_INTERVAL must be a duration such as 30s")
+	}
+
+	subtaskCompletePolicy, err := parseSubtaskPolicy(getEnv("SUBTASK_COMPLETE_POLICY", subtaskBlock))
+	if err != nil {
+		log.Fatal("SUBTASK_COMPLETE_POLICY ", err)
+	}
+	subtaskDeletePolicy, err := parseSubtaskPolicy(getEnv("SUBTASK_DELETE_POLICY", subtaskCascade))
+	if err != nil {
+		log.Fatal("SUBTASK_DELETE_POLICY ", err)
+	}
+	blockedTaskPolicy := getEnv("BLOCKED_TASK_POLICY", blockedReject)
+	if blockedTaskPolicy != blockedReject && blockedTaskPolicy != blockedWarn {
+		log.Fatal("BLOCKED_TASK_POLICY must be reject or warn")
+	}
+
+	attachmentStore, attachmentStoreName, err := newBlobStore()
+	if err != nil {
+		log.Fatal("ATTACHMENT_STORE ", err)
+	}
+	attachmentMaxSize, err := strconv.ParseInt(getEnv("ATTACHMENT_MAX_SIZE", strconv.Itoa(defaultAttachmentMaxSize)), 10, 64)
+	if err != nil || attachmentMaxSize <= 0 {
+		log.Fatal("ATTACHMENT_MAX_SIZE must be a positive number of bytes")
+	}
+	attachmentTypes, err := parseAttachmentTypes(getEnv("ATTACHMENT_TYPES", defaultAttachmentTypes))
+	if err != nil {
+		log.Fatal("ATTACHMENT_TYPES ", err)
+	}
+	attachmentURLTTL, err := time.ParseDuration(getEnv("ATTACHMENT_URL_TTL", "15m"))
+	if err != nil || attachmentURLTTL <= 0 {
+		log.Fatal("ATTACHMENT_URL_TTL must be a duration such as 15m")
+	}
+	// Without a shared secret download URLs only work on the replica that
+	// issued them, which is only good enough in development
+	attachmentURLSecret := os.Getenv("ATTACHMENT_URL_SECRET")
+	if attachmentURLSecret == "" && getEnv("APP_ENV", "development") != "development" {
+		log.Fatal("ATTACHMENT_URL_SECRET must be set outside development")
+	}
 
 	// Initialize database
-	db, err := initDatabase(databaseURL)
+	db, err := initDatabase(databaseURL, autoMigrate)
 	if err != nil {
 		log.Fatal("Failed to initialize database:", err)
 	}
@@ -72,9 +207,28 @@ func main() {
 
 	// Create task service
 	taskService := &TaskService{
-		db:             db,
-		authServiceURL: authServiceURL,
-		corsOrigins:    corsOrigins,
+		db:                     db,
+		authServiceURL:         authServiceURL,
+		notificationServiceURL: notificationServiceURL,
+		corsOrigins:            corsOrigins,
+		audience:               audience,
+		oauthClientID:          oauthClientID,
+		oauthClientSecret:      oauthClientSecret,
+		subtaskCompletePolicy:  subtaskCompletePolicy,
+		subtaskDeletePolicy:    subtaskDeletePolicy,
+		blockedTaskPolicy:      blockedTaskPolicy,
+		attachments: attachmentConfig{
+			store:     attachmentStore,
+			maxSize:   attachmentMaxSize,
+			types:     attachmentTypes,
+			urlTTL:    attachmentURLTTL,
+			urlKey:    attachmentURLKey(attachmentURLSecret),
+			publicURL: os.Getenv("PUBLIC_URL"),
+		},
+	}
+
+	if reminderInterval > 0 {
+		go taskService.runScheduler(reminderInterval)
 	}
 
 	// Setup routes
@@ -84,14 +238,21 @@ func main() {
 	log.Printf("Task service starting on port %s", port)
 	log.Printf("Database: %s", databaseURL)
 	log.Printf("Auth Service URL: %s", authServiceURL)
+	log.Printf("Notification Service URL: %s", notificationServiceURL)
 	log.Printf("CORS Origins: %s", corsOrigins)
+	log.Printf("Token audience: %s", audience)
+	log.Printf("OAuth client: %s (secret configured: %t)", oauthClientID, oauthClientSecret != "")
+	log.Printf("Subtask policies: %s on complete, %s on delete", subtaskCompletePolicy, subtaskDeletePolicy)
+	log.Printf("Blocked task policy: %s", blockedTaskPolicy)
+	log.Printf("Attachment store: %s, up to %d bytes", attachmentStoreName, attachmentMaxSize)
 
 	if err := http.ListenAndServe(":"+port, router); err != nil {
 		log.Fatal("Server failed to start:", err)
 	}
 }
 
-func initDatabase(databaseURL string) (*sql.DB, error) {
+// openDatabase opens the SQLite database without touching its schema
+func openDatabase(databaseURL string) (*sql.DB, error) {
 	// Create data directory if it doesn't exist
 	if err := os.MkdirAll("./data", 0755); err != nil {
 		return nil, fmt.Errorf("failed to create data directory: %v", err)
@@ -102,37 +263,37 @@ func initDatabase(databaseURL string) (*sql.DB, error) {
 		return nil, fmt.Errorf("failed to open database: %v", err)
 	}
 
-	// Create tasks table
-	createTableSQL := `
-	CREATE TABLE IF NOT EXISTS tasks (
-		id INTEGER PRIMARY KEY AUTOINCREMENT,
-		title TEXT NOT NULL,
-		description TEXT,
-		status TEXT DEFAULT 'pending',
-		priority TEXT DEFAULT 'medium',
-		user_id INTEGER NOT NULL,
-		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
-		updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
-	);
-	`
-
-	if _, err := db.Exec(createTableSQL); err != nil {
-		return nil, fmt.Errorf("failed to create tasks table: %v", err)
+	// The task search index needs FTS5
+	if err := checkFTS5(db); err != nil {
+		db.Close()
+		return nil, err
 	}
+	return db, nil
+}
 
-	// Create trigger to update updated_at timestamp
-	triggerSQL := `
-	CREATE TRIGGER IF NOT EXISTS update_tasks_updated_at 
-	AFTER UPDATE ON tasks
-	BEGIN
-		UPDATE tasks SET updated_at = CURRENT_TIMESTAMP WHERE id = NEW.id;
-	END;
-	`
+// initDatabase opens the database, applies pending migrations when
+// autoMigrate is set and checks the schema version
+func initDatabase(databaseURL string, autoMigrate bool) (*sql.DB, error) {
+	db, err := openDatabase(databaseURL)
+	if err != nil {
+		return nil, err
+	}
 
-	if _, err := db.Exec(triggerSQL); err != nil {
-		return nil, fmt.Errorf("failed to create update trigger: %v", err)
+	if autoMigrate {
+		result, err := migrateDatabase(db, -1, false)
+		if err != nil {
+			db.Close()
+			return nil, fmt.Errorf("failed to migrate database: %v", err)
+		}
+		for _, step := range result.Steps {
+			log.Printf("Applied migration %d_%s", step.Version, step.Name)
+		}
 	}
 
+	if err := checkSchemaVersion(db); err != nil {
+		db.Close()
+		return nil, err
+	}
 	return db, nil
 }
 
@@ -145,12 +306,44 @@ func setupRoutes(taskService *TaskService) *mux.Router {
 	// Health check endpoint
 	router.HandleFunc("/health", healthCheck).Methods("GET")
 
+	// Attachment downloads are authorized by their signed URL
+	router.HandleFunc("/api/attachments/{id}/content", taskService.downloadAttachmentHandler).Methods("GET")
+
 	// Task endpoints (all require authentication)
 	router.HandleFunc("/api/tasks", taskService.authMiddleware(taskService.getTasksHandler)).Methods("GET")
 	router.HandleFunc("/api/tasks", taskService.authMiddleware(taskService.createTaskHandler)).Methods("POST")
 	router.HandleFunc("/api/tasks/{id}", taskService.authMiddleware(taskService.getTaskHandler)).Methods("GET")
 	router.HandleFunc("/api/tasks/{id}", taskService.authMiddleware(taskService.updateTaskHandler)).Methods("PUT")
 	router.HandleFunc("/api/tasks/{id}", taskService.authMiddleware(taskService.deleteTaskHandler)).Methods("DELETE")
+	router.HandleFunc("/api/tasks/{id}/recurrence", taskService.authMiddleware(taskService.setRecurrenceHandler)).Methods("PUT")
+	router.HandleFunc("/api/tasks/{id}/recurrence", taskService.authMiddleware(taskService.endRecurrenceHandler)).Methods("DELETE")
+	router.HandleFunc("/api/tasks/{id}/subtasks", taskService.authMiddleware(taskService.getSubtasksHandler)).Methods("GET")
+	router.HandleFunc("/api/tasks/{id}/links", taskService.authMiddleware(taskService.getLinksHandler)).Methods("GET")
+	router.HandleFunc("/api/tasks/{id}/links", taskService.authMiddleware(taskService.addLinkHandler)).Methods("POST")
+	router.HandleFunc("/api/tasks/{id}/links/{linkId}", taskService.authMiddleware(taskService.deleteLinkHandler)).Methods("DELETE")
+	router.HandleFunc("/api/tasks/{id}/skip", taskService.authMiddleware(taskService.skipOccurrenceHandler)).Methods("POST")
+	router.HandleFunc("/api/tasks/{id}/shares", taskService.authMiddleware(taskService.getSharesHandler)).Methods("GET")
+	router.HandleFunc("/api/tasks/{id}/shares", taskService.authMiddleware(taskService.shareTaskHandler)).Methods("POST")
+	router.HandleFunc("/api/tasks/{id}/shares/{userId}", taskService.authMiddleware(taskService.unshareTaskHandler)).Methods("DELETE")
+	router.HandleFunc("/api/tasks/{id}/attachments", taskService.authMiddleware(taskService.getAttachmentsHandler)).Methods("GET")
+	router.HandleFunc("/api/tasks/{id}/attachments", taskService.authMiddleware(taskService.uploadAttachmentHandler)).Methods("POST")
+	router.HandleFunc("/api/tasks/{id}/attachments/{attachmentId}", taskService.authMiddleware(taskService.getAttachmentHandler)).Methods("GET")
+	router.HandleFunc("/api/tasks/{id}/attachments/{attachmentId}", taskService.authMiddleware(taskService.deleteAttachmentHandler)).Methods("DELETE")
+	router.HandleFunc("/api/tasks/{id}/comments", taskService.authMiddleware(taskService.getCommentsHandler)).Methods("GET")
+	router.HandleFunc("/api/tasks/{id}/comments", taskService.authMiddleware(taskService.createCommentHandler)).Methods("POST")
+	router.HandleFunc("/api/tasks/{id}/comments/{commentId}", taskService.authMiddleware(taskService.updateCommentHandler)).Methods("PUT")
+	router.HandleFunc("/api/tasks/{id}/comments/{commentId}", taskService.authMiddleware(taskService.deleteCommentHandler)).Methods("DELETE")
+	router.HandleFunc("/api/tasks/{id}/comments/{commentId}/history", taskService.authMiddleware(taskService.getCommentHistoryHandler)).Methods("GET")
+
+	// Tag endpoints
+	router.HandleFunc("/api/tags", taskService.authMiddleware(taskService.getTagsHandler)).Methods("GET")
+	router.HandleFunc("/api/tags", taskService.authMiddleware(taskService.createTagHandler)).Methods("POST")
+	router.HandleFunc("/api/tags/{id}", taskService.authMiddleware(taskService.updateTagHandler)).Methods("PUT")
+	router.HandleFunc("/api/tags/{id}", taskService.authMiddleware(taskService.deleteTagHandler)).Methods("DELETE")
+	router.HandleFunc("/api/tags/{id}/merge", taskService.authMiddleware(taskService.mergeTagHandler)).Methods("POST")
+
+	// Called by the auth service when it deletes a user
+	router.HandleFunc("/api/users/{id}", taskService.serviceMiddleware("users:delete", taskService.deleteUserDataHandler)).Methods("DELETE")
 
 	return router
 }
@@ -197,23 +390,102 @@ func (ts *TaskService) authMiddleware(next http.HandlerFunc) http.HandlerFunc {
 		}
 
 		// Validate token with auth service
-		userID, err := ts.validateToken(tokenString)
+		userID, username, err := ts.validateToken(tokenString, requiredScope(r))
+		if err == errInsufficientScope {
+			http.Error(w, "Insufficient token scope", http.StatusForbidden)
+			return
+		}
 		if err != nil {
 			http.Error(w, "Invalid token", http.StatusUnauthorized)
 			return
 		}
 
-		// Add user ID to request context
+		// Add user ID and username to request context
 		r.Header.Set("X-User-ID", strconv.Itoa(userID))
+		r.Header.Set("X-Username", username)
+		next.ServeHTTP(w, r)
+	}
+}
+
+// errInsufficientScope means the token is valid but down-scoped below what
+// the request needs
+var errInsufficientScope = errors.New("insufficient token scope")
+
+// requiredScope is the scope a down-scoped token needs for the request.
+// Tokens without a scope claim are accepted for every request.
+func requiredScope(r *http.Request) string {
+	if r.Method == http.MethodGet {
+		return "tasks:read"
+	}
+	return "tasks:write"
+}
+
+// serviceMiddleware lets other services make requests that act for no user.
+// They need a token issued to them, by the client credentials grant, that
+// explicitly grants scope.
+func (ts *TaskService) serviceMiddleware(scope string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		tokenString := r.Header.Get("Authorization")
+		if tokenString == "" {
+			http.Error(w, "Authorization header required", http.StatusUnauthorized)
+			return
+		}
+
+		// Remove "Bearer " prefix if present
+		if len(tokenString) > 7 && tokenString[:7] == "Bearer " {
+			tokenString = tokenString[7:]
+		}
+
+		token, err := ts.checkToken(tokenString, scope)
+		if err == errInsufficientScope {
+			http.Error(w, "Insufficient token scope", http.StatusForbidden)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Invalid token", http.StatusUnauthorized)
+			return
+		}
+		if token.ClientID == "" || token.UserID != 0 || !hasScope(token.Scope, scope) {
+			http.Error(w, "A service token with the "+scope+" scope is required", http.StatusForbidden)
+			return
+		}
+
 		next.ServeHTTP(w, r)
 	}
 }
 
-func (ts *TaskService) validateToken(tokenString string) (int, error) {
+// validatedToken is what the auth service reports about a valid token
+type validatedToken struct {
+	Valid    bool     `json:"valid"`
+	UserID   int      `json:"user_id"` // 0 for service tokens
+	Username string   `json:"username"`
+	Audience []string `json:"aud"`
+	Scope    string   `json:"scope"`     // empty for unrestricted tokens
+	ClientID string   `json:"client_id"` // set for tokens issued to a service
+}
+
+// validateToken checks a user's token and returns who it is for
+func (ts *TaskService) validateToken(tokenString, scope string) (int, string, error) {
+	token, err := ts.checkToken(tokenString, scope)
+	if err != nil {
+		return 0, "", err
+	}
+
+	// Service tokens act for no user
+	if token.UserID == 0 {
+		return 0, "", fmt.Errorf("token has no user")
+	}
+
+	return token.UserID, token.Username, nil
+}
+
+// checkToken has the auth service validate a token for this service's
+// audience and the scope the request needs
+func (ts *TaskService) checkToken(tokenString, scope string) (*validatedToken, error) {
 	// Call auth service to validate token
-	req, err := http.NewRequest("GET", ts.authServiceURL+"/api/auth/validate", nil)
+	req, err := http.NewRequest("GET", ts.authServiceURL+"/api/auth/validate?audience="+url.QueryEscape(ts.audience)+"&scope="+url.QueryEscape(scope), nil)
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
 
 	req.Header.Set("Authorization", "Bearer "+tokenString)
@@ -221,29 +493,31 @@ func (ts *TaskService) validateToken(tokenString string) (int, error) {
 	client := &http.Client{Timeout: 5 * time.Second}
 	resp, err := client.Do(req)
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		return 0, fmt.Errorf("token validation failed")
+	if resp.StatusCode == http.StatusForbidden {
+		return nil, errInsufficientScope
 	}
-
-	var validationResponse struct {
-		Valid    bool   `json:"valid"`
-		UserID   int    `json:"user_id"`
-		Username string `json:"username"`
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("token validation failed")
 	}
 
+	var validationResponse validatedToken
 	if err := json.NewDecoder(resp.Body).Decode(&validationResponse); err != nil {
-		return 0, err
+		return nil, err
 	}
 
 	if !validationResponse.Valid {
-		return 0, fmt.Errorf("invalid token")
+		return nil, fmt.Errorf("invalid token")
+	}
+
+	if !hasAudience(validationResponse.Audience, ts.audience) {
+		return nil, fmt.Errorf("token not issued for %s", ts.audience)
 	}
 
-	return validationResponse.UserID, nil
+	return &validationResponse, nil
 }
 
 func (ts *TaskService) getTasksHandler(w http.ResponseWriter, r *http.Request) {
@@ -254,47 +528,242 @@ func (ts *TaskService) getTasksHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	page, err := parsePageParams(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	// Get query parameters
 	status := r.URL.Query().Get("status")
 	priority := r.URL.Query().Get("priority")
-
-	// Build query
-	query := "SELECT id, title, description, status, priority, user_id, created_at, updated_at FROM tasks WHERE user_id = ?"
-	args := []interface{}{userID}
+	q := r.URL.Query().Get("q")
+
+	// Build filters; users see their own tasks and ones assigned or shared
+	// to them
+	visible := accessCondition("tasks", userID, false)
+	from := " FROM tasks"
+	where := " WHERE " + visible.sql
+	args := visible.args
+
+	// Full-text search joins the index and ranks by relevance
+	search := q != ""
+	if search {
+		match, err := parseSearchQuery(q)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		from = " FROM tasks_fts JOIN tasks ON tasks.id = tasks_fts.rowid"
+		where = " WHERE tasks_fts MATCH ? AND " + visible.sql
+		args = append([]interface{}{match}, visible.args...)
+	}
 
 	if status != "" {
-		query += " AND status = ?"
+		where += " AND tasks.status = ?"
 		args = append(args, status)
 	}
 
 	if priority != "" {
-		query += " AND priority = ?"
+		where += " AND tasks.priority = ?"
 		args = append(args, priority)
 	}
 
-	query += " ORDER BY created_at DESC"
+	dueConditions, err := dueFilters(r.URL.Query(), time.Now())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	tagConditions, err := tagFilters(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	sharingConditions, err := sharingFilters(r.URL.Query(), userID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	for _, cond := range append(append(dueConditions, tagConditions...), sharingConditions...) {
+		where += " AND (" + cond.sql + ")"
+		args = append(args, cond.args...)
+	}
+
+	if r.URL.Query().Get("blocked") != "" {
+		blocked, err := boolParam(r.URL.Query(), "blocked")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if blocked {
+			where += " AND " + blockedExpr
+		} else {
+			where += " AND NOT " + blockedExpr
+		}
+	}
+
+	// Newest first; IDs follow creation order. Search results go by relevance
+	// unless the filter sorts them.
+	order := defaultSort
+	if search {
+		order = relevanceSort
+	}
 
-	rows, err := ts.db.Query(query, args...)
+	// The tree view lists top-level tasks with their subtasks nested
+	view := r.URL.Query().Get("view")
+	if view != "" && view != "list" && view != "tree" {
+		http.Error(w, "view must be list or tree", http.StatusBadRequest)
+		return
+	}
+	// Subtasks of tasks the user can't see are top-level for them
+	if view == "tree" {
+		parentVisible := accessCondition("parent", userID, false)
+		where += " AND (tasks.parent_id IS NULL OR NOT EXISTS (SELECT 1 FROM tasks parent WHERE parent.id = tasks.parent_id AND " + parentVisible.sql + "))"
+		args = append(args, parentVisible.args...)
+	}
+
+	if expr := r.URL.Query().Get("filter"); expr != "" {
+		filter, err := parseTaskFilter(expr)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		for _, cond := range filter.conditions {
+			where += " AND (" + cond.sql + ")"
+			args = append(args, cond.args...)
+		}
+		if filter.sort != nil {
+			order = *filter.sort
+		}
+	}
+
+	// The total ignores the cursor so it stays the same on every page
+	var total *int
+	if page.IncludeTotal {
+		var count int
+		if err := ts.db.QueryRow("SELECT COUNT(*)"+from+where, args...).Scan(&count); err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		total = &count
+	}
+
+	columns := taskColumns
+	if search {
+		columns += ", " + searchColumns
+	}
+
+	paging := order.pagingSort()
+	direction, after := " ASC", " > ?"
+	if paging.desc {
+		direction, after = " DESC", " < ?"
+	}
+	orderBy := " ORDER BY tasks.id" + direction
+	if paging.keyed() {
+		columns += ", " + paging.expr
+		orderBy = " ORDER BY " + paging.expr + direction + ", tasks.id" + direction
+	}
+	if order.withinPage {
+		columns += ", " + order.expr
+	}
+
+	if page.After != nil {
+		if page.After.Sort != paging.name || paging.keyed() != (page.After.Key != nil) {
+			http.Error(w, "cursor belongs to a different listing", http.StatusBadRequest)
+			return
+		}
+		if paging.keyed() {
+			where += " AND (" + paging.expr + after + " OR (" + paging.expr + " = ? AND tasks.id" + after + "))"
+			args = append(args, page.After.Key, page.After.Key, page.After.ID)
+		} else {
+			where += " AND tasks.id" + after
+			args = append(args, page.After.ID)
+		}
+	}
+
+	// One extra row tells us whether there is a next page
+	args = append(args, page.Limit+1)
+
+	rows, err := ts.db.Query("SELECT "+columns+from+where+orderBy+" LIMIT ?", args...)
 	if err != nil {
 		http.Error(w, "Database error", http.StatusInternalServerError)
 		return
 	}
 	defer rows.Close()
 
-	var tasks []Task
+	tasks := []Task{}
+	var cursors []pageCursor
+	scores := map[int]float64{}
 	for rows.Next() {
-		var task Task
-		err := rows.Scan(&task.ID, &task.Title, &task.Description, &task.Status, &task.Priority, &task.UserID, &task.CreatedAt, &task.UpdatedAt)
+		var extra []interface{}
+		var titleSnippet, descriptionSnippet sql.NullString
+		if search {
+			extra = append(extra, &titleSnippet, &descriptionSnippet)
+		}
+		cursor := pageCursor{Sort: paging.name}
+		if paging.keyed() {
+			extra = append(extra, &cursor.Key)
+		}
+		var score float64
+		if order.withinPage {
+			extra = append(extra, &score)
+		}
+		task, err := scanTask(rows, extra...)
 		if err != nil {
 			http.Error(w, "Database scan error", http.StatusInternalServerError)
 			return
 		}
+		cursor.ID = task.ID
+		scores[task.ID] = score
+
+		if search {
+			task.Highlights = &TaskHighlights{
+				Title:       highlightSnippet(titleSnippet.String),
+				Description: highlightSnippet(descriptionSnippet.String),
+			}
+		}
 		tasks = append(tasks, task)
+		cursors = append(cursors, cursor)
+	}
+
+	response := newTaskPage(tasks, cursors, page.Limit)
+	response.Total = total
+	if order.withinPage {
+		sort.SliceStable(response.Tasks, func(i, j int) bool {
+			return scores[response.Tasks[i].ID] < scores[response.Tasks[j].ID]
+		})
+	}
+
+	if err := ts.attachTags(response.Tasks); err == nil {
+		err = ts.attachAccess(response.Tasks, userID)
+	}
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	if view == "tree" {
+		var ids []int
+		for _, task := range response.Tasks {
+			ids = append(ids, task.ID)
+		}
+		subtasks, err := loadSubtrees(ts.db, ids)
+		if err == nil {
+			err = ts.attachTags(subtasks)
+		}
+		if err == nil {
+			err = ts.attachAccess(subtasks, userID)
+		}
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		attachSubtasks(response.Tasks, visibleTasks(subtasks))
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(tasks)
+	json.NewEncoder(w).Encode(response)
 }
 
 func (ts *TaskService) createTaskHandler(w http.ResponseWriter, r *http.Request) {
@@ -322,29 +791,93 @@ func (ts *TaskService) createTaskHandler(w http.ResponseWriter, r *http.Request)
 		req.Priority = "medium"
 	}
 
+	schedule, err := resolveSchedule(taskSchedule{}, &req.DueAt, &req.StartAt, &req.Timezone)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	reminders, err := resolveReminders(req.Reminders, schedule)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var parentID *int
+	if req.ParentID != nil && *req.ParentID != 0 {
+		if err := ts.checkParent(0, *req.ParentID, userID); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		parentID = req.ParentID
+	}
+	tags, err := resolveTagNames(req.Tags)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	assignees, ok := ts.resolveAssignees(w, r, req.Assignees)
+	if !ok {
+		return
+	}
+	var rule *RRule
+	var recurFrom string
+	if req.Recurrence != nil {
+		rule, recurFrom, err = validateRecurrence(*req.Recurrence, schedule)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	tx, err := ts.db.Begin()
+	if err != nil {
+		http.Error(w, "Failed to create task", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
 	// Insert task
-	result, err := ts.db.Exec(`
-		INSERT INTO tasks (title, description, priority, user_id) 
-		VALUES (?, ?, ?, ?)
-	`, req.Title, req.Description, req.Priority, userID)
+	result, err := tx.Exec(`
+		INSERT INTO tasks (title, description, priority, user_id, due_at, start_at, timezone, parent_id) 
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+	`, req.Title, req.Description, req.Priority, userID, nullableDBTime(schedule.DueAt), nullableDBTime(schedule.StartAt), schedule.Timezone, parentID)
 
 	if err != nil {
 		http.Error(w, "Failed to create task", http.StatusInternalServerError)
 		return
 	}
 
-	// Get created task
 	taskID, _ := result.LastInsertId()
-	var task Task
-	err = ts.db.QueryRow(`
-		SELECT id, title, description, status, priority, user_id, created_at, updated_at 
-		FROM tasks WHERE id = ?
-	`, taskID).Scan(&task.ID, &task.Title, &task.Description, &task.Status, &task.Priority, &task.UserID, &task.CreatedAt, &task.UpdatedAt)
+	if err := saveSchedule(tx, int(taskID), schedule, schedule.DueAt != nil, &reminders); err != nil {
+		http.Error(w, "Failed to create task", http.StatusInternalServerError)
+		return
+	}
+	if err := saveTaskTags(tx, int(taskID), userID, tags); err != nil {
+		http.Error(w, "Failed to create task", http.StatusInternalServerError)
+		return
+	}
+	if _, err := saveAssignees(tx, int(taskID), assignees); err != nil {
+		http.Error(w, "Failed to create task", http.StatusInternalServerError)
+		return
+	}
+	if rule != nil {
+		template := newSeriesTemplate(req.Title, req.Description, req.Priority, schedule, reminders)
+		if err := createSeries(tx, int(taskID), userID, rule, recurFrom, schedule, template); err != nil {
+			http.Error(w, "Failed to create task", http.StatusInternalServerError)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Failed to create task", http.StatusInternalServerError)
+		return
+	}
 
+	// Get created task
+	task, err := ts.loadTask(int(taskID), userID)
 	if err != nil {
 		http.Error(w, "Failed to retrieve created task", http.StatusInternalServerError)
 		return
 	}
+	ts.notifyAssignees(r, task, assignees)
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusCreated)
@@ -366,12 +899,7 @@ func (ts *TaskService) getTaskHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var task Task
-	err = ts.db.QueryRow(`
-		SELECT id, title, description, status, priority, user_id, created_at, updated_at 
-		FROM tasks WHERE id = ? AND user_id = ?
-	`, taskID, userID).Scan(&task.ID, &task.Title, &task.Description, &task.Status, &task.Priority, &task.UserID, &task.CreatedAt, &task.UpdatedAt)
-
+	task, err := ts.loadTask(taskID, userID)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			http.Error(w, "Task not found", http.StatusNotFound)
@@ -407,13 +935,16 @@ func (ts *TaskService) updateTaskHandler(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	// Check if task exists and belongs to user
-	var existingTask Task
-	err = ts.db.QueryRow(`
-		SELECT id, title, description, status, priority, user_id, created_at, updated_at 
-		FROM tasks WHERE id = ? AND user_id = ?
-	`, taskID, userID).Scan(&existingTask.ID, &existingTask.Title, &existingTask.Description, &existingTask.Status, &existingTask.Priority, &existingTask.UserID, &existingTask.CreatedAt, &existingTask.UpdatedAt)
+	// Changes to a recurring task apply to this occurrence only, or to
+	// following ones as well
+	scope := r.URL.Query().Get("scope")
+	if scope != "" && scope != scopeThis && scope != scopeFollowing {
+		http.Error(w, "scope must be this or following", http.StatusBadRequest)
+		return
+	}
 
+	// Check if task exists and the user can change it
+	existingTask, err := ts.loadTask(taskID, userID)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			http.Error(w, "Task not found", http.StatusNotFound)
@@ -422,29 +953,155 @@ func (ts *TaskService) updateTaskHandler(w http.ResponseWriter, r *http.Request)
 		http.Error(w, "Database error", http.StatusInternalServerError)
 		return
 	}
+	if !existingTask.allows(accessEditor) {
+		http.Error(w, "You can't edit this task", http.StatusForbidden)
+		return
+	}
+
+	parentID := existingTask.ParentID
+	if req.ParentID != nil {
+		parentID = nil
+		if *req.ParentID != 0 {
+			if err := ts.checkParent(taskID, *req.ParentID, userID); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			parentID = req.ParentID
+		}
+	}
+	var tags []string
+	if req.Tags != nil {
+		if tags, err = resolveTagNames(*req.Tags); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	var assignees []UserRef
+	if req.Assignees != nil {
+		var ok bool
+		if assignees, ok = ts.resolveAssignees(w, r, *req.Assignees); !ok {
+			return
+		}
+	}
+	finishing := !isFinished(existingTask.Status) && isFinished(req.Status)
+
+	// Starting or finishing a task that waits on unfinished ones
+	if existingTask.Blocked && req.Status != existingTask.Status && (req.Status == statusInProgress || finishing) {
+		// Blockers the user can't see aren't named
+		message := "Task is blocked"
+		if blockers := existingTask.Links.blockers(); blockers != "" {
+			message += " by " + blockers
+		}
+		if ts.blockedTaskPolicy == blockedReject {
+			http.Error(w, message, http.StatusConflict)
+			return
+		}
+		w.Header().Set("Warning", `299 task-service "`+message+`"`)
+	}
+	policy, err := subtaskPolicy(r, ts.subtaskCompletePolicy)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	current := taskSchedule{DueAt: existingTask.DueAt, StartAt: existingTask.StartAt, Timezone: existingTask.Timezone}
+	schedule, err := resolveSchedule(current, req.DueAt, req.StartAt, req.Timezone)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var reminders *[]Reminder
+	if req.Reminders != nil {
+		resolved, err := resolveReminders(*req.Reminders, schedule)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		reminders = &resolved
+	}
+	dueChanged := !sameTime(current.DueAt, schedule.DueAt)
+	if scope == scopeFollowing {
+		if existingTask.SeriesID == nil {
+			http.Error(w, "Task is not recurring", http.StatusBadRequest)
+			return
+		}
+		if schedule.DueAt == nil {
+			http.Error(w, "recurring tasks need a due_at", http.StatusBadRequest)
+			return
+		}
+	}
+
+	tx, err := ts.db.Begin()
+	if err != nil {
+		http.Error(w, "Failed to update task", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
 
 	// Update task
-	_, err = ts.db.Exec(`
-		UPDATE tasks SET title = ?, description = ?, status = ?, priority = ? 
-		WHERE id = ? AND user_id = ?
-	`, req.Title, req.Description, req.Status, req.Priority, taskID, userID)
+	_, err = tx.Exec(`
+		UPDATE tasks SET title = ?, description = ?, status = ?, priority = ?, due_at = ?, start_at = ?, timezone = ?, parent_id = ? 
+		WHERE id = ?
+	`, req.Title, req.Description, req.Status, req.Priority, nullableDBTime(schedule.DueAt), nullableDBTime(schedule.StartAt), schedule.Timezone, parentID, taskID)
 
 	if err != nil {
 		http.Error(w, "Failed to update task", http.StatusInternalServerError)
 		return
 	}
 
-	// Get updated task
-	var task Task
-	err = ts.db.QueryRow(`
-		SELECT id, title, description, status, priority, user_id, created_at, updated_at 
-		FROM tasks WHERE id = ? AND user_id = ?
-	`, taskID, userID).Scan(&task.ID, &task.Title, &task.Description, &task.Status, &task.Priority, &task.UserID, &task.CreatedAt, &task.UpdatedAt)
+	if err := saveSchedule(tx, taskID, schedule, dueChanged, reminders); err != nil {
+		http.Error(w, "Failed to update task", http.StatusInternalServerError)
+		return
+	}
+	// Tags are the owner's, whoever sets them
+	if req.Tags != nil {
+		if err := saveTaskTags(tx, taskID, existingTask.UserID, tags); err != nil {
+			http.Error(w, "Failed to update task", http.StatusInternalServerError)
+			return
+		}
+	}
+	var assigned []UserRef
+	if req.Assignees != nil {
+		if assigned, err = saveAssignees(tx, taskID, assignees); err != nil {
+			http.Error(w, "Failed to update task", http.StatusInternalServerError)
+			return
+		}
+	}
+	if scope == scopeFollowing {
+		if err := updateFollowing(tx, &existingTask, req, schedule, reminders); err != nil {
+			http.Error(w, "Failed to update task", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if finishing {
+		if err := finishSubtasks(tx, taskID, userID, req.Status, policy); err != nil {
+			if err == errOpenSubtasks {
+				http.Error(w, "Task has unfinished subtasks", http.StatusConflict)
+				return
+			}
+			http.Error(w, "Failed to update task", http.StatusInternalServerError)
+			return
+		}
+
+		// Finishing an occurrence of a recurring task creates the next one
+		if _, err := advanceSeries(tx, existingTask, time.Now()); err != nil {
+			http.Error(w, "Failed to update task", http.StatusInternalServerError)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Failed to update task", http.StatusInternalServerError)
+		return
+	}
 
+	// Get updated task
+	task, err := ts.loadTask(taskID, userID)
 	if err != nil {
 		http.Error(w, "Failed to retrieve updated task", http.StatusInternalServerError)
 		return
 	}
+	ts.notifyAssignees(r, task, assigned)
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
@@ -466,35 +1123,172 @@ func (ts *TaskService) deleteTaskHandler(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	// Check if task exists and belongs to user
-	var count int
-	err = ts.db.QueryRow(`
-		SELECT COUNT(*) FROM tasks WHERE id = ? AND user_id = ?
-	`, taskID, userID).Scan(&count)
+	policy, err := subtaskPolicy(r, ts.subtaskDeletePolicy)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
+	// Check if task exists and belongs to user
+	task, err := ts.loadTask(taskID, userID)
 	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Task not found", http.StatusNotFound)
+			return
+		}
 		http.Error(w, "Database error", http.StatusInternalServerError)
 		return
 	}
-
-	if count == 0 {
-		http.Error(w, "Task not found", http.StatusNotFound)
+	if !task.allows(accessOwner) {
+		http.Error(w, "Only the task's owner can delete it", http.StatusForbidden)
 		return
 	}
 
 	// Delete task
-	_, err = ts.db.Exec(`
-		DELETE FROM tasks WHERE id = ? AND user_id = ?
-	`, taskID, userID)
-
+	tx, err := ts.db.Begin()
 	if err != nil {
 		http.Error(w, "Failed to delete task", http.StatusInternalServerError)
 		return
 	}
+	defer tx.Rollback()
+
+	if err := deleteSubtasks(tx, taskID, userID, policy); err != nil {
+		if err == errHasSubtasks {
+			http.Error(w, "Task has subtasks", http.StatusConflict)
+			return
+		}
+		http.Error(w, "Failed to delete task", http.StatusInternalServerError)
+		return
+	}
+	if err := deleteTask(tx, taskID); err != nil {
+		http.Error(w, "Failed to delete task", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Failed to delete task", http.StatusInternalServerError)
+		return
+	}
+	ts.purgeDeletedBlobsAsync()
 
 	w.WriteHeader(http.StatusNoContent)
 }
 
+// scanTask scans a row of taskColumns followed by the extra columns
+func scanTask(row rowScanner, extra ...interface{}) (Task, error) {
+	var task Task
+	var dueAt, startAt, occurrenceAt sql.NullTime
+	var seriesID, parentID sql.NullInt64
+	dest := []interface{}{&task.ID, &task.Title, &task.Description, &task.Status, &task.Priority, &task.UserID, &task.CreatedAt, &task.UpdatedAt, &dueAt, &startAt, &task.Timezone, &seriesID, &occurrenceAt, &parentID, &task.Blocked}
+	if err := row.Scan(append(dest, extra...)...); err != nil {
+		return task, err
+	}
+
+	loc := taskLocation(task.Timezone)
+	if dueAt.Valid {
+		t := dueAt.Time.In(loc)
+		task.DueAt = &t
+	}
+	if startAt.Valid {
+		t := startAt.Time.In(loc)
+		task.StartAt = &t
+	}
+	if seriesID.Valid {
+		id := int(seriesID.Int64)
+		task.SeriesID = &id
+	}
+	if occurrenceAt.Valid {
+		task.occurrenceAt = &occurrenceAt.Time
+	}
+	if parentID.Valid {
+		id := int(parentID.Int64)
+		task.ParentID = &id
+	}
+	task.Overdue = task.DueAt != nil && task.DueAt.Before(time.Now()) && !isFinished(task.Status)
+	return task, nil
+}
+
+// loadTask loads a task the user can see with its tags, assignees, the
+// user's access, reminders, recurrence, subtask progress and links
+func (ts *TaskService) loadTask(taskID, userID int) (Task, error) {
+	visible := accessCondition("tasks", userID, false)
+	task, err := scanTask(ts.db.QueryRow(`
+		SELECT `+taskColumns+` 
+		FROM tasks WHERE id = ? AND `+visible.sql+`
+	`, append([]interface{}{taskID}, visible.args...)...))
+	if err != nil {
+		return task, err
+	}
+	tasks := []Task{task}
+	if err := ts.attachTags(tasks); err != nil {
+		return task, err
+	}
+	if err := ts.attachAccess(tasks, userID); err != nil {
+		return task, err
+	}
+	task = tasks[0]
+	if err := ts.loadReminders(&task); err != nil {
+		return task, err
+	}
+	if err := ts.loadProgress(&task); err != nil {
+		return task, err
+	}
+	if err := ts.loadLinks(&task, userID); err != nil {
+		return task, err
+	}
+	return task, ts.loadRecurrence(&task)
+}
+
+// deleteTask removes a task and everything that belongs to it
+func deleteTask(tx *sql.Tx, taskID int) error {
+	for _, stmt := range []string{
+		"DELETE FROM task_reminders WHERE task_id = ?",
+		"DELETE FROM task_tags WHERE task_id = ?",
+		"DELETE FROM task_assignees WHERE task_id = ?",
+		"DELETE FROM task_shares WHERE task_id = ?",
+		"DELETE FROM task_links WHERE task_id = ?1 OR target_id = ?1",
+		"DELETE FROM task_comment_mentions WHERE comment_id IN (SELECT id FROM task_comments WHERE task_id = ?)",
+		"DELETE FROM task_comment_edits WHERE comment_id IN (SELECT id FROM task_comments WHERE task_id = ?)",
+		"DELETE FROM task_comments WHERE task_id = ?",
+		// Their blobs are removed once the transaction commits
+		"INSERT OR IGNORE INTO deleted_blobs (storage_key) SELECT storage_key FROM task_attachments WHERE task_id = ?",
+		"DELETE FROM task_attachments WHERE task_id = ?",
+		// A series goes with its last occurrence
+		`DELETE FROM task_series WHERE id IN (SELECT series_id FROM tasks WHERE id = ?1)
+			AND NOT EXISTS (SELECT 1 FROM tasks WHERE series_id = task_series.id AND id != ?1)`,
+		"DELETE FROM tasks WHERE id = ?",
+	} {
+		if _, err := tx.Exec(stmt, taskID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func sameTime(a, b *time.Time) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Equal(*b)
+}
+
+func hasAudience(audience []string, want string) bool {
+	for _, aud := range audience {
+		if aud == want {
+			return true
+		}
+	}
+	return false
+}
+
+func hasScope(scope, want string) bool {
+	for _, s := range strings.Fields(scope) {
+		if s == want {
+			return true
+		}
+	}
+	return false
+}
+
 func getEnv(key, defaultValue string) string {
 	if value := os.Getenv(key); value != "" {
 		return value
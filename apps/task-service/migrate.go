@@ -0,0 +1,335 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"embed"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// migrationFiles holds the schema migrations, named
+// NNNN_description.up.sql and NNNN_description.down.sql
+//
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+var migrationFileName = regexp.MustCompile(`^(\d+)_([a-z0-9_]+)\.(up|down)\.sql$`)
+
+// migrationLockTimeout is how long a replica waits for another one to finish migrating
+const migrationLockTimeout = 2 * time.Minute
+
+type migration struct {
+	version  int
+	name     string
+	up       string
+	down     string
+	checksum string
+}
+
+// MigrationStep is a migration that was (or, in a dry run, would be) applied
+type MigrationStep struct {
+	Version   int    `json:"version"`
+	Name      string `json:"name"`
+	Direction string `json:"direction"`
+	SQL       string `json:"sql,omitempty"`
+}
+
+// MigrationResult describes a migration run
+type MigrationResult struct {
+	FromVersion int             `json:"from_version"`
+	ToVersion   int             `json:"to_version"`
+	DryRun      bool            `json:"dry_run"`
+	Steps       []MigrationStep `json:"steps"`
+}
+
+// AppliedMigration is a row of schema_migrations
+type AppliedMigration struct {
+	Version   int       `json:"version"`
+	Name      string    `json:"name"`
+	AppliedAt time.Time `json:"applied_at"`
+}
+
+// MigrationStatus compares the database with the migrations in this binary
+type MigrationStatus struct {
+	Version       int                `json:"version"`
+	LatestVersion int                `json:"latest_version"`
+	Applied       []AppliedMigration `json:"applied"`
+	Pending       []MigrationStep    `json:"pending"`
+}
+
+// sqlExecer is satisfied by *sql.DB, *sql.Conn and *sql.Tx
+type sqlExecer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// loadMigrations reads the embedded migrations ordered by version
+func loadMigrations() ([]migration, error) {
+	entries, err := fs.ReadDir(migrationFiles, "migrations")
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := map[int]*migration{}
+	for _, entry := range entries {
+		match := migrationFileName.FindStringSubmatch(entry.Name())
+		if match == nil {
+			return nil, fmt.Errorf("invalid migration file name %q", entry.Name())
+		}
+		version, _ := strconv.Atoi(match[1])
+		content, err := migrationFiles.ReadFile("migrations/" + entry.Name())
+		if err != nil {
+			return nil, err
+		}
+
+		m := byVersion[version]
+		if m == nil {
+			m = &migration{version: version, name: match[2]}
+			byVersion[version] = m
+		}
+		if m.name != match[2] {
+			return nil, fmt.Errorf("migration %d has conflicting names %q and %q", version, m.name, match[2])
+		}
+		if match[3] == "up" {
+			m.up = string(content)
+			sum := sha256.Sum256(content)
+			m.checksum = hex.EncodeToString(sum[:])
+		} else {
+			m.down = string(content)
+		}
+	}
+
+	migrations := make([]migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.up == "" {
+			return nil, fmt.Errorf("migration %d has no up file", m.version)
+		}
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].version < migrations[j].version
+	})
+	return migrations, nil
+}
+
+func latestVersion(migrations []migration) int {
+	if len(migrations) == 0 {
+		return 0
+	}
+	return migrations[len(migrations)-1].version
+}
+
+// migrateDatabase moves the schema to the target version (latest when target
+// is negative). It holds SQLite's write lock for the whole run, so replicas
+// starting together apply each migration once: the others wait and then find
+// nothing to do. A dry run executes the same statements and rolls back, so
+// broken SQL is reported without changing the database.
+func migrateDatabase(db *sql.DB, target int, dryRun bool) (*MigrationResult, error) {
+	migrations, err := loadMigrations()
+	if err != nil {
+		return nil, err
+	}
+	if target < 0 {
+		target = latestVersion(migrations)
+	}
+	if target > latestVersion(migrations) {
+		return nil, fmt.Errorf("unknown target version %d (latest is %d)", target, latestVersion(migrations))
+	}
+
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, fmt.Sprintf("PRAGMA busy_timeout = %d", migrationLockTimeout.Milliseconds())); err != nil {
+		return nil, err
+	}
+	if _, err := conn.ExecContext(ctx, "BEGIN IMMEDIATE"); err != nil {
+		return nil, fmt.Errorf("failed to acquire migration lock: %v", err)
+	}
+	committed := false
+	defer func() {
+		if !committed {
+			conn.ExecContext(ctx, "ROLLBACK")
+		}
+	}()
+
+	if err := createMigrationsTable(ctx, conn); err != nil {
+		return nil, err
+	}
+	applied, err := appliedMigrations(ctx, conn)
+	if err != nil {
+		return nil, err
+	}
+	current, err := verifyAppliedMigrations(migrations, applied)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &MigrationResult{FromVersion: current, ToVersion: target, DryRun: dryRun, Steps: []MigrationStep{}}
+
+	for _, m := range migrations {
+		if target > current && m.version > current && m.version <= target {
+			if _, err := conn.ExecContext(ctx, m.up); err != nil {
+				return nil, fmt.Errorf("migration %d_%s failed: %v", m.version, m.name, err)
+			}
+			_, err := conn.ExecContext(ctx, `
+				INSERT INTO schema_migrations (version, name, checksum, applied_at) VALUES (?, ?, ?, ?)
+			`, m.version, m.name, m.checksum, time.Now().UTC())
+			if err != nil {
+				return nil, err
+			}
+			result.Steps = append(result.Steps, MigrationStep{m.version, m.name, "up", m.up})
+		}
+	}
+
+	for i := len(migrations) - 1; i >= 0; i-- {
+		m := migrations[i]
+		if target < current && m.version <= current && m.version > target {
+			if m.down == "" {
+				return nil, fmt.Errorf("migration %d_%s cannot be rolled back", m.version, m.name)
+			}
+			if _, err := conn.ExecContext(ctx, m.down); err != nil {
+				return nil, fmt.Errorf("rollback of migration %d_%s failed: %v", m.version, m.name, err)
+			}
+			if _, err := conn.ExecContext(ctx, "DELETE FROM schema_migrations WHERE version = ?", m.version); err != nil {
+				return nil, err
+			}
+			result.Steps = append(result.Steps, MigrationStep{m.version, m.name, "down", m.down})
+		}
+	}
+
+	if dryRun {
+		return result, nil
+	}
+	if _, err := conn.ExecContext(ctx, "COMMIT"); err != nil {
+		return nil, err
+	}
+	committed = true
+	return result, nil
+}
+
+// checkSchemaVersion fails unless the database is exactly at the latest
+// version this binary knows, with unmodified migrations
+func checkSchemaVersion(db *sql.DB) error {
+	status, err := migrationStatus(db)
+	if err != nil {
+		return err
+	}
+	if status.Version > status.LatestVersion {
+		return fmt.Errorf("database schema version %d is newer than this build supports (%d)", status.Version, status.LatestVersion)
+	}
+	if len(status.Pending) > 0 {
+		return fmt.Errorf("database schema is at version %d but this build needs %d; run the migrate command", status.Version, status.LatestVersion)
+	}
+	return nil
+}
+
+// migrationStatus reports applied and pending migrations without changing anything
+func migrationStatus(db *sql.DB) (*MigrationStatus, error) {
+	migrations, err := loadMigrations()
+	if err != nil {
+		return nil, err
+	}
+
+	ctx := context.Background()
+	if err := createMigrationsTable(ctx, db); err != nil {
+		return nil, err
+	}
+	applied, err := appliedMigrations(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+
+	status := &MigrationStatus{
+		LatestVersion: latestVersion(migrations),
+		Applied:       []AppliedMigration{},
+		Pending:       []MigrationStep{},
+	}
+	for _, a := range applied {
+		status.Applied = append(status.Applied, a.AppliedMigration)
+		status.Version = a.Version
+	}
+	if status.Version > status.LatestVersion {
+		return status, nil
+	}
+	if _, err := verifyAppliedMigrations(migrations, applied); err != nil {
+		return nil, err
+	}
+
+	for _, m := range migrations {
+		if m.version > status.Version {
+			status.Pending = append(status.Pending, MigrationStep{Version: m.version, Name: m.name, Direction: "up"})
+		}
+	}
+	return status, nil
+}
+
+type appliedMigration struct {
+	AppliedMigration
+	checksum string
+}
+
+func createMigrationsTable(ctx context.Context, db sqlExecer) error {
+	_, err := db.ExecContext(ctx, `
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			version INTEGER PRIMARY KEY,
+			name TEXT NOT NULL,
+			checksum TEXT NOT NULL,
+			applied_at DATETIME NOT NULL
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create schema_migrations table: %v", err)
+	}
+	return nil
+}
+
+func appliedMigrations(ctx context.Context, db sqlExecer) ([]appliedMigration, error) {
+	rows, err := db.QueryContext(ctx, "SELECT version, name, checksum, applied_at FROM schema_migrations ORDER BY version")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var applied []appliedMigration
+	for rows.Next() {
+		var a appliedMigration
+		if err := rows.Scan(&a.Version, &a.Name, &a.checksum, &a.AppliedAt); err != nil {
+			return nil, err
+		}
+		applied = append(applied, a)
+	}
+	return applied, rows.Err()
+}
+
+// verifyAppliedMigrations returns the current version, refusing databases
+// migrated by a newer build or with migrations edited after they were applied
+func verifyAppliedMigrations(migrations []migration, applied []appliedMigration) (int, error) {
+	known := map[int]migration{}
+	for _, m := range migrations {
+		known[m.version] = m
+	}
+
+	current := 0
+	for _, a := range applied {
+		m, ok := known[a.Version]
+		if !ok {
+			return 0, fmt.Errorf("database has migration %d_%s which this build does not know; it was migrated by a newer version", a.Version, a.Name)
+		}
+		if m.checksum != a.checksum {
+			return 0, fmt.Errorf("migration %d_%s was modified after it was applied", a.Version, a.Name)
+		}
+		current = a.Version
+	}
+	return current, nil
+}
@@ -0,0 +1,2 @@
+DROP TRIGGER IF EXISTS update_tasks_updated_at;
+DROP TABLE IF EXISTS tasks;
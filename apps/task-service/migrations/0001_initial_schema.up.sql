@@ -0,0 +1,19 @@
+-- Baseline schema. Databases created before versioned migrations already
+-- have these objects, so every statement must be safe to re-run.
+
+CREATE TABLE IF NOT EXISTS tasks (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	title TEXT NOT NULL,
+	description TEXT,
+	status TEXT DEFAULT 'pending',
+	priority TEXT DEFAULT 'medium',
+	user_id INTEGER NOT NULL,
+	created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+	updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TRIGGER IF NOT EXISTS update_tasks_updated_at
+AFTER UPDATE ON tasks
+BEGIN
+	UPDATE tasks SET updated_at = CURRENT_TIMESTAMP WHERE id = NEW.id;
+END;
@@ -0,0 +1,2 @@
+-- Task lists are filtered by user and paged by ID
+CREATE INDEX idx_tasks_user_id ON tasks(user_id, id);
@@ -0,0 +1,29 @@
+-- Full-text index over task titles and descriptions. It reads its content
+-- from the tasks table; the triggers keep it in sync. Requires a binary built
+-- with -tags sqlite_fts5.
+CREATE VIRTUAL TABLE tasks_fts USING fts5(
+	title,
+	description,
+	content = 'tasks',
+	content_rowid = 'id',
+	tokenize = 'unicode61 remove_diacritics 2',
+	prefix = '2 3'
+);
+
+INSERT INTO tasks_fts (tasks_fts) VALUES ('rebuild');
+
+CREATE TRIGGER tasks_fts_insert AFTER INSERT ON tasks
+BEGIN
+	INSERT INTO tasks_fts (rowid, title, description) VALUES (NEW.id, NEW.title, NEW.description);
+END;
+
+CREATE TRIGGER tasks_fts_delete AFTER DELETE ON tasks
+BEGIN
+	INSERT INTO tasks_fts (tasks_fts, rowid, title, description) VALUES ('delete', OLD.id, OLD.title, OLD.description);
+END;
+
+CREATE TRIGGER tasks_fts_update AFTER UPDATE OF title, description ON tasks
+BEGIN
+	INSERT INTO tasks_fts (tasks_fts, rowid, title, description) VALUES ('delete', OLD.id, OLD.title, OLD.description);
+	INSERT INTO tasks_fts (rowid, title, description) VALUES (NEW.id, NEW.title, NEW.description);
+END;
@@ -0,0 +1,7 @@
+DROP INDEX IF EXISTS idx_task_reminders_pending;
+DROP INDEX IF EXISTS idx_task_reminders_task_id;
+DROP TABLE IF EXISTS task_reminders;
+DROP INDEX IF EXISTS idx_tasks_due_at;
+ALTER TABLE tasks DROP COLUMN timezone;
+ALTER TABLE tasks DROP COLUMN start_at;
+ALTER TABLE tasks DROP COLUMN due_at;
@@ -0,0 +1,20 @@
+-- Due and start dates, stored as UTC text, and the IANA timezone the task
+-- is scheduled in
+ALTER TABLE tasks ADD COLUMN due_at DATETIME;
+ALTER TABLE tasks ADD COLUMN start_at DATETIME;
+ALTER TABLE tasks ADD COLUMN timezone TEXT NOT NULL DEFAULT 'UTC';
+CREATE INDEX idx_tasks_due_at ON tasks(due_at);
+
+-- Notifications the scheduler sends for a task. Reminders are set by users,
+-- either at a fixed time or minutes_before the due date; the overdue notice
+-- is kept at the due date. sent_at is set once a row has been handled.
+CREATE TABLE task_reminders (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	task_id INTEGER NOT NULL,
+	kind TEXT NOT NULL DEFAULT 'reminder',
+	minutes_before INTEGER,
+	remind_at DATETIME NOT NULL,
+	sent_at DATETIME
+);
+CREATE INDEX idx_task_reminders_task_id ON task_reminders(task_id);
+CREATE INDEX idx_task_reminders_pending ON task_reminders(remind_at) WHERE sent_at IS NULL;
@@ -0,0 +1,4 @@
+DROP INDEX IF EXISTS idx_tasks_series_id;
+ALTER TABLE tasks DROP COLUMN occurrence_at;
+ALTER TABLE tasks DROP COLUMN series_id;
+DROP TABLE IF EXISTS task_series;
@@ -0,0 +1,24 @@
+-- Recurring tasks. Each occurrence is a task; the series holds the rule,
+-- anchored at dtstart, and the template new occurrences are made from.
+-- occurrence_at is the slot an occurrence fills, which stays put when its
+-- due date is moved.
+CREATE TABLE task_series (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	user_id INTEGER NOT NULL,
+	rrule TEXT NOT NULL,
+	timezone TEXT NOT NULL DEFAULT 'UTC',
+	recur_from TEXT NOT NULL DEFAULT 'due',
+	dtstart DATETIME NOT NULL,
+	title TEXT NOT NULL,
+	description TEXT,
+	priority TEXT,
+	start_offset INTEGER,
+	reminder_minutes TEXT,
+	occurrences INTEGER NOT NULL DEFAULT 1,
+	ended_at DATETIME,
+	created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+
+ALTER TABLE tasks ADD COLUMN series_id INTEGER;
+ALTER TABLE tasks ADD COLUMN occurrence_at DATETIME;
+CREATE INDEX idx_tasks_series_id ON tasks(series_id, occurrence_at);
@@ -0,0 +1,3 @@
+-- Subtasks point at their parent task; top-level tasks have none
+ALTER TABLE tasks ADD COLUMN parent_id INTEGER;
+CREATE INDEX idx_tasks_parent_id ON tasks(parent_id);
@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS idx_task_links_target_id;
+DROP INDEX IF EXISTS idx_task_links_pair;
+DROP TABLE IF EXISTS task_links;
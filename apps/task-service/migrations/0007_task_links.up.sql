@@ -0,0 +1,12 @@
+-- Links between tasks. A blocks link means task_id has to be finished before
+-- target_id can be started; relates_to links are stored with the lower task
+-- ID first.
+CREATE TABLE task_links (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	task_id INTEGER NOT NULL,
+	target_id INTEGER NOT NULL,
+	kind TEXT NOT NULL,
+	created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+CREATE UNIQUE INDEX idx_task_links_pair ON task_links(task_id, target_id, kind);
+CREATE INDEX idx_task_links_target_id ON task_links(target_id, kind);
@@ -0,0 +1,16 @@
+-- Each user's tags; names are unique per user regardless of case
+CREATE TABLE tags (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	user_id INTEGER NOT NULL,
+	name TEXT NOT NULL,
+	color TEXT NOT NULL DEFAULT '#6b7280',
+	created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+CREATE UNIQUE INDEX idx_tags_user_name ON tags(user_id, name COLLATE NOCASE);
+
+CREATE TABLE task_tags (
+	task_id INTEGER NOT NULL,
+	tag_id INTEGER NOT NULL,
+	PRIMARY KEY (task_id, tag_id)
+);
+CREATE INDEX idx_task_tags_tag_id ON task_tags(tag_id);
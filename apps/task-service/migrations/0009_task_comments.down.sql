@@ -0,0 +1,5 @@
+DROP TABLE IF EXISTS task_comment_mentions;
+DROP INDEX IF EXISTS idx_task_comment_edits_comment_id;
+DROP TABLE IF EXISTS task_comment_edits;
+DROP INDEX IF EXISTS idx_task_comments_task_id;
+DROP TABLE IF EXISTS task_comments;
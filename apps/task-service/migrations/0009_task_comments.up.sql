@@ -0,0 +1,29 @@
+-- Comments on tasks, with their Markdown body. updated_at is set once a
+-- comment has been edited.
+CREATE TABLE task_comments (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	task_id INTEGER NOT NULL,
+	user_id INTEGER NOT NULL,
+	username TEXT NOT NULL,
+	body TEXT NOT NULL,
+	created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+	updated_at DATETIME
+);
+CREATE INDEX idx_task_comments_task_id ON task_comments(task_id, id);
+
+-- The earlier bodies of edited comments
+CREATE TABLE task_comment_edits (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	comment_id INTEGER NOT NULL,
+	body TEXT NOT NULL,
+	edited_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX idx_task_comment_edits_comment_id ON task_comment_edits(comment_id, id);
+
+-- Users mentioned in comments, so edits only notify new mentions
+CREATE TABLE task_comment_mentions (
+	comment_id INTEGER NOT NULL,
+	user_id INTEGER NOT NULL,
+	username TEXT NOT NULL,
+	PRIMARY KEY (comment_id, user_id)
+);
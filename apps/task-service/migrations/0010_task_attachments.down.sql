@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS deleted_blobs;
+DROP INDEX IF EXISTS idx_task_attachments_task_id;
+DROP TABLE IF EXISTS task_attachments;
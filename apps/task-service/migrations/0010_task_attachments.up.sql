@@ -0,0 +1,20 @@
+-- Files attached to tasks. The contents are in the blob store under
+-- storage_key.
+CREATE TABLE task_attachments (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	task_id INTEGER NOT NULL,
+	user_id INTEGER NOT NULL,
+	filename TEXT NOT NULL,
+	content_type TEXT NOT NULL,
+	size INTEGER NOT NULL,
+	storage_key TEXT NOT NULL,
+	created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX idx_task_attachments_task_id ON task_attachments(task_id);
+
+-- Blobs of deleted attachments, removed from the store once the deletion
+-- has committed
+CREATE TABLE deleted_blobs (
+	storage_key TEXT PRIMARY KEY,
+	deleted_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
@@ -0,0 +1,4 @@
+DROP INDEX IF EXISTS idx_task_shares_user_id;
+DROP TABLE IF EXISTS task_shares;
+DROP INDEX IF EXISTS idx_task_assignees_user_id;
+DROP TABLE IF EXISTS task_assignees;
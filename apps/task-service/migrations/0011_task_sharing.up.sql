@@ -0,0 +1,21 @@
+-- Users working on a task, besides its creator in tasks.user_id. Assignees
+-- can edit the task.
+CREATE TABLE task_assignees (
+	task_id INTEGER NOT NULL,
+	user_id INTEGER NOT NULL,
+	username TEXT NOT NULL,
+	assigned_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+	PRIMARY KEY (task_id, user_id)
+);
+CREATE INDEX idx_task_assignees_user_id ON task_assignees(user_id);
+
+-- Users a task is shared with, as a viewer or editor
+CREATE TABLE task_shares (
+	task_id INTEGER NOT NULL,
+	user_id INTEGER NOT NULL,
+	username TEXT NOT NULL,
+	role TEXT NOT NULL,
+	created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+	PRIMARY KEY (task_id, user_id)
+);
+CREATE INDEX idx_task_shares_user_id ON task_shares(user_id);
@@ -0,0 +1,2 @@
+ALTER TABLE task_reminders DROP COLUMN retry_at;
+ALTER TABLE task_reminders DROP COLUMN attempts;
@@ -0,0 +1,4 @@
+-- Failed sends of a reminder, and when the scheduler tries it again. A row
+-- that keeps failing is given up on, with sent_at set, after a few attempts.
+ALTER TABLE task_reminders ADD COLUMN attempts INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE task_reminders ADD COLUMN retry_at DATETIME;
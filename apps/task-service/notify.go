@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Notification-service only takes notifications from services, with a token
+// for its audience that grants notifications:write
+const (
+	notificationAudience = "notification-service"
+	notificationScope    = "notifications:write"
+
+	tokenExchangeGrantType = "urn:ietf:params:oauth:grant-type:token-exchange"
+	accessTokenType        = "urn:ietf:params:oauth:token-type:access_token"
+)
+
+// TaskNotification is the payload for notification-service's POST /api/notifications
+type TaskNotification struct {
+	UserID  int    `json:"user_id"`
+	Title   string `json:"title"`
+	Message string `json:"message"`
+	Type    string `json:"type"`
+}
+
+// cachedToken is task-service's own token, reused until shortly before it
+// expires
+type cachedToken struct {
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+}
+
+// sendNotification posts a notification to notification-service. The
+// authorization is that of the user request the notification comes from, or
+// empty for scheduled work.
+func (ts *TaskService) sendNotification(authorization string, notification TaskNotification) error {
+	if ts.notificationServiceURL == "" {
+		return fmt.Errorf("notification service URL not configured")
+	}
+
+	payload, err := json.Marshal(notification)
+	if err != nil {
+		return err
+	}
+
+	token, err := ts.notificationToken(authorization)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", ts.notificationServiceURL+"/api/notifications", bytes.NewBuffer(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("notification service returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// sendNotificationAsync delivers a notification without blocking the request
+func (ts *TaskService) sendNotificationAsync(authorization string, notification TaskNotification) {
+	go func() {
+		if err := ts.sendNotification(authorization, notification); err != nil {
+			log.Printf("Failed to send %q notification to user %d: %v", notification.Title, notification.UserID, err)
+		}
+	}()
+}
+
+// notificationToken gets a token for notification-service. A user's token is
+// exchanged for one that acts on their behalf (RFC 8693); scheduled work uses
+// task-service's own token from the client credentials grant.
+func (ts *TaskService) notificationToken(authorization string) (string, error) {
+	if authorization != "" {
+		token, _, err := ts.requestToken(url.Values{
+			"grant_type":         {tokenExchangeGrantType},
+			"subject_token":      {strings.TrimPrefix(authorization, "Bearer ")},
+			"subject_token_type": {accessTokenType},
+			"audience":           {notificationAudience},
+			"scope":              {notificationScope},
+		})
+		return token, err
+	}
+
+	ts.serviceToken.mu.Lock()
+	defer ts.serviceToken.mu.Unlock()
+	if ts.serviceToken.token != "" && time.Now().Before(ts.serviceToken.expires) {
+		return ts.serviceToken.token, nil
+	}
+
+	token, expiresIn, err := ts.requestToken(url.Values{
+		"grant_type": {"client_credentials"},
+		"audience":   {notificationAudience},
+		"scope":      {notificationScope},
+	})
+	if err != nil {
+		return "", err
+	}
+	ts.serviceToken.token = token
+	// Renew early so a token doesn't expire on the way
+	ts.serviceToken.expires = time.Now().Add(time.Duration(expiresIn)*time.Second - 30*time.Second)
+	return token, nil
+}
+
+// requestToken calls auth-service's token endpoint with task-service's
+// client credentials and returns the token and its lifetime in seconds
+func (ts *TaskService) requestToken(form url.Values) (string, int, error) {
+	if ts.oauthClientSecret == "" {
+		return "", 0, fmt.Errorf("OAUTH_CLIENT_SECRET not configured")
+	}
+
+	req, err := http.NewRequest("POST", ts.authServiceURL+"/oauth2/token", strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", 0, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(ts.oauthClientID, ts.oauthClientSecret)
+
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", 0, err
+	}
+	defer resp.Body.Close()
+
+	var response struct {
+		AccessToken      string `json:"access_token"`
+		ExpiresIn        int    `json:"expires_in"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return "", 0, fmt.Errorf("token request returned status %d", resp.StatusCode)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", 0, fmt.Errorf("token request failed: %s: %s", response.Error, response.ErrorDescription)
+	}
+	return response.AccessToken, response.ExpiresIn, nil
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+)
+
+// Page sizes for list endpoints
+const (
+	defaultPageLimit = 50
+	maxPageLimit     = 200
+)
+
+var errInvalidCursor = errors.New("invalid cursor")
+
+// TaskPage is one page of a task listing. NextCursor is null on the last page.
+type TaskPage struct {
+	Tasks      []Task  `json:"tasks"`
+	NextCursor *string `json:"next_cursor"`
+	Total      *int    `json:"total,omitempty"`
+}
+
+// pageCursor marks the last row of the previous page. Tasks are listed
+// newest first by ID, so rows inserted while paging never shift later pages.
+// Listings sorted by something else also carry the sort and its key.
+type pageCursor struct {
+	ID   int         `json:"id"`
+	Sort string      `json:"sort,omitempty"`
+	Key  interface{} `json:"key,omitempty"`
+}
+
+// PageParams are the pagination query parameters of a list request
+type PageParams struct {
+	Limit        int
+	After        *pageCursor
+	IncludeTotal bool
+}
+
+// parsePageParams reads limit, cursor and include_total from the query string
+func parsePageParams(r *http.Request) (PageParams, error) {
+	query := r.URL.Query()
+	params := PageParams{
+		Limit:        defaultPageLimit,
+		IncludeTotal: query.Get("include_total") == "true",
+	}
+
+	if limit := query.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 1 || n > maxPageLimit {
+			return params, errors.New("limit must be between 1 and " + strconv.Itoa(maxPageLimit))
+		}
+		params.Limit = n
+	}
+
+	if cursor := query.Get("cursor"); cursor != "" {
+		after, err := decodeCursor(cursor)
+		if err != nil {
+			return params, err
+		}
+		params.After = after
+	}
+
+	return params, nil
+}
+
+func encodeCursor(cursor pageCursor) string {
+	data, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeCursor(s string) (*pageCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, errInvalidCursor
+	}
+	var cursor pageCursor
+	if err := json.Unmarshal(data, &cursor); err != nil || cursor.ID <= 0 {
+		return nil, errInvalidCursor
+	}
+	return &cursor, nil
+}
+
+// newTaskPage trims a result fetched with limit+1 rows to the page size and
+// sets the cursor for the next page. cursors holds the cursor of each task.
+func newTaskPage(tasks []Task, cursors []pageCursor, limit int) TaskPage {
+	page := TaskPage{Tasks: tasks}
+	if page.Tasks == nil {
+		page.Tasks = []Task{}
+	}
+	if len(page.Tasks) > limit {
+		page.Tasks = page.Tasks[:limit]
+		next := encodeCursor(cursors[limit-1])
+		page.NextCursor = &next
+	}
+	return page
+}
@@ -0,0 +1,443 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// maxFilterLength bounds the filter parameter
+const maxFilterLength = 1024
+
+// filterKind decides which operators a field supports and how its values are
+// compared
+type filterKind int
+
+const (
+	filterEnum filterKind = iota // exact match, comparable if the field has an order
+	filterText                   // case-insensitive substring match
+	filterTime                   // date or RFC 3339 timestamp
+	filterInt
+)
+
+// filterField maps a filter field to the SQL expression it filters on
+type filterField struct {
+	expr     string
+	kind     filterKind
+	order    []string // enum values from lowest to highest
+	sortable bool
+	sort     string // overrides the sort expression
+}
+
+// sortExpr is the expression a listing sorted by the field is ordered by
+func (f filterField) sortExpr() string {
+	if f.sort != "" {
+		return f.sort
+	}
+	if f.order != nil {
+		return enumRank(f.expr, f.order)
+	}
+	if f.kind == filterText {
+		return f.expr + " COLLATE NOCASE"
+	}
+	return f.expr
+}
+
+var priorityOrder = []string{"low", "medium", "high", "urgent"}
+
+// filterFields are the fields a filter expression can use. Timestamps set
+// by SQLite go through datetime() so they compare as UTC text whatever format
+// they were stored in. A missing due or start date sorts as later than any
+// date.
+var filterFields = map[string]filterField{
+	"id":          {expr: "tasks.id", kind: filterInt, sortable: true},
+	"parent":      {expr: "tasks.parent_id", kind: filterInt},
+	"status":      {expr: "tasks.status", kind: filterEnum, sortable: true},
+	"priority":    {expr: "tasks.priority", kind: filterEnum, order: priorityOrder, sortable: true},
+	"title":       {expr: "tasks.title", kind: filterText, sortable: true},
+	"description": {expr: "tasks.description", kind: filterText},
+	"created":     {expr: "datetime(tasks.created_at)", kind: filterTime, sortable: true},
+	"created_at":  {expr: "datetime(tasks.created_at)", kind: filterTime, sortable: true},
+	"updated":     {expr: "datetime(tasks.updated_at)", kind: filterTime, sortable: true},
+	"updated_at":  {expr: "datetime(tasks.updated_at)", kind: filterTime, sortable: true},
+	"due":         {expr: "tasks.due_at", kind: filterTime, sortable: true, sort: "IFNULL(tasks.due_at, '9999-12-31')"},
+	"due_at":      {expr: "tasks.due_at", kind: filterTime, sortable: true, sort: "IFNULL(tasks.due_at, '9999-12-31')"},
+	"start":       {expr: "tasks.start_at", kind: filterTime, sortable: true, sort: "IFNULL(tasks.start_at, '9999-12-31')"},
+	"start_at":    {expr: "tasks.start_at", kind: filterTime, sortable: true, sort: "IFNULL(tasks.start_at, '9999-12-31')"},
+}
+
+// sqlCondition is a WHERE clause fragment with its bound arguments. User
+// input only ever reaches the query as an argument.
+type sqlCondition struct {
+	sql  string
+	args []interface{}
+}
+
+// taskSort orders a listing by one key, with the task ID breaking ties in
+// the same direction. The name identifies the order in page cursors.
+// withinPage sorts only the tasks of each page, which are paged newest first
+// by ID, for keys that shift whenever other tasks change.
+type taskSort struct {
+	name       string
+	expr       string
+	desc       bool
+	withinPage bool
+}
+
+// keyed reports whether the sort key is something other than the task ID,
+// in which case page cursors carry it
+func (s taskSort) keyed() bool {
+	return s.expr != "tasks.id"
+}
+
+// defaultSort lists the newest tasks first
+var defaultSort = taskSort{expr: "tasks.id", desc: true}
+
+// pagingSort is the order page cursors follow
+func (s taskSort) pagingSort() taskSort {
+	if s.withinPage {
+		return taskSort{name: s.name, expr: defaultSort.expr, desc: defaultSort.desc}
+	}
+	return s
+}
+
+// TaskFilter is a parsed filter expression
+type TaskFilter struct {
+	conditions []sqlCondition
+	sort       *taskSort
+}
+
+// FilterError is a filter parse error. Pos is the 1-based character position
+// it refers to.
+type FilterError struct {
+	Pos int
+	Msg string
+}
+
+func (e *FilterError) Error() string {
+	return fmt.Sprintf("invalid filter at position %d: %s", e.Pos, e.Msg)
+}
+
+// filterValue is one value of a term and where it starts
+type filterValue struct {
+	text string
+	pos  int
+}
+
+type filterParser struct {
+	input []rune
+	pos   int
+}
+
+// parseTaskFilter parses a filter expression such as
+//
+//	status:pending priority:high,urgent created>2026-01-01 -status:done sort:-updated
+//
+// Terms are field, operator (: > >= < <=) and value, separated by spaces and
+// all required to match. Comma-separated values match any of them, a leading
+// - negates a term and values with spaces are double-quoted. sort:field
+// orders the result, ascending unless the field starts with -.
+func parseTaskFilter(expr string) (*TaskFilter, error) {
+	if len(expr) > maxFilterLength {
+		return nil, fmt.Errorf("filter must be at most %d characters", maxFilterLength)
+	}
+
+	p := &filterParser{input: []rune(expr)}
+	filter := &TaskFilter{}
+	for {
+		p.skipSpace()
+		if p.done() {
+			return filter, nil
+		}
+		if err := p.parseTerm(filter); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (p *filterParser) parseTerm(filter *TaskFilter) error {
+	termPos := p.pos
+	negate := false
+	if p.peek() == '-' {
+		negate = true
+		p.pos++
+	}
+
+	namePos := p.pos
+	for !p.done() && (unicode.IsLetter(p.peek()) || p.peek() == '_') {
+		p.pos++
+	}
+	name := strings.ToLower(string(p.input[namePos:p.pos]))
+	if name == "" {
+		return p.errorAt(namePos, "expected a field name")
+	}
+
+	opPos := p.pos
+	op := p.parseOperator()
+	if op == "" {
+		return p.errorAt(opPos, fmt.Sprintf("expected :, >, >=, < or <= after %q", name))
+	}
+
+	field, ok := filterFields[name]
+	if !ok && name != "sort" {
+		return p.errorAt(namePos, fmt.Sprintf("unknown field %q", name))
+	}
+
+	values, err := p.parseValues()
+	if err != nil {
+		return err
+	}
+	if !p.done() && !unicode.IsSpace(p.peek()) {
+		return p.errorAt(p.pos, "expected a space between terms")
+	}
+
+	if name == "sort" {
+		if negate {
+			return p.errorAt(termPos, "sort can't be negated")
+		}
+		if filter.sort != nil {
+			return p.errorAt(termPos, "only one sort is allowed")
+		}
+		sort, err := p.parseSort(op, opPos, values)
+		if err != nil {
+			return err
+		}
+		filter.sort = sort
+		return nil
+	}
+
+	cond, err := p.condition(name, field, op, opPos, values)
+	if err != nil {
+		return err
+	}
+	if negate {
+		// NULL counts as not matching, so negated terms include it
+		cond.sql = "(" + cond.sql + ") IS NOT 1"
+	}
+	filter.conditions = append(filter.conditions, cond)
+	return nil
+}
+
+func (p *filterParser) parseOperator() string {
+	for _, op := range []string{">=", "<=", ":", ">", "<"} {
+		if p.hasPrefix(op) {
+			p.pos += len(op)
+			return op
+		}
+	}
+	return ""
+}
+
+// parseValues reads a comma-separated list of bare or quoted values
+func (p *filterParser) parseValues() ([]filterValue, error) {
+	var values []filterValue
+	for {
+		value := filterValue{pos: p.pos}
+		if p.peek() == '"' {
+			text, err := p.parseQuoted()
+			if err != nil {
+				return nil, err
+			}
+			value.text = text
+		} else {
+			for !p.done() && !unicode.IsSpace(p.peek()) && p.peek() != ',' {
+				p.pos++
+			}
+			value.text = string(p.input[value.pos:p.pos])
+			if value.text == "" {
+				return nil, p.errorAt(value.pos, "expected a value")
+			}
+		}
+		values = append(values, value)
+
+		if p.peek() != ',' {
+			return values, nil
+		}
+		p.pos++
+	}
+}
+
+// parseQuoted reads a double-quoted value, in which \" and \\ are escapes
+func (p *filterParser) parseQuoted() (string, error) {
+	start := p.pos
+	p.pos++
+
+	var text strings.Builder
+	for !p.done() {
+		c := p.peek()
+		p.pos++
+		switch {
+		case c == '"':
+			return text.String(), nil
+		case c == '\\' && !p.done():
+			text.WriteRune(p.peek())
+			p.pos++
+		default:
+			text.WriteRune(c)
+		}
+	}
+	return "", p.errorAt(start, "unterminated quoted value")
+}
+
+func (p *filterParser) parseSort(op string, opPos int, values []filterValue) (*taskSort, error) {
+	if op != ":" {
+		return nil, p.errorAt(opPos, "sort only supports :")
+	}
+	if len(values) != 1 {
+		return nil, p.errorAt(values[1].pos, "sort takes a single field")
+	}
+
+	name := strings.ToLower(values[0].text)
+	desc := strings.HasPrefix(name, "-")
+	field, ok := filterFields[strings.TrimPrefix(name, "-")]
+	if !ok || !field.sortable {
+		return nil, p.errorAt(values[0].pos, fmt.Sprintf("can't sort by %q", values[0].text))
+	}
+	return &taskSort{name: name, expr: field.sortExpr(), desc: desc}, nil
+}
+
+// condition builds the SQL for one term
+func (p *filterParser) condition(name string, field filterField, op string, opPos int, values []filterValue) (sqlCondition, error) {
+	compare := op != ":"
+	if compare && (field.kind == filterText || (field.kind == filterEnum && field.order == nil)) {
+		return sqlCondition{}, p.errorAt(opPos, fmt.Sprintf("%s only supports :", name))
+	}
+	if (compare || field.kind == filterTime) && len(values) > 1 {
+		return sqlCondition{}, p.errorAt(values[1].pos, fmt.Sprintf("%s%s takes a single value", name, op))
+	}
+
+	switch field.kind {
+	case filterText:
+		var likes []string
+		var args []interface{}
+		for _, value := range values {
+			likes = append(likes, field.expr+` LIKE ? ESCAPE '\'`)
+			args = append(args, "%"+escapeLike(value.text)+"%")
+		}
+		return sqlCondition{sql: strings.Join(likes, " OR "), args: args}, nil
+
+	case filterEnum:
+		if compare {
+			rank := indexOf(field.order, strings.ToLower(values[0].text))
+			if rank < 0 {
+				return sqlCondition{}, p.errorAt(values[0].pos, fmt.Sprintf("%s must be one of %s", name, strings.Join(field.order, ", ")))
+			}
+			return sqlCondition{sql: enumRank(field.expr, field.order) + " " + op + " ?", args: []interface{}{rank}}, nil
+		}
+		var args []interface{}
+		for _, value := range values {
+			args = append(args, value.text)
+		}
+		return inCondition(field.expr, args), nil
+
+	case filterInt:
+		var args []interface{}
+		for _, value := range values {
+			n, err := strconv.Atoi(value.text)
+			if err != nil {
+				return sqlCondition{}, p.errorAt(value.pos, fmt.Sprintf("%s must be a number", name))
+			}
+			args = append(args, n)
+		}
+		if compare {
+			return sqlCondition{sql: field.expr + " " + op + " ?", args: args}, nil
+		}
+		return inCondition(field.expr, args), nil
+
+	case filterTime:
+		from, to, err := parseFilterTime(values[0].text)
+		if err != nil {
+			return sqlCondition{}, p.errorAt(values[0].pos, fmt.Sprintf("%s must be a date (2006-01-02) or an RFC 3339 timestamp", name))
+		}
+		return timeCondition(field.expr, op, from, to), nil
+	}
+	return sqlCondition{}, errors.New("unsupported filter field")
+}
+
+// parseFilterTime returns the UTC interval [from, to) a value covers: a whole
+// day for dates and a single second for timestamps
+func parseFilterTime(value string) (time.Time, time.Time, error) {
+	if day, err := time.Parse("2006-01-02", value); err == nil {
+		return day, day.AddDate(0, 0, 1), nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	t = t.UTC().Truncate(time.Second)
+	return t, t.Add(time.Second), nil
+}
+
+// timeCondition compares against an interval, so created>2026-01-01 means
+// after that day and created:2026-01-01 means during it
+func timeCondition(expr, op string, from, to time.Time) sqlCondition {
+	switch op {
+	case ">":
+		return sqlCondition{sql: expr + " >= ?", args: []interface{}{dbTime(to)}}
+	case ">=":
+		return sqlCondition{sql: expr + " >= ?", args: []interface{}{dbTime(from)}}
+	case "<":
+		return sqlCondition{sql: expr + " < ?", args: []interface{}{dbTime(from)}}
+	case "<=":
+		return sqlCondition{sql: expr + " < ?", args: []interface{}{dbTime(to)}}
+	}
+	return sqlCondition{sql: expr + " >= ? AND " + expr + " < ?", args: []interface{}{dbTime(from), dbTime(to)}}
+}
+
+func inCondition(expr string, args []interface{}) sqlCondition {
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(args)), ", ")
+	return sqlCondition{sql: expr + " IN (" + placeholders + ")", args: args}
+}
+
+// enumRank maps an enum column to its position in order, -1 if unknown
+func enumRank(expr string, order []string) string {
+	var rank strings.Builder
+	rank.WriteString("CASE " + expr)
+	for i, value := range order {
+		fmt.Fprintf(&rank, " WHEN '%s' THEN %d", value, i)
+	}
+	rank.WriteString(" ELSE -1 END")
+	return rank.String()
+}
+
+// escapeLike escapes LIKE wildcards so values match literally
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(s)
+}
+
+func indexOf(values []string, want string) int {
+	for i, value := range values {
+		if value == want {
+			return i
+		}
+	}
+	return -1
+}
+
+func (p *filterParser) done() bool {
+	return p.pos >= len(p.input)
+}
+
+func (p *filterParser) peek() rune {
+	if p.done() {
+		return 0
+	}
+	return p.input[p.pos]
+}
+
+func (p *filterParser) hasPrefix(s string) bool {
+	return strings.HasPrefix(string(p.input[p.pos:]), s)
+}
+
+func (p *filterParser) skipSpace() {
+	for !p.done() && unicode.IsSpace(p.peek()) {
+		p.pos++
+	}
+}
+
+func (p *filterParser) errorAt(pos int, msg string) error {
+	return &FilterError{Pos: pos + 1, Msg: msg}
+}
@@ -0,0 +1,556 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// How the next occurrence of a series is scheduled: by the rule after the
+// previous occurrence's slot, or by the rule counted from the day the
+// previous occurrence was finished
+const (
+	recurFromDue        = "due"
+	recurFromCompletion = "completion"
+)
+
+// Scopes of an update to a recurring task
+const (
+	scopeThis      = "this"
+	scopeFollowing = "following"
+)
+
+// statusSkipped marks an occurrence of a recurring task that was skipped
+const statusSkipped = "skipped"
+
+// upcomingOccurrences is how many future dates a task's recurrence lists
+const upcomingOccurrences = 3
+
+// Recurrence describes the series a task belongs to
+type Recurrence struct {
+	SeriesID     int         `json:"series_id"`
+	RRule        string      `json:"rrule"`
+	RecurFrom    string      `json:"recur_from"`
+	Timezone     string      `json:"timezone"`
+	OccurrenceAt *time.Time  `json:"occurrence_at"`
+	Occurrences  int         `json:"occurrences"`
+	Ended        bool        `json:"ended"`
+	NextTaskID   *int        `json:"next_task_id,omitempty"`
+	Upcoming     []time.Time `json:"upcoming,omitempty"`
+}
+
+// RecurrenceRequest makes a task recurring or changes the rule of its series
+type RecurrenceRequest struct {
+	RRule     string `json:"rrule"`
+	RecurFrom string `json:"recur_from"`
+}
+
+// taskSeries is a task_series row
+type taskSeries struct {
+	ID          int
+	UserID      int
+	RRule       string
+	Timezone    string
+	RecurFrom   string
+	DTStart     time.Time
+	Occurrences int
+	Ended       bool
+	template    seriesTemplate
+}
+
+// seriesTemplate is what each new occurrence of a series is created from.
+// Start dates and reminders keep their distance to the due date; reminders
+// at fixed times aren't carried over.
+type seriesTemplate struct {
+	Title           string
+	Description     string
+	Priority        string
+	StartOffset     *int64 // seconds from start_at to due_at
+	ReminderMinutes []int
+}
+
+// newSeriesTemplate takes the template from an occurrence
+func newSeriesTemplate(title, description, priority string, schedule taskSchedule, reminders []Reminder) seriesTemplate {
+	template := seriesTemplate{Title: title, Description: description, Priority: priority}
+	if schedule.StartAt != nil && schedule.DueAt != nil {
+		offset := int64(schedule.DueAt.Sub(*schedule.StartAt).Seconds())
+		template.StartOffset = &offset
+	}
+	for _, reminder := range reminders {
+		if reminder.MinutesBefore != nil {
+			template.ReminderMinutes = append(template.ReminderMinutes, *reminder.MinutesBefore)
+		}
+	}
+	return template
+}
+
+// validateRecurrence checks a recurrence request against the task's
+// schedule. The rule starts at the due date, so one is required.
+func validateRecurrence(req RecurrenceRequest, schedule taskSchedule) (*RRule, string, error) {
+	if schedule.DueAt == nil {
+		return nil, "", errors.New("recurring tasks need a due_at")
+	}
+	recurFrom := req.RecurFrom
+	if recurFrom == "" {
+		recurFrom = recurFromDue
+	}
+	if recurFrom != recurFromDue && recurFrom != recurFromCompletion {
+		return nil, "", errors.New("recur_from must be due or completion")
+	}
+	rule, err := parseRRule(req.RRule, taskLocation(schedule.Timezone))
+	if err != nil {
+		return nil, "", err
+	}
+	return rule, recurFrom, nil
+}
+
+// createSeries starts a series at a task, which becomes its first occurrence
+func createSeries(tx *sql.Tx, taskID, userID int, rule *RRule, recurFrom string, schedule taskSchedule, template seriesTemplate) error {
+	result, err := tx.Exec(`
+		INSERT INTO task_series (user_id, rrule, timezone, recur_from, dtstart, title, description, priority, start_offset, reminder_minutes)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, userID, rule.String(), schedule.Timezone, recurFrom, dbTime(*schedule.DueAt),
+		template.Title, template.Description, template.Priority, template.StartOffset, joinInts(template.ReminderMinutes))
+	if err != nil {
+		return err
+	}
+
+	seriesID, _ := result.LastInsertId()
+	_, err = tx.Exec("UPDATE tasks SET series_id = ?, occurrence_at = due_at WHERE id = ?", seriesID, taskID)
+	return err
+}
+
+// saveSeriesTemplate updates what future occurrences of a series are created from
+func saveSeriesTemplate(tx *sql.Tx, seriesID int, timezone string, template seriesTemplate) error {
+	_, err := tx.Exec(`
+		UPDATE task_series SET timezone = ?, title = ?, description = ?, priority = ?, start_offset = ?, reminder_minutes = ?
+		WHERE id = ?
+	`, timezone, template.Title, template.Description, template.Priority, template.StartOffset, joinInts(template.ReminderMinutes), seriesID)
+	return err
+}
+
+// updateFollowing applies an update of a recurring task to the occurrences
+// after it. Moving the due date moves the series, so later occurrences are
+// counted from the new date.
+func updateFollowing(tx *sql.Tx, task *Task, req UpdateTaskRequest, schedule taskSchedule, reminders *[]Reminder) error {
+	if reminders == nil {
+		reminders = &task.Reminders
+	}
+	template := newSeriesTemplate(req.Title, req.Description, req.Priority, schedule, *reminders)
+	if err := saveSeriesTemplate(tx, *task.SeriesID, schedule.Timezone, template); err != nil {
+		return err
+	}
+
+	if !sameTime(task.occurrenceAt, schedule.DueAt) {
+		if _, err := tx.Exec("UPDATE task_series SET dtstart = ? WHERE id = ?", dbTime(*schedule.DueAt), *task.SeriesID); err != nil {
+			return err
+		}
+		if _, err := tx.Exec("UPDATE tasks SET occurrence_at = due_at WHERE id = ?", task.ID); err != nil {
+			return err
+		}
+		task.occurrenceAt = schedule.DueAt
+	}
+
+	// Occurrences that were already created get the same changes
+	unfinished := unfinishedCondition()
+	_, err := tx.Exec(`
+		UPDATE tasks SET title = ?, description = ?, priority = ?
+		WHERE series_id = ? AND occurrence_at > ? AND `+unfinished.sql,
+		append([]interface{}{req.Title, req.Description, req.Priority, *task.SeriesID, dbTime(*task.occurrenceAt)}, unfinished.args...)...)
+	return err
+}
+
+func loadSeries(q interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}, seriesID int) (taskSeries, error) {
+	var series taskSeries
+	var description, priority, reminderMinutes sql.NullString
+	var startOffset sql.NullInt64
+	var endedAt sql.NullTime
+	err := q.QueryRow(`
+		SELECT id, user_id, rrule, timezone, recur_from, dtstart, occurrences, ended_at,
+			title, description, priority, start_offset, reminder_minutes
+		FROM task_series WHERE id = ?
+	`, seriesID).Scan(&series.ID, &series.UserID, &series.RRule, &series.Timezone, &series.RecurFrom, &series.DTStart, &series.Occurrences, &endedAt,
+		&series.template.Title, &description, &priority, &startOffset, &reminderMinutes)
+	if err != nil {
+		return series, err
+	}
+
+	series.Ended = endedAt.Valid
+	series.template.Description = description.String
+	series.template.Priority = priority.String
+	if startOffset.Valid {
+		series.template.StartOffset = &startOffset.Int64
+	}
+	for _, item := range strings.Split(reminderMinutes.String, ",") {
+		if minutes, err := strconv.Atoi(item); err == nil {
+			series.template.ReminderMinutes = append(series.template.ReminderMinutes, minutes)
+		}
+	}
+	return series, nil
+}
+
+// nextOccurrence returns when the occurrence after one filling the slot
+// occurrenceAt and finished at finishedAt is due, or false if the series is
+// over
+func (series taskSeries) nextOccurrence(occurrenceAt, finishedAt time.Time) (time.Time, bool, error) {
+	loc := taskLocation(series.Timezone)
+	rule, err := parseRRule(series.RRule, loc)
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	if series.Ended || (rule.Count > 0 && series.Occurrences >= rule.Count) {
+		return time.Time{}, false, nil
+	}
+
+	if series.RecurFrom == recurFromCompletion {
+		// Restart the rule on the day of completion, at the usual time.
+		// Finishing early doesn't bring the next occurrence before this one.
+		finished := finishedAt.In(loc)
+		start := series.DTStart.In(loc)
+		anchor := time.Date(finished.Year(), finished.Month(), finished.Day(), start.Hour(), start.Minute(), start.Second(), 0, loc)
+		after := anchor
+		if occurrenceAt.After(after) {
+			after = occurrenceAt
+		}
+		next, ok := rule.After(anchor, after)
+		return next, ok, nil
+	}
+	next, ok := rule.After(series.DTStart.In(loc), occurrenceAt.In(loc))
+	return next, ok, nil
+}
+
+// advanceSeries creates the occurrence that follows a finished or skipped
+// task and returns its ID, or 0 when the series is over or the task already
+// has a later occurrence because it was reopened and finished again
+func advanceSeries(tx *sql.Tx, task Task, finishedAt time.Time) (int, error) {
+	if task.SeriesID == nil || task.occurrenceAt == nil {
+		return 0, nil
+	}
+
+	var later int
+	err := tx.QueryRow("SELECT COUNT(*) FROM tasks WHERE series_id = ? AND occurrence_at > ?", *task.SeriesID, dbTime(*task.occurrenceAt)).Scan(&later)
+	if err != nil || later > 0 {
+		return 0, err
+	}
+
+	series, err := loadSeries(tx, *task.SeriesID)
+	if err != nil {
+		return 0, err
+	}
+	next, ok, err := series.nextOccurrence(*task.occurrenceAt, finishedAt)
+	if err != nil || !ok {
+		return 0, err
+	}
+
+	schedule := taskSchedule{DueAt: &next, Timezone: series.Timezone}
+	if series.template.StartOffset != nil {
+		startAt := next.Add(-time.Duration(*series.template.StartOffset) * time.Second)
+		schedule.StartAt = &startAt
+	}
+	var reminders []ReminderRequest
+	for i := range series.template.ReminderMinutes {
+		reminders = append(reminders, ReminderRequest{MinutesBefore: &series.template.ReminderMinutes[i]})
+	}
+	resolved, err := resolveReminders(reminders, schedule)
+	if err != nil {
+		return 0, err
+	}
+
+	result, err := tx.Exec(`
+		INSERT INTO tasks (title, description, priority, user_id, due_at, start_at, timezone, series_id, occurrence_at, parent_id)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, series.template.Title, series.template.Description, series.template.Priority, series.UserID,
+		dbTime(next), nullableDBTime(schedule.StartAt), series.Timezone, series.ID, dbTime(next), task.ParentID)
+	if err != nil {
+		return 0, err
+	}
+	nextID, _ := result.LastInsertId()
+
+	if err := saveSchedule(tx, int(nextID), schedule, true, &resolved); err != nil {
+		return 0, err
+	}
+	if _, err := tx.Exec("INSERT INTO task_tags (task_id, tag_id) SELECT ?, tag_id FROM task_tags WHERE task_id = ?", nextID, task.ID); err != nil {
+		return 0, err
+	}
+	if err := copySharing(tx, task.ID, int(nextID)); err != nil {
+		return 0, err
+	}
+	if _, err := tx.Exec("UPDATE task_series SET occurrences = occurrences + 1 WHERE id = ?", series.ID); err != nil {
+		return 0, err
+	}
+	return int(nextID), nil
+}
+
+// loadRecurrence sets the recurrence of a task that belongs to a series
+func (ts *TaskService) loadRecurrence(task *Task) error {
+	if task.SeriesID == nil {
+		return nil
+	}
+
+	series, err := loadSeries(ts.db, *task.SeriesID)
+	if err != nil {
+		return err
+	}
+
+	loc := taskLocation(series.Timezone)
+	recurrence := &Recurrence{
+		SeriesID:    series.ID,
+		RRule:       series.RRule,
+		RecurFrom:   series.RecurFrom,
+		Timezone:    series.Timezone,
+		Occurrences: series.Occurrences,
+		Ended:       series.Ended,
+	}
+
+	if task.occurrenceAt != nil {
+		occurrenceAt := task.occurrenceAt.In(loc)
+		recurrence.OccurrenceAt = &occurrenceAt
+
+		var nextID int
+		err := ts.db.QueryRow(`
+			SELECT id FROM tasks WHERE series_id = ? AND occurrence_at > ?
+			ORDER BY occurrence_at LIMIT 1
+		`, series.ID, dbTime(occurrenceAt)).Scan(&nextID)
+		if err == nil {
+			recurrence.NextTaskID = &nextID
+		} else if err != sql.ErrNoRows {
+			return err
+		}
+
+		// Only due-date series have dates that are known in advance
+		if recurrence.NextTaskID == nil && series.RecurFrom == recurFromDue {
+			slot := occurrenceAt
+			for i := 0; i < upcomingOccurrences; i++ {
+				next, ok, err := series.nextOccurrence(slot, slot)
+				if err != nil || !ok {
+					break
+				}
+				recurrence.Upcoming = append(recurrence.Upcoming, next)
+				series.Occurrences++
+				slot = next
+			}
+		}
+	}
+
+	task.Recurrence = recurrence
+	return nil
+}
+
+// setRecurrenceHandler makes a task recurring, or changes the rule of its
+// series from this occurrence on
+func (ts *TaskService) setRecurrenceHandler(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.Atoi(r.Header.Get("X-User-ID"))
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+	taskID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid task ID", http.StatusBadRequest)
+		return
+	}
+
+	var req RecurrenceRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	task, err := ts.loadTask(taskID, userID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Task not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if !task.allows(accessEditor) {
+		http.Error(w, "You can't edit this task", http.StatusForbidden)
+		return
+	}
+
+	schedule := taskSchedule{DueAt: task.DueAt, StartAt: task.StartAt, Timezone: task.Timezone}
+	rule, recurFrom, err := validateRecurrence(req, schedule)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	tx, err := ts.db.Begin()
+	if err != nil {
+		http.Error(w, "Failed to update recurrence", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	if task.SeriesID == nil {
+		template := newSeriesTemplate(task.Title, task.Description, task.Priority, schedule, task.Reminders)
+		err = createSeries(tx, taskID, task.UserID, rule, recurFrom, schedule, template)
+	} else {
+		// The new rule starts at this occurrence, which also resumes an
+		// ended series
+		_, err = tx.Exec(`
+			UPDATE task_series SET rrule = ?, recur_from = ?, timezone = ?, dtstart = ?, occurrences = 1, ended_at = NULL
+			WHERE id = ?
+		`, rule.String(), recurFrom, task.Timezone, dbTime(*task.DueAt), *task.SeriesID)
+		if err == nil {
+			_, err = tx.Exec("UPDATE tasks SET occurrence_at = due_at WHERE id = ?", taskID)
+		}
+	}
+	if err != nil {
+		http.Error(w, "Failed to update recurrence", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Failed to update recurrence", http.StatusInternalServerError)
+		return
+	}
+
+	task, err = ts.loadTask(taskID, userID)
+	if err != nil {
+		http.Error(w, "Failed to retrieve updated task", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(task)
+}
+
+// endRecurrenceHandler ends a task's series. Existing occurrences stay, but
+// finishing them creates no more.
+func (ts *TaskService) endRecurrenceHandler(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.Atoi(r.Header.Get("X-User-ID"))
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+	taskID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid task ID", http.StatusBadRequest)
+		return
+	}
+
+	task, err := ts.loadTask(taskID, userID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Task not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if !task.allows(accessEditor) {
+		http.Error(w, "You can't edit this task", http.StatusForbidden)
+		return
+	}
+	if task.SeriesID == nil {
+		http.Error(w, "Task is not recurring", http.StatusBadRequest)
+		return
+	}
+
+	_, err = ts.db.Exec("UPDATE task_series SET ended_at = ? WHERE id = ? AND ended_at IS NULL", dbTime(time.Now()), *task.SeriesID)
+	if err != nil {
+		http.Error(w, "Failed to end series", http.StatusInternalServerError)
+		return
+	}
+
+	task, err = ts.loadTask(taskID, userID)
+	if err != nil {
+		http.Error(w, "Failed to retrieve updated task", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(task)
+}
+
+// skipOccurrenceHandler skips an open occurrence of a recurring task and
+// creates the next one
+func (ts *TaskService) skipOccurrenceHandler(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.Atoi(r.Header.Get("X-User-ID"))
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+	taskID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid task ID", http.StatusBadRequest)
+		return
+	}
+
+	task, err := ts.loadTask(taskID, userID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Task not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if !task.allows(accessEditor) {
+		http.Error(w, "You can't edit this task", http.StatusForbidden)
+		return
+	}
+	if task.SeriesID == nil {
+		http.Error(w, "Task is not recurring", http.StatusBadRequest)
+		return
+	}
+	if isFinished(task.Status) {
+		http.Error(w, "Task is already "+task.Status, http.StatusConflict)
+		return
+	}
+	policy, err := subtaskPolicy(r, ts.subtaskCompletePolicy)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	tx, err := ts.db.Begin()
+	if err != nil {
+		http.Error(w, "Failed to skip occurrence", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("UPDATE tasks SET status = ? WHERE id = ?", statusSkipped, taskID); err != nil {
+		http.Error(w, "Failed to skip occurrence", http.StatusInternalServerError)
+		return
+	}
+	if err := finishSubtasks(tx, taskID, userID, statusSkipped, policy); err != nil {
+		if err == errOpenSubtasks {
+			http.Error(w, "Task has unfinished subtasks", http.StatusConflict)
+			return
+		}
+		http.Error(w, "Failed to skip occurrence", http.StatusInternalServerError)
+		return
+	}
+	if _, err := advanceSeries(tx, task, time.Now()); err != nil {
+		http.Error(w, "Failed to skip occurrence", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Failed to skip occurrence", http.StatusInternalServerError)
+		return
+	}
+
+	task, err = ts.loadTask(taskID, userID)
+	if err != nil {
+		http.Error(w, "Failed to retrieve updated task", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(task)
+}
@@ -0,0 +1,400 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Supported RRULE frequencies
+const (
+	freqDaily   = "DAILY"
+	freqWeekly  = "WEEKLY"
+	freqMonthly = "MONTHLY"
+	freqYearly  = "YEARLY"
+)
+
+// maxRecurrencePeriods bounds how far a rule is expanded looking for an
+// occurrence, so rules that never match (FREQ=YEARLY;BYMONTH=2;BYMONTHDAY=30)
+// give up. The calendar repeats every 400 years, so yearly rules stop there.
+const (
+	maxRecurrencePeriods = 10000
+	maxRecurrenceYears   = 400
+)
+
+var weekdayCodes = map[string]time.Weekday{
+	"SU": time.Sunday, "MO": time.Monday, "TU": time.Tuesday, "WE": time.Wednesday,
+	"TH": time.Thursday, "FR": time.Friday, "SA": time.Saturday,
+}
+
+// weekdayRule is a BYDAY entry. N is the nth such weekday of the month, or
+// of the year in yearly rules without BYMONTH, counting from the end when
+// negative; 0 means every one.
+type weekdayRule struct {
+	N   int
+	Day time.Weekday
+}
+
+// RRule is the subset of an RFC 5545 recurrence rule tasks support: FREQ
+// (DAILY, WEEKLY, MONTHLY or YEARLY), INTERVAL, COUNT, UNTIL, BYDAY,
+// BYMONTHDAY, BYMONTH and WKST. Occurrences keep the wall-clock time of the
+// first one in the rule's timezone, across DST changes. Yearly rules with
+// BYDAY or BYMONTHDAY but no BYMONTH cover every month, and their BYDAY
+// ordinals count within the year (20MO is the 20th Monday).
+type RRule struct {
+	Freq       string
+	Interval   int
+	Count      int
+	Until      *time.Time
+	ByDay      []weekdayRule
+	ByMonthDay []int
+	ByMonth    []int
+	WeekStart  time.Weekday
+}
+
+// parseRRule parses a rule, with or without the RRULE: prefix. An UNTIL
+// without a Z suffix is a local time in loc, and a date-only UNTIL includes
+// the whole day.
+func parseRRule(s string, loc *time.Location) (*RRule, error) {
+	s = strings.TrimPrefix(strings.TrimSpace(s), "RRULE:")
+	if s == "" {
+		return nil, errors.New("rrule is empty")
+	}
+
+	rule := &RRule{Interval: 1, WeekStart: time.Monday}
+	seen := map[string]bool{}
+	for _, part := range strings.Split(s, ";") {
+		name, value, ok := strings.Cut(part, "=")
+		name = strings.ToUpper(name)
+		if !ok || value == "" {
+			return nil, fmt.Errorf("rrule part %q is not NAME=VALUE", part)
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("rrule has %s more than once", name)
+		}
+		seen[name] = true
+
+		var err error
+		switch name {
+		case "FREQ":
+			rule.Freq = strings.ToUpper(value)
+			if rule.Freq != freqDaily && rule.Freq != freqWeekly && rule.Freq != freqMonthly && rule.Freq != freqYearly {
+				err = errors.New("must be DAILY, WEEKLY, MONTHLY or YEARLY")
+			}
+		case "INTERVAL":
+			rule.Interval, err = parsePositive(value)
+		case "COUNT":
+			rule.Count, err = parsePositive(value)
+		case "UNTIL":
+			var until time.Time
+			until, err = parseUntil(value, loc)
+			rule.Until = &until
+		case "BYDAY":
+			rule.ByDay, err = parseByDay(value)
+		case "BYMONTHDAY":
+			rule.ByMonthDay, err = parseIntList(value, -31, 31)
+		case "BYMONTH":
+			rule.ByMonth, err = parseIntList(value, 1, 12)
+			sort.Ints(rule.ByMonth)
+		case "WKST":
+			day, ok := weekdayCodes[strings.ToUpper(value)]
+			if !ok {
+				err = errors.New("must be a weekday such as MO")
+			}
+			rule.WeekStart = day
+		default:
+			err = errors.New("is not supported")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("rrule %s: %v", name, err)
+		}
+	}
+
+	if rule.Freq == "" {
+		return nil, errors.New("rrule needs a FREQ")
+	}
+	if rule.Count > 0 && rule.Until != nil {
+		return nil, errors.New("rrule can't have both COUNT and UNTIL")
+	}
+	if len(rule.ByMonthDay) > 0 && rule.Freq == freqWeekly {
+		return nil, errors.New("rrule BYMONTHDAY can't be used with FREQ=WEEKLY")
+	}
+	for _, day := range rule.ByDay {
+		if day.N != 0 && rule.Freq != freqMonthly && rule.Freq != freqYearly {
+			return nil, errors.New("rrule BYDAY ordinals need FREQ=MONTHLY or YEARLY")
+		}
+		// Ordinals count within the month unless a yearly rule covers the
+		// whole year
+		if (day.N < -5 || day.N > 5) && (rule.Freq != freqYearly || len(rule.ByMonth) > 0) {
+			return nil, errors.New("rrule BYDAY ordinals within a month must be between -5 and 5")
+		}
+	}
+	return rule, nil
+}
+
+// String formats the rule canonically, with UNTIL in UTC
+func (r *RRule) String() string {
+	parts := []string{"FREQ=" + r.Freq}
+	if r.Interval > 1 {
+		parts = append(parts, "INTERVAL="+strconv.Itoa(r.Interval))
+	}
+	if len(r.ByMonth) > 0 {
+		parts = append(parts, "BYMONTH="+joinInts(r.ByMonth))
+	}
+	if len(r.ByMonthDay) > 0 {
+		parts = append(parts, "BYMONTHDAY="+joinInts(r.ByMonthDay))
+	}
+	if len(r.ByDay) > 0 {
+		var days []string
+		for _, day := range r.ByDay {
+			code := strings.ToUpper(day.Day.String()[:2])
+			if day.N != 0 {
+				code = strconv.Itoa(day.N) + code
+			}
+			days = append(days, code)
+		}
+		parts = append(parts, "BYDAY="+strings.Join(days, ","))
+	}
+	if r.WeekStart != time.Monday {
+		parts = append(parts, "WKST="+strings.ToUpper(r.WeekStart.String()[:2]))
+	}
+	if r.Count > 0 {
+		parts = append(parts, "COUNT="+strconv.Itoa(r.Count))
+	}
+	if r.Until != nil {
+		parts = append(parts, "UNTIL="+r.Until.UTC().Format("20060102T150405Z"))
+	}
+	return strings.Join(parts, ";")
+}
+
+// After returns the first occurrence later than t of the rule starting at
+// dtstart, in dtstart's location. COUNT is not applied; the caller counts
+// occurrences.
+func (r *RRule) After(dtstart, t time.Time) (time.Time, bool) {
+	periods := maxRecurrencePeriods
+	if r.Freq == freqYearly {
+		periods = maxRecurrenceYears
+	}
+	for i := 0; i < periods; i++ {
+		for _, occurrence := range r.period(dtstart, i*r.Interval) {
+			if occurrence.Before(dtstart) || !occurrence.After(t) {
+				continue
+			}
+			if r.Until != nil && occurrence.After(*r.Until) {
+				return time.Time{}, false
+			}
+			return occurrence, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// period returns the occurrences, in order, of the kth period (day, week,
+// month or year) after the one dtstart is in
+func (r *RRule) period(dtstart time.Time, k int) []time.Time {
+	loc := dtstart.Location()
+	year, month, day := dtstart.Date()
+	hour, min, sec := dtstart.Clock()
+	at := func(year int, month time.Month, day int) time.Time {
+		return time.Date(year, month, day, hour, min, sec, 0, loc)
+	}
+
+	var occurrences []time.Time
+	switch r.Freq {
+	case freqDaily:
+		date := at(year, month, day+k)
+		if r.inMonth(date.Month()) && r.onMonthDay(date.Day(), daysIn(date)) && r.onWeekday(date.Weekday()) {
+			occurrences = append(occurrences, date)
+		}
+
+	case freqWeekly:
+		offset := (int(dtstart.Weekday()) - int(r.WeekStart) + 7) % 7
+		for i := 0; i < 7; i++ {
+			date := at(year, month, day-offset+7*k+i)
+			if len(r.ByDay) == 0 && date.Weekday() != dtstart.Weekday() {
+				continue
+			}
+			if r.inMonth(date.Month()) && r.onWeekday(date.Weekday()) {
+				occurrences = append(occurrences, date)
+			}
+		}
+
+	case freqMonthly:
+		first := at(year, month+time.Month(k), 1)
+		if r.inMonth(first.Month()) {
+			occurrences = r.monthDays(first, day)
+		}
+
+	case freqYearly:
+		if len(r.ByMonth) == 0 && (len(r.ByDay) > 0 || len(r.ByMonthDay) > 0) {
+			occurrences = r.yearDays(at(year+k, time.January, 1))
+			break
+		}
+		months := r.ByMonth
+		if len(months) == 0 {
+			months = []int{int(month)}
+		}
+		for _, m := range months {
+			occurrences = append(occurrences, r.monthDays(at(year+k, time.Month(m), 1), day)...)
+		}
+	}
+	return occurrences
+}
+
+// monthDays returns the matching days of the month starting at first. Without
+// BYMONTHDAY or BYDAY that is the day of month of the first occurrence, if
+// the month has it.
+func (r *RRule) monthDays(first time.Time, defaultDay int) []time.Time {
+	n := daysIn(first)
+	var days []time.Time
+	for day := 1; day <= n; day++ {
+		if len(r.ByMonthDay) == 0 && len(r.ByDay) == 0 && day != defaultDay {
+			continue
+		}
+		date := first.AddDate(0, 0, day-1)
+		if r.onMonthDay(day, n) && r.onNthWeekday(date.Weekday(), day, n) {
+			days = append(days, date)
+		}
+	}
+	return days
+}
+
+// yearDays returns the matching days of the year starting at first, with
+// BYDAY ordinals counting within the year
+func (r *RRule) yearDays(first time.Time) []time.Time {
+	n := time.Date(first.Year(), time.December, 31, 0, 0, 0, 0, time.UTC).YearDay()
+	var days []time.Time
+	for day := 1; day <= n; day++ {
+		date := first.AddDate(0, 0, day-1)
+		if r.onMonthDay(date.Day(), daysIn(date)) && r.onNthWeekday(date.Weekday(), day, n) {
+			days = append(days, date)
+		}
+	}
+	return days
+}
+
+func (r *RRule) inMonth(month time.Month) bool {
+	if len(r.ByMonth) == 0 {
+		return true
+	}
+	for _, m := range r.ByMonth {
+		if time.Month(m) == month {
+			return true
+		}
+	}
+	return false
+}
+
+// onMonthDay matches BYMONTHDAY, where negative days count from the end of a
+// month of n days
+func (r *RRule) onMonthDay(day, n int) bool {
+	if len(r.ByMonthDay) == 0 {
+		return true
+	}
+	for _, md := range r.ByMonthDay {
+		if md == day || n+md+1 == day {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *RRule) onWeekday(weekday time.Weekday) bool {
+	if len(r.ByDay) == 0 {
+		return true
+	}
+	for _, wd := range r.ByDay {
+		if wd.Day == weekday {
+			return true
+		}
+	}
+	return false
+}
+
+// onNthWeekday matches BYDAY with ordinals for a day of a month, or a year,
+// of n days
+func (r *RRule) onNthWeekday(weekday time.Weekday, day, n int) bool {
+	if len(r.ByDay) == 0 {
+		return true
+	}
+	for _, wd := range r.ByDay {
+		if wd.Day != weekday {
+			continue
+		}
+		if wd.N == 0 || (wd.N > 0 && (day-1)/7+1 == wd.N) || (wd.N < 0 && (n-day)/7+1 == -wd.N) {
+			return true
+		}
+	}
+	return false
+}
+
+func daysIn(t time.Time) int {
+	return time.Date(t.Year(), t.Month()+1, 0, 0, 0, 0, 0, time.UTC).Day()
+}
+
+func parsePositive(value string) (int, error) {
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 1 {
+		return 0, errors.New("must be a positive number")
+	}
+	return n, nil
+}
+
+func parseUntil(value string, loc *time.Location) (time.Time, error) {
+	if t, err := time.Parse("20060102T150405Z", value); err == nil {
+		return t, nil
+	}
+	if t, err := time.ParseInLocation("20060102T150405", value, loc); err == nil {
+		return t, nil
+	}
+	if t, err := time.ParseInLocation("20060102", value, loc); err == nil {
+		return t.AddDate(0, 0, 1).Add(-time.Second), nil
+	}
+	return time.Time{}, errors.New("must be a date (20261231) or date-time (20261231T235959Z)")
+}
+
+func parseByDay(value string) ([]weekdayRule, error) {
+	var days []weekdayRule
+	for _, item := range strings.Split(strings.ToUpper(value), ",") {
+		if len(item) < 2 {
+			return nil, fmt.Errorf("%q is not a weekday", item)
+		}
+		day, ok := weekdayCodes[item[len(item)-2:]]
+		if !ok {
+			return nil, fmt.Errorf("%q is not a weekday", item)
+		}
+		rule := weekdayRule{Day: day}
+		if ordinal := item[:len(item)-2]; ordinal != "" {
+			n, err := strconv.Atoi(ordinal)
+			if err != nil || n == 0 || n < -53 || n > 53 {
+				return nil, fmt.Errorf("%q has an invalid ordinal", item)
+			}
+			rule.N = n
+		}
+		days = append(days, rule)
+	}
+	return days, nil
+}
+
+func parseIntList(value string, min, max int) ([]int, error) {
+	var values []int
+	for _, item := range strings.Split(value, ",") {
+		n, err := strconv.Atoi(item)
+		if err != nil || n == 0 || n < min || n > max {
+			return nil, fmt.Errorf("%q must be between %d and %d", item, min, max)
+		}
+		values = append(values, n)
+	}
+	return values, nil
+}
+
+func joinInts(values []int) string {
+	var items []string
+	for _, v := range values {
+		items = append(items, strconv.Itoa(v))
+	}
+	return strings.Join(items, ",")
+}
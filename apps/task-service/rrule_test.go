@@ -0,0 +1,77 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRRuleAfter(t *testing.T) {
+	tests := []struct {
+		name     string
+		rule     string
+		timezone string
+		dtstart  string
+		after    string
+		want     string // empty when the rule has no later occurrence
+	}{
+		{"last day of month", "FREQ=MONTHLY;BYMONTHDAY=-1", "UTC", "2026-01-31T09:00", "2026-01-31T09:00", "2026-02-28T09:00Z"},
+		{"last day of month in a leap year", "FREQ=MONTHLY;BYMONTHDAY=-1", "UTC", "2028-01-31T09:00", "2028-01-31T09:00", "2028-02-29T09:00Z"},
+		{"day 31 skips short months", "FREQ=MONTHLY", "UTC", "2026-01-31T09:00", "2026-01-31T09:00", "2026-03-31T09:00Z"},
+		{"last Friday", "FREQ=MONTHLY;BYDAY=-1FR", "UTC", "2026-10-30T17:00", "2026-10-30T17:00", "2026-11-27T17:00Z"},
+		{"last Friday across a year", "FREQ=MONTHLY;BYDAY=-1FR", "UTC", "2026-10-30T17:00", "2026-12-25T17:00", "2027-01-29T17:00Z"},
+		{"into summer time", "FREQ=DAILY", "Europe/Berlin", "2026-03-28T09:00", "2026-03-28T09:00", "2026-03-29T09:00+02:00"},
+		{"out of summer time", "FREQ=WEEKLY", "America/New_York", "2026-10-26T09:00", "2026-10-26T09:00", "2026-11-02T09:00-05:00"},
+		{"UNTIL date includes the day", "FREQ=DAILY;UNTIL=20261105", "Europe/Berlin", "2026-11-01T23:30", "2026-11-04T23:30", "2026-11-05T23:30+01:00"},
+		{"UNTIL date ends the rule", "FREQ=DAILY;UNTIL=20261105", "Europe/Berlin", "2026-11-01T23:30", "2026-11-05T23:30", ""},
+		{"UNTIL in UTC", "FREQ=DAILY;UNTIL=20261105T075959Z", "Europe/Berlin", "2026-11-01T09:00", "2026-11-04T09:00", ""},
+		{"never matches", "FREQ=YEARLY;BYMONTH=2;BYMONTHDAY=30", "UTC", "2026-01-01T09:00", "2026-01-01T09:00", ""},
+		{"yearly weekday covers every month", "FREQ=YEARLY;BYDAY=MO", "UTC", "2026-01-05T09:00", "2026-01-31T09:00", "2026-02-02T09:00Z"},
+		{"yearly month day covers every month", "FREQ=YEARLY;BYMONTHDAY=1", "UTC", "2026-01-01T09:00", "2026-01-01T09:00", "2026-02-01T09:00Z"},
+		{"nth weekday of the year", "FREQ=YEARLY;BYDAY=20MO", "UTC", "2026-05-18T09:00", "2026-05-18T09:00", "2027-05-17T09:00Z"},
+		{"last weekday of the year", "FREQ=YEARLY;BYDAY=-1MO", "UTC", "2026-01-01T09:00", "2026-01-01T09:00", "2026-12-28T09:00Z"},
+		{"nth weekday of a month", "FREQ=YEARLY;BYMONTH=11;BYDAY=4TH", "UTC", "2026-01-01T09:00", "2026-01-01T09:00", "2026-11-26T09:00Z"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			loc, err := time.LoadLocation(tt.timezone)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rule, err := parseRRule(tt.rule, loc)
+			if err != nil {
+				t.Fatalf("parseRRule(%q): %v", tt.rule, err)
+			}
+			dtstart, _ := time.ParseInLocation("2006-01-02T15:04", tt.dtstart, loc)
+			after, _ := time.ParseInLocation("2006-01-02T15:04", tt.after, loc)
+
+			got, ok := rule.After(dtstart, after)
+			if tt.want == "" {
+				if ok {
+					t.Errorf("After(%s) = %s, want none", tt.after, got)
+				}
+				return
+			}
+			if !ok {
+				t.Fatalf("After(%s) found none, want %s", tt.after, tt.want)
+			}
+			if s := got.Format("2006-01-02T15:04Z07:00"); s != tt.want {
+				t.Errorf("After(%s) = %s, want %s", tt.after, s, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseRRuleErrors(t *testing.T) {
+	for _, rule := range []string{
+		"FREQ=MONTHLY;BYDAY=20MO",
+		"FREQ=YEARLY;BYMONTH=1;BYDAY=6MO",
+		"FREQ=YEARLY;BYDAY=54MO",
+		"FREQ=WEEKLY;BYDAY=1MO",
+		"FREQ=DAILY;COUNT=3;UNTIL=20261231",
+	} {
+		if _, err := parseRRule(rule, time.UTC); err == nil {
+			t.Errorf("parseRRule(%q) succeeded", rule)
+		}
+	}
+}
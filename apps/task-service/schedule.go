@@ -0,0 +1,530 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	_ "time/tzdata" // the alpine image has no zoneinfo database
+)
+
+// Scheduling limits
+const (
+	maxRemindersPerTask = 10
+	reminderBatchSize   = 100
+	// Reminders missed by more than this, e.g. because the service was down,
+	// are dropped rather than sent late. Overdue notices are always sent.
+	reminderGracePeriod = 24 * time.Hour
+	// A reminder that fails to send is retried after reminderRetryDelay,
+	// doubling each time, and dropped after maxReminderAttempts
+	reminderRetryDelay  = time.Minute
+	maxReminderAttempts = 5
+)
+
+// dbTimeLayout is how times are stored: UTC, in the format of SQLite's
+// CURRENT_TIMESTAMP, so stored times compare correctly as text
+const dbTimeLayout = "2006-01-02 15:04:05"
+
+// notificationTimeLayout formats times in notification messages
+const notificationTimeLayout = "Mon, 02 Jan 2006 15:04 MST"
+
+// Kinds of task_reminders rows
+const (
+	reminderKindReminder = "reminder"
+	reminderKindOverdue  = "overdue"
+)
+
+// finishedStatuses are the statuses of tasks that can't be overdue and get no
+// reminders
+var finishedStatuses = []string{"completed", "done", statusSkipped}
+
+// Reminder is a notification scheduled for a task, either minutes before its
+// due date or at a fixed time
+type Reminder struct {
+	ID            int        `json:"id"`
+	MinutesBefore *int       `json:"minutes_before,omitempty"`
+	RemindAt      time.Time  `json:"remind_at"`
+	SentAt        *time.Time `json:"sent_at,omitempty"`
+}
+
+// ReminderRequest sets a reminder. Exactly one of MinutesBefore and At is
+// required; At is parsed like due_at.
+type ReminderRequest struct {
+	MinutesBefore *int   `json:"minutes_before"`
+	At            string `json:"at"`
+}
+
+// taskSchedule is a task's due date, start date and timezone
+type taskSchedule struct {
+	DueAt    *time.Time
+	StartAt  *time.Time
+	Timezone string
+}
+
+// dueReminder is a pending task_reminders row and the task it belongs to
+type dueReminder struct {
+	id       int
+	kind     string
+	remindAt time.Time
+	attempts int
+	taskID   int
+	title    string
+	userID   int
+	dueAt    sql.NullTime
+	timezone string
+}
+
+func dbTime(t time.Time) string {
+	return t.UTC().Format(dbTimeLayout)
+}
+
+// nullableDBTime stores a missing time as NULL
+func nullableDBTime(t *time.Time) interface{} {
+	if t == nil {
+		return nil
+	}
+	return dbTime(*t)
+}
+
+func isFinished(status string) bool {
+	return indexOf(finishedStatuses, status) >= 0
+}
+
+// unfinishedCondition matches tasks whose status is not a finished one
+func unfinishedCondition() sqlCondition {
+	var args []interface{}
+	for _, status := range finishedStatuses {
+		args = append(args, status)
+	}
+	cond := inCondition("tasks.status", args)
+	cond.sql = "(" + cond.sql + ") IS NOT 1"
+	return cond
+}
+
+// loadLocation loads an IANA timezone; empty means UTC
+func loadLocation(name string) (*time.Location, error) {
+	if name == "" {
+		return time.UTC, nil
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil || name == "Local" {
+		return nil, fmt.Errorf("unknown timezone %q; use an IANA name such as Europe/Berlin", name)
+	}
+	return loc, nil
+}
+
+// taskLocation is the location a task's times are shown in
+func taskLocation(timezone string) *time.Location {
+	loc, err := loadLocation(timezone)
+	if err != nil {
+		return time.UTC
+	}
+	return loc
+}
+
+// parseTaskTime parses an RFC 3339 timestamp or a local time without an
+// offset (2026-03-01T17:00), which is taken to be in loc
+func parseTaskTime(value string, loc *time.Location) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	for _, layout := range []string{"2006-01-02T15:04:05", "2006-01-02T15:04"} {
+		if t, err := time.ParseInLocation(layout, value, loc); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, errors.New("must be an RFC 3339 timestamp or a local time like 2026-03-01T17:00")
+}
+
+// resolveSchedule applies requested changes to a task's schedule. Nil keeps
+// the current value and an empty string clears it. Local times are in the
+// resulting timezone.
+func resolveSchedule(current taskSchedule, dueAt, startAt, timezone *string) (taskSchedule, error) {
+	schedule := current
+	if timezone != nil {
+		schedule.Timezone = *timezone
+	}
+	if schedule.Timezone == "" {
+		schedule.Timezone = "UTC"
+	}
+	loc, err := loadLocation(schedule.Timezone)
+	if err != nil {
+		return schedule, err
+	}
+
+	for _, field := range []struct {
+		name  string
+		value *string
+		dest  **time.Time
+	}{
+		{"due_at", dueAt, &schedule.DueAt},
+		{"start_at", startAt, &schedule.StartAt},
+	} {
+		if field.value == nil {
+			continue
+		}
+		if *field.value == "" {
+			*field.dest = nil
+			continue
+		}
+		t, err := parseTaskTime(*field.value, loc)
+		if err != nil {
+			return schedule, fmt.Errorf("%s %v", field.name, err)
+		}
+		*field.dest = &t
+	}
+
+	if schedule.StartAt != nil && schedule.DueAt != nil && schedule.StartAt.After(*schedule.DueAt) {
+		return schedule, errors.New("start_at must not be after due_at")
+	}
+	return schedule, nil
+}
+
+// resolveReminders validates reminder requests against the task's schedule
+func resolveReminders(requests []ReminderRequest, schedule taskSchedule) ([]Reminder, error) {
+	if len(requests) > maxRemindersPerTask {
+		return nil, fmt.Errorf("a task can have at most %d reminders", maxRemindersPerTask)
+	}
+
+	loc := taskLocation(schedule.Timezone)
+	reminders := []Reminder{}
+	for _, req := range requests {
+		var reminder Reminder
+		switch {
+		case req.MinutesBefore != nil && req.At == "":
+			if *req.MinutesBefore < 0 {
+				return nil, errors.New("minutes_before must not be negative")
+			}
+			if schedule.DueAt == nil {
+				return nil, errors.New("minutes_before reminders need a due_at")
+			}
+			reminder.MinutesBefore = req.MinutesBefore
+			reminder.RemindAt = schedule.DueAt.Add(-time.Duration(*req.MinutesBefore) * time.Minute)
+		case req.At != "" && req.MinutesBefore == nil:
+			t, err := parseTaskTime(req.At, loc)
+			if err != nil {
+				return nil, fmt.Errorf("reminder at %v", err)
+			}
+			reminder.RemindAt = t
+		default:
+			return nil, errors.New("each reminder needs either minutes_before or at")
+		}
+		reminders = append(reminders, reminder)
+	}
+	return reminders, nil
+}
+
+// saveSchedule stores a task's reminders and keeps the reminders relative to
+// its due date, and its overdue notice, in step with the due date. A nil
+// reminders leaves the user's reminders as they are.
+func saveSchedule(tx *sql.Tx, taskID int, schedule taskSchedule, dueChanged bool, reminders *[]Reminder) error {
+	if reminders != nil {
+		if _, err := tx.Exec("DELETE FROM task_reminders WHERE task_id = ? AND kind = ?", taskID, reminderKindReminder); err != nil {
+			return err
+		}
+		for _, reminder := range *reminders {
+			_, err := tx.Exec(`
+				INSERT INTO task_reminders (task_id, kind, minutes_before, remind_at)
+				VALUES (?, ?, ?, ?)
+			`, taskID, reminderKindReminder, reminder.MinutesBefore, dbTime(reminder.RemindAt))
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	if !dueChanged {
+		return nil
+	}
+
+	if _, err := tx.Exec("DELETE FROM task_reminders WHERE task_id = ? AND kind = ?", taskID, reminderKindOverdue); err != nil {
+		return err
+	}
+	if schedule.DueAt == nil {
+		_, err := tx.Exec("DELETE FROM task_reminders WHERE task_id = ? AND minutes_before IS NOT NULL", taskID)
+		return err
+	}
+
+	// Relative reminders move with the due date and go out again
+	_, err := tx.Exec(`
+		UPDATE task_reminders SET remind_at = datetime(?, '-' || minutes_before || ' minutes'), sent_at = NULL, attempts = 0, retry_at = NULL
+		WHERE task_id = ? AND minutes_before IS NOT NULL
+	`, dbTime(*schedule.DueAt), taskID)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`
+		INSERT INTO task_reminders (task_id, kind, minutes_before, remind_at)
+		VALUES (?, ?, 0, ?)
+	`, taskID, reminderKindOverdue, dbTime(*schedule.DueAt))
+	return err
+}
+
+// loadReminders sets the user's reminders of a task
+func (ts *TaskService) loadReminders(task *Task) error {
+	rows, err := ts.db.Query(`
+		SELECT id, minutes_before, remind_at, sent_at FROM task_reminders
+		WHERE task_id = ? AND kind = ?
+		ORDER BY remind_at, id
+	`, task.ID, reminderKindReminder)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	loc := taskLocation(task.Timezone)
+	task.Reminders = []Reminder{}
+	for rows.Next() {
+		var reminder Reminder
+		var minutesBefore sql.NullInt64
+		var sentAt sql.NullTime
+		if err := rows.Scan(&reminder.ID, &minutesBefore, &reminder.RemindAt, &sentAt); err != nil {
+			return err
+		}
+		if minutesBefore.Valid {
+			minutes := int(minutesBefore.Int64)
+			reminder.MinutesBefore = &minutes
+		}
+		reminder.RemindAt = reminder.RemindAt.In(loc)
+		if sentAt.Valid {
+			t := sentAt.Time.In(loc)
+			reminder.SentAt = &t
+		}
+		task.Reminders = append(task.Reminders, reminder)
+	}
+	return rows.Err()
+}
+
+// dueFilters builds the conditions of the overdue, due_today and due_within
+// list parameters. due_today is the current day in the tz parameter's
+// timezone, UTC by default.
+func dueFilters(query url.Values, now time.Time) ([]sqlCondition, error) {
+	var conditions []sqlCondition
+
+	if overdue, err := boolParam(query, "overdue"); err != nil {
+		return nil, err
+	} else if overdue {
+		conditions = append(conditions, sqlCondition{sql: "tasks.due_at < ?", args: []interface{}{dbTime(now)}}, unfinishedCondition())
+	}
+
+	if dueToday, err := boolParam(query, "due_today"); err != nil {
+		return nil, err
+	} else if dueToday {
+		loc, err := loadLocation(query.Get("tz"))
+		if err != nil {
+			return nil, err
+		}
+		local := now.In(loc)
+		start := time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, loc)
+		conditions = append(conditions, sqlCondition{
+			sql:  "tasks.due_at >= ? AND tasks.due_at < ?",
+			args: []interface{}{dbTime(start), dbTime(start.AddDate(0, 0, 1))},
+		})
+	}
+
+	if within := query.Get("due_within"); within != "" {
+		window, err := parseWindow(within)
+		if err != nil {
+			return nil, err
+		}
+		conditions = append(conditions, sqlCondition{
+			sql:  "tasks.due_at >= ? AND tasks.due_at <= ?",
+			args: []interface{}{dbTime(now), dbTime(now.Add(window))},
+		}, unfinishedCondition())
+	}
+
+	return conditions, nil
+}
+
+func boolParam(query url.Values, name string) (bool, error) {
+	value := query.Get(name)
+	if value == "" {
+		return false, nil
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("%s must be true or false", name)
+	}
+	return b, nil
+}
+
+// parseWindow parses a due_within value: a Go duration (36h) or a number of
+// days (3d)
+func parseWindow(value string) (time.Duration, error) {
+	var window time.Duration
+	if days, err := strconv.Atoi(strings.TrimSuffix(value, "d")); err == nil && strings.HasSuffix(value, "d") {
+		window = time.Duration(days) * 24 * time.Hour
+	} else if window, err = time.ParseDuration(value); err != nil {
+		return 0, errors.New("due_within must be a duration like 36h or 3d")
+	}
+	if window <= 0 {
+		return 0, errors.New("due_within must be positive")
+	}
+	return window, nil
+}
+
+// runScheduler sends due reminders and overdue notices until the process
+// exits. They are stored with the tasks, so ones that fall due while the
+// service is down go out once it is back. It also retries deleting the
+// blobs of deleted attachments.
+func (ts *TaskService) runScheduler(interval time.Duration) {
+	for {
+		sent, err := ts.deliverReminders(time.Now())
+		if err != nil {
+			log.Printf("Failed to deliver task reminders: %v", err)
+		} else if sent > 0 {
+			log.Printf("Sent %d task reminders", sent)
+		}
+		if _, err := ts.purgeDeletedBlobs(); err != nil {
+			log.Printf("Failed to delete attachment blobs: %v", err)
+		}
+		time.Sleep(interval)
+	}
+}
+
+// deliverReminders sends the reminders and overdue notices due by now. Each
+// one is claimed before it is sent, so replicas sharing the database never
+// send it twice. A failed send releases the claim with a later retry_at, so
+// it doesn't hold up the rest of the batch.
+func (ts *TaskService) deliverReminders(now time.Time) (int, error) {
+	unfinished := unfinishedCondition()
+	args := append([]interface{}{dbTime(now)}, unfinished.args...)
+	args = append(args, reminderBatchSize)
+
+	rows, err := ts.db.Query(`
+		SELECT r.id, r.kind, r.remind_at, r.attempts, tasks.id, tasks.title, tasks.user_id, tasks.due_at, tasks.timezone
+		FROM task_reminders r JOIN tasks ON tasks.id = r.task_id
+		WHERE r.sent_at IS NULL AND COALESCE(r.retry_at, r.remind_at) <= ? AND `+unfinished.sql+`
+		ORDER BY COALESCE(r.retry_at, r.remind_at)
+		LIMIT ?
+	`, args...)
+	if err != nil {
+		return 0, err
+	}
+
+	var due []dueReminder
+	for rows.Next() {
+		var reminder dueReminder
+		if err := rows.Scan(&reminder.id, &reminder.kind, &reminder.remindAt, &reminder.attempts, &reminder.taskID, &reminder.title, &reminder.userID, &reminder.dueAt, &reminder.timezone); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		due = append(due, reminder)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	sent := 0
+	for _, reminder := range due {
+		result, err := ts.db.Exec("UPDATE task_reminders SET sent_at = ? WHERE id = ? AND sent_at IS NULL", dbTime(now), reminder.id)
+		if err != nil {
+			return sent, err
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			continue
+		}
+
+		if reminder.kind == reminderKindReminder && now.Sub(reminder.remindAt) > reminderGracePeriod {
+			continue
+		}
+
+		if err := ts.sendReminder(reminder); err != nil {
+			ts.retryReminder(reminder, now, err)
+			continue
+		}
+		sent++
+	}
+	return sent, nil
+}
+
+// sendReminder sends a reminder or overdue notice to the task's owner and
+// assignees. It only fails when no one could be sent it, so a retry doesn't
+// send it twice to the others.
+func (ts *TaskService) sendReminder(reminder dueReminder) error {
+	recipients, err := ts.reminderRecipients(reminder)
+	if err != nil {
+		return err
+	}
+	var sendErr error
+	delivered := 0
+	for _, userID := range recipients {
+		if err := ts.sendNotification("", reminderNotification(reminder, userID)); err != nil {
+			log.Printf("Failed to send reminder %d for task %d to user %d: %v", reminder.id, reminder.taskID, userID, err)
+			sendErr = err
+			continue
+		}
+		delivered++
+	}
+	if delivered == 0 {
+		return sendErr
+	}
+	return nil
+}
+
+// reminderRecipients lists the owner of a reminder's task and its assignees
+func (ts *TaskService) reminderRecipients(reminder dueReminder) ([]int, error) {
+	rows, err := ts.db.Query("SELECT user_id FROM task_assignees WHERE task_id = ? AND user_id != ? ORDER BY user_id", reminder.taskID, reminder.userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	recipients := []int{reminder.userID}
+	for rows.Next() {
+		var userID int
+		if err := rows.Scan(&userID); err != nil {
+			return nil, err
+		}
+		recipients = append(recipients, userID)
+	}
+	return recipients, rows.Err()
+}
+
+// retryReminder releases the claim on a reminder that failed to send and
+// backs it off, or leaves it claimed once it has failed maxReminderAttempts
+// times.
+func (ts *TaskService) retryReminder(reminder dueReminder, now time.Time, sendErr error) {
+	attempts := reminder.attempts + 1
+	if attempts >= maxReminderAttempts {
+		log.Printf("Giving up on reminder %d for task %d after %d attempts: %v", reminder.id, reminder.taskID, attempts, sendErr)
+		ts.db.Exec("UPDATE task_reminders SET attempts = ? WHERE id = ?", attempts, reminder.id)
+		return
+	}
+
+	retryAt := now.Add(reminderRetryDelay << (attempts - 1))
+	log.Printf("Failed to send reminder %d for task %d, retrying at %s: %v", reminder.id, reminder.taskID, dbTime(retryAt), sendErr)
+	_, err := ts.db.Exec("UPDATE task_reminders SET sent_at = NULL, attempts = ?, retry_at = ? WHERE id = ?", attempts, dbTime(retryAt), reminder.id)
+	if err != nil {
+		log.Printf("Failed to release reminder %d: %v", reminder.id, err)
+	}
+}
+
+// reminderNotification words a reminder or overdue notice for one of its
+// recipients, with times in the task's timezone
+func reminderNotification(reminder dueReminder, userID int) TaskNotification {
+	loc := taskLocation(reminder.timezone)
+	notification := TaskNotification{
+		UserID:  userID,
+		Title:   "Task reminder",
+		Message: fmt.Sprintf("Reminder for %q", reminder.title),
+		Type:    "reminder",
+	}
+
+	if reminder.kind == reminderKindOverdue {
+		notification.Title = "Task overdue"
+		notification.Message = fmt.Sprintf("%q is overdue", reminder.title)
+		notification.Type = "warning"
+		if reminder.dueAt.Valid {
+			notification.Message = fmt.Sprintf("%q was due %s", reminder.title, reminder.dueAt.Time.In(loc).Format(notificationTimeLayout))
+		}
+	} else if reminder.dueAt.Valid {
+		notification.Message = fmt.Sprintf("%q is due %s", reminder.title, reminder.dueAt.Time.In(loc).Format(notificationTimeLayout))
+	}
+	return notification
+}
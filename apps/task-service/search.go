@@ -0,0 +1,103 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"html"
+	"strings"
+)
+
+// maxSearchQueryLength bounds the q parameter
+const maxSearchQueryLength = 256
+
+// searchColumns selects the title and description snippets of a full-text
+// match. Matches are marked with char(1) and char(2), which survive HTML
+// escaping.
+const searchColumns = `snippet(tasks_fts, 0, char(1), char(2), '…', 12),
+	snippet(tasks_fts, 1, char(1), char(2), '…', 12)`
+
+// relevanceSort orders search results by bm25 score. Scores are negative,
+// lower is more relevant, and title matches weigh ten times more than
+// description matches. A task's score changes as other tasks are added or
+// edited, so it can't key a cursor; each page is sorted by score instead.
+var relevanceSort = taskSort{name: "relevance", expr: "bm25(tasks_fts, 10.0, 1.0)", withinPage: true}
+
+// TaskHighlights are the matching parts of a task, HTML-escaped with the
+// matched terms wrapped in <mark>
+type TaskHighlights struct {
+	Title       string `json:"title"`
+	Description string `json:"description,omitempty"`
+}
+
+// checkFTS5 fails fast when the SQLite driver was built without FTS5, which
+// the search index needs
+func checkFTS5(db *sql.DB) error {
+	var enabled bool
+	if err := db.QueryRow("SELECT sqlite_compileoption_used('ENABLE_FTS5')").Scan(&enabled); err != nil {
+		return err
+	}
+	if !enabled {
+		return errors.New("SQLite was built without FTS5; build with -tags sqlite_fts5")
+	}
+	return nil
+}
+
+// parseSearchQuery turns the q parameter into an FTS5 query. Words must all
+// match; "quoted words" match as a phrase and a trailing * matches a prefix
+// (deploy* finds deployment). Everything else is treated as literal text, so
+// users can't inject FTS5 operators or column filters.
+func parseSearchQuery(q string) (string, error) {
+	if len(q) > maxSearchQueryLength {
+		return "", fmt.Errorf("q must be at most %d characters", maxSearchQueryLength)
+	}
+
+	var terms []string
+	rest := strings.TrimSpace(q)
+	for rest != "" {
+		var term string
+		prefix := false
+
+		if rest[0] == '"' {
+			end := strings.IndexByte(rest[1:], '"')
+			if end < 0 {
+				return "", errors.New("q has an unterminated phrase")
+			}
+			term = rest[1 : end+1]
+			rest = rest[end+2:]
+		} else {
+			end := strings.IndexAny(rest, " \t\"")
+			if end < 0 {
+				end = len(rest)
+			}
+			term = rest[:end]
+			rest = rest[end:]
+			if strings.HasSuffix(term, "*") {
+				term = strings.TrimRight(term, "*")
+				prefix = true
+			}
+		}
+		rest = strings.TrimSpace(rest)
+
+		if strings.TrimSpace(term) == "" {
+			continue
+		}
+		quoted := `"` + strings.ReplaceAll(term, `"`, `""`) + `"`
+		if prefix {
+			quoted += "*"
+		}
+		terms = append(terms, quoted)
+	}
+
+	if len(terms) == 0 {
+		return "", errors.New("q must contain a search term")
+	}
+	return strings.Join(terms, " "), nil
+}
+
+// highlightSnippet escapes a snippet for HTML and turns its match markers into <mark> tags
+func highlightSnippet(snippet string) string {
+	escaped := html.EscapeString(snippet)
+	escaped = strings.ReplaceAll(escaped, "\x01", "<mark>")
+	return strings.ReplaceAll(escaped, "\x02", "</mark>")
+}
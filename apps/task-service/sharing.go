@@ -0,0 +1,535 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// A user's access to a task. The owner created it; assignees and users it
+// is shared with as editors can change it, viewers can only see it.
+const (
+	accessViewer = "viewer"
+	accessEditor = "editor"
+	accessOwner  = "owner"
+)
+
+// maxAssignees caps the users a task can be assigned to
+const maxAssignees = 20
+
+var accessRanks = map[string]int{accessViewer: 1, accessEditor: 2, accessOwner: 3}
+
+// Share is a user a task is shared with, and their role: viewer or editor
+type Share struct {
+	UserID    int       `json:"user_id"`
+	Username  string    `json:"username"`
+	Role      string    `json:"role"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// ShareRequest shares a task with a user, or changes their role
+type ShareRequest struct {
+	Username string `json:"username"`
+	Role     string `json:"role"`
+}
+
+// allows reports whether the requesting user has at least the given access
+// to a task
+func (task Task) allows(access string) bool {
+	return accessRanks[task.Access] >= accessRanks[access]
+}
+
+// accessCondition matches the tasks under alias that a user can see, or
+// with edit set, change
+func accessCondition(alias string, userID int, edit bool) sqlCondition {
+	role := ""
+	if edit {
+		role = " AND task_shares.role = 'editor'"
+	}
+	return sqlCondition{
+		sql: "(" + alias + ".user_id = ?" +
+			" OR EXISTS (SELECT 1 FROM task_assignees WHERE task_assignees.task_id = " + alias + ".id AND task_assignees.user_id = ?)" +
+			" OR EXISTS (SELECT 1 FROM task_shares WHERE task_shares.task_id = " + alias + ".id AND task_shares.user_id = ?" + role + "))",
+		args: []interface{}{userID, userID, userID},
+	}
+}
+
+// sharingFilters builds the conditions of the assigned_to (me, none or a
+// user ID), created_by (me or a user ID) and shared_with_me list parameters
+func sharingFilters(query url.Values, userID int) ([]sqlCondition, error) {
+	var conditions []sqlCondition
+
+	if value := query.Get("assigned_to"); value != "" {
+		const assigned = "EXISTS (SELECT 1 FROM task_assignees WHERE task_assignees.task_id = tasks.id"
+		if value == "none" {
+			conditions = append(conditions, sqlCondition{sql: "NOT " + assigned + ")"})
+		} else {
+			assignee, err := userParam(value, userID)
+			if err != nil {
+				return nil, errors.New("assigned_to must be me, none or a user ID")
+			}
+			conditions = append(conditions, sqlCondition{sql: assigned + " AND task_assignees.user_id = ?)", args: []interface{}{assignee}})
+		}
+	}
+
+	if value := query.Get("created_by"); value != "" {
+		creator, err := userParam(value, userID)
+		if err != nil {
+			return nil, errors.New("created_by must be me or a user ID")
+		}
+		conditions = append(conditions, sqlCondition{sql: "tasks.user_id = ?", args: []interface{}{creator}})
+	}
+
+	if query.Get("shared_with_me") != "" {
+		shared, err := boolParam(query, "shared_with_me")
+		if err != nil {
+			return nil, err
+		}
+		cond := sqlCondition{sql: "EXISTS (SELECT 1 FROM task_shares WHERE task_shares.task_id = tasks.id AND task_shares.user_id = ?)", args: []interface{}{userID}}
+		if !shared {
+			cond.sql = "NOT " + cond.sql
+		}
+		conditions = append(conditions, cond)
+	}
+	return conditions, nil
+}
+
+// userParam parses a user parameter: me or a user ID
+func userParam(value string, userID int) (int, error) {
+	if value == "me" {
+		return userID, nil
+	}
+	return strconv.Atoi(value)
+}
+
+// attachAccess sets the assignees of the given tasks and the user's access
+// to each, which is empty for tasks the user can't see
+func (ts *TaskService) attachAccess(tasks []Task, userID int) error {
+	if len(tasks) == 0 {
+		return nil
+	}
+	index := map[int]int{}
+	var ids []interface{}
+	for i := range tasks {
+		tasks[i].Assignees = []UserRef{}
+		tasks[i].Access = ""
+		if tasks[i].UserID == userID {
+			tasks[i].Access = accessOwner
+		}
+		index[tasks[i].ID] = i
+		ids = append(ids, tasks[i].ID)
+	}
+
+	cond := inCondition("task_id", ids)
+	rows, err := ts.db.Query("SELECT task_id, user_id, username FROM task_assignees WHERE "+cond.sql+" ORDER BY username", cond.args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var taskID int
+		var assignee UserRef
+		if err := rows.Scan(&taskID, &assignee.UserID, &assignee.Username); err != nil {
+			return err
+		}
+		task := &tasks[index[taskID]]
+		task.Assignees = append(task.Assignees, assignee)
+		if assignee.UserID == userID && task.Access != accessOwner {
+			task.Access = accessEditor
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	args := append([]interface{}{userID}, cond.args...)
+	shares, err := ts.db.Query("SELECT task_id, role FROM task_shares WHERE user_id = ? AND "+cond.sql, args...)
+	if err != nil {
+		return err
+	}
+	defer shares.Close()
+	for shares.Next() {
+		var taskID int
+		var role string
+		if err := shares.Scan(&taskID, &role); err != nil {
+			return err
+		}
+		task := &tasks[index[taskID]]
+		if accessRanks[role] > accessRanks[task.Access] {
+			task.Access = role
+		}
+	}
+	return shares.Err()
+}
+
+// visibleTasks keeps the tasks attachAccess gave the user access to
+func visibleTasks(tasks []Task) []Task {
+	var visible []Task
+	for _, task := range tasks {
+		if task.Access != "" {
+			visible = append(visible, task)
+		}
+	}
+	return visible
+}
+
+// resolveUsers looks up usernames, all of which have to be users
+func (ts *TaskService) resolveUsers(r *http.Request, usernames []string) ([]UserRef, error) {
+	var unique []string
+	seen := map[string]bool{}
+	for _, username := range usernames {
+		username = strings.TrimPrefix(strings.TrimSpace(username), "@")
+		if username != "" && !seen[username] {
+			seen[username] = true
+			unique = append(unique, username)
+		}
+	}
+
+	users, err := ts.lookupUsers(r.Header.Get("Authorization"), unique)
+	if err != nil {
+		return nil, err
+	}
+	found := map[string]bool{}
+	for _, user := range users {
+		found[user.Username] = true
+	}
+	for _, username := range unique {
+		if !found[username] {
+			return nil, &unknownUserError{username}
+		}
+	}
+	return users, nil
+}
+
+// unknownUserError is a username that isn't a user
+type unknownUserError struct {
+	username string
+}
+
+func (e *unknownUserError) Error() string {
+	return "unknown user " + e.username
+}
+
+// resolveAssignees looks up the users a task is assigned to by name,
+// answering the request when that fails
+func (ts *TaskService) resolveAssignees(w http.ResponseWriter, r *http.Request, usernames []string) ([]UserRef, bool) {
+	if len(usernames) > maxAssignees {
+		http.Error(w, fmt.Sprintf("a task can have at most %d assignees", maxAssignees), http.StatusBadRequest)
+		return nil, false
+	}
+	assignees, err := ts.resolveUsers(r, usernames)
+	if err != nil {
+		var unknown *unknownUserError
+		if errors.As(err, &unknown) {
+			http.Error(w, "assignees: "+err.Error(), http.StatusBadRequest)
+			return nil, false
+		}
+		http.Error(w, "Failed to resolve assignees: "+err.Error(), http.StatusBadGateway)
+		return nil, false
+	}
+	return assignees, true
+}
+
+// saveAssignees replaces the assignees of a task and returns the users that
+// weren't assigned before
+func saveAssignees(tx *sql.Tx, taskID int, assignees []UserRef) ([]UserRef, error) {
+	rows, err := tx.Query("SELECT user_id FROM task_assignees WHERE task_id = ?", taskID)
+	if err != nil {
+		return nil, err
+	}
+	previous := map[int]bool{}
+	for rows.Next() {
+		var userID int
+		if err := rows.Scan(&userID); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		previous[userID] = true
+	}
+	rows.Close()
+
+	var keep []interface{}
+	var added []UserRef
+	for _, assignee := range assignees {
+		keep = append(keep, assignee.UserID)
+		if previous[assignee.UserID] {
+			continue
+		}
+		_, err := tx.Exec("INSERT INTO task_assignees (task_id, user_id, username) VALUES (?, ?, ?)", taskID, assignee.UserID, assignee.Username)
+		if err != nil {
+			return nil, err
+		}
+		added = append(added, assignee)
+	}
+
+	stmt := "DELETE FROM task_assignees WHERE task_id = ?"
+	args := []interface{}{taskID}
+	if len(keep) > 0 {
+		cond := inCondition("user_id", keep)
+		stmt += " AND NOT " + cond.sql
+		args = append(args, cond.args...)
+	}
+	if _, err := tx.Exec(stmt, args...); err != nil {
+		return nil, err
+	}
+	return added, nil
+}
+
+// notifyAssignees tells users they were assigned to a task, unless they
+// assigned themselves
+func (ts *TaskService) notifyAssignees(r *http.Request, task Task, assignees []UserRef) {
+	userID, _ := strconv.Atoi(r.Header.Get("X-User-ID"))
+	for _, assignee := range assignees {
+		if assignee.UserID == userID {
+			continue
+		}
+		ts.sendNotificationAsync(r.Header.Get("Authorization"), TaskNotification{
+			UserID:  assignee.UserID,
+			Title:   "You were assigned a task",
+			Message: fmt.Sprintf("%s assigned you to %q", r.Header.Get("X-Username"), task.Title),
+			Type:    "assignment",
+		})
+	}
+}
+
+// taskMembers returns the users with access to a task
+func (ts *TaskService) taskMembers(taskID int) (map[int]bool, error) {
+	rows, err := ts.db.Query(`
+		SELECT user_id FROM tasks WHERE id = ?1
+		UNION SELECT user_id FROM task_assignees WHERE task_id = ?1
+		UNION SELECT user_id FROM task_shares WHERE task_id = ?1
+	`, taskID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	members := map[int]bool{}
+	for rows.Next() {
+		var userID int
+		if err := rows.Scan(&userID); err != nil {
+			return nil, err
+		}
+		members[userID] = true
+	}
+	return members, rows.Err()
+}
+
+// copySharing gives the next occurrence of a recurring task the assignees
+// and shares of the one before
+func copySharing(tx *sql.Tx, fromID, toID int) error {
+	for _, stmt := range []string{
+		"INSERT INTO task_assignees (task_id, user_id, username) SELECT ?1, user_id, username FROM task_assignees WHERE task_id = ?2",
+		"INSERT INTO task_shares (task_id, user_id, username, role) SELECT ?1, user_id, username, role FROM task_shares WHERE task_id = ?2",
+	} {
+		if _, err := tx.Exec(stmt, toID, fromID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (ts *TaskService) loadShares(taskID int) ([]Share, error) {
+	rows, err := ts.db.Query("SELECT user_id, username, role, created_at FROM task_shares WHERE task_id = ? ORDER BY username", taskID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	shares := []Share{}
+	for rows.Next() {
+		var share Share
+		if err := rows.Scan(&share.UserID, &share.Username, &share.Role, &share.CreatedAt); err != nil {
+			return nil, err
+		}
+		shares = append(shares, share)
+	}
+	return shares, rows.Err()
+}
+
+func (ts *TaskService) getSharesHandler(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.Atoi(r.Header.Get("X-User-ID"))
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+	taskID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid task ID", http.StatusBadRequest)
+		return
+	}
+
+	if _, err := ts.loadTask(taskID, userID); err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Task not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	shares, err := ts.loadShares(taskID)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(shares)
+}
+
+// shareTaskHandler shares a task with a user, or changes their role. Only
+// the owner can.
+func (ts *TaskService) shareTaskHandler(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.Atoi(r.Header.Get("X-User-ID"))
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+	taskID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid task ID", http.StatusBadRequest)
+		return
+	}
+
+	var req ShareRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.Role == "" {
+		req.Role = accessViewer
+	}
+	if req.Role != accessViewer && req.Role != accessEditor {
+		http.Error(w, "role must be viewer or editor", http.StatusBadRequest)
+		return
+	}
+	if strings.TrimSpace(req.Username) == "" {
+		http.Error(w, "username is required", http.StatusBadRequest)
+		return
+	}
+
+	task, err := ts.loadTask(taskID, userID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Task not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if !task.allows(accessOwner) {
+		http.Error(w, "Only the task's owner can share it", http.StatusForbidden)
+		return
+	}
+
+	users, err := ts.resolveUsers(r, []string{req.Username})
+	if err != nil {
+		var unknown *unknownUserError
+		if errors.As(err, &unknown) {
+			http.Error(w, "User not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Failed to resolve user: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+	user := users[0]
+	if user.UserID == task.UserID {
+		http.Error(w, "A task can't be shared with its owner", http.StatusBadRequest)
+		return
+	}
+
+	result, err := ts.db.Exec(`
+		UPDATE task_shares SET role = ? WHERE task_id = ? AND user_id = ?
+	`, req.Role, taskID, user.UserID)
+	if err != nil {
+		http.Error(w, "Failed to share task", http.StatusInternalServerError)
+		return
+	}
+	status := http.StatusOK
+	if n, _ := result.RowsAffected(); n == 0 {
+		_, err := ts.db.Exec(`
+			INSERT INTO task_shares (task_id, user_id, username, role) VALUES (?, ?, ?, ?)
+		`, taskID, user.UserID, user.Username, req.Role)
+		if err != nil {
+			http.Error(w, "Failed to share task", http.StatusInternalServerError)
+			return
+		}
+		status = http.StatusCreated
+		ts.sendNotificationAsync(r.Header.Get("Authorization"), TaskNotification{
+			UserID:  user.UserID,
+			Title:   "A task was shared with you",
+			Message: fmt.Sprintf("%s shared %q with you as %s", r.Header.Get("X-Username"), task.Title, req.Role),
+			Type:    "share",
+		})
+	}
+
+	var share Share
+	err = ts.db.QueryRow(`
+		SELECT user_id, username, role, created_at FROM task_shares WHERE task_id = ? AND user_id = ?
+	`, taskID, user.UserID).Scan(&share.UserID, &share.Username, &share.Role, &share.CreatedAt)
+	if err != nil {
+		http.Error(w, "Failed to retrieve share", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(share)
+}
+
+// unshareTaskHandler stops sharing a task with a user. The owner can remove
+// anyone, others only themselves.
+func (ts *TaskService) unshareTaskHandler(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.Atoi(r.Header.Get("X-User-ID"))
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+	vars := mux.Vars(r)
+	taskID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid task ID", http.StatusBadRequest)
+		return
+	}
+	shareUserID, err := strconv.Atoi(vars["userId"])
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+
+	task, err := ts.loadTask(taskID, userID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Task not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if !task.allows(accessOwner) && shareUserID != userID {
+		http.Error(w, "Only the task's owner can unshare it", http.StatusForbidden)
+		return
+	}
+
+	result, err := ts.db.Exec("DELETE FROM task_shares WHERE task_id = ? AND user_id = ?", taskID, shareUserID)
+	if err != nil {
+		http.Error(w, "Failed to unshare task", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		http.Error(w, "Share not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
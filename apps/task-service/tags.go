@@ -0,0 +1,492 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// Tag limits
+const (
+	maxTagNameLength = 50
+	maxTagsPerTask   = 20
+)
+
+// defaultTagColor is the color of tags created without one
+const defaultTagColor = "#6b7280"
+
+var tagColorPattern = regexp.MustCompile(`^#[0-9a-f]{6}$`)
+
+// Tag is a user's label for tasks
+type Tag struct {
+	ID    int    `json:"id"`
+	Name  string `json:"name"`
+	Color string `json:"color"`
+}
+
+// TagUsage is a tag with the number of tasks that have it
+type TagUsage struct {
+	Tag
+	Usage int `json:"usage"`
+}
+
+// TagRequest creates a tag, or renames or recolors one. Fields left empty
+// on update keep their value.
+type TagRequest struct {
+	Name  string `json:"name"`
+	Color string `json:"color"`
+}
+
+// MergeTagRequest moves a tag's tasks to another tag and deletes it
+type MergeTagRequest struct {
+	Into int `json:"into"`
+}
+
+// normalizeTagName trims a tag name and checks it. Commas separate names in
+// the tag filters, so they can't be part of one.
+func normalizeTagName(name string) (string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return "", errors.New("tag name is required")
+	}
+	if len([]rune(name)) > maxTagNameLength {
+		return "", fmt.Errorf("tag name must be at most %d characters", maxTagNameLength)
+	}
+	if strings.Contains(name, ",") {
+		return "", errors.New("tag name can't contain commas")
+	}
+	return name, nil
+}
+
+// normalizeTagColor checks a #rrggbb color; empty means the default
+func normalizeTagColor(color string) (string, error) {
+	if color == "" {
+		return defaultTagColor, nil
+	}
+	color = strings.ToLower(color)
+	if !tagColorPattern.MatchString(color) {
+		return "", errors.New("color must be a hex color such as #3b82f6")
+	}
+	return color, nil
+}
+
+// resolveTagNames checks the tag names of a task and drops duplicates,
+// which differ only in case
+func resolveTagNames(names []string) ([]string, error) {
+	var resolved []string
+	seen := map[string]bool{}
+	for _, name := range names {
+		name, err := normalizeTagName(name)
+		if err != nil {
+			return nil, err
+		}
+		if seen[strings.ToLower(name)] {
+			continue
+		}
+		seen[strings.ToLower(name)] = true
+		resolved = append(resolved, name)
+	}
+	if len(resolved) > maxTagsPerTask {
+		return nil, fmt.Errorf("a task can have at most %d tags", maxTagsPerTask)
+	}
+	return resolved, nil
+}
+
+// saveTaskTags replaces the tags of a task, creating tags the user doesn't
+// have yet
+func saveTaskTags(tx *sql.Tx, taskID, userID int, names []string) error {
+	if _, err := tx.Exec("DELETE FROM task_tags WHERE task_id = ?", taskID); err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		_, err := tx.Exec("INSERT OR IGNORE INTO tags (user_id, name, color) VALUES (?, ?, ?)", userID, name, defaultTagColor)
+		if err != nil {
+			return err
+		}
+		var tagID int
+		err = tx.QueryRow("SELECT id FROM tags WHERE user_id = ? AND name = ? COLLATE NOCASE", userID, name).Scan(&tagID)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec("INSERT INTO task_tags (task_id, tag_id) VALUES (?, ?)", taskID, tagID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// attachTags sets the tags of the given tasks, sorted by name
+func (ts *TaskService) attachTags(tasks []Task) error {
+	if len(tasks) == 0 {
+		return nil
+	}
+	index := map[int]int{}
+	var ids []interface{}
+	for i := range tasks {
+		tasks[i].Tags = []Tag{}
+		index[tasks[i].ID] = i
+		ids = append(ids, tasks[i].ID)
+	}
+
+	cond := inCondition("task_tags.task_id", ids)
+	rows, err := ts.db.Query(`
+		SELECT task_tags.task_id, tags.id, tags.name, tags.color
+		FROM task_tags JOIN tags ON tags.id = task_tags.tag_id
+		WHERE `+cond.sql+`
+		ORDER BY tags.name COLLATE NOCASE
+	`, cond.args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var taskID int
+		var tag Tag
+		if err := rows.Scan(&taskID, &tag.ID, &tag.Name, &tag.Color); err != nil {
+			return err
+		}
+		i := index[taskID]
+		tasks[i].Tags = append(tasks[i].Tags, tag)
+	}
+	return rows.Err()
+}
+
+// tagFilters builds the conditions of the tag (all of), tag_any (any of)
+// and tag_none (none of) list parameters, which take comma-separated tag
+// names in any case
+func tagFilters(query url.Values) ([]sqlCondition, error) {
+	const hasTag = "EXISTS (SELECT 1 FROM task_tags JOIN tags ON tags.id = task_tags.tag_id WHERE task_tags.task_id = tasks.id AND "
+
+	var conditions []sqlCondition
+	for _, param := range []string{"tag", "tag_any", "tag_none"} {
+		value := query.Get(param)
+		if value == "" {
+			continue
+		}
+		var names []interface{}
+		for _, name := range strings.Split(value, ",") {
+			name, err := normalizeTagName(name)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", param, err)
+			}
+			names = append(names, name)
+		}
+
+		switch param {
+		case "tag":
+			for _, name := range names {
+				conditions = append(conditions, sqlCondition{sql: hasTag + "tags.name = ? COLLATE NOCASE)", args: []interface{}{name}})
+			}
+		case "tag_any", "tag_none":
+			cond := inCondition("tags.name COLLATE NOCASE", names)
+			cond.sql = hasTag + cond.sql + ")"
+			if param == "tag_none" {
+				cond.sql = "NOT " + cond.sql
+			}
+			conditions = append(conditions, cond)
+		}
+	}
+	return conditions, nil
+}
+
+// loadTagUsage loads one of a user's tags with its usage count
+func (ts *TaskService) loadTagUsage(tagID, userID int) (TagUsage, error) {
+	var tag TagUsage
+	err := ts.db.QueryRow(`
+		SELECT tags.id, tags.name, tags.color, (SELECT COUNT(*) FROM task_tags WHERE task_tags.tag_id = tags.id)
+		FROM tags WHERE tags.id = ? AND tags.user_id = ?
+	`, tagID, userID).Scan(&tag.ID, &tag.Name, &tag.Color, &tag.Usage)
+	return tag, err
+}
+
+// tagNameTaken reports whether another of the user's tags has the name
+func (ts *TaskService) tagNameTaken(userID, tagID int, name string) (bool, error) {
+	var count int
+	err := ts.db.QueryRow("SELECT COUNT(*) FROM tags WHERE user_id = ? AND name = ? COLLATE NOCASE AND id != ?", userID, name, tagID).Scan(&count)
+	return count > 0, err
+}
+
+// getTagsHandler lists the user's tags by name with their usage counts
+func (ts *TaskService) getTagsHandler(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.Atoi(r.Header.Get("X-User-ID"))
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+
+	rows, err := ts.db.Query(`
+		SELECT tags.id, tags.name, tags.color, COUNT(task_tags.task_id)
+		FROM tags LEFT JOIN task_tags ON task_tags.tag_id = tags.id
+		WHERE tags.user_id = ?
+		GROUP BY tags.id
+		ORDER BY tags.name COLLATE NOCASE
+	`, userID)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	tags := []TagUsage{}
+	for rows.Next() {
+		var tag TagUsage
+		if err := rows.Scan(&tag.ID, &tag.Name, &tag.Color, &tag.Usage); err != nil {
+			http.Error(w, "Database scan error", http.StatusInternalServerError)
+			return
+		}
+		tags = append(tags, tag)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(tags)
+}
+
+func (ts *TaskService) createTagHandler(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.Atoi(r.Header.Get("X-User-ID"))
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+
+	var req TagRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	name, err := normalizeTagName(req.Name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	color, err := normalizeTagColor(req.Color)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	taken, err := ts.tagNameTaken(userID, 0, name)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if taken {
+		http.Error(w, "Tag already exists", http.StatusConflict)
+		return
+	}
+
+	result, err := ts.db.Exec("INSERT INTO tags (user_id, name, color) VALUES (?, ?, ?)", userID, name, color)
+	if err != nil {
+		http.Error(w, "Failed to create tag", http.StatusInternalServerError)
+		return
+	}
+	tagID, _ := result.LastInsertId()
+
+	tag, err := ts.loadTagUsage(int(tagID), userID)
+	if err != nil {
+		http.Error(w, "Failed to retrieve created tag", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(tag)
+}
+
+// updateTagHandler renames or recolors a tag. Renaming a tag to the name of
+// another is refused; merge them instead.
+func (ts *TaskService) updateTagHandler(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.Atoi(r.Header.Get("X-User-ID"))
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+	tagID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid tag ID", http.StatusBadRequest)
+		return
+	}
+
+	var req TagRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	tag, err := ts.loadTagUsage(tagID, userID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Tag not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	name, color := tag.Name, tag.Color
+	if req.Name != "" {
+		if name, err = normalizeTagName(req.Name); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if req.Color != "" {
+		if color, err = normalizeTagColor(req.Color); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	taken, err := ts.tagNameTaken(userID, tagID, name)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if taken {
+		http.Error(w, "Another tag has this name; merge the tags instead", http.StatusConflict)
+		return
+	}
+
+	if _, err := ts.db.Exec("UPDATE tags SET name = ?, color = ? WHERE id = ?", name, color, tagID); err != nil {
+		http.Error(w, "Failed to update tag", http.StatusInternalServerError)
+		return
+	}
+
+	tag, err = ts.loadTagUsage(tagID, userID)
+	if err != nil {
+		http.Error(w, "Failed to retrieve updated tag", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(tag)
+}
+
+// deleteTagHandler deletes a tag and removes it from its tasks
+func (ts *TaskService) deleteTagHandler(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.Atoi(r.Header.Get("X-User-ID"))
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+	tagID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid tag ID", http.StatusBadRequest)
+		return
+	}
+
+	if _, err := ts.loadTagUsage(tagID, userID); err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Tag not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	tx, err := ts.db.Begin()
+	if err != nil {
+		http.Error(w, "Failed to delete tag", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	for _, stmt := range []string{
+		"DELETE FROM task_tags WHERE tag_id = ?",
+		"DELETE FROM tags WHERE id = ?",
+	} {
+		if _, err := tx.Exec(stmt, tagID); err != nil {
+			http.Error(w, "Failed to delete tag", http.StatusInternalServerError)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Failed to delete tag", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// mergeTagHandler moves the tasks of a tag to another tag and deletes it
+func (ts *TaskService) mergeTagHandler(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.Atoi(r.Header.Get("X-User-ID"))
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+	tagID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid tag ID", http.StatusBadRequest)
+		return
+	}
+
+	var req MergeTagRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.Into == tagID {
+		http.Error(w, "A tag can't be merged into itself", http.StatusBadRequest)
+		return
+	}
+
+	for _, id := range []int{tagID, req.Into} {
+		if _, err := ts.loadTagUsage(id, userID); err != nil {
+			if err == sql.ErrNoRows {
+				http.Error(w, "Tag not found", http.StatusNotFound)
+				return
+			}
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	tx, err := ts.db.Begin()
+	if err != nil {
+		http.Error(w, "Failed to merge tags", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	// Tasks that have both tags keep one
+	_, err = tx.Exec("INSERT OR IGNORE INTO task_tags (task_id, tag_id) SELECT task_id, ? FROM task_tags WHERE tag_id = ?", req.Into, tagID)
+	if err != nil {
+		http.Error(w, "Failed to merge tags", http.StatusInternalServerError)
+		return
+	}
+	for _, stmt := range []string{
+		"DELETE FROM task_tags WHERE tag_id = ?",
+		"DELETE FROM tags WHERE id = ?",
+	} {
+		if _, err := tx.Exec(stmt, tagID); err != nil {
+			http.Error(w, "Failed to merge tags", http.StatusInternalServerError)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Failed to merge tags", http.StatusInternalServerError)
+		return
+	}
+
+	tag, err := ts.loadTagUsage(req.Into, userID)
+	if err != nil {
+		http.Error(w, "Failed to retrieve merged tag", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(tag)
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+// deleteUserDataHandler deletes everything a user has in the task service:
+// the tasks they own, their comments and uploads on other users' tasks, their
+// tags, and their assignments, shares and mentions. Subtasks of their tasks
+// that belong to others become top-level tasks.
+func (ts *TaskService) deleteUserDataHandler(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil || userID <= 0 {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := ts.db.Begin()
+	if err != nil {
+		http.Error(w, "Failed to delete user data", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	if err := deleteUserData(tx, userID); err != nil {
+		http.Error(w, "Failed to delete user data", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Failed to delete user data", http.StatusInternalServerError)
+		return
+	}
+	ts.purgeDeletedBlobsAsync()
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func deleteUserData(tx *sql.Tx, userID int) error {
+	rows, err := tx.Query("SELECT id FROM tasks WHERE user_id = ?", userID)
+	if err != nil {
+		return err
+	}
+	var owned []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		owned = append(owned, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(`
+		UPDATE tasks SET parent_id = NULL
+		WHERE user_id != ?1 AND parent_id IN (SELECT id FROM tasks WHERE user_id = ?1)
+	`, userID); err != nil {
+		return err
+	}
+	for _, id := range owned {
+		if err := deleteTask(tx, id); err != nil {
+			return err
+		}
+	}
+
+	for _, stmt := range []string{
+		"DELETE FROM task_comment_mentions WHERE comment_id IN (SELECT id FROM task_comments WHERE user_id = ?)",
+		"DELETE FROM task_comment_edits WHERE comment_id IN (SELECT id FROM task_comments WHERE user_id = ?)",
+		"DELETE FROM task_comments WHERE user_id = ?",
+		"DELETE FROM task_comment_mentions WHERE user_id = ?",
+		// Their blobs are removed once the transaction commits
+		"INSERT OR IGNORE INTO deleted_blobs (storage_key) SELECT storage_key FROM task_attachments WHERE user_id = ?",
+		"DELETE FROM task_attachments WHERE user_id = ?",
+		"DELETE FROM task_tags WHERE tag_id IN (SELECT id FROM tags WHERE user_id = ?)",
+		"DELETE FROM tags WHERE user_id = ?",
+		"DELETE FROM task_assignees WHERE user_id = ?",
+		"DELETE FROM task_shares WHERE user_id = ?",
+		"DELETE FROM task_series WHERE user_id = ?",
+	} {
+		if _, err := tx.Exec(stmt, userID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
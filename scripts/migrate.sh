@@ -0,0 +1,15 @@
+#!/bin/bash
+
+# Database Migration Script for Task Manager
+# Applies pending schema migrations for the auth and task services.
+# Extra arguments are passed through, e.g. --dry-run or --to 3
+
+set -e
+
+echo "🔐 Migrating Auth Service database..."
+(cd apps/auth-service && go run . migrate "$@")
+
+echo "📋 Migrating Task Service database..."
+(cd apps/task-service && go run -tags sqlite_fts5 . migrate "$@")
+
+echo "🎉 Migrations complete!"